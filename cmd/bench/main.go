@@ -0,0 +1,76 @@
+// Command bench works with the structured results the demos write with -bench-format=json. Its report subcommand
+// renders one or more result files into a self-contained HTML page or SVG image:
+//
+//	bench report -out report.html geforce.json iris.json
+//
+// The report charts the mean time against the local size and the throughput against the problem size, with a line
+// per device and error bars from the samples. It needs no OpenCL driver.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/eriklupander/ocltest/internal/benchreport"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func main() {
+	if len(os.Args) < 2 || os.Args[1] != "report" {
+		fmt.Fprintln(os.Stderr, "usage: bench report [-out file] [-format html|svg] [-title title] results.json...")
+		os.Exit(2)
+	}
+	if err := report(os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "bench report: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func report(args []string) error {
+	flags := flag.NewFlagSet("report", flag.ExitOnError)
+	out := flags.String("out", "report.html", "File to write the report to, - for stdout")
+	formatFlag := flags.String("format", "", "Report format, html or svg. Defaults to the extension of -out, or html")
+	title := flags.String("title", "Benchmark report", "Title of the report")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		return fmt.Errorf("no result files given")
+	}
+
+	if *formatFlag == "" {
+		*formatFlag = "html"
+		if strings.EqualFold(filepath.Ext(*out), ".svg") {
+			*formatFlag = "svg"
+		}
+	}
+	format, err := benchreport.ParseFormat(*formatFlag)
+	if err != nil {
+		return err
+	}
+
+	var results []benchreport.Result
+	for _, name := range flags.Args() {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		fileResults, err := benchreport.Read(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		results = append(results, fileResults...)
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	return benchreport.Write(w, results, format, *title)
+}
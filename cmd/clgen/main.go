@@ -0,0 +1,137 @@
+// Command clgen generates typed Go wrappers for the kernels in a directory of .cl files. Every file becomes a
+// registered kernel spec named after the file, embedded with go:embed, and every kernel in it a function such as
+//
+//	func Multiply2(ctx context.Context, sess *Session, input1, input2, output *Buffer[float64], count uint32, global, local []int) (*Event, error)
+//
+// so kernel calls are checked by the compiler instead of by positional SetArgs calls at run time. It is run by
+// go generate in internal/app.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"github.com/eriklupander/ocltest/internal/clparse"
+	"go/format"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+func main() {
+	dir := flag.String("dir", "kernels", "Directory with the .cl files, relative to the output package")
+	out := flag.String("out", "kernels_gen.go", "Go file to write")
+	pkg := flag.String("pkg", "app", "Package name of the generated file")
+	flag.Parse()
+
+	src, err := generate(*dir, *pkg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "clgen: %v\n", err)
+		os.Exit(1)
+	}
+	if err := os.WriteFile(*out, src, 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "clgen: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// generate returns the formatted Go source for all .cl files in dir.
+func generate(dir, pkg string) ([]byte, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.cl"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no .cl files in %s", dir)
+	}
+	sort.Strings(files)
+
+	var decls, inits, funcs bytes.Buffer
+	usesCL := false
+	seen := map[string]string{}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		kernels, err := clparse.Parse(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+
+		spec := strings.TrimSuffix(filepath.Base(file), ".cl")
+		srcVar := lowerCamel(spec) + "Src"
+		fmt.Fprintf(&decls, "//go:embed %s\nvar %s string\n\n", filepath.ToSlash(file), srcVar)
+		if requires := requirements(string(data), kernels); requires != "" {
+			fmt.Fprintf(&inits, "\tRegisterKernel(KernelSpec{Name: %q, Source: %s, Requires: Requirements{%s}})\n", spec, srcVar, requires)
+		} else {
+			fmt.Fprintf(&inits, "\tRegisterKernel(KernelSpec{Name: %q, Source: %s})\n", spec, srcVar)
+		}
+
+		for _, k := range kernels {
+			if other, dup := seen[k.GoName()]; dup {
+				return nil, fmt.Errorf("%s: kernel %s and %s both map to %s", file, k.Name, other, k.GoName())
+			}
+			seen[k.GoName()] = file + ":" + k.Name
+			stub, err := k.GoStub(spec)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", file, k.Line, err)
+			}
+			usesCL = usesCL || strings.Contains(stub, "cl.")
+			funcs.WriteString("\n" + stub)
+		}
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// Code generated by clgen from %s/*.cl. DO NOT EDIT.\n\npackage %s\n\n", filepath.ToSlash(dir), pkg)
+	b.WriteString("import (\n\t\"context\"\n\t_ \"embed\"\n")
+	if usesCL {
+		b.WriteString("\t\"github.com/jgillich/go-opencl/cl\"\n")
+	}
+	b.WriteString(")\n\n")
+	b.Write(decls.Bytes())
+	fmt.Fprintf(&b, "func init() {\n%s}\n", inits.String())
+	b.Write(funcs.Bytes())
+
+	src, err := format.Source(b.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("format generated code: %w\n%s", err, b.String())
+	}
+	return src, nil
+}
+
+// requirements returns the fields of an app.Requirements literal for what the source needs: fp64 or fp16 for
+// double or half parameters or enabled extensions, and printf if it prints.
+func requirements(src string, kernels []clparse.Kernel) string {
+	var fp64, fp16 bool
+	for _, k := range kernels {
+		for _, p := range k.Params {
+			base := strings.TrimRight(p.Type, "0123456789")
+			fp64 = fp64 || base == "double"
+			fp16 = fp16 || base == "half"
+		}
+	}
+	fp64 = fp64 || strings.Contains(src, "cl_khr_fp64")
+	fp16 = fp16 || strings.Contains(src, "cl_khr_fp16")
+	var fields []string
+	if fp64 {
+		fields = append(fields, "FP64: true")
+	}
+	if fp16 {
+		fields = append(fields, "FP16: true")
+	}
+	if strings.Contains(src, "printf(") {
+		fields = append(fields, "Printf: true")
+	}
+	return strings.Join(fields, ", ")
+}
+
+// lowerCamel turns a file name like "square_root" into "squareRoot".
+func lowerCamel(name string) string {
+	parts := strings.FieldsFunc(name, func(r rune) bool { return r == '_' || r == '-' || r == '.' })
+	for i := 1; i < len(parts); i++ {
+		parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+	}
+	return strings.Join(parts, "")
+}
@@ -1,36 +1,233 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"github.com/eriklupander/ocltest/internal/app"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
 )
 
 func main() {
-	op := flag.String("op", "square", "Demo to run: square, square-local, structs, multidim, vectors, batched-square, benchmark")
+	op := flag.String("op", "square", "Demo to run: square, square-local, structs, multidim, vectors, batched-square, benchmark, reduce, scan, sort, gemm, convolve, histogram, fft, map, stubs, template, fp16, bench-suite, zero-copy, pool, oom, resize, kernel-info")
 	deviceIndex := flag.Int("device", 0, "OpenCL device index")
+	devicesFlag := flag.String("devices", "", "Comma-separated device indexes to split square and benchmark across, e.g. 0,2")
+	weightsFlag := flag.String("weights", "", "Comma-separated static weights for -devices, e.g. 1,3. Calibrates when omitted")
+	gemmFlag := flag.String("gemm", "auto", "GEMM variant for the gemm op: auto, naive, tiled or blocked")
+	inFlag := flag.String("in", "", "Input PNG for the convolve and resize ops")
+	outFlag := flag.String("out", "out.png", "Output PNG for the convolve and resize ops")
+	filterFlag := flag.String("filter", "blur", "Filter for the convolve op: blur or sobel")
+	borderFlag := flag.String("border", "clamp", "Border mode for the convolve op: clamp, wrap or zero")
+	widthFlag := flag.Int("width", 0, "Output width for the resize op. 0 keeps the aspect ratio")
+	heightFlag := flag.Int("height", 0, "Output height for the resize op. 0 keeps the aspect ratio")
+	specFlag := flag.String("spec", "", "Kernel spec for the kernel-info op. Empty means all registered specs")
+	kernelFlag := flag.String("kernel", "", "Kernel for the kernel-info op. Empty means all kernels of the spec")
+	timeout := flag.Duration("timeout", 0, "Abort the op after this long, e.g. 30s. 0 means no timeout")
+	buildOptsFlag := flag.String("build-opts", "", "OpenCL compiler options for all programs, e.g. -cl-fast-relaxed-math")
+	benchFormatFlag := flag.String("bench-format", "markdown", "Output format of structured benchmark results: markdown or json")
+	benchOutFlag := flag.String("bench-out", "", "File to write structured benchmark results to instead of stdout")
+	sizesFlag := flag.String("sizes", "", "Problem sizes in elements to sweep benchmark, benchmark2, benchmark3 and batched-square over, e.g. 1K..64M:x4 or 1M,16M")
+	var defines stringList
+	flag.Var(&defines, "D", "Preprocessor define NAME or NAME=VAL for all programs. May be repeated")
 	flag.Parse()
 
-	switch *op {
+	deviceIndexes, err := parseInts(*devicesFlag)
+	if err != nil {
+		fmt.Printf("Invalid -devices: %v\n", err)
+		os.Exit(1)
+	}
+	weights, err := parseFloats(*weightsFlag)
+	if err != nil {
+		fmt.Printf("Invalid -weights: %v\n", err)
+		os.Exit(1)
+	}
+	opts := options{in: *inFlag, out: *outFlag, filter: *filterFlag, width: *widthFlag, height: *heightFlag,
+		spec: *specFlag, kernel: *kernelFlag}
+	if opts.gemmVariant, err = app.ParseGemmVariant(*gemmFlag); err != nil {
+		fmt.Printf("Invalid -gemm: %v\n", err)
+		os.Exit(1)
+	}
+	if opts.border, err = app.ParseBorderMode(*borderFlag); err != nil {
+		fmt.Printf("Invalid -border: %v\n", err)
+		os.Exit(1)
+	}
+	if opts.sizes, err = app.ParseSizes(*sizesFlag); err != nil {
+		fmt.Printf("Invalid -sizes: %v\n", err)
+		os.Exit(1)
+	}
+	buildOpts, err := app.ParseBuildOptions(*buildOptsFlag)
+	if err != nil {
+		fmt.Printf("Invalid -build-opts: %v\n", err)
+		os.Exit(1)
+	}
+	for _, def := range defines {
+		if buildOpts, err = buildOpts.WithDefine(def); err != nil {
+			fmt.Printf("Invalid -D: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	app.SetDefaultBuildOptions(buildOpts)
+	benchFormat, err := app.ParseBenchFormat(*benchFormatFlag)
+	if err != nil {
+		fmt.Printf("Invalid -bench-format: %v\n", err)
+		os.Exit(1)
+	}
+	if *benchOutFlag != "" {
+		f, err := os.Create(*benchOutFlag)
+		if err != nil {
+			fmt.Printf("Invalid -bench-out: %v\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		app.SetBenchOutput(f, benchFormat)
+	} else {
+		app.SetBenchOutput(os.Stdout, benchFormat)
+	}
+
+	// Ctrl-C cancels the context too, so an interrupted benchmark still releases its OpenCL resources.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+
+	if err := run(ctx, *op, *deviceIndex, deviceIndexes, weights, opts); err != nil {
+		fmt.Printf("%s failed: %v\n", *op, err)
+		stop()
+		os.Exit(1)
+	}
+}
+
+// options holds the flags that only apply to some ops.
+type options struct {
+	gemmVariant app.GemmVariant
+	in, out     string
+	filter      string
+	border      app.BorderMode
+	sizes       []int
+	// width and height are the resize op's output size.
+	width, height int
+	// spec and kernel select the kernels of the kernel-info op.
+	spec, kernel string
+}
+
+func run(ctx context.Context, op string, deviceIndex int, deviceIndexes []int, weights []float64, opts options) error {
+	if len(deviceIndexes) > 0 {
+		switch op {
+		case "square":
+			return app.SquareMulti(ctx, deviceIndexes, weights)
+		case "benchmark":
+			return app.BenchmarkMulti(ctx, deviceIndexes, weights)
+		default:
+			return fmt.Errorf("-devices is only supported by square and benchmark")
+		}
+	}
+	if len(opts.sizes) > 0 {
+		return app.SizeSweep(ctx, deviceIndex, op, opts.sizes)
+	}
+
+	switch op {
 	case "structs":
-		app.Structs(*deviceIndex)
+		return app.Structs(ctx, deviceIndex)
 	case "multidim":
-		app.MultiDim(*deviceIndex)
+		return app.MultiDim(ctx, deviceIndex)
 	case "vectors":
-		app.Vectors(*deviceIndex)
+		return app.Vectors(ctx, deviceIndex)
 	case "batched-square":
-		app.BatchedSquare(*deviceIndex)
+		return app.BatchedSquare(ctx, deviceIndex)
 	case "square":
-		app.Square(*deviceIndex)
+		return app.Square(ctx, deviceIndex)
 	case "square-local":
-		app.SquareLocalSize(*deviceIndex)
+		return app.SquareLocalSize(ctx, deviceIndex)
 	case "benchmark":
-		app.Benchmark(*deviceIndex)
+		return app.Benchmark(ctx, deviceIndex)
 	case "benchmark2":
-		app.Benchmark2(*deviceIndex)
+		return app.Benchmark2(ctx, deviceIndex)
 	case "benchmark3":
-		app.Benchmark3(*deviceIndex)
+		return app.Benchmark3(ctx, deviceIndex)
+	case "reduce":
+		return app.ReduceBenchmark(ctx, deviceIndex)
+	case "scan":
+		return app.ScanDemo(ctx, deviceIndex)
+	case "sort":
+		return app.SortBenchmark(ctx, deviceIndex)
+	case "gemm":
+		return app.GemmBenchmark(ctx, deviceIndex, opts.gemmVariant)
+	case "convolve":
+		return app.ConvolveDemo(ctx, deviceIndex, opts.in, opts.out, opts.filter, opts.border)
+	case "histogram":
+		return app.HistogramBenchmark(ctx, deviceIndex)
+	case "fft":
+		return app.FFTBenchmark(ctx, deviceIndex)
+	case "map":
+		return app.MapDemo(ctx, deviceIndex)
+	case "stubs":
+		return app.KernelStubs()
+	case "template":
+		return app.TemplateDemo(ctx, deviceIndex)
+	case "fp16":
+		return app.HalfBenchmark(ctx, deviceIndex)
+	case "bench-suite":
+		return app.BenchSuite(ctx, deviceIndex)
+	case "zero-copy":
+		return app.ZeroCopyBenchmark(ctx, deviceIndex)
+	case "pool":
+		return app.PoolDemo(ctx, deviceIndex)
+	case "oom":
+		return app.OOMDemo(ctx, deviceIndex)
+	case "resize":
+		return app.ResizeDemo(ctx, deviceIndex, opts.in, opts.out, opts.width, opts.height)
+	case "kernel-info":
+		return app.KernelInfoDemo(ctx, deviceIndex, opts.spec, opts.kernel)
 	default:
-		fmt.Printf("Unknown op: %s. Options: square, square-local, structs, multidim, vectors, batched-square, benchmark\n", *op)
+		fmt.Printf("Unknown op: %s. Options: square, square-local, structs, multidim, vectors, batched-square, benchmark, reduce, scan, sort, gemm, convolve, histogram, fft, map, stubs, template, fp16, bench-suite, zero-copy, pool, oom, resize, kernel-info\n", op)
+	}
+	return nil
+}
+
+// stringList is a flag that may be given several times, collecting its values in order.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+func parseInts(s string) ([]int, error) {
+	var out []int
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		v, err := strconv.Atoi(f)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
+
+func parseFloats(s string) ([]float64, error) {
+	var out []float64
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(f, 64)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, v)
 	}
+	return out, nil
 }
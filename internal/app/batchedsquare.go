@@ -1,9 +1,9 @@
 package app
 
 import (
+	"context"
 	"fmt"
 	"github.com/jgillich/go-opencl/cl"
-	"time"
 	"unsafe"
 )
 
@@ -19,41 +19,31 @@ var batchedSquareSrc = `__kernel void square(
    }
 }`
 
-func BatchedSquare(deviceIndex int) {
-	// First, get hold of a Platform
-	platforms, _ := cl.GetPlatforms()
-
-	// Next, get all devices from the first platform. Check so there's at least one device
-	devices, _ := platforms[0].GetDevices(cl.DeviceTypeAll)
-	if len(devices) == 0 {
-		panic("GetDevices returned no devices")
-	}
-	for i := range devices {
-		fmt.Printf("Device %d - %s: max work group size: %d\n", i, devices[i].Name(), devices[i].MaxWorkGroupSize())
+func BatchedSquare(ctx context.Context, deviceIndex int) error {
+	// Select a device to use. On my mac: 0 == CPU, 1 == Iris GPU, 2 == GeForce 750M GPU. The session holds an
+	// OpenCL context and a "Command Queue" bound to the selected device.
+	sess, err := openDemoSession(deviceIndex)
+	if err != nil {
+		return err
 	}
-
-	// Select a device to use. On my mac: 0 == CPU, 1 == Iris GPU, 2 == GeForce 750M GPU
-	// Use selected device to create an OpenCL context
-	context, _ := cl.CreateContext([]*cl.Device{devices[deviceIndex]})
-	defer context.Release()
-	fmt.Println(devices[deviceIndex].Name())
-
-	// Create a "Command Queue" bound to the selected device
-	queue, _ := context.CreateCommandQueue(devices[deviceIndex], 0)
-	defer queue.Release()
+	defer sess.Release()
 
 	// Create an OpenCL "program" from the source code. (batchedSquareSrc is declared elsewhere)
-	program, _ := context.CreateProgramWithSource([]string{batchedSquareSrc})
+	program, err := sess.Context.CreateProgramWithSource([]string{batchedSquareSrc})
+	if err != nil {
+		return fmt.Errorf("create program: %w", err)
+	}
+	defer program.Release()
 
 	// Build the OpenCL program
-	if err := program.BuildProgram(nil, ""); err != nil {
-		panic("BuildProgram failed: " + err.Error())
+	if err := program.BuildProgram(nil, sess.BuildOptions.String()); err != nil {
+		return fmt.Errorf("build program: %w", err)
 	}
 
 	// Create the actual Kernel with a name, the Kernel is what we call when we want to execute something.
 	kernel, err := program.CreateKernel("square")
 	if err != nil {
-		panic("CreateKernel failed: " + err.Error())
+		return fmt.Errorf("create kernel: %w", err)
 	}
 	defer kernel.Release()
 
@@ -67,17 +57,17 @@ func BatchedSquare(deviceIndex int) {
 	// Prepare for loading data into Device memory by creating an empty OpenCL buffers (memory)
 	// for the input data. Note that we're allocating 4x bytes the size of data since each int32
 	// uses 4 bytes.
-	inputBuffer, err := context.CreateEmptyBuffer(cl.MemReadOnly, 4*len(numbers))
+	inputBuffer, err := createBuffer(sess.Context, sess.Device, cl.MemReadOnly, 4*len(numbers))
 	if err != nil {
-		panic("CreateBuffer failed for matrices input: " + err.Error())
+		return fmt.Errorf("input buffer: %w", err)
 	}
 	defer inputBuffer.Release()
 
 	// Do the same for the output. We'll expect to get int32's back, the same number
 	// of items we passed in the input.
-	outputBuffer, err := context.CreateEmptyBuffer(cl.MemReadOnly, 4*len(numbers))
+	outputBuffer, err := createBuffer(sess.Context, sess.Device, cl.MemReadOnly, 4*len(numbers))
 	if err != nil {
-		panic("CreateBuffer failed for output: " + err.Error())
+		return fmt.Errorf("output buffer: %w", err)
 	}
 	defer outputBuffer.Release()
 
@@ -90,8 +80,8 @@ func BatchedSquare(deviceIndex int) {
 	// fly using unsafe.Sizeof.
 	inputDataPtr := unsafe.Pointer(&numbers[0])
 	inputDataTotalSize := int(unsafe.Sizeof(numbers[0])) * len(numbers) // 1024 x 4
-	if _, err := queue.EnqueueWriteBuffer(inputBuffer, true, 0, inputDataTotalSize, inputDataPtr, nil); err != nil {
-		panic("EnqueueWriteBuffer failed: " + err.Error())
+	if err := writeDemoInput(sess, inputBuffer, inputDataPtr, inputDataTotalSize); err != nil {
+		return err
 	}
 	fmt.Printf("Enqueed %d bytes into the write buffer\n", inputDataTotalSize)
 
@@ -99,43 +89,20 @@ func BatchedSquare(deviceIndex int) {
 	// then the output. This matches the signature of our OpenCL kernel:
 	// __kernel void square(__global int* input, __global int* output)
 	if err := kernel.SetArgs(inputBuffer, outputBuffer); err != nil {
-		panic("SetKernelArgs failed: " + err.Error())
+		return fmt.Errorf("set kernel args: %w", err)
 	}
 
 	size, _ := kernel.PreferredWorkGroupSizeMultiple(nil)
 
-	maxWGSize := devices[deviceIndex].MaxWorkGroupSize()
-	maxWISize := devices[deviceIndex].MaxWorkItemSizes()[0]
+	maxWGSize := sess.Device.MaxWorkGroupSize()
+	maxWISize := sess.Device.MaxWorkItemSizes()[0]
 	fmt.Printf("Preferred Work Group Size Multiple: %d, MaxWG: %d, MaxWI: %d\n", size, maxWGSize, maxWISize)
 	// For fun, time how long the execution takes
-	localSizes := []int{1, 2, 4, 8, 16, 32, 64, 128, 256, 512, 1024}
-	fmt.Println(
-		`| Device        | Work group size [ Local size | Result  |
-| ------------- |:-------------:| -----:| -----:|`)
-	iterations := int64(16)
-	for _, lz := range localSizes {
-		if lz > maxWGSize {
-			continue
-		}
-
-		var sum = int64(0)
-		for it := 0; it < int(iterations); it++ {
-			st := time.Now()
-
-			// Finally, start work! Enqueue executes the loaded args on the specified kernel.
-			if _, err := queue.EnqueueNDRangeKernel(kernel, nil, []int{elemCount / lz}, []int{lz}, nil); err != nil {
-				panic("EnqueueNDRangeKernel failed: " + err.Error())
-			}
-
-			// Finish() blocks the main goroutine until the OpenCL queue is empty, i.e. all calculations are done.
-			// The results have been written to the outputBuffer.
-			if err := queue.Finish(); err != nil {
-				panic("Finish failed: %" + err.Error())
-			}
-			//fmt.Printf("LZ: %d Took: %v\n", lz, time.Since(st))
-			sum += time.Since(st).Microseconds()
-		}
-		fmt.Printf("| %s   | %d | %d | %v |\n", devices[deviceIndex].Name(), elemCount/lz, lz, (time.Microsecond * time.Duration(sum/iterations)).String())
+	// Finally, start work! benchmarkDemo runs the kernel with the loaded args at every local size the kernel and
+	// device allow, blocking until the OpenCL queue is empty after every run. The results have been written to the
+	// outputBuffer.
+	if err := benchmarkDemo(ctx, sess, kernel, "batched-square", elemCount); err != nil {
+		return err
 	}
 
 	// Allocate storage for loading the output from the OpenCL program. Remember, we expect
@@ -145,10 +112,11 @@ func BatchedSquare(deviceIndex int) {
 	// The EnqueueReadBuffer copies the data in the OpenCL "output" buffer into the "results" slice.
 	outputDataPtrOut := unsafe.Pointer(&results[0])
 	outputDataSizeOut := int(unsafe.Sizeof(results[0])) * len(results)
-	if _, err := queue.EnqueueReadBuffer(outputBuffer, true, 0, outputDataSizeOut, outputDataPtrOut, nil); err != nil {
-		panic("EnqueueReadBuffer failed: " + err.Error())
+	if _, err := sess.Queue.EnqueueReadBuffer(outputBuffer, true, 0, outputDataSizeOut, outputDataPtrOut, nil); err != nil {
+		return fmt.Errorf("read output: %w", err)
 	}
 	//for i := 0; i < elemCount; i++ {
 	//	fmt.Printf("%d ", results[i])
 	//}
+	return nil
 }
@@ -1,9 +1,9 @@
 package app
 
 import (
+	"context"
 	"fmt"
 	"github.com/jgillich/go-opencl/cl"
-	"time"
 	"unsafe"
 )
 
@@ -20,41 +20,31 @@ __kernel void squareRoot(
 }
 `
 
-func Benchmark2(deviceIndex int) {
-	// First, get hold of a Platform
-	platforms, _ := cl.GetPlatforms()
-
-	// Next, get all devices from the first platform. Check so there's at least one device
-	devices, _ := platforms[0].GetDevices(cl.DeviceTypeAll)
-	if len(devices) == 0 {
-		panic("GetDevices returned no devices")
-	}
-	for i := range devices {
-		fmt.Printf("Device %d - %s: max work group size: %d\n", i, devices[i].Name(), devices[i].MaxWorkGroupSize())
+func Benchmark2(ctx context.Context, deviceIndex int) error {
+	// Select a device to use. On my mac: 0 == CPU, 1 == Iris GPU, 2 == GeForce 750M GPU. The session holds an
+	// OpenCL context and a "Command Queue" bound to the selected device.
+	sess, err := openDemoSession(deviceIndex)
+	if err != nil {
+		return err
 	}
-
-	// Select a device to use. On my mac: 0 == CPU, 1 == Iris GPU, 2 == GeForce 750M GPU
-	// Use selected device to create an OpenCL context
-	context, _ := cl.CreateContext([]*cl.Device{devices[deviceIndex]})
-	defer context.Release()
-	fmt.Println(devices[deviceIndex].Name())
-
-	// Create a "Command Queue" bound to the selected device
-	queue, _ := context.CreateCommandQueue(devices[deviceIndex], 0)
-	defer queue.Release()
+	defer sess.Release()
 
 	// Create an OpenCL "program" from the source code. (benchmarkSrc is declared elsewhere)
-	program, _ := context.CreateProgramWithSource([]string{benchmark2Src})
+	program, err := sess.Context.CreateProgramWithSource([]string{benchmark2Src})
+	if err != nil {
+		return fmt.Errorf("create program: %w", err)
+	}
+	defer program.Release()
 
 	// Build the OpenCL program
-	if err := program.BuildProgram(nil, ""); err != nil {
-		panic("BuildProgram failed: " + err.Error())
+	if err := program.BuildProgram(nil, sess.BuildOptions.String()); err != nil {
+		return fmt.Errorf("build program: %w", err)
 	}
 
 	// Create the actual Kernel with a name, the Kernel is what we call when we want to execute something.
 	kernel, err := program.CreateKernel("squareRoot")
 	if err != nil {
-		panic("CreateKernel failed: " + err.Error())
+		return fmt.Errorf("create kernel: %w", err)
 	}
 	defer kernel.Release()
 
@@ -69,17 +59,17 @@ func Benchmark2(deviceIndex int) {
 	// Prepare for loading data into Device memory by creating an empty OpenCL buffers (memory)
 	// for the input data. Note that we're allocating 4x bytes the size of data since each int32
 	// uses 4 bytes.
-	inputBuffer, err := context.CreateEmptyBuffer(cl.MemReadOnly, 4*len(numbers))
+	inputBuffer, err := createBuffer(sess.Context, sess.Device, cl.MemReadOnly, 4*len(numbers))
 	if err != nil {
-		panic("CreateBuffer failed for matrices input: " + err.Error())
+		return fmt.Errorf("input buffer: %w", err)
 	}
 	defer inputBuffer.Release()
 
 	// Do the same for the output. We'll expect to get int32's back, the same number
 	// of items we passed in the input.
-	outputBuffer, err := context.CreateEmptyBuffer(cl.MemReadOnly, 4*len(numbers))
+	outputBuffer, err := createBuffer(sess.Context, sess.Device, cl.MemReadOnly, 4*len(numbers))
 	if err != nil {
-		panic("CreateBuffer failed for output: " + err.Error())
+		return fmt.Errorf("output buffer: %w", err)
 	}
 	defer outputBuffer.Release()
 
@@ -92,8 +82,8 @@ func Benchmark2(deviceIndex int) {
 	// fly using unsafe.Sizeof.
 	inputDataPtr := unsafe.Pointer(&numbers[0])
 	inputDataTotalSize := int(unsafe.Sizeof(numbers[0])) * len(numbers) // 1024 x 4
-	if _, err := queue.EnqueueWriteBuffer(inputBuffer, true, 0, inputDataTotalSize, inputDataPtr, nil); err != nil {
-		panic("EnqueueWriteBuffer failed: " + err.Error())
+	if err := writeDemoInput(sess, inputBuffer, inputDataPtr, inputDataTotalSize); err != nil {
+		return err
 	}
 	fmt.Printf("Enqueed %d bytes into the write buffer\n", inputDataTotalSize)
 
@@ -101,58 +91,31 @@ func Benchmark2(deviceIndex int) {
 	// then the output. This matches the signature of our OpenCL kernel:
 	// __kernel void square(__global int* input, __global int* output)
 	if err := kernel.SetArgs(inputBuffer, outputBuffer); err != nil {
-		panic("SetKernelArgs failed: " + err.Error())
+		return fmt.Errorf("set kernel args: %w", err)
 	}
 
-	maxWgSize := devices[deviceIndex].MaxWorkGroupSize()
-	wgSize, err := kernel.WorkGroupSize(devices[deviceIndex])
+	maxWgSize := sess.Device.MaxWorkGroupSize()
+	wgSize, err := kernel.WorkGroupSize(sess.Device)
 	if err != nil {
-		panic("get work group size: " + err.Error())
+		return fmt.Errorf("get work group size: %w", err)
 	}
-	preferredMultiple, err := kernel.PreferredWorkGroupSizeMultiple(devices[deviceIndex])
+	preferredMultiple, err := kernel.PreferredWorkGroupSizeMultiple(sess.Device)
 	if err != nil {
-		panic("get preferred multiple: " + err.Error())
+		return fmt.Errorf("get preferred multiple: %w", err)
 	}
-	wiSizes := devices[deviceIndex].MaxWorkItemSizes()
+	wiSizes := sess.Device.MaxWorkItemSizes()
 	fmt.Printf("WorkGroupSize: %d\n", wgSize)
 	fmt.Printf("Max WorkGroupSize: %d\n", maxWgSize)
 	fmt.Printf("Preferred multiple: %d\n", preferredMultiple)
 	fmt.Printf("Work item sizes: %v\n", wiSizes)
-	fmt.Printf("Max compute units: %v\n", devices[deviceIndex].MaxComputeUnits())
-	fmt.Printf("Max samplers: %v\n", devices[deviceIndex].MaxSamplers())
-
-	localSizes := []int{1, 2, 4, 8, 16, 32, 64, 128, 256, 512, 1024}
-	fmt.Println(
-		`| Device        | Work group size | Local size | Result  |
-| ------------- |:-------------:| -----:| -----:|`)
-	iterations := int64(16)
-	for _, localSize := range localSizes {
-		var sum = int64(0)
-		st := time.Now()
-		if (deviceIndex == 0) && localSize > 128 {
-			break
-		}
-		if (deviceIndex == 1) && localSize > 512 {
-			break
-		}
-		if (deviceIndex == 2) && localSize > 1024 {
-			break
-		}
-		for it := 0; it < int(iterations); it++ {
-			// Finally, start work! Enqueue executes the loaded args on the specified kernel.
-			if _, err := queue.EnqueueNDRangeKernel(kernel, nil, []int{elemCount / 16}, []int{localSize}, nil); err != nil {
-				panic("EnqueueNDRangeKernel failed: " + err.Error())
-			}
-
-			// Finish() blocks the main goroutine until the OpenCL queue is empty, i.e. all calculations are done.
-			// The results have been written to the outputBuffer.
-			if err := queue.Finish(); err != nil {
-				panic("Finish failed: %" + err.Error())
-			}
-
-			sum += time.Since(st).Microseconds()
-		}
-		fmt.Printf("| %s   | %d | %d | %v |\n", devices[deviceIndex].Name(), elemCount, localSize, (time.Microsecond * time.Duration(sum/iterations)).String())
+	fmt.Printf("Max compute units: %v\n", sess.Device.MaxComputeUnits())
+	fmt.Printf("Max samplers: %v\n", sess.Device.MaxSamplers())
+
+	// Finally, start work! benchmarkDemo runs the kernel with the loaded args at every local size the kernel and
+	// device allow, blocking until the OpenCL queue is empty after every run. The results have been written to the
+	// outputBuffer.
+	if err := benchmarkDemo(ctx, sess, kernel, "benchmark2", elemCount); err != nil {
+		return err
 	}
 
 	// Allocate storage for loading the output from the OpenCL program. Remember, we expect
@@ -162,8 +125,9 @@ func Benchmark2(deviceIndex int) {
 	// The EnqueueReadBuffer copies the data in the OpenCL "output" buffer into the "results" slice.
 	outputDataPtrOut := unsafe.Pointer(&results[0])
 	outputDataSizeOut := int(unsafe.Sizeof(results[0])) * len(results)
-	if _, err := queue.EnqueueReadBuffer(outputBuffer, true, 0, outputDataSizeOut, outputDataPtrOut, nil); err != nil {
-		panic("EnqueueReadBuffer failed: " + err.Error())
+	if _, err := sess.Queue.EnqueueReadBuffer(outputBuffer, true, 0, outputDataSizeOut, outputDataPtrOut, nil); err != nil {
+		return fmt.Errorf("read output: %w", err)
 	}
 	fmt.Printf("%v\n", results[len(numbers)-1])
+	return nil
 }
@@ -0,0 +1,115 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/eriklupander/ocltest/internal/benchreport"
+	"io"
+	"os"
+	"sync"
+)
+
+// BenchResult is one measured configuration of a benchmark, with every sample kept so reports can show the spread.
+// It is the benchreport.Result the bench report reads back.
+type BenchResult = benchreport.Result
+
+// BenchFormat selects how BenchWriter prints results.
+type BenchFormat string
+
+const (
+	// BenchMarkdown prints a Markdown table row per result, like the other benchmarks.
+	BenchMarkdown BenchFormat = "markdown"
+	// BenchJSON prints one JSON object per line, for tools and the bench report.
+	BenchJSON BenchFormat = "json"
+)
+
+// ParseBenchFormat parses a -bench-format flag value.
+func ParseBenchFormat(s string) (BenchFormat, error) {
+	switch f := BenchFormat(s); f {
+	case BenchMarkdown, BenchJSON:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown benchmark format %q, expected markdown or json", s)
+}
+
+// BenchWriter writes benchmark results as they are measured.
+type BenchWriter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format BenchFormat
+	header bool
+}
+
+// NewBenchWriter returns a writer printing results to w in format.
+func NewBenchWriter(w io.Writer, format BenchFormat) *BenchWriter {
+	return &BenchWriter{w: w, format: format}
+}
+
+// Write prints r.
+func (b *BenchWriter) Write(r BenchResult) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.format == BenchJSON {
+		line, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(b.w, "%s\n", line)
+		return err
+	}
+
+	if !b.header {
+		b.header = true
+		if _, err := fmt.Fprintln(b.w,
+			`| Device        | Benchmark | Variant | Size | Local size | Mean | Std dev | Throughput | Annotations |
+| ------------- |:-------------:|:-------------:| -----:| -----:| -----:| -----:| -----:|:-------------:|`); err != nil {
+			return err
+		}
+	}
+	variant, size, local := r.Variant, "-", "-"
+	if variant == "" {
+		variant = "-"
+	}
+	if r.Size > 0 {
+		size = benchreport.FormatSize(r.Size, r.SizeUnit)
+	}
+	if r.LocalSize > 0 {
+		local = fmt.Sprint(r.LocalSize)
+	}
+	if r.Skipped != "" {
+		_, err := fmt.Fprintf(b.w, "| %s   | %s | %s | %s | %s | - | - | skipped: %s | - |\n", r.Device, r.Benchmark,
+			variant, size, local, r.Skipped)
+		return err
+	}
+	throughput := "-"
+	if v, unit := r.Throughput(); unit != "" {
+		throughput = fmt.Sprintf("%.2f %s", v, unit)
+	}
+	annotations := r.FormatAnnotations()
+	if annotations == "" {
+		annotations = "-"
+	}
+	_, err := fmt.Fprintf(b.w, "| %s   | %s | %s | %s | %s | %v | %v | %s | %s |\n", r.Device, r.Benchmark, variant, size,
+		local, r.Mean(), r.StdDev(), throughput, annotations)
+	return err
+}
+
+var (
+	benchOutputMu sync.Mutex
+	benchOutput   = NewBenchWriter(os.Stdout, BenchMarkdown)
+)
+
+// SetBenchOutput makes benchmarks that produce structured results write them to w in format. It is meant to be
+// called once at startup, e.g. from command line flags. The default is Markdown on stdout.
+func SetBenchOutput(w io.Writer, format BenchFormat) {
+	benchOutputMu.Lock()
+	defer benchOutputMu.Unlock()
+	benchOutput = NewBenchWriter(w, format)
+}
+
+// benchWriter returns the writer set with SetBenchOutput.
+func benchWriter() *BenchWriter {
+	benchOutputMu.Lock()
+	defer benchOutputMu.Unlock()
+	return benchOutput
+}
@@ -0,0 +1,40 @@
+package app
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBenchWriterMarkdown(t *testing.T) {
+	info := KernelInfo{WorkGroupSize: 256, PreferredMultiple: 32, LocalMem: 1024, PrivateMem: 16, MaxWorkGroupSize: 256,
+		DeviceLocalMem: 32768, ComputeUnits: 4}
+	measured := BenchResult{Benchmark: "benchmark3", Device: "GPU", Size: 1 << 20, SizeUnit: "elements", LocalSize: 64,
+		Samples: []time.Duration{100 * time.Microsecond, 100 * time.Microsecond}, Work: 8 << 20, WorkUnit: "B"}
+	info.annotate(&measured, 64)
+	results := []BenchResult{
+		measured,
+		{Benchmark: "h2d", Device: "GPU", Size: 4 << 30, SizeUnit: "B", Skipped: "exceeds the max allocation"},
+		{Benchmark: "fma", Device: "GPU", Variant: "float", Samples: []time.Duration{time.Millisecond}},
+	}
+
+	var b bytes.Buffer
+	w := NewBenchWriter(&b, BenchMarkdown)
+	for _, r := range results {
+		if err := w.Write(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{
+		"| Device        | Benchmark | Variant | Size | Local size | Mean | Std dev | Throughput | Annotations |",
+		"| ------------- |:-------------:|:-------------:| -----:| -----:| -----:| -----:| -----:|:-------------:|",
+		"| GPU   | benchmark3 | - | 1M | 64 | 100µs | 0s | 83.89 GB/s | local_mem=1024, occupancy=1.00, " +
+			"occupancy_limit=work items, private_mem=16 |",
+		"| GPU   | h2d | - | 4GB | - | - | - | skipped: exceeds the max allocation | - |",
+		"| GPU   | fma | float | - | - | 1ms | 0s | - | - |",
+	}
+	if got := b.String(); got != strings.Join(want, "\n")+"\n" {
+		t.Errorf("markdown output:\n%swant:\n%s", got, strings.Join(want, "\n"))
+	}
+}
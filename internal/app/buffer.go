@@ -0,0 +1,232 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"github.com/jgillich/go-opencl/cl"
+	"unsafe"
+)
+
+// Buffer is a device buffer holding Len elements of type T. It remembers the session it was created in, so reads
+// and writes go through that session's queue.
+type Buffer[T any] struct {
+	Mem  *cl.MemObject
+	Len  int
+	sess *Session
+	// pool is the MemPool the buffer came from, if any, and poolGen the generation it was handed out with.
+	pool    *MemPool
+	poolGen uint64
+}
+
+// elemSize returns the size in bytes of a single T.
+func elemSize[T any]() int {
+	var zero T
+	return int(unsafe.Sizeof(zero))
+}
+
+// clTypeName returns the OpenCL C name of the type T, with complex64 mapping to float2. It panics for types without
+// an OpenCL equivalent, which callers rule out with their type constraints.
+func clTypeName[T any]() string {
+	name, ok := lookupCLTypeName[T]()
+	if !ok {
+		var zero T
+		panic(fmt.Sprintf("no OpenCL type for %T", zero))
+	}
+	return name
+}
+
+// lookupCLTypeName is clTypeName for types that may not have an OpenCL equivalent, such as Go structs.
+func lookupCLTypeName[T any]() (string, bool) {
+	var zero T
+	return scalarCLTypeName(zero)
+}
+
+// scalarCLTypeName returns the OpenCL C type of the Go value v.
+func scalarCLTypeName(v interface{}) (string, bool) {
+	switch v.(type) {
+	case int8:
+		return "char", true
+	case uint8:
+		return "uchar", true
+	case int16:
+		return "short", true
+	case uint16:
+		return "ushort", true
+	case int32:
+		return "int", true
+	case uint32:
+		return "uint", true
+	case int64:
+		return "long", true
+	case uint64:
+		return "ulong", true
+	case float32:
+		return "float", true
+	case float64:
+		return "double", true
+	case Half:
+		return "half", true
+	case complex64:
+		return "float2", true
+	}
+	return "", false
+}
+
+// NewBuffer allocates an uninitialized buffer for n elements of T. Sizes the device can't allocate are reported as
+// *AllocError.
+func NewBuffer[T any](sess *Session, flags cl.MemFlag, n int) (*Buffer[T], error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("buffer length must be positive, got %d", n)
+	}
+	mem, err := createBuffer(sess.Context, sess.Device, flags, n*elemSize[T]())
+	if err != nil {
+		return nil, err
+	}
+	return &Buffer[T]{Mem: mem, Len: n, sess: sess}, nil
+}
+
+// NewBufferFrom allocates a buffer with room for data and uploads data into it.
+func NewBufferFrom[T any](ctx context.Context, sess *Session, flags cl.MemFlag, data []T) (*Buffer[T], error) {
+	buf, err := NewBuffer[T](sess, flags, len(data))
+	if err != nil {
+		return nil, err
+	}
+	if err := buf.Write(ctx, data); err != nil {
+		buf.Release()
+		return nil, err
+	}
+	return buf, nil
+}
+
+// Bytes returns the size of the buffer in bytes.
+func (b *Buffer[T]) Bytes() int {
+	return b.Len * elemSize[T]()
+}
+
+// Write uploads data to the start of the buffer, blocking until the transfer is done.
+func (b *Buffer[T]) Write(ctx context.Context, data []T) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(data) > b.Len {
+		return fmt.Errorf("cannot write %d elements into a buffer of %d", len(data), b.Len)
+	}
+	if err := writeSlice(b.sess.Queue, b.Mem, data); err != nil {
+		return fmt.Errorf("write buffer: %w", err)
+	}
+	return nil
+}
+
+// Read downloads the first len(dst) elements of the buffer into dst, blocking until the transfer is done.
+func (b *Buffer[T]) Read(ctx context.Context, dst []T) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(dst) > b.Len {
+		return fmt.Errorf("cannot read %d elements from a buffer of %d", len(dst), b.Len)
+	}
+	if err := readSlice(b.sess.Queue, b.Mem, dst); err != nil {
+		return fmt.Errorf("read buffer: %w", err)
+	}
+	return nil
+}
+
+// ReadAt downloads len(dst) elements starting at element offset into dst, blocking until the transfer is done.
+func (b *Buffer[T]) ReadAt(ctx context.Context, offset int, dst []T) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if offset < 0 || offset+len(dst) > b.Len {
+		return fmt.Errorf("cannot read %d elements at offset %d from a buffer of %d", len(dst), offset, b.Len)
+	}
+	if len(dst) == 0 {
+		return nil
+	}
+	size := elemSize[T]() * len(dst)
+	if _, err := b.sess.Queue.EnqueueReadBuffer(b.Mem, true, offset*elemSize[T](), size, unsafe.Pointer(&dst[0]), nil); err != nil {
+		return fmt.Errorf("read buffer: %w", err)
+	}
+	return nil
+}
+
+// CopyTo copies the buffer into dst on the device, blocking until the copy is done.
+func (b *Buffer[T]) CopyTo(ctx context.Context, dst *Buffer[T]) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if dst.Len < b.Len {
+		return fmt.Errorf("cannot copy %d elements into a buffer of %d", b.Len, dst.Len)
+	}
+	if _, err := b.sess.Queue.EnqueueCopyBuffer(b.Mem, dst.Mem, 0, 0, b.Bytes(), nil); err != nil {
+		return fmt.Errorf("copy buffer: %w", err)
+	}
+	return b.sess.Finish(ctx)
+}
+
+// ReadAll downloads the whole buffer into a new slice.
+func (b *Buffer[T]) ReadAll(ctx context.Context) ([]T, error) {
+	out := make([]T, b.Len)
+	if err := b.Read(ctx, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Release frees the device memory, or returns it to its MemPool.
+func (b *Buffer[T]) Release() {
+	if b.pool != nil {
+		b.pool.put(b.Mem, b.poolGen)
+		return
+	}
+	b.Mem.Release()
+}
+
+func (b *Buffer[T]) deviceMem() *cl.MemObject {
+	return b.Mem
+}
+
+func (b *Buffer[T]) elemTypeName() string {
+	name, _ := lookupCLTypeName[T]()
+	return name
+}
+
+// deviceMem is implemented by Buffer so that buffers of any element type can be passed to setKernelArgs.
+type deviceMem interface {
+	deviceMem() *cl.MemObject
+	// elemTypeName returns the OpenCL C element type, or "" if it has none.
+	elemTypeName() string
+}
+
+// setKernelArgs works like kernel.SetArgs, but also accepts *Buffer[T] and the scalar types cl.Kernel.SetArg
+// doesn't know about, such as float64.
+func setKernelArgs(kernel *cl.Kernel, args ...interface{}) error {
+	for i, arg := range args {
+		if err := setKernelArg(kernel, i, arg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setKernelArg sets a single argument like setKernelArgs.
+func setKernelArg(kernel *cl.Kernel, index int, arg interface{}) error {
+	var err error
+	switch v := arg.(type) {
+	case deviceMem:
+		err = kernel.SetArgBuffer(index, v.deviceMem())
+	case *Sampler:
+		err = v.setArg(kernel, index)
+	case float64:
+		err = kernel.SetArgUnsafe(index, 8, unsafe.Pointer(&v))
+	case int16:
+		err = kernel.SetArgUnsafe(index, 2, unsafe.Pointer(&v))
+	case uint16:
+		err = kernel.SetArgUnsafe(index, 2, unsafe.Pointer(&v))
+	default:
+		err = kernel.SetArg(index, arg)
+	}
+	if err != nil {
+		return fmt.Errorf("set kernel arg %d: %w", index, err)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package app
+
+import (
+	"fmt"
+	"github.com/jgillich/go-opencl/cl"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// BuildOptions are the options programs are compiled with: preprocessor defines plus any other compiler flags,
+// e.g. -cl-fast-relaxed-math, -cl-std=CL2.0 or -I include paths.
+type BuildOptions struct {
+	// Defines maps macro names to values. An empty value defines the macro without one, like -DNAME.
+	Defines map[string]string
+	// Flags are passed to the compiler as is, in order.
+	Flags []string
+}
+
+// ParseBuildOptions parses a compiler options string such as "-DTS=16 -cl-fast-relaxed-math". Both -DNAME=VAL and
+// -D NAME=VAL are recognized as defines, everything else is kept as a flag.
+func ParseBuildOptions(s string) (BuildOptions, error) {
+	var opts BuildOptions
+	fields := strings.Fields(s)
+	for i := 0; i < len(fields); i++ {
+		f := fields[i]
+		if f != "-D" && !strings.HasPrefix(f, "-D") {
+			opts.Flags = append(opts.Flags, f)
+			continue
+		}
+		def := strings.TrimPrefix(f, "-D")
+		if def == "" {
+			if i+1 == len(fields) {
+				return BuildOptions{}, fmt.Errorf("-D without a macro name")
+			}
+			i++
+			def = fields[i]
+		}
+		var err error
+		if opts, err = opts.WithDefine(def); err != nil {
+			return BuildOptions{}, err
+		}
+	}
+	return opts, nil
+}
+
+// WithDefine returns a copy of o with the define "NAME" or "NAME=VAL" added, replacing an earlier value.
+func (o BuildOptions) WithDefine(def string) (BuildOptions, error) {
+	name, value, _ := strings.Cut(def, "=")
+	if name == "" || strings.ContainsAny(name, " \t()") {
+		return BuildOptions{}, fmt.Errorf("invalid define %q", def)
+	}
+	return o.Merge(BuildOptions{Defines: map[string]string{name: value}}), nil
+}
+
+// Merge returns o with the defines and flags of other added. Defines in other replace those of the same name in o.
+func (o BuildOptions) Merge(other BuildOptions) BuildOptions {
+	merged := BuildOptions{Flags: append(append([]string(nil), o.Flags...), other.Flags...)}
+	if len(o.Defines)+len(other.Defines) > 0 {
+		merged.Defines = make(map[string]string, len(o.Defines)+len(other.Defines))
+		for name, value := range o.Defines {
+			merged.Defines[name] = value
+		}
+		for name, value := range other.Defines {
+			merged.Defines[name] = value
+		}
+	}
+	return merged
+}
+
+// String returns the options in the form BuildProgram takes them. Defines come first, sorted by name, so equal
+// options always give the same string.
+func (o BuildOptions) String() string {
+	names := make([]string, 0, len(o.Defines))
+	for name := range o.Defines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, 0, len(names)+len(o.Flags))
+	for _, name := range names {
+		if value := o.Defines[name]; value != "" {
+			parts = append(parts, "-D"+name+"="+value)
+		} else {
+			parts = append(parts, "-D"+name)
+		}
+	}
+	return strings.Join(append(parts, o.Flags...), " ")
+}
+
+// For returns the options string for building on device, with the flag that keeps kernel argument info added
+// where the device supports it.
+func (o BuildOptions) For(device *cl.Device) string {
+	return strings.TrimSpace(o.String() + " " + kernelArgInfoOption(device))
+}
+
+// describeBuildOptions returns the options for benchmark output, which records what the kernels were built with.
+func describeBuildOptions(o BuildOptions) string {
+	if s := o.String(); s != "" {
+		return s
+	}
+	return "(none)"
+}
+
+var (
+	defaultBuildOptionsMu sync.RWMutex
+	defaultBuildOptions   BuildOptions
+)
+
+// SetDefaultBuildOptions sets the options new sessions compile with. It is meant to be called once at startup, e.g.
+// from command line flags.
+func SetDefaultBuildOptions(o BuildOptions) {
+	defaultBuildOptionsMu.Lock()
+	defer defaultBuildOptionsMu.Unlock()
+	defaultBuildOptions = o
+}
+
+// DefaultBuildOptions returns the options set with SetDefaultBuildOptions.
+func DefaultBuildOptions() BuildOptions {
+	defaultBuildOptionsMu.RLock()
+	defer defaultBuildOptionsMu.RUnlock()
+	return defaultBuildOptions
+}
@@ -0,0 +1,224 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jgillich/go-opencl/cl"
+	"sort"
+	"strings"
+)
+
+// CLVersion is an OpenCL or OpenCL C version such as 1.2.
+type CLVersion struct {
+	Major, Minor int
+}
+
+// AtLeast reports whether v is major.minor or newer.
+func (v CLVersion) AtLeast(major, minor int) bool {
+	return v.Major > major || (v.Major == major && v.Minor >= minor)
+}
+
+func (v CLVersion) String() string {
+	return fmt.Sprintf("%d.%d", v.Major, v.Minor)
+}
+
+// parseCLVersion parses version strings like "OpenCL 1.2 CUDA" or "OpenCL C 1.2 " after the given prefix. It
+// returns the zero version if s doesn't match.
+func parseCLVersion(s, prefix string) CLVersion {
+	var v CLVersion
+	if !strings.HasPrefix(s, prefix) {
+		return CLVersion{}
+	}
+	if _, err := fmt.Sscanf(strings.TrimPrefix(s, prefix), "%d.%d", &v.Major, &v.Minor); err != nil {
+		return CLVersion{}
+	}
+	return v
+}
+
+// Capabilities are the features of a device that kernels may depend on.
+type Capabilities struct {
+	Device     string
+	Extensions map[string]bool
+	// Version is the OpenCL version of the device, CVersion the OpenCL C version its compiler accepts.
+	Version  CLVersion
+	CVersion CLVersion
+	FP64     bool
+	FP16     bool
+	Printf   bool
+	// GlobalAtomics and LocalAtomics are 32 bit integer atomics on global and local memory.
+	GlobalAtomics bool
+	LocalAtomics  bool
+	Images        bool
+	LocalMemSize  int64
+}
+
+// DeviceCapabilities queries the capabilities of device.
+func DeviceCapabilities(device *cl.Device) Capabilities {
+	c := Capabilities{
+		Device:       device.Name(),
+		Extensions:   map[string]bool{},
+		Version:      parseCLVersion(device.Version(), "OpenCL "),
+		CVersion:     parseCLVersion(device.OpenCLCVersion(), "OpenCL C "),
+		Images:       device.ImageSupport(),
+		LocalMemSize: device.LocalMemSize(),
+	}
+	for _, ext := range strings.Fields(device.Extensions()) {
+		c.Extensions[ext] = true
+	}
+	// OpenCL 1.0 devices report no OpenCL C version. Their compiler speaks OpenCL C 1.0.
+	if c.CVersion == (CLVersion{}) {
+		c.CVersion = CLVersion{1, 0}
+	}
+	c.FP64 = c.Extensions["cl_khr_fp64"]
+	c.FP16 = c.Extensions["cl_khr_fp16"]
+	// printf is core in OpenCL C 1.2, older devices may offer it as a vendor extension.
+	c.Printf = c.CVersion.AtLeast(1, 2) || c.Extensions["cl_intel_printf"] || c.Extensions["cl_amd_printf"]
+	// 32 bit atomics became core in OpenCL 1.1.
+	c.GlobalAtomics = c.Version.AtLeast(1, 1) || c.Extensions["cl_khr_global_int32_base_atomics"]
+	c.LocalAtomics = c.Version.AtLeast(1, 1) || c.Extensions["cl_khr_local_int32_base_atomics"]
+	return c
+}
+
+// Capabilities returns the capabilities of the session's device. They are queried once per session.
+func (s *Session) Capabilities() Capabilities {
+	s.capsOnce.Do(func() {
+		s.caps = DeviceCapabilities(s.Device)
+	})
+	return s.caps
+}
+
+// Requirements are the device features a kernel needs. The zero value requires nothing.
+type Requirements struct {
+	FP64          bool
+	FP16          bool
+	Printf        bool
+	GlobalAtomics bool
+	LocalAtomics  bool
+	Images        bool
+	// CVersion is the minimum OpenCL C version, e.g. {2, 0} for kernels built with -cl-std=CL2.0.
+	CVersion CLVersion
+	// LocalMem is the number of bytes of local memory the kernel uses.
+	LocalMem   int64
+	Extensions []string
+}
+
+// Merge returns the requirements of a program needing both r and other.
+func (r Requirements) Merge(other Requirements) Requirements {
+	merged := Requirements{
+		FP64:          r.FP64 || other.FP64,
+		FP16:          r.FP16 || other.FP16,
+		Printf:        r.Printf || other.Printf,
+		GlobalAtomics: r.GlobalAtomics || other.GlobalAtomics,
+		LocalAtomics:  r.LocalAtomics || other.LocalAtomics,
+		Images:        r.Images || other.Images,
+		CVersion:      r.CVersion,
+		LocalMem:      r.LocalMem,
+		Extensions:    append(append([]string(nil), r.Extensions...), other.Extensions...),
+	}
+	if !merged.CVersion.AtLeast(other.CVersion.Major, other.CVersion.Minor) {
+		merged.CVersion = other.CVersion
+	}
+	if other.LocalMem > merged.LocalMem {
+		merged.LocalMem = other.LocalMem
+	}
+	return merged
+}
+
+// typeRequirements returns what a program using the given OpenCL C types needs, i.e. fp64 for double and fp16 for
+// half, including their vector types.
+func typeRequirements(typeNames ...string) Requirements {
+	var r Requirements
+	for _, name := range typeNames {
+		base := strings.TrimRight(name, "0123456789")
+		r.FP64 = r.FP64 || base == "double"
+		r.FP16 = r.FP16 || base == "half"
+	}
+	return r
+}
+
+// ErrUnsupportedDevice is matched by the errors returned for kernels the device can't run, see UnsupportedError.
+var ErrUnsupportedDevice = errors.New("not supported by device")
+
+// UnsupportedError lists what a device lacks to run a kernel.
+type UnsupportedError struct {
+	Device  string
+	Missing []string
+}
+
+func (e *UnsupportedError) Error() string {
+	return fmt.Sprintf("%s lacks %s", e.Device, strings.Join(e.Missing, ", "))
+}
+
+// Is makes errors.Is(err, ErrUnsupportedDevice) true for every UnsupportedError.
+func (e *UnsupportedError) Is(target error) bool {
+	return target == ErrUnsupportedDevice
+}
+
+// Missing returns a description of every requirement in r the device doesn't meet.
+func (c Capabilities) Missing(r Requirements) []string {
+	var missing []string
+	check := func(required, supported bool, what string) {
+		if required && !supported {
+			missing = append(missing, what)
+		}
+	}
+	check(r.FP64, c.FP64, "double precision (cl_khr_fp64)")
+	check(r.FP16, c.FP16, "half precision (cl_khr_fp16)")
+	check(r.Printf, c.Printf, "printf")
+	check(r.GlobalAtomics, c.GlobalAtomics, "global 32 bit atomics")
+	check(r.LocalAtomics, c.LocalAtomics, "local 32 bit atomics")
+	check(r.Images, c.Images, "image support")
+	if !c.CVersion.AtLeast(r.CVersion.Major, r.CVersion.Minor) {
+		missing = append(missing, fmt.Sprintf("OpenCL C %s (has %s)", r.CVersion, c.CVersion))
+	}
+	if r.LocalMem > c.LocalMemSize {
+		missing = append(missing, fmt.Sprintf("%d bytes of local memory (has %d)", r.LocalMem, c.LocalMemSize))
+	}
+	for _, ext := range r.Extensions {
+		check(true, c.Extensions[ext], ext)
+	}
+	return missing
+}
+
+// Check returns an *UnsupportedError if the device doesn't meet r.
+func (c Capabilities) Check(r Requirements) error {
+	if missing := c.Missing(r); len(missing) > 0 {
+		return &UnsupportedError{Device: c.Device, Missing: missing}
+	}
+	return nil
+}
+
+// String lists the capabilities on one line, for demo output.
+func (c Capabilities) String() string {
+	var features []string
+	for name, ok := range map[string]bool{
+		"fp64": c.FP64, "fp16": c.FP16, "printf": c.Printf, "global atomics": c.GlobalAtomics,
+		"local atomics": c.LocalAtomics, "images": c.Images,
+	} {
+		if ok {
+			features = append(features, name)
+		}
+	}
+	sort.Strings(features)
+	return fmt.Sprintf("OpenCL %s, OpenCL C %s, %d KB local memory, %s", c.Version, c.CVersion, c.LocalMemSize/1024,
+		strings.Join(features, ", "))
+}
+
+// FirstSupported returns the first of the registered specs whose requirements the session's device meets, for
+// picking a fallback variant. The error lists why each one was rejected.
+func (s *Session) FirstSupported(specNames ...string) (string, error) {
+	caps := s.Capabilities()
+	var reasons []string
+	for _, name := range specNames {
+		spec, err := LookupKernel(name)
+		if err != nil {
+			return "", err
+		}
+		err = caps.Check(spec.Requires)
+		if err == nil {
+			return name, nil
+		}
+		reasons = append(reasons, fmt.Sprintf("%s: %v", name, err))
+	}
+	return "", fmt.Errorf("no supported variant: %s: %w", strings.Join(reasons, "; "), ErrUnsupportedDevice)
+}
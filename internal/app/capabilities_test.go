@@ -0,0 +1,137 @@
+package app
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseCLVersion(t *testing.T) {
+	tests := []struct {
+		s, prefix string
+		want      CLVersion
+	}{
+		{s: "OpenCL 1.2 CUDA", prefix: "OpenCL ", want: CLVersion{1, 2}},
+		{s: "OpenCL 1.0 ", prefix: "OpenCL ", want: CLVersion{1, 0}},
+		{s: "OpenCL 3.0 NEO ", prefix: "OpenCL ", want: CLVersion{3, 0}},
+		{s: "OpenCL C 1.2 ", prefix: "OpenCL C ", want: CLVersion{1, 2}},
+		{s: "OpenCL C 2.0", prefix: "OpenCL C ", want: CLVersion{2, 0}},
+		// The device version doesn't match the OpenCL C prefix and vice versa.
+		{s: "OpenCL 1.2 CUDA", prefix: "OpenCL C "},
+		{s: "OpenCL C 1.2 ", prefix: "OpenCL "},
+		{s: "", prefix: "OpenCL "},
+		{s: "OpenCL ", prefix: "OpenCL "},
+		{s: "OpenCL one.two", prefix: "OpenCL "},
+		{s: "OpenCL 1", prefix: "OpenCL "},
+		{s: "opencl 1.2", prefix: "OpenCL "},
+	}
+	for _, tt := range tests {
+		if got := parseCLVersion(tt.s, tt.prefix); got != tt.want {
+			t.Errorf("parseCLVersion(%q, %q) = %v, want %v", tt.s, tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestRequirementsMerge(t *testing.T) {
+	tests := []struct {
+		name     string
+		r, other Requirements
+		want     Requirements
+	}{
+		{name: "zero values"},
+		{name: "flags are or-ed", r: Requirements{FP64: true, Printf: true},
+			other: Requirements{FP16: true, LocalAtomics: true, Images: true},
+			want:  Requirements{FP64: true, FP16: true, Printf: true, LocalAtomics: true, Images: true}},
+		{name: "higher version wins", r: Requirements{CVersion: CLVersion{1, 2}},
+			other: Requirements{CVersion: CLVersion{2, 0}},
+			want:  Requirements{CVersion: CLVersion{2, 0}}},
+		{name: "higher version kept", r: Requirements{CVersion: CLVersion{1, 2}},
+			other: Requirements{CVersion: CLVersion{1, 1}},
+			want:  Requirements{CVersion: CLVersion{1, 2}}},
+		{name: "more local memory wins", r: Requirements{LocalMem: 1024}, other: Requirements{LocalMem: 4096},
+			want: Requirements{LocalMem: 4096}},
+		{name: "extensions are concatenated", r: Requirements{Extensions: []string{"cl_khr_fp64"}},
+			other: Requirements{GlobalAtomics: true, Extensions: []string{"cl_khr_int64_base_atomics"}},
+			want: Requirements{GlobalAtomics: true,
+				Extensions: []string{"cl_khr_fp64", "cl_khr_int64_base_atomics"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.r.Merge(tt.other); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Merge() = %+v, want %+v", got, tt.want)
+			}
+			if got := tt.other.Merge(tt.r); got.CVersion != tt.want.CVersion || got.LocalMem != tt.want.LocalMem {
+				t.Errorf("reversed Merge() = %+v, want version %v and local mem %d", got, tt.want.CVersion,
+					tt.want.LocalMem)
+			}
+		})
+	}
+
+	// Merging mustn't write to the receiver's extensions through a shared backing array.
+	exts := make([]string, 1, 2)
+	exts[0] = "cl_khr_fp64"
+	r := Requirements{Extensions: exts}
+	r.Merge(Requirements{Extensions: []string{"a"}})
+	r.Merge(Requirements{Extensions: []string{"b"}})
+	if got := exts[:2][1]; got != "" {
+		t.Errorf("Merge() wrote %q past the receiver's extensions", got)
+	}
+}
+
+func TestCapabilitiesCheck(t *testing.T) {
+	// cl12 is an OpenCL 1.2 GPU with fp64 but no fp16 or images.
+	cl12 := Capabilities{Device: "GPU", Extensions: map[string]bool{"cl_khr_fp64": true}, Version: CLVersion{1, 2},
+		CVersion: CLVersion{1, 2}, FP64: true, Printf: true, GlobalAtomics: true, LocalAtomics: true,
+		LocalMemSize: 32768}
+	// cl10 is an OpenCL 1.0 device with only the global atomics extension.
+	cl10 := Capabilities{Device: "old", Extensions: map[string]bool{"cl_khr_global_int32_base_atomics": true},
+		Version: CLVersion{1, 0}, CVersion: CLVersion{1, 0}, GlobalAtomics: true, LocalMemSize: 16384}
+	tests := []struct {
+		name string
+		caps Capabilities
+		r    Requirements
+		want []string
+	}{
+		{name: "nothing required", caps: cl10},
+		{name: "fp64", caps: cl12, r: Requirements{FP64: true}},
+		{name: "no fp64", caps: cl10, r: Requirements{FP64: true}, want: []string{"double precision (cl_khr_fp64)"}},
+		{name: "no fp16", caps: cl12, r: Requirements{FP64: true, FP16: true},
+			want: []string{"half precision (cl_khr_fp16)"}},
+		{name: "atomics", caps: cl12, r: Requirements{GlobalAtomics: true, LocalAtomics: true}},
+		{name: "no local atomics", caps: cl10, r: Requirements{GlobalAtomics: true, LocalAtomics: true},
+			want: []string{"local 32 bit atomics"}},
+		{name: "version met", caps: cl12, r: Requirements{CVersion: CLVersion{1, 1}}},
+		{name: "version too old", caps: cl12, r: Requirements{CVersion: CLVersion{2, 0}},
+			want: []string{"OpenCL C 2.0 (has 1.2)"}},
+		{name: "local memory", caps: cl10, r: Requirements{LocalMem: 32768},
+			want: []string{"32768 bytes of local memory (has 16384)"}},
+		{name: "extensions", caps: cl12, r: Requirements{Extensions: []string{"cl_khr_fp64", "cl_khr_gl_sharing"}},
+			want: []string{"cl_khr_gl_sharing"}},
+		{name: "everything missing in order", caps: cl10,
+			r: Requirements{FP64: true, FP16: true, Printf: true, LocalAtomics: true, Images: true,
+				CVersion: CLVersion{1, 2}},
+			want: []string{"double precision (cl_khr_fp64)", "half precision (cl_khr_fp16)", "printf",
+				"local 32 bit atomics", "image support", "OpenCL C 1.2 (has 1.0)"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.caps.Missing(tt.r); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Missing() = %q, want %q", got, tt.want)
+			}
+			err := tt.caps.Check(tt.r)
+			if tt.want == nil {
+				if err != nil {
+					t.Errorf("Check() = %v, want nil", err)
+				}
+				return
+			}
+			var unsupported *UnsupportedError
+			if !errors.As(err, &unsupported) || !errors.Is(err, ErrUnsupportedDevice) {
+				t.Fatalf("Check() = %v, want an *UnsupportedError matching ErrUnsupportedDevice", err)
+			}
+			if unsupported.Device != tt.caps.Device || !reflect.DeepEqual(unsupported.Missing, tt.want) {
+				t.Errorf("Check() = %+v, want device %s missing %q", unsupported, tt.caps.Device, tt.want)
+			}
+		})
+	}
+}
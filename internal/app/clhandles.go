@@ -0,0 +1,59 @@
+package app
+
+// #cgo linux pkg-config: OpenCL
+// #cgo darwin LDFLAGS: -framework OpenCL
+// #define CL_USE_DEPRECATED_OPENCL_1_2_APIS
+// #if defined(__APPLE__)
+// #include <OpenCL/cl.h>
+// #else
+// #include <CL/cl.h>
+// #endif
+import "C"
+
+import (
+	"github.com/jgillich/go-opencl/cl"
+	"unsafe"
+)
+
+// The cl package keeps the OpenCL handles in unexported fields and has no accessors for them, so the calls it
+// doesn't wrap read them through unsafe. That depends on the field layout of the version go.mod pins,
+// github.com/jgillich/go-opencl v0.0.0-20180608191952-a0efba3e5257:
+//
+//	type Kernel struct { clKernel C.cl_kernel; name string }
+//	type Device struct { id C.cl_device_id }
+//	type Context struct { clContext C.cl_context; devices []*Device }
+//	type MemObject struct { clMem C.cl_mem; size int }
+//
+// TestCLHandleLayout checks it, so upgrading the package needs these helpers revisited if the test fails.
+
+// clKernelHandle returns the cl_kernel behind k.
+func clKernelHandle(k *cl.Kernel) C.cl_kernel {
+	return *(*C.cl_kernel)(unsafe.Pointer(k))
+}
+
+// clDeviceHandle returns the cl_device_id behind d.
+func clDeviceHandle(d *cl.Device) C.cl_device_id {
+	return *(*C.cl_device_id)(unsafe.Pointer(d))
+}
+
+// clContextHandle returns the cl_context behind c.
+func clContextHandle(c *cl.Context) C.cl_context {
+	return *(*C.cl_context)(unsafe.Pointer(c))
+}
+
+// clMemObject mirrors the layout of cl.MemObject: the cl_mem handle followed by the size in bytes.
+type clMemObject struct {
+	mem  C.cl_mem
+	size int
+}
+
+// clMemHandle returns the cl_mem behind m.
+func clMemHandle(m *cl.MemObject) C.cl_mem {
+	return (*clMemObject)(unsafe.Pointer(m)).mem
+}
+
+// newCLMemObject wraps mem, a buffer of size bytes, in a cl.MemObject. Unlike the cl package's own buffers it has
+// no finalizer, so it must be released.
+func newCLMemObject(mem C.cl_mem, size int) *cl.MemObject {
+	return (*cl.MemObject)(unsafe.Pointer(&clMemObject{mem: mem, size: size}))
+}
@@ -0,0 +1,60 @@
+package app
+
+import (
+	"github.com/jgillich/go-opencl/cl"
+	"reflect"
+	"testing"
+	"unsafe"
+)
+
+// TestCLHandleLayout fails if the cl package no longer lays out its types the way clhandles.go assumes: each handle
+// first, and a MemObject's size in bytes right after its cl_mem.
+func TestCLHandleLayout(t *testing.T) {
+	tests := []struct {
+		name   string
+		typ    reflect.Type
+		field  string
+		handle func(p unsafe.Pointer) unsafe.Pointer
+	}{
+		{name: "Kernel", typ: reflect.TypeOf(cl.Kernel{}), field: "clKernel",
+			handle: func(p unsafe.Pointer) unsafe.Pointer { return unsafe.Pointer(clKernelHandle((*cl.Kernel)(p))) }},
+		{name: "Device", typ: reflect.TypeOf(cl.Device{}), field: "id",
+			handle: func(p unsafe.Pointer) unsafe.Pointer { return unsafe.Pointer(clDeviceHandle((*cl.Device)(p))) }},
+		{name: "Context", typ: reflect.TypeOf(cl.Context{}), field: "clContext",
+			handle: func(p unsafe.Pointer) unsafe.Pointer { return unsafe.Pointer(clContextHandle((*cl.Context)(p))) }},
+		{name: "MemObject", typ: reflect.TypeOf(cl.MemObject{}), field: "clMem",
+			handle: func(p unsafe.Pointer) unsafe.Pointer { return unsafe.Pointer(clMemHandle((*cl.MemObject)(p))) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, ok := tt.typ.FieldByName(tt.field)
+			if !ok {
+				t.Fatalf("cl.%s has no field %s", tt.name, tt.field)
+			}
+			if f.Offset != 0 || f.Type.Kind() != reflect.Ptr {
+				t.Fatalf("cl.%s.%s is a %v at offset %d, want a pointer handle at offset 0", tt.name, tt.field,
+					f.Type, f.Offset)
+			}
+			// Plant a Go pointer where the handle lives and read it back through the helper.
+			v := reflect.New(tt.typ)
+			want := unsafe.Pointer(new(byte))
+			*(*unsafe.Pointer)(unsafe.Pointer(v.Elem().Field(f.Index[0]).UnsafeAddr())) = want
+			if got := tt.handle(unsafe.Pointer(v.Pointer())); got != want {
+				t.Errorf("handle of cl.%s = %p, want %p", tt.name, got, want)
+			}
+		})
+	}
+
+	typ := reflect.TypeOf(cl.MemObject{})
+	size, ok := typ.FieldByName("size")
+	if !ok || size.Type.Kind() != reflect.Int || size.Offset != unsafe.Offsetof(clMemObject{}.size) ||
+		typ.Size() != unsafe.Sizeof(clMemObject{}) {
+		t.Fatalf("cl.MemObject doesn't match clMemObject: size field %+v, %d bytes, want %d", size, typ.Size(),
+			unsafe.Sizeof(clMemObject{}))
+	}
+	// A nil handle, as the test can't spell C.cl_mem; the handle's placement is checked above.
+	m := newCLMemObject(clMemHandle(new(cl.MemObject)), 4096)
+	if got := reflect.ValueOf(m).Elem().FieldByName("size").Int(); got != 4096 {
+		t.Errorf("newCLMemObject(_, 4096) has size %d", got)
+	}
+}
@@ -0,0 +1,464 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"github.com/jgillich/go-opencl/cl"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+)
+
+// BorderMode controls what a convolution reads outside the image.
+type BorderMode int32
+
+const (
+	// BorderClamp repeats the edge pixels.
+	BorderClamp BorderMode = iota
+	// BorderWrap tiles the image, so reads past the right edge continue at the left one.
+	BorderWrap
+	// BorderZero treats everything outside the image as 0.
+	BorderZero
+)
+
+// ParseBorderMode parses the value of the -border flag.
+func ParseBorderMode(s string) (BorderMode, error) {
+	switch s {
+	case "clamp":
+		return BorderClamp, nil
+	case "wrap":
+		return BorderWrap, nil
+	case "zero":
+		return BorderZero, nil
+	}
+	return 0, fmt.Errorf("unknown border mode %q, expected clamp, wrap or zero", s)
+}
+
+// FloatImage is a host image with Channels (1 for grayscale, 4 for RGBA) interleaved float32 values per pixel in
+// the range 0-1, stored row by row.
+type FloatImage struct {
+	Width, Height, Channels int
+	Pix                     []float32
+}
+
+// ImageBuffer is a FloatImage in a device buffer.
+type ImageBuffer struct {
+	*Buffer[float32]
+	Width, Height, Channels int
+}
+
+// NewImageBufferFrom uploads img.
+func NewImageBufferFrom(ctx context.Context, sess *Session, img *FloatImage) (*ImageBuffer, error) {
+	if len(img.Pix) != img.Width*img.Height*img.Channels {
+		return nil, fmt.Errorf("got %d values for a %dx%d image with %d channels", len(img.Pix), img.Width, img.Height, img.Channels)
+	}
+	buf, err := NewBufferFrom(ctx, sess, cl.MemReadWrite, img.Pix)
+	if err != nil {
+		return nil, err
+	}
+	return &ImageBuffer{Buffer: buf, Width: img.Width, Height: img.Height, Channels: img.Channels}, nil
+}
+
+// Download reads the image back to the host.
+func (b *ImageBuffer) Download(ctx context.Context) (*FloatImage, error) {
+	pix, err := b.ReadAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &FloatImage{Width: b.Width, Height: b.Height, Channels: b.Channels, Pix: pix}, nil
+}
+
+// Filter is a Width x Height convolution kernel stored row by row. The output pixel is aligned with the filter
+// element at (Width/2, Height/2), so even sizes reach one pixel further to the left and top than to the right and
+// bottom. Filters are applied without flipping, i.e. as a correlation, like in most image libraries.
+type Filter struct {
+	Width, Height int
+	Weights       []float32
+}
+
+// SeparableFilter is a filter that is the outer product of a column and a row vector, and can be applied as two
+// 1D passes in O(len(Row)+len(Col)) instead of O(len(Row)*len(Col)) reads per pixel.
+type SeparableFilter struct {
+	Row, Col []float32
+}
+
+// Filter returns the equivalent 2D filter.
+func (s SeparableFilter) Filter() Filter {
+	f := Filter{Width: len(s.Row), Height: len(s.Col), Weights: make([]float32, len(s.Row)*len(s.Col))}
+	for y, cv := range s.Col {
+		for x, rv := range s.Row {
+			f.Weights[y*f.Width+x] = cv * rv
+		}
+	}
+	return f
+}
+
+// GaussianFilter returns a normalized Gaussian blur with the given sigma, cut off at three sigmas.
+func GaussianFilter(sigma float64) SeparableFilter {
+	radius := int(math.Ceil(3 * sigma))
+	weights := make([]float32, 2*radius+1)
+	sum := 0.0
+	for i := -radius; i <= radius; i++ {
+		w := math.Exp(-float64(i*i) / (2 * sigma * sigma))
+		weights[i+radius] = float32(w)
+		sum += w
+	}
+	for i := range weights {
+		weights[i] /= float32(sum)
+	}
+	return SeparableFilter{Row: weights, Col: weights}
+}
+
+// SobelFilters returns the horizontal and vertical Sobel gradient filters.
+func SobelFilters() (gx, gy SeparableFilter) {
+	return SeparableFilter{Row: []float32{-1, 0, 1}, Col: []float32{1, 2, 1}},
+		SeparableFilter{Row: []float32{1, 2, 1}, Col: []float32{-1, 0, 1}}
+}
+
+// Each work group first copies its tile of the image plus the halo the filter reaches into local memory, with
+// every work item loading several pixels when the halo is wide, and then computes its output pixel from the tile
+// only. The separable path runs the same kernel twice with 1 pixel high and 1 pixel wide filters, so the halo is
+// only loaded along one axis per pass.
+var convSrc = `
+#define BORDER_CLAMP 0
+#define BORDER_WRAP 1
+
+// borderIndex maps i into [0, n), or returns -1 when the pixel should read as zero.
+inline int borderIndex(int i, int n, int border)
+{
+   if (i >= 0 && i < n) {
+      return i;
+   }
+   if (border == BORDER_CLAMP) {
+      return clamp(i, 0, n - 1);
+   }
+   if (border == BORDER_WRAP) {
+      return ((i % n) + n) % n;
+   }
+   return -1;
+}
+
+__kernel void convolve2D(
+   __global const float* src,
+   __global float* dst,
+   __constant float* filter,
+   const int width,
+   const int height,
+   const int channels,
+   const int filterWidth,
+   const int filterHeight,
+   const int border,
+   __local float* tile)
+{
+   int lx = get_local_id(0);
+   int ly = get_local_id(1);
+   int lw = get_local_size(0);
+   int lh = get_local_size(1);
+   int tileWidth = lw + filterWidth - 1;
+   int tileHeight = lh + filterHeight - 1;
+   int x0 = get_group_id(0) * lw - filterWidth / 2;
+   int y0 = get_group_id(1) * lh - filterHeight / 2;
+
+   for (int ty = ly; ty < tileHeight; ty += lh) {
+      int sy = borderIndex(y0 + ty, height, border);
+      for (int tx = lx; tx < tileWidth; tx += lw) {
+         int sx = borderIndex(x0 + tx, width, border);
+         for (int c = 0; c < channels; c++) {
+            tile[(ty * tileWidth + tx) * channels + c] = (sx < 0 || sy < 0) ? 0.0f : src[(sy * width + sx) * channels + c];
+         }
+      }
+   }
+   barrier(CLK_LOCAL_MEM_FENCE);
+
+   int x = get_global_id(0);
+   int y = get_global_id(1);
+   if (x >= width || y >= height) {
+      return;
+   }
+   for (int c = 0; c < channels; c++) {
+      float acc = 0.0f;
+      for (int fy = 0; fy < filterHeight; fy++) {
+         for (int fx = 0; fx < filterWidth; fx++) {
+            acc += filter[fy * filterWidth + fx] * tile[((ly + fy) * tileWidth + lx + fx) * channels + c];
+         }
+      }
+      dst[(y * width + x) * channels + c] = acc;
+   }
+}
+`
+
+func init() {
+	RegisterKernel(KernelSpec{Name: "conv", Source: convSrc})
+}
+
+// Convolve applies f to img and returns the result in a new image buffer, which the caller releases.
+func Convolve(ctx context.Context, sess *Session, img *ImageBuffer, f Filter, border BorderMode) (*ImageBuffer, error) {
+	if f.Width < 1 || f.Height < 1 || len(f.Weights) != f.Width*f.Height {
+		return nil, fmt.Errorf("invalid %dx%d filter with %d weights", f.Width, f.Height, len(f.Weights))
+	}
+	weights, err := NewBufferFrom(ctx, sess, cl.MemReadOnly, f.Weights)
+	if err != nil {
+		return nil, err
+	}
+	defer weights.Release()
+
+	buf, err := NewBuffer[float32](sess, cl.MemReadWrite, img.Len)
+	if err != nil {
+		return nil, err
+	}
+	out := &ImageBuffer{Buffer: buf, Width: img.Width, Height: img.Height, Channels: img.Channels}
+	if err := convolve(ctx, sess, img, out, weights, f.Width, f.Height, border); err != nil {
+		out.Release()
+		return nil, err
+	}
+	return out, nil
+}
+
+// ConvolveSeparable applies f to img as a row pass followed by a column pass and returns the result in a new
+// image buffer, which the caller releases. The result matches Convolve with f.Filter() up to rounding.
+func ConvolveSeparable(ctx context.Context, sess *Session, img *ImageBuffer, f SeparableFilter, border BorderMode) (*ImageBuffer, error) {
+	rows, err := Convolve(ctx, sess, img, Filter{Width: len(f.Row), Height: 1, Weights: f.Row}, border)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Release()
+	return Convolve(ctx, sess, rows, Filter{Width: 1, Height: len(f.Col), Weights: f.Col}, border)
+}
+
+func convolve(ctx context.Context, sess *Session, src, dst *ImageBuffer, weights *Buffer[float32], fw, fh int, border BorderMode) error {
+	kernel, err := sess.Kernel(ctx, "conv", "convolve2D")
+	if err != nil {
+		return err
+	}
+	defer kernel.Release()
+
+	local, err := convLocalSize(sess, kernel, fw, fh, src.Channels)
+	if err != nil {
+		return err
+	}
+	tileBytes := (local[0] + fw - 1) * (local[1] + fh - 1) * src.Channels * 4
+	if err := setKernelArgs(kernel, src.Buffer, dst.Buffer, weights, int32(src.Width), int32(src.Height), int32(src.Channels),
+		int32(fw), int32(fh), int32(border), cl.LocalBuffer(tileBytes)); err != nil {
+		return err
+	}
+	global := []int{(src.Width + local[0] - 1) / local[0] * local[0], (src.Height + local[1] - 1) / local[1] * local[1]}
+	return sess.Run(ctx, kernel, global, local)
+}
+
+// convLocalSize returns the largest square local size of at most 16x16 whose tile and halo fit in local memory.
+func convLocalSize(sess *Session, kernel *cl.Kernel, fw, fh, channels int) ([]int, error) {
+	maxLocal, err := kernel.WorkGroupSize(sess.Device)
+	if err != nil {
+		return nil, fmt.Errorf("get work group size: %w", err)
+	}
+	wiSizes := sess.Device.MaxWorkItemSizes()
+	for side := 16; side >= 1; side /= 2 {
+		if side*side > maxLocal || side > wiSizes[0] || side > wiSizes[1] {
+			continue
+		}
+		if int64((side+fw-1)*(side+fh-1)*channels*4) <= sess.Device.LocalMemSize() {
+			return []int{side, side}, nil
+		}
+	}
+	return nil, fmt.Errorf("a %dx%d filter over %d channels does not fit in local memory on %s", fw, fh, channels, sess)
+}
+
+// convolveCPU is the host reference for Convolve.
+func convolveCPU(img *FloatImage, f Filter, border BorderMode) *FloatImage {
+	out := &FloatImage{Width: img.Width, Height: img.Height, Channels: img.Channels, Pix: make([]float32, len(img.Pix))}
+	index := func(i, n int) int {
+		switch {
+		case i >= 0 && i < n:
+			return i
+		case border == BorderClamp && i < 0:
+			return 0
+		case border == BorderClamp:
+			return n - 1
+		case border == BorderWrap:
+			return ((i % n) + n) % n
+		}
+		return -1
+	}
+	for y := 0; y < img.Height; y++ {
+		for x := 0; x < img.Width; x++ {
+			for c := 0; c < img.Channels; c++ {
+				acc := float32(0)
+				for fy := 0; fy < f.Height; fy++ {
+					sy := index(y+fy-f.Height/2, img.Height)
+					for fx := 0; fx < f.Width; fx++ {
+						sx := index(x+fx-f.Width/2, img.Width)
+						if sx < 0 || sy < 0 {
+							continue
+						}
+						acc += f.Weights[fy*f.Width+fx] * img.Pix[(sy*img.Width+sx)*img.Channels+c]
+					}
+				}
+				out.Pix[(y*img.Width+x)*img.Channels+c] = acc
+			}
+		}
+	}
+	return out
+}
+
+// maxDiff returns the largest absolute difference between two images of the same size.
+func maxDiff(a, b *FloatImage) float64 {
+	diff := 0.0
+	for i := range a.Pix {
+		diff = math.Max(diff, math.Abs(float64(a.Pix[i]-b.Pix[i])))
+	}
+	return diff
+}
+
+// LoadPNG decodes a PNG file. Grayscale images get one channel, everything else is converted to
+// non-premultiplied RGBA.
+func LoadPNG(path string) (*FloatImage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	src, err := png.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("decode %s: %w", path, err)
+	}
+
+	bounds := src.Bounds()
+	img := &FloatImage{Width: bounds.Dx(), Height: bounds.Dy(), Channels: 4}
+	switch src.(type) {
+	case *image.Gray, *image.Gray16:
+		img.Channels = 1
+	}
+	img.Pix = make([]float32, img.Width*img.Height*img.Channels)
+	for y := 0; y < img.Height; y++ {
+		for x := 0; x < img.Width; x++ {
+			i := (y*img.Width + x) * img.Channels
+			c := src.At(bounds.Min.X+x, bounds.Min.Y+y)
+			if img.Channels == 1 {
+				img.Pix[i] = float32(color.Gray16Model.Convert(c).(color.Gray16).Y) / 0xffff
+				continue
+			}
+			n := color.NRGBA64Model.Convert(c).(color.NRGBA64)
+			img.Pix[i] = float32(n.R) / 0xffff
+			img.Pix[i+1] = float32(n.G) / 0xffff
+			img.Pix[i+2] = float32(n.B) / 0xffff
+			img.Pix[i+3] = float32(n.A) / 0xffff
+		}
+	}
+	return img, nil
+}
+
+// SavePNG encodes img as an 8 bit PNG, clamping values to 0-1.
+func SavePNG(path string, img *FloatImage) error {
+	to8 := func(v float32) uint8 {
+		return uint8(math.Round(math.Max(0, math.Min(1, float64(v))) * 255))
+	}
+	var dst image.Image
+	if img.Channels == 1 {
+		gray := image.NewGray(image.Rect(0, 0, img.Width, img.Height))
+		for i, v := range img.Pix {
+			gray.Pix[i] = to8(v)
+		}
+		dst = gray
+	} else {
+		rgba := image.NewNRGBA(image.Rect(0, 0, img.Width, img.Height))
+		for i, v := range img.Pix {
+			rgba.Pix[i] = to8(v)
+		}
+		dst = rgba
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(f, dst); err != nil {
+		f.Close()
+		return fmt.Errorf("encode %s: %w", path, err)
+	}
+	return f.Close()
+}
+
+// ConvolveDemo reads the PNG at in, applies a Gaussian blur or a Sobel edge filter on the device and writes the
+// result to out. Both the separable and the full 2D path are checked against the Go reference.
+func ConvolveDemo(ctx context.Context, deviceIndex int, in, out, filter string, border BorderMode) error {
+	img, err := LoadPNG(in)
+	if err != nil {
+		return err
+	}
+	devices, err := getDevices()
+	if err != nil {
+		return err
+	}
+	sess, err := NewSession(devices, deviceIndex)
+	if err != nil {
+		return err
+	}
+	defer sess.Release()
+	fmt.Println(sess)
+	fmt.Printf("Read %s: %dx%d with %d channels\n", in, img.Width, img.Height, img.Channels)
+
+	var passes []SeparableFilter
+	switch filter {
+	case "blur":
+		passes = []SeparableFilter{GaussianFilter(2)}
+	case "sobel":
+		gx, gy := SobelFilters()
+		passes = []SeparableFilter{gx, gy}
+	default:
+		return fmt.Errorf("unknown filter %q, expected blur or sobel", filter)
+	}
+
+	src, err := NewImageBufferFrom(ctx, sess, img)
+	if err != nil {
+		return err
+	}
+	defer src.Release()
+
+	var results []*FloatImage
+	for _, pass := range passes {
+		want := convolveCPU(img, pass.Filter(), border)
+		for _, separable := range []bool{true, false} {
+			var dst *ImageBuffer
+			if separable {
+				dst, err = ConvolveSeparable(ctx, sess, src, pass, border)
+			} else {
+				dst, err = Convolve(ctx, sess, src, pass.Filter(), border)
+			}
+			if err != nil {
+				return err
+			}
+			got, err := dst.Download(ctx)
+			dst.Release()
+			if err != nil {
+				return err
+			}
+			if diff := maxDiff(got, want); diff > 1e-4 {
+				return fmt.Errorf("%dx%d filter (separable: %v) differs from the reference by %g", len(pass.Row), len(pass.Col), separable, diff)
+			}
+			fmt.Printf("%dx%d filter (separable: %v) matches the reference\n", len(pass.Row), len(pass.Col), separable)
+			if separable {
+				results = append(results, got)
+			}
+		}
+	}
+
+	result := results[0]
+	if filter == "sobel" {
+		// Gradient magnitude, scaled so the strongest possible edge maps to 1.
+		gy := results[1]
+		for i := range result.Pix {
+			result.Pix[i] = float32(math.Hypot(float64(result.Pix[i]), float64(gy.Pix[i])) / (4 * math.Sqrt2))
+			// The gradient of an opaque alpha channel is 0, keep the edges visible.
+			if result.Channels == 4 && i%4 == 3 {
+				result.Pix[i] = 1
+			}
+		}
+	}
+	if err := SavePNG(out, result); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s\n", out)
+	return nil
+}
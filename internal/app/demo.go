@@ -0,0 +1,66 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"github.com/jgillich/go-opencl/cl"
+	"unsafe"
+)
+
+// openDemoSession lists the devices with their max work group size, like the original demos did, and opens a
+// session on devices[deviceIndex].
+//
+// The demos launch their kernels with sess.Run, which stops waiting and returns ctx.Err() as soon as the context
+// is cancelled or times out. The kernel in flight is abandoned and still runs to completion on the device, which
+// the demos' deferred sess.Release waits for before freeing the queue.
+func openDemoSession(deviceIndex int) (*Session, error) {
+	devices, err := getDevices()
+	if err != nil {
+		return nil, err
+	}
+	for i := range devices {
+		fmt.Printf("Device %d - %s: max work group size: %d\n", i, devices[i].Name(), devices[i].MaxWorkGroupSize())
+	}
+	sess, err := NewSession(devices, deviceIndex)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println(sess.Device.Name())
+	return sess, nil
+}
+
+// writeDemoInput blocks while uploading the size bytes at ptr into buf, the input buffer of a demo whose output
+// buffer has the same size. Drivers may only allocate the buffers on first use, so running out of memory can show
+// up here too, reported as an *AllocError for both buffers.
+func writeDemoInput(sess *Session, buf *cl.MemObject, ptr unsafe.Pointer, size int) error {
+	if _, err := sess.Queue.EnqueueWriteBuffer(buf, true, 0, size, ptr, nil); err != nil {
+		return fmt.Errorf("write input: %w", allocFailure(sess.Device, int64(2*size), err))
+	}
+	return nil
+}
+
+// benchmarkDemo times the kernel of the benchmark demo named benchmark, whose arguments are set, on n elements at
+// every local size the kernel and device allow, launched like SizeSweep does. The results go to the structured
+// benchmark output, see SetBenchOutput, annotated with the kernel's local and private memory use and an occupancy
+// estimate.
+func benchmarkDemo(ctx context.Context, sess *Session, kernel *cl.Kernel, benchmark string, n int) error {
+	info, err := QueryKernelInfo(kernel, sess.Device)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Kernel work-group size: %d, local memory: %d bytes, private memory: %d bytes\n", info.WorkGroupSize,
+		info.LocalMem, info.PrivateMem)
+	fmt.Printf("Build options: %s\n", describeBuildOptions(sess.BuildOptions))
+	localSizes := []int{1, 2, 4, 8, 16, 32, 64, 128, 256, 512, 1024}
+	results, err := measureLocalSizes(ctx, sess, kernel, benchmark, sweepKernels[benchmark], n, localSizes, info, 16)
+	if err != nil {
+		return err
+	}
+	out := benchWriter()
+	for _, r := range results {
+		if err := out.Write(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,464 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"github.com/jgillich/go-opencl/cl"
+	"hash/fnv"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Mappable lists the element types element-wise expressions can be compiled for.
+type Mappable interface {
+	int32 | float32 | float64
+}
+
+// Expr is a node of an element-wise expression, built from variables, constants and the operator functions
+// below. Nodes are compared by identity, so a subexpression used twice is computed once in the generated kernel.
+type Expr interface {
+	// emit returns the OpenCL C expression for the node, with its operands already bound to temporaries.
+	emit(typeName string, operands []string) (string, error)
+	operands() []Expr
+}
+
+// Var is an input of a Func. Its name only shows up in the generated source.
+type Var struct {
+	name string
+}
+
+var identifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// NewVar returns a new input variable. name must be a valid C identifier.
+func NewVar(name string) *Var {
+	return &Var{name: name}
+}
+
+func (v *Var) emit(string, []string) (string, error) {
+	return "", fmt.Errorf("variable %s is not an input of the function", v.name)
+}
+
+func (v *Var) operands() []Expr { return nil }
+
+type constExpr struct {
+	value float64
+}
+
+// Const is a constant, converted to the element type the function is compiled for.
+func Const(value float64) Expr {
+	return &constExpr{value: value}
+}
+
+func (c *constExpr) emit(typeName string, _ []string) (string, error) {
+	if typeName == "int" {
+		if c.value != math.Trunc(c.value) || math.Abs(c.value) > math.MaxInt32 {
+			return "", fmt.Errorf("constant %v is not an int", c.value)
+		}
+		return strconv.FormatInt(int64(c.value), 10), nil
+	}
+	if math.IsNaN(c.value) || math.IsInf(c.value, 0) {
+		return "", fmt.Errorf("constant %v is not finite", c.value)
+	}
+	if typeName == "float" && math.Abs(c.value) > math.MaxFloat32 {
+		return "", fmt.Errorf("constant %v overflows float", c.value)
+	}
+	lit := strconv.FormatFloat(c.value, 'g', -1, 64)
+	if !strings.ContainsAny(lit, ".e") {
+		lit += ".0"
+	}
+	if typeName == "float" {
+		lit += "f"
+	}
+	return lit, nil
+}
+
+func (c *constExpr) operands() []Expr { return nil }
+
+type callExpr struct {
+	op        string
+	args      []Expr
+	floatOnly bool
+	// format is the OpenCL C template of the call, with %[1]s, %[2]s for the operands.
+	format string
+	// intFormat replaces format for int, where some builtins have different names.
+	intFormat string
+}
+
+func (c *callExpr) emit(typeName string, operands []string) (string, error) {
+	if typeName == "int" {
+		if c.floatOnly {
+			return "", fmt.Errorf("%s needs a floating point type", c.op)
+		}
+		if c.intFormat != "" {
+			return fmt.Sprintf(c.intFormat, toAny(operands)...), nil
+		}
+	}
+	return fmt.Sprintf(c.format, toAny(operands)...), nil
+}
+
+func (c *callExpr) operands() []Expr { return c.args }
+
+func toAny(s []string) []interface{} {
+	out := make([]interface{}, len(s))
+	for i, v := range s {
+		out[i] = v
+	}
+	return out
+}
+
+func call(op, format string, args ...Expr) Expr {
+	return &callExpr{op: op, args: args, format: format}
+}
+
+func floatCall(op, format string, args ...Expr) Expr {
+	return &callExpr{op: op, args: args, floatOnly: true, format: format}
+}
+
+// The operator functions build expression nodes. Sqrt, Exp, Log, Sin, Cos and Pow need a floating point type and
+// fail to compile for int32.
+
+func Add(a, b Expr) Expr { return call("Add", "%[1]s + %[2]s", a, b) }
+func Sub(a, b Expr) Expr { return call("Sub", "%[1]s - %[2]s", a, b) }
+func Mul(a, b Expr) Expr { return call("Mul", "%[1]s * %[2]s", a, b) }
+func Div(a, b Expr) Expr { return call("Div", "%[1]s / %[2]s", a, b) }
+func Neg(a Expr) Expr    { return call("Neg", "-%[1]s", a) }
+func Min(a, b Expr) Expr { return call("Min", "min(%[1]s, %[2]s)", a, b) }
+func Max(a, b Expr) Expr { return call("Max", "max(%[1]s, %[2]s)", a, b) }
+func Sqrt(a Expr) Expr   { return floatCall("Sqrt", "sqrt(%[1]s)", a) }
+func Exp(a Expr) Expr    { return floatCall("Exp", "exp(%[1]s)", a) }
+func Log(a Expr) Expr    { return floatCall("Log", "log(%[1]s)", a) }
+func Sin(a Expr) Expr    { return floatCall("Sin", "sin(%[1]s)", a) }
+func Cos(a Expr) Expr    { return floatCall("Cos", "cos(%[1]s)", a) }
+func Pow(a, b Expr) Expr { return floatCall("Pow", "pow(%[1]s, %[2]s)", a, b) }
+
+// Abs is fabs for floating point types and abs, which returns an unsigned value, cast back for int.
+func Abs(a Expr) Expr {
+	return &callExpr{op: "Abs", args: []Expr{a}, format: "fabs(%[1]s)", intFormat: "(int)abs(%[1]s)"}
+}
+
+// Func is an element-wise function of one or more inputs with one or more outputs. It is compiled into a single
+// fused kernel per element type, the first time it is applied with that type.
+type Func struct {
+	ins  []*Var
+	outs []Expr
+}
+
+// Map returns the function computing out from the single input in, e.g. Map(x, Sqrt(Mul(x, x))).
+func Map(in *Var, out Expr) *Func {
+	return MapN([]*Var{in}, out)
+}
+
+// MapN returns the function computing outs from ins.
+func MapN(ins []*Var, outs ...Expr) *Func {
+	return &Func{ins: ins, outs: outs}
+}
+
+// Source returns the OpenCL C source of the function's kernel, called "map", for element type typeName. The
+// kernel takes the inputs, then the outputs, then the element count.
+func (f *Func) Source(typeName string) (string, error) {
+	if len(f.ins) == 0 || len(f.outs) == 0 {
+		return "", fmt.Errorf("a function needs at least one input and one output")
+	}
+
+	var params, body []string
+	names := map[Expr]string{}
+	declared := map[string]bool{}
+	for i, v := range f.ins {
+		if !identifier.MatchString(v.name) {
+			return "", fmt.Errorf("input %d: %q is not a valid identifier", i, v.name)
+		}
+		if _, dup := names[v]; dup {
+			return "", fmt.Errorf("input %s is passed twice", v.name)
+		}
+		// Distinct variables with the same name would declare v_name twice.
+		if declared[v.name] {
+			return "", fmt.Errorf("input %d: another input is named %s", i, v.name)
+		}
+		declared[v.name] = true
+		names[v] = "v_" + v.name
+		params = append(params, fmt.Sprintf("__global const T* in_%d", i))
+		body = append(body, fmt.Sprintf("   const T v_%s = in_%d[i];", v.name, i))
+	}
+
+	// Bind every node to a temporary in dependency order, so shared subexpressions are computed once.
+	var bind func(e Expr) (string, error)
+	bind = func(e Expr) (string, error) {
+		if name, ok := names[e]; ok {
+			return name, nil
+		}
+		var operands []string
+		for _, op := range e.operands() {
+			name, err := bind(op)
+			if err != nil {
+				return "", err
+			}
+			operands = append(operands, name)
+		}
+		code, err := e.emit(typeName, operands)
+		if err != nil {
+			return "", err
+		}
+		name := fmt.Sprintf("t%d", len(names)-len(f.ins))
+		names[e] = name
+		body = append(body, fmt.Sprintf("   const T %s = %s;", name, code))
+		return name, nil
+	}
+	for i, out := range f.outs {
+		name, err := bind(out)
+		if err != nil {
+			return "", fmt.Errorf("output %d: %w", i, err)
+		}
+		params = append(params, fmt.Sprintf("__global T* out_%d", i))
+		body = append(body, fmt.Sprintf("   out_%d[i] = %s;", i, name))
+	}
+	params = append(params, "const unsigned int n")
+
+	return fmt.Sprintf(`%s#define T %s
+
+__kernel void map(
+   %s)
+{
+   const unsigned int i = get_global_id(0);
+   if (i >= n) {
+      return;
+   }
+%s
+}
+`, typePragmas(typeName), typeName, strings.Join(params, ",\n   "), strings.Join(body, "\n")), nil
+}
+
+// Apply runs f over ins, writing outs. All buffers must have the same length.
+func Apply[T Mappable](ctx context.Context, sess *Session, f *Func, ins, outs []*Buffer[T]) error {
+	if len(ins) != len(f.ins) || len(outs) != len(f.outs) {
+		return fmt.Errorf("function takes %d inputs and %d outputs, got %d and %d", len(f.ins), len(f.outs), len(ins), len(outs))
+	}
+	n := ins[0].Len
+	for _, buf := range append(append([]*Buffer[T]{}, ins...), outs...) {
+		if buf.Len != n {
+			return fmt.Errorf("buffer lengths differ: %d and %d", n, buf.Len)
+		}
+	}
+
+	spec, err := f.spec(clTypeName[T]())
+	if err != nil {
+		return err
+	}
+
+	args := make([]interface{}, 0, len(ins)+len(outs)+1)
+	for _, buf := range ins {
+		args = append(args, buf)
+	}
+	for _, buf := range outs {
+		args = append(args, buf)
+	}
+	args = append(args, uint32(n))
+	return runElementwise(ctx, sess, spec, "map", n, args...)
+}
+
+// spec registers the function's kernel for element type typeName and returns its spec name.
+func (f *Func) spec(typeName string) (string, error) {
+	src, err := f.Source(typeName)
+	if err != nil {
+		return "", err
+	}
+	h := fnv.New64a()
+	h.Write([]byte(src))
+	spec := KernelSpec{Name: fmt.Sprintf("map_%s_%x", typeName, h.Sum64()), Source: src, Requires: typeRequirements(typeName)}
+	if err := EnsureKernel(spec); err != nil {
+		return "", err
+	}
+	return spec.Name, nil
+}
+
+// ApplySlices runs f over the host slices ins, writing outs, in chunks if they don't fit on the device at once, see
+// ElementwiseSlices.
+func ApplySlices[T Mappable](ctx context.Context, sess *Session, f *Func, ins, outs [][]T) error {
+	if len(ins) != len(f.ins) || len(outs) != len(f.outs) {
+		return fmt.Errorf("function takes %d inputs and %d outputs, got %d and %d", len(f.ins), len(f.outs), len(ins), len(outs))
+	}
+	spec, err := f.spec(clTypeName[T]())
+	if err != nil {
+		return err
+	}
+	return ElementwiseSlices(ctx, sess, spec, "map", ins, outs)
+}
+
+// ApplyNew is Apply with newly allocated outputs, which the caller releases.
+func ApplyNew[T Mappable](ctx context.Context, sess *Session, f *Func, ins ...*Buffer[T]) ([]*Buffer[T], error) {
+	if len(ins) == 0 {
+		return nil, fmt.Errorf("no inputs")
+	}
+	outs := make([]*Buffer[T], 0, len(f.outs))
+	release := func() {
+		for _, buf := range outs {
+			buf.Release()
+		}
+	}
+	for range f.outs {
+		buf, err := NewBuffer[T](sess, cl.MemReadWrite, ins[0].Len)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		outs = append(outs, buf)
+	}
+	if err := Apply(ctx, sess, f, ins, outs); err != nil {
+		release()
+		return nil, err
+	}
+	return outs, nil
+}
+
+// evalCPU is the host reference for Apply on a single element. For int, Div truncates like in C.
+func evalCPU(e Expr, vars map[*Var]float64, isInt bool) float64 {
+	switch n := e.(type) {
+	case *Var:
+		return vars[n]
+	case *constExpr:
+		return n.value
+	case *callExpr:
+		args := make([]float64, len(n.args))
+		for i, arg := range n.args {
+			args[i] = evalCPU(arg, vars, isInt)
+		}
+		switch n.op {
+		case "Add":
+			return args[0] + args[1]
+		case "Sub":
+			return args[0] - args[1]
+		case "Mul":
+			return args[0] * args[1]
+		case "Div":
+			if isInt {
+				return math.Trunc(args[0] / args[1])
+			}
+			return args[0] / args[1]
+		case "Neg":
+			return -args[0]
+		case "Min":
+			return math.Min(args[0], args[1])
+		case "Max":
+			return math.Max(args[0], args[1])
+		case "Abs":
+			return math.Abs(args[0])
+		case "Sqrt":
+			return math.Sqrt(args[0])
+		case "Exp":
+			return math.Exp(args[0])
+		case "Log":
+			return math.Log(args[0])
+		case "Sin":
+			return math.Sin(args[0])
+		case "Cos":
+			return math.Cos(args[0])
+		case "Pow":
+			return math.Pow(args[0], args[1])
+		}
+	}
+	panic(fmt.Sprintf("evalCPU: unknown node %T", e))
+}
+
+// verifyMap applies f to ins on the device and compares every output element with evalCPU.
+func verifyMap[T Mappable](ctx context.Context, sess *Session, name string, f *Func, ins ...[]T) error {
+	var bufs []*Buffer[T]
+	defer func() {
+		for _, buf := range bufs {
+			buf.Release()
+		}
+	}()
+	for _, data := range ins {
+		buf, err := NewBufferFrom(ctx, sess, cl.MemReadOnly, data)
+		if err != nil {
+			return err
+		}
+		bufs = append(bufs, buf)
+	}
+	st := time.Now()
+	outs, err := ApplyNew(ctx, sess, f, bufs...)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	took := time.Since(st)
+	bufs = append(bufs, outs...)
+
+	isInt := clTypeName[T]() == "int"
+	vars := map[*Var]float64{}
+	for o, out := range outs {
+		got, err := out.ReadAll(ctx)
+		if err != nil {
+			return err
+		}
+		for i := range got {
+			for v, in := range f.ins {
+				vars[in] = float64(ins[v][i])
+			}
+			want := evalCPU(f.outs[o], vars, isInt)
+			if math.Abs(float64(got[i])-want) > 1e-4*math.Max(1, math.Abs(want)) {
+				return fmt.Errorf("%s: output %d element %d is %v, expected %v", name, o, i, got[i], want)
+			}
+		}
+	}
+	fmt.Printf("%s (%s, %d outputs) OK, took %v\n", name, clTypeName[T](), len(outs), took)
+	return nil
+}
+
+// MapDemo compiles a few element-wise functions, including the square and squareRoot kernels other demos write by
+// hand and a fused function with two inputs and two outputs, and checks them against the CPU.
+func MapDemo(ctx context.Context, deviceIndex int) error {
+	devices, err := getDevices()
+	if err != nil {
+		return err
+	}
+	sess, err := NewSession(devices, deviceIndex)
+	if err != nil {
+		return err
+	}
+	defer sess.Release()
+	fmt.Println(sess)
+
+	n := 1 << 20
+	ints := make([]int32, n)
+	floats := make([]float32, n)
+	xs := make([]float64, n)
+	ys := make([]float64, n)
+	for i := 0; i < n; i++ {
+		ints[i] = int32(i%2000) - 1000
+		floats[i] = float32(i%1000) / 10
+		xs[i] = float64(i%997) / 97
+		ys[i] = float64(i%89) - 44
+	}
+
+	x := NewVar("x")
+	y := NewVar("y")
+	square := Map(x, Mul(x, x))
+	if err := verifyMap(ctx, sess, "square", square, ints); err != nil {
+		return err
+	}
+	if err := verifyMap(ctx, sess, "sqrt(x*x)", Map(x, Sqrt(Mul(x, x))), floats); err != nil {
+		return err
+	}
+	if err := verifyMap(ctx, sess, "clamped halves", Map(x, Min(Max(Div(x, Const(2)), Const(-100)), Const(100))), ints); err != nil {
+		return err
+	}
+
+	// The shared x*x, y*y and their sum are computed once for both outputs.
+	xx, yy := Mul(x, x), Mul(y, y)
+	sum := Add(xx, yy)
+	polar := MapN([]*Var{x, y}, Sqrt(sum), Div(Sub(xx, yy), Add(sum, Const(1))))
+	if sess.Capabilities().FP64 {
+		if err := verifyMap(ctx, sess, "hypot and ratio", polar, xs, ys); err != nil {
+			return err
+		}
+	} else {
+		fmt.Println("double: skipped, device does not support double-precision floating point")
+	}
+	src, err := polar.Source("float")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Generated source for float:\n%s", src)
+	return nil
+}
@@ -0,0 +1,77 @@
+package app
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestFuncSourceInputs(t *testing.T) {
+	x, y := NewVar("x"), NewVar("y")
+	otherX := NewVar("x")
+	tests := []struct {
+		name    string
+		f       *Func
+		wantErr string
+	}{
+		{name: "distinct names", f: MapN([]*Var{x, y}, Add(x, y))},
+		{name: "same variable twice", f: MapN([]*Var{x, x}, Add(x, x)), wantErr: "passed twice"},
+		{name: "same name twice", f: MapN([]*Var{x, otherX}, Add(x, otherX)), wantErr: "another input is named x"},
+		{name: "invalid identifier", f: Map(NewVar("1x"), Const(1)), wantErr: "not a valid identifier"},
+		{name: "not an input", f: Map(x, Add(x, y)), wantErr: "not an input"},
+		{name: "no outputs", f: MapN([]*Var{x}), wantErr: "at least one input and one output"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, err := tt.f.Source("float")
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if strings.Count(src, "const T v_x ") != 1 {
+					t.Errorf("expected v_x to be declared once:\n%s", src)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, expected one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConstEmit(t *testing.T) {
+	tests := []struct {
+		value    float64
+		typeName string
+		want     string
+		wantErr  string
+	}{
+		{value: 2, typeName: "float", want: "2.0f"},
+		{value: 0.5, typeName: "double", want: "0.5"},
+		{value: 1e300, typeName: "double", want: "1e+300"},
+		{value: math.MaxFloat32, typeName: "float", want: "3.4028234663852886e+38f"},
+		{value: -3, typeName: "int", want: "-3"},
+		{value: 1e300, typeName: "float", wantErr: "overflows float"},
+		{value: -1e39, typeName: "float", wantErr: "overflows float"},
+		{value: math.NaN(), typeName: "float", wantErr: "not finite"},
+		{value: math.Inf(1), typeName: "double", wantErr: "not finite"},
+		{value: math.Inf(-1), typeName: "float", wantErr: "not finite"},
+		{value: math.NaN(), typeName: "int", wantErr: "not an int"},
+		{value: 0.5, typeName: "int", wantErr: "not an int"},
+		{value: 1 << 40, typeName: "int", wantErr: "not an int"},
+	}
+	for _, tt := range tests {
+		got, err := Const(tt.value).emit(tt.typeName, nil)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Const(%v) as %s: got %q, %v, expected an error containing %q", tt.value, tt.typeName, got, err,
+					tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("Const(%v) as %s = %q, %v, expected %q", tt.value, tt.typeName, got, err, tt.want)
+		}
+	}
+}
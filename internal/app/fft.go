@@ -0,0 +1,428 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"github.com/jgillich/go-opencl/cl"
+	"math"
+	"math/bits"
+	"math/cmplx"
+	"time"
+)
+
+// FFTDirection selects the forward or the inverse transform.
+type FFTDirection int
+
+const (
+	// FFTForward computes X[k] = sum x[j] * exp(-2*pi*i*j*k/n).
+	FFTForward FFTDirection = iota
+	// FFTInverse computes the inverse including the 1/n scaling, so a forward and an inverse transform round-trip.
+	FFTInverse
+)
+
+func (d FFTDirection) sign() float32 {
+	if d == FFTInverse {
+		return 1
+	}
+	return -1
+}
+
+// The transform is a Stockham autosort FFT: each pass reads one buffer and writes the other, and the output of the
+// last pass is already in natural order, so no bit reversal is needed. p is the size of the sub-transforms that
+// are already done; a radix-4 pass turns them into sub-transforms of size 4p, a radix-2 pass into size 2p.
+// Dimension 1 of the NDRange selects the row for batched transforms of n elements each.
+var fftSrc = `
+inline float2 cmul(float2 a, float2 b)
+{
+   return (float2)(a.x * b.x - a.y * b.y, a.x * b.y + a.y * b.x);
+}
+
+inline float2 twiddle(float2 u, float alpha)
+{
+   return cmul(u, (float2)(cos(alpha), sin(alpha)));
+}
+
+__kernel void fftRadix2(
+   __global const float2* x,
+   __global float2* y,
+   const uint n,
+   const uint p,
+   const float sign)
+{
+   uint i = get_global_id(0);
+   uint base = get_global_id(1) * n;
+   uint t = n / 2;
+   uint k = i & (p - 1);
+   uint j = ((i - k) << 1) + k;
+
+   float2 u0 = x[base + i];
+   float2 u1 = twiddle(x[base + i + t], sign * M_PI_F * (float)k / (float)p);
+   y[base + j] = u0 + u1;
+   y[base + j + p] = u0 - u1;
+}
+
+__kernel void fftRadix4(
+   __global const float2* x,
+   __global float2* y,
+   const uint n,
+   const uint p,
+   const float sign)
+{
+   uint i = get_global_id(0);
+   uint base = get_global_id(1) * n;
+   uint t = n / 4;
+   uint k = i & (p - 1);
+   uint j = ((i - k) << 2) + k;
+
+   float alpha = sign * M_PI_F * (float)k / (float)(2 * p);
+   float2 u0 = x[base + i];
+   float2 u1 = twiddle(x[base + i + t], alpha);
+   float2 u2 = twiddle(x[base + i + 2 * t], 2 * alpha);
+   float2 u3 = twiddle(x[base + i + 3 * t], 3 * alpha);
+
+   float2 v0 = u0 + u2;
+   float2 v1 = u0 - u2;
+   float2 v2 = u1 + u3;
+   float2 d = u1 - u3;
+   // Multiply by -i for the forward and by i for the inverse transform.
+   float2 v3 = (float2)(-sign * d.y, sign * d.x);
+
+   y[base + j] = v0 + v2;
+   y[base + j + p] = v1 + v3;
+   y[base + j + 2 * p] = v0 - v2;
+   y[base + j + 3 * p] = v1 - v3;
+}
+
+__kernel void fftScale(__global float2* x, const uint n, const float factor)
+{
+   uint i = get_global_id(0);
+   if (i < n) {
+      x[i] *= factor;
+   }
+}
+
+// transpose writes the width x height matrix src as the height x width matrix dst.
+__kernel void fftTranspose(
+   __global const float2* src,
+   __global float2* dst,
+   const uint width,
+   const uint height)
+{
+   uint x = get_global_id(0);
+   uint y = get_global_id(1);
+   dst[x * height + y] = src[y * width + x];
+}
+`
+
+func init() {
+	RegisterKernel(KernelSpec{Name: "fft", Source: fftSrc})
+}
+
+// FFT transforms buf in place. Its length must be a power of two; pad with zeros up to nextPowOf2 otherwise.
+func FFT(ctx context.Context, sess *Session, buf *Buffer[complex64], dir FFTDirection) error {
+	return fftRows(ctx, sess, buf, buf.Len, 1, dir)
+}
+
+// FFT2D transforms the row-major width x height matrix in buf in place. Both sides must be powers of two.
+func FFT2D(ctx context.Context, sess *Session, buf *Buffer[complex64], width, height int, dir FFTDirection) error {
+	if width*height != buf.Len {
+		return fmt.Errorf("buffer of %d elements does not hold a %dx%d matrix", buf.Len, width, height)
+	}
+	if err := fftRows(ctx, sess, buf, width, height, dir); err != nil {
+		return err
+	}
+	// The columns are transformed as the rows of the transposed matrix.
+	transposed, err := NewBuffer[complex64](sess, cl.MemReadWrite, buf.Len)
+	if err != nil {
+		return err
+	}
+	defer transposed.Release()
+	if err := fftTranspose(ctx, sess, buf, transposed, width, height); err != nil {
+		return err
+	}
+	if err := fftRows(ctx, sess, transposed, height, width, dir); err != nil {
+		return err
+	}
+	return fftTranspose(ctx, sess, transposed, buf, height, width)
+}
+
+func fftTranspose(ctx context.Context, sess *Session, src, dst *Buffer[complex64], width, height int) error {
+	kernel, err := sess.Kernel(ctx, "fft", "fftTranspose")
+	if err != nil {
+		return err
+	}
+	defer kernel.Release()
+	if err := setKernelArgs(kernel, src, dst, uint32(width), uint32(height)); err != nil {
+		return err
+	}
+	return sess.Run(ctx, kernel, []int{width, height}, nil)
+}
+
+// fftRows transforms batch consecutive rows of n elements each, using radix-4 passes and one radix-2 pass when
+// log2(n) is odd.
+func fftRows(ctx context.Context, sess *Session, buf *Buffer[complex64], n, batch int, dir FFTDirection) error {
+	if n < 2 || n != nextPowOf2(n) {
+		return fmt.Errorf("FFT size must be a power of two of at least 2, got %d", n)
+	}
+	radix2, err := sess.Kernel(ctx, "fft", "fftRadix2")
+	if err != nil {
+		return err
+	}
+	defer radix2.Release()
+	radix4, err := sess.Kernel(ctx, "fft", "fftRadix4")
+	if err != nil {
+		return err
+	}
+	defer radix4.Release()
+	scratch, err := NewBuffer[complex64](sess, cl.MemReadWrite, buf.Len)
+	if err != nil {
+		return err
+	}
+	defer scratch.Release()
+
+	src, dst := buf, scratch
+	for p := 1; p < n; {
+		kernel, radix := radix4, 4
+		if p*4 > n {
+			kernel, radix = radix2, 2
+		}
+		if err := setKernelArgs(kernel, src, dst, uint32(n), uint32(p), dir.sign()); err != nil {
+			return err
+		}
+		if err := sess.Run(ctx, kernel, []int{n / radix, batch}, nil); err != nil {
+			return err
+		}
+		src, dst = dst, src
+		p *= radix
+	}
+	if src != buf {
+		if err := src.CopyTo(ctx, buf); err != nil {
+			return err
+		}
+	}
+
+	if dir == FFTInverse {
+		scale, err := sess.Kernel(ctx, "fft", "fftScale")
+		if err != nil {
+			return err
+		}
+		defer scale.Release()
+		if err := setKernelArgs(scale, buf, uint32(buf.Len), float32(1)/float32(n)); err != nil {
+			return err
+		}
+		return sess.Run(ctx, scale, []int{(buf.Len + 63) / 64 * 64}, nil)
+	}
+	return nil
+}
+
+// fftCPU is the host reference for FFT, an iterative radix-2 transform in complex128.
+func fftCPU(in []complex128, dir FFTDirection) []complex128 {
+	n := len(in)
+	out := make([]complex128, n)
+	shift := 64 - bits.TrailingZeros(uint(n))
+	for i, v := range in {
+		out[bits.Reverse64(uint64(i))>>shift] = v
+	}
+	if n == 1 {
+		return out
+	}
+	sign := float64(dir.sign())
+	for size := 2; size <= n; size <<= 1 {
+		half := size / 2
+		twiddles := make([]complex128, half)
+		for k := range twiddles {
+			twiddles[k] = cmplx.Rect(1, sign*2*math.Pi*float64(k)/float64(size))
+		}
+		for start := 0; start < n; start += size {
+			for k := 0; k < half; k++ {
+				u := out[start+k]
+				v := out[start+k+half] * twiddles[k]
+				out[start+k] = u + v
+				out[start+k+half] = u - v
+			}
+		}
+	}
+	if dir == FFTInverse {
+		for i := range out {
+			out[i] /= complex(float64(n), 0)
+		}
+	}
+	return out
+}
+
+// fft2DCPU is the host reference for FFT2D.
+func fft2DCPU(in []complex128, width, height int, dir FFTDirection) []complex128 {
+	out := make([]complex128, len(in))
+	for y := 0; y < height; y++ {
+		copy(out[y*width:], fftCPU(in[y*width:(y+1)*width], dir))
+	}
+	col := make([]complex128, height)
+	for x := 0; x < width; x++ {
+		for y := range col {
+			col[y] = out[y*width+x]
+		}
+		for y, v := range fftCPU(col, dir) {
+			out[y*width+x] = v
+		}
+	}
+	return out
+}
+
+// fftError returns the RMS error of got relative to the RMS of want.
+func fftError(got []complex64, want []complex128) float64 {
+	var diff, norm float64
+	for i := range want {
+		d := complex128(got[i]) - want[i]
+		diff += real(d)*real(d) + imag(d)*imag(d)
+		norm += real(want[i])*real(want[i]) + imag(want[i])*imag(want[i])
+	}
+	return math.Sqrt(diff / norm)
+}
+
+// fftSignal returns a deterministic test signal: a few tones plus a ramp, so no bin is trivially zero.
+func fftSignal(n int) ([]complex64, []complex128) {
+	in := make([]complex64, n)
+	ref := make([]complex128, n)
+	for i := range in {
+		t := float64(i) / float64(n)
+		v := complex(math.Sin(2*math.Pi*3*t)+0.5*math.Cos(2*math.Pi*17*t)+t, 0.25*math.Sin(2*math.Pi*5*t))
+		in[i] = complex64(v)
+		ref[i] = complex128(in[i])
+	}
+	return in, ref
+}
+
+// fftMaxError is the largest relative RMS error accepted from the float32 device transform.
+const fftMaxError = 1e-4
+
+// verifyFFT checks the forward and inverse transforms of data against the host reference.
+func verifyFFT(ctx context.Context, sess *Session, buf *Buffer[complex64], in []complex64, ref []complex128, width, height int) error {
+	if err := buf.Write(ctx, in); err != nil {
+		return err
+	}
+	transform := func(dir FFTDirection) error {
+		if height == 1 {
+			return FFT(ctx, sess, buf, dir)
+		}
+		return FFT2D(ctx, sess, buf, width, height, dir)
+	}
+
+	if err := transform(FFTForward); err != nil {
+		return err
+	}
+	got, err := buf.ReadAll(ctx)
+	if err != nil {
+		return err
+	}
+	want := fftCPU(ref, FFTForward)
+	if height > 1 {
+		want = fft2DCPU(ref, width, height, FFTForward)
+	}
+	if e := fftError(got, want); e > fftMaxError {
+		return fmt.Errorf("%dx%d forward transform has a relative error of %g", width, height, e)
+	}
+
+	if err := transform(FFTInverse); err != nil {
+		return err
+	}
+	if got, err = buf.ReadAll(ctx); err != nil {
+		return err
+	}
+	if e := fftError(got, ref); e > fftMaxError {
+		return fmt.Errorf("%dx%d inverse transform has a relative error of %g", width, height, e)
+	}
+	return nil
+}
+
+// FFTBenchmark verifies a 2D transform and times 1D forward transforms of 2^10 through 2^24 points. Sizes up to
+// 2^20 are checked against the host reference, larger ones only round-tripped through the inverse transform.
+// GFLOPS use the customary 5 n log2(n) operation count.
+func FFTBenchmark(ctx context.Context, deviceIndex int) error {
+	devices, err := getDevices()
+	if err != nil {
+		return err
+	}
+	sess, err := NewSession(devices, deviceIndex)
+	if err != nil {
+		return err
+	}
+	defer sess.Release()
+	fmt.Println(sess)
+
+	width, height := 256, 512
+	in, ref := fftSignal(width * height)
+	buf, err := NewBuffer[complex64](sess, cl.MemReadWrite, len(in))
+	if err != nil {
+		return err
+	}
+	err = verifyFFT(ctx, sess, buf, in, ref, width, height)
+	buf.Release()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("2D %dx%d: OK\n", width, height)
+
+	fmt.Printf("Build options: %s\n", describeBuildOptions(sess.BuildOptions))
+	fmt.Println(
+		`| Device        | Size | Result  | GFLOPS |
+| ------------- |:-------------:| -----:| -----:|`)
+	iterations := int64(16)
+	for log2 := 10; log2 <= 24; log2++ {
+		n := 1 << log2
+		// Each transform needs the buffer itself and a scratch buffer of the same size.
+		if int64(n*8) > sess.Device.MaxMemAllocSize() || int64(2*n*8) > sess.Device.GlobalMemSize() {
+			fmt.Printf("| %s   | 2^%d | skipped: too large | - |\n", sess.Device.Name(), log2)
+			continue
+		}
+		in, ref := fftSignal(n)
+		buf, err := NewBuffer[complex64](sess, cl.MemReadWrite, n)
+		if err != nil {
+			return err
+		}
+		if log2 <= 20 {
+			err = verifyFFT(ctx, sess, buf, in, ref, n, 1)
+		} else {
+			err = verifyRoundTrip(ctx, sess, buf, in, ref)
+		}
+		if err != nil {
+			buf.Release()
+			return err
+		}
+
+		var sum = int64(0)
+		for it := 0; it < int(iterations); it++ {
+			st := time.Now()
+			if err := FFT(ctx, sess, buf, FFTForward); err != nil {
+				buf.Release()
+				return err
+			}
+			sum += time.Since(st).Microseconds()
+		}
+		buf.Release()
+		avg := time.Microsecond * time.Duration(sum/iterations)
+		flops := 5 * float64(n) * float64(log2)
+		fmt.Printf("| %s   | 2^%d | %v | %.2f |\n", sess.Device.Name(), log2, avg.String(), flops/avg.Seconds()/1e9)
+	}
+	return nil
+}
+
+// verifyRoundTrip checks that a forward and an inverse transform give back the input.
+func verifyRoundTrip(ctx context.Context, sess *Session, buf *Buffer[complex64], in []complex64, ref []complex128) error {
+	if err := buf.Write(ctx, in); err != nil {
+		return err
+	}
+	if err := FFT(ctx, sess, buf, FFTForward); err != nil {
+		return err
+	}
+	if err := FFT(ctx, sess, buf, FFTInverse); err != nil {
+		return err
+	}
+	got, err := buf.ReadAll(ctx)
+	if err != nil {
+		return err
+	}
+	if e := fftError(got, ref); e > fftMaxError {
+		return fmt.Errorf("%d point round trip has a relative error of %g", len(in), e)
+	}
+	return nil
+}
@@ -0,0 +1,494 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"github.com/jgillich/go-opencl/cl"
+	"math"
+	"time"
+)
+
+// Float lists the element types the GEMM kernels support.
+type Float interface {
+	float32 | float64
+}
+
+// Matrix is a row-major Rows x Cols matrix in a device buffer.
+type Matrix[T Float] struct {
+	*Buffer[T]
+	Rows, Cols int
+}
+
+// NewMatrixFrom uploads the row-major data of a rows x cols matrix.
+func NewMatrixFrom[T Float](ctx context.Context, sess *Session, rows, cols int, data []T) (*Matrix[T], error) {
+	if len(data) != rows*cols {
+		return nil, fmt.Errorf("got %d elements for a %dx%d matrix", len(data), rows, cols)
+	}
+	buf, err := NewBufferFrom(ctx, sess, cl.MemReadWrite, data)
+	if err != nil {
+		return nil, err
+	}
+	return &Matrix[T]{Buffer: buf, Rows: rows, Cols: cols}, nil
+}
+
+// GemmVariant selects the matrix multiply kernel.
+type GemmVariant string
+
+const (
+	// GemmAuto times the other variants on the device once and uses the fastest.
+	GemmAuto GemmVariant = "auto"
+	// GemmNaive computes one element of C per work item straight from global memory.
+	GemmNaive GemmVariant = "naive"
+	// GemmTiled stages TS x TS tiles of A and B in local memory, so each global element is read once per tile
+	// instead of once per multiply.
+	GemmTiled GemmVariant = "tiled"
+	// GemmBlocked is GemmTiled where every work item computes gemmWPT elements of a column, keeping the partial
+	// sums in registers and reusing each value loaded from the B tile gemmWPT times.
+	GemmBlocked GemmVariant = "blocked"
+)
+
+var gemmVariants = []GemmVariant{GemmNaive, GemmTiled, GemmBlocked}
+
+// ParseGemmVariant parses the value of the -gemm flag.
+func ParseGemmVariant(s string) (GemmVariant, error) {
+	switch v := GemmVariant(s); v {
+	case GemmAuto, GemmNaive, GemmTiled, GemmBlocked:
+		return v, nil
+	}
+	return "", fmt.Errorf("unknown GEMM variant %q, expected auto, naive, tiled or blocked", s)
+}
+
+// gemmWPT is the number of C elements each work item computes in the register-blocked kernel.
+const gemmWPT = 4
+
+// All kernels compute C = A * B for row-major A (M x K), B (K x N) and C (M x N). Dimension 0 of the NDRange runs
+// along the columns of C and dimension 1 along the rows, like in MultiDim. TS is the tile size and is compiled in,
+// since local memory arrays need a constant size.
+var gemmSrc = `
+%s
+#define T %s
+#define TS %d
+#define WPT %d
+#define RTS (TS / WPT)
+
+__kernel void gemmNaive(
+   const unsigned int M,
+   const unsigned int N,
+   const unsigned int K,
+   __global const T* A,
+   __global const T* B,
+   __global T* C)
+{
+   unsigned int col = get_global_id(0);
+   unsigned int row = get_global_id(1);
+   if (row < M && col < N) {
+      T acc = 0;
+      for (unsigned int k = 0; k < K; k++) {
+         acc += A[row * K + k] * B[k * N + col];
+      }
+      C[row * N + col] = acc;
+   }
+}
+
+__kernel void gemmTiled(
+   const unsigned int M,
+   const unsigned int N,
+   const unsigned int K,
+   __global const T* A,
+   __global const T* B,
+   __global T* C)
+{
+   __local T As[TS][TS];
+   __local T Bs[TS][TS];
+   unsigned int tx = get_local_id(0);
+   unsigned int ty = get_local_id(1);
+   unsigned int col = get_group_id(0) * TS + tx;
+   unsigned int row = get_group_id(1) * TS + ty;
+
+   T acc = 0;
+   for (unsigned int t = 0; t < (K + TS - 1) / TS; t++) {
+      unsigned int ak = t * TS + tx;
+      unsigned int bk = t * TS + ty;
+      As[ty][tx] = (row < M && ak < K) ? A[row * K + ak] : 0;
+      Bs[ty][tx] = (bk < K && col < N) ? B[bk * N + col] : 0;
+      barrier(CLK_LOCAL_MEM_FENCE);
+      for (unsigned int k = 0; k < TS; k++) {
+         acc += As[ty][k] * Bs[k][tx];
+      }
+      barrier(CLK_LOCAL_MEM_FENCE);
+   }
+   if (row < M && col < N) {
+      C[row * N + col] = acc;
+   }
+}
+
+__kernel void gemmBlocked(
+   const unsigned int M,
+   const unsigned int N,
+   const unsigned int K,
+   __global const T* A,
+   __global const T* B,
+   __global T* C)
+{
+   __local T As[TS][TS];
+   __local T Bs[TS][TS];
+   unsigned int tx = get_local_id(0);
+   unsigned int ty = get_local_id(1);
+   unsigned int col = get_group_id(0) * TS + tx;
+   unsigned int rowBase = get_group_id(1) * TS;
+
+   T acc[WPT];
+   for (unsigned int w = 0; w < WPT; w++) {
+      acc[w] = 0;
+   }
+   for (unsigned int t = 0; t < (K + TS - 1) / TS; t++) {
+      for (unsigned int w = 0; w < WPT; w++) {
+         unsigned int r = ty + w * RTS;
+         unsigned int ak = t * TS + tx;
+         unsigned int bk = t * TS + r;
+         As[r][tx] = (rowBase + r < M && ak < K) ? A[(rowBase + r) * K + ak] : 0;
+         Bs[r][tx] = (bk < K && col < N) ? B[bk * N + col] : 0;
+      }
+      barrier(CLK_LOCAL_MEM_FENCE);
+      for (unsigned int k = 0; k < TS; k++) {
+         T b = Bs[k][tx];
+         for (unsigned int w = 0; w < WPT; w++) {
+            acc[w] += As[ty + w * RTS][k] * b;
+         }
+      }
+      barrier(CLK_LOCAL_MEM_FENCE);
+   }
+   for (unsigned int w = 0; w < WPT; w++) {
+      unsigned int row = rowBase + ty + w * RTS;
+      if (row < M && col < N) {
+         C[row * N + col] = acc[w];
+      }
+   }
+}
+`
+
+// gemmKernel returns the kernel for variant with tile size ts, registering the program for the element type and
+// tile size the first time it is needed.
+func gemmKernel[T Float](ctx context.Context, sess *Session, variant GemmVariant, ts int) (*cl.Kernel, error) {
+	typeName := clTypeName[T]()
+	spec := KernelSpec{
+		Name:     fmt.Sprintf("gemm_%s_%d", typeName, ts),
+		Source:   fmt.Sprintf(gemmSrc, typePragmas(typeName), typeName, ts, gemmWPT),
+		Requires: typeRequirements(typeName),
+	}
+	if err := EnsureKernel(spec); err != nil {
+		return nil, err
+	}
+	name := map[GemmVariant]string{GemmNaive: "gemmNaive", GemmTiled: "gemmTiled", GemmBlocked: "gemmBlocked"}[variant]
+	if name == "" {
+		return nil, fmt.Errorf("no kernel for GEMM variant %q", variant)
+	}
+	return sess.Kernel(ctx, spec.Name, name)
+}
+
+// gemmLocalSize returns the local work size of variant for tile size ts.
+func gemmLocalSize(variant GemmVariant, ts int) []int {
+	if variant == GemmBlocked {
+		return []int{ts, ts / gemmWPT}
+	}
+	return []int{ts, ts}
+}
+
+// gemmTileSizes returns the tile sizes from the usual local size sweep that variant can use on the session's device.
+// Larger tiles need more registers per work item, so every candidate's kernel is built to check its local size
+// against the kernel's work-group size rather than the device's.
+func gemmTileSizes[T Float](ctx context.Context, sess *Session, variant GemmVariant) ([]int, error) {
+	wiSizes := sess.Device.MaxWorkItemSizes()
+	localMem := sess.Device.LocalMemSize()
+	var sizes []int
+	for _, ts := range []int{1, 2, 4, 8, 16, 32, 64, 128, 256, 512, 1024} {
+		local := gemmLocalSize(variant, ts)
+		if variant == GemmBlocked && ts < gemmWPT {
+			continue
+		}
+		if local[0]*local[1] > sess.Device.MaxWorkGroupSize() || local[0] > wiSizes[0] || local[1] > wiSizes[1] {
+			continue
+		}
+		// Two TS x TS tiles is the most any variant keeps in local memory.
+		if variant != GemmNaive && int64(2*ts*ts*elemSize[T]()) > localMem {
+			continue
+		}
+		kernel, err := gemmKernel[T](ctx, sess, variant, ts)
+		if err != nil {
+			return nil, fmt.Errorf("tile size %d: %w", ts, err)
+		}
+		maxLocal, err := kernel.WorkGroupSize(sess.Device)
+		kernel.Release()
+		if err != nil {
+			return nil, fmt.Errorf("tile size %d: get work group size: %w", ts, err)
+		}
+		if local[0]*local[1] > maxLocal {
+			continue
+		}
+		sizes = append(sizes, ts)
+	}
+	return sizes, nil
+}
+
+// MatMulWith computes C = A * B with the given variant and tile size. The caller releases C.
+func MatMulWith[T Float](ctx context.Context, sess *Session, a, b *Matrix[T], variant GemmVariant, ts int) (*Matrix[T], error) {
+	if variant == GemmAuto {
+		return MatMul(ctx, sess, a, b)
+	}
+	if a.Cols != b.Rows {
+		return nil, fmt.Errorf("cannot multiply a %dx%d matrix by a %dx%d matrix", a.Rows, a.Cols, b.Rows, b.Cols)
+	}
+	if variant == GemmBlocked && ts%gemmWPT != 0 {
+		return nil, fmt.Errorf("tile size %d of the blocked variant must be a multiple of %d", ts, gemmWPT)
+	}
+	kernel, err := gemmKernel[T](ctx, sess, variant, ts)
+	if err != nil {
+		return nil, err
+	}
+	defer kernel.Release()
+
+	m, n, k := a.Rows, b.Cols, a.Cols
+	buf, err := NewBuffer[T](sess, cl.MemReadWrite, m*n)
+	if err != nil {
+		return nil, err
+	}
+	c := &Matrix[T]{Buffer: buf, Rows: m, Cols: n}
+	if err := setKernelArgs(kernel, uint32(m), uint32(n), uint32(k), a.Buffer, b.Buffer, c.Buffer); err != nil {
+		c.Release()
+		return nil, err
+	}
+	local := gemmLocalSize(variant, ts)
+	global := []int{(n + ts - 1) / ts * local[0], (m + ts - 1) / ts * local[1]}
+	if err := sess.Run(ctx, kernel, global, local); err != nil {
+		c.Release()
+		return nil, err
+	}
+	return c, nil
+}
+
+type gemmChoice struct {
+	variant GemmVariant
+	ts      int
+}
+
+// MatMul computes C = A * B with the variant and tile size the autotuner found fastest on the session's device.
+// The caller releases C.
+func MatMul[T Float](ctx context.Context, sess *Session, a, b *Matrix[T]) (*Matrix[T], error) {
+	choice, err := tuneGemm[T](ctx, sess)
+	if err != nil {
+		return nil, err
+	}
+	return MatMulWith(ctx, sess, a, b, choice.variant, choice.ts)
+}
+
+// tuneGemm times every variant and tile size once on a 512x512 problem and remembers the fastest.
+func tuneGemm[T Float](ctx context.Context, sess *Session) (gemmChoice, error) {
+	// Build options like -cl-fast-relaxed-math change which variant is fastest, so they are part of the key.
+	key := clTypeName[T]() + " " + sess.BuildOptions.String()
+	sess.gemmMu.Lock()
+	choice, ok := sess.gemmTuned[key]
+	sess.gemmMu.Unlock()
+	if ok {
+		return choice, nil
+	}
+
+	size := 512
+	data := make([]T, size*size)
+	for i := range data {
+		data[i] = T(i%17) / 17
+	}
+	a, err := NewMatrixFrom(ctx, sess, size, size, data)
+	if err != nil {
+		return gemmChoice{}, err
+	}
+	defer a.Release()
+
+	best := gemmChoice{}
+	bestTime := time.Duration(math.MaxInt64)
+	for _, variant := range gemmVariants {
+		sizes, err := gemmTileSizes[T](ctx, sess, variant)
+		if err != nil {
+			return gemmChoice{}, fmt.Errorf("tune %s: %w", variant, err)
+		}
+		for _, ts := range sizes {
+			// The first run includes building the program, only the second one is timed.
+			for run := 0; run < 2; run++ {
+				st := time.Now()
+				c, err := MatMulWith(ctx, sess, a, a, variant, ts)
+				if err != nil {
+					return gemmChoice{}, fmt.Errorf("tune %s with tile size %d: %w", variant, ts, err)
+				}
+				took := time.Since(st)
+				c.Release()
+				if run == 1 && took < bestTime {
+					best, bestTime = gemmChoice{variant: variant, ts: ts}, took
+				}
+			}
+		}
+	}
+	if best.variant == "" {
+		return gemmChoice{}, fmt.Errorf("no GEMM variant fits on %s", sess)
+	}
+	sess.gemmMu.Lock()
+	if sess.gemmTuned == nil {
+		sess.gemmTuned = map[string]gemmChoice{}
+	}
+	sess.gemmTuned[key] = best
+	sess.gemmMu.Unlock()
+	return best, nil
+}
+
+// matMulCPU is the host reference for MatMul.
+func matMulCPU[T Float](a, b []T, m, n, k int) []T {
+	c := make([]T, m*n)
+	for row := 0; row < m; row++ {
+		for i := 0; i < k; i++ {
+			av := a[row*k+i]
+			for col := 0; col < n; col++ {
+				c[row*n+col] += av * b[i*n+col]
+			}
+		}
+	}
+	return c
+}
+
+// verifyGemm multiplies matrices whose sizes aren't multiples of any tile size with every variant and tile size
+// and compares with matMulCPU.
+func verifyGemm[T Float](ctx context.Context, sess *Session, variants []GemmVariant) error {
+	m, n, k := 150, 97, 203
+	aData := make([]T, m*k)
+	bData := make([]T, k*n)
+	for i := range aData {
+		aData[i] = T(i%13) - 6
+	}
+	for i := range bData {
+		bData[i] = T(i%7) / 4
+	}
+	want := matMulCPU(aData, bData, m, n, k)
+
+	a, err := NewMatrixFrom(ctx, sess, m, k, aData)
+	if err != nil {
+		return err
+	}
+	defer a.Release()
+	b, err := NewMatrixFrom(ctx, sess, k, n, bData)
+	if err != nil {
+		return err
+	}
+	defer b.Release()
+
+	for _, variant := range variants {
+		sizes, err := gemmTileSizes[T](ctx, sess, variant)
+		if err != nil {
+			return fmt.Errorf("%s %s: %w", clTypeName[T](), variant, err)
+		}
+		for _, ts := range sizes {
+			c, err := MatMulWith(ctx, sess, a, b, variant, ts)
+			if err != nil {
+				return fmt.Errorf("%s %s with tile size %d: %w", clTypeName[T](), variant, ts, err)
+			}
+			got, err := c.ReadAll(ctx)
+			c.Release()
+			if err != nil {
+				return err
+			}
+			for i := range want {
+				if math.Abs(float64(got[i]-want[i])) > 1e-3*math.Max(1, math.Abs(float64(want[i]))) {
+					return fmt.Errorf("%s %s with tile size %d: element %d is %v, expected %v", clTypeName[T](), variant, ts, i, got[i], want[i])
+				}
+			}
+		}
+		fmt.Printf("%s %s: %dx%d * %dx%d OK\n", clTypeName[T](), variant, m, k, k, n)
+	}
+	return nil
+}
+
+// benchmarkGemm times each variant over its tile sizes on size x size matrices and reports GFLOPS.
+func benchmarkGemm[T Float](ctx context.Context, sess *Session, variants []GemmVariant, size int) error {
+	data := make([]T, size*size)
+	for i := range data {
+		data[i] = T(i%17) / 17
+	}
+	a, err := NewMatrixFrom(ctx, sess, size, size, data)
+	if err != nil {
+		return err
+	}
+	defer a.Release()
+
+	flops := 2 * float64(size) * float64(size) * float64(size)
+	iterations := int64(4)
+	for _, variant := range variants {
+		sizes, err := gemmTileSizes[T](ctx, sess, variant)
+		if err != nil {
+			return fmt.Errorf("%s %s: %w", clTypeName[T](), variant, err)
+		}
+		for _, ts := range sizes {
+			var sum = int64(0)
+			for it := 0; it < int(iterations); it++ {
+				st := time.Now()
+				c, err := MatMulWith(ctx, sess, a, a, variant, ts)
+				if err != nil {
+					return err
+				}
+				sum += time.Since(st).Microseconds()
+				c.Release()
+			}
+			avg := time.Microsecond * time.Duration(sum/iterations)
+			fmt.Printf("| %s   | %s | %s | %d | %v | %.2f |\n", sess.Device.Name(), clTypeName[T](), variant, ts, avg.String(), flops/avg.Seconds()/1e9)
+		}
+	}
+	return nil
+}
+
+// GemmBenchmark verifies the GEMM variants against the CPU and reports GFLOPS for 1024x1024 matrices over the
+// tile sizes each variant supports. With GemmAuto all variants are run and the autotuner's pick is printed.
+func GemmBenchmark(ctx context.Context, deviceIndex int, variant GemmVariant) error {
+	devices, err := getDevices()
+	if err != nil {
+		return err
+	}
+	sess, err := NewSession(devices, deviceIndex)
+	if err != nil {
+		return err
+	}
+	defer sess.Release()
+	fmt.Println(sess)
+
+	variants := []GemmVariant{variant}
+	if variant == GemmAuto {
+		variants = gemmVariants
+	}
+	fp64 := sess.Capabilities().FP64
+	if err := verifyGemm[float32](ctx, sess, variants); err != nil {
+		return err
+	}
+	if !fp64 {
+		fmt.Println("double: skipped, device does not support double-precision floating point")
+	} else {
+		if err := verifyGemm[float64](ctx, sess, variants); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Build options: %s\n", describeBuildOptions(sess.BuildOptions))
+	fmt.Println(
+		`| Device        | Type | Variant | Tile size | Result  | GFLOPS |
+| ------------- |:-------------:|:-------------:| -----:| -----:| -----:|`)
+	if err := benchmarkGemm[float32](ctx, sess, variants, 1024); err != nil {
+		return err
+	}
+	if fp64 {
+		if err := benchmarkGemm[float64](ctx, sess, variants, 1024); err != nil {
+			return err
+		}
+	}
+
+	if variant == GemmAuto {
+		choice, err := tuneGemm[float32](ctx, sess)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Autotuned float GEMM: %s with tile size %d\n", choice.variant, choice.ts)
+	}
+	return nil
+}
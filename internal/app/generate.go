@@ -0,0 +1,10 @@
+package app
+
+// The kernels in kernels/*.cl are registered and wrapped in typed Go functions by cmd/clgen. Rerun go generate
+// after adding or changing a .cl file.
+//
+// The other demos keep their sources inline: they build them by hand to show the raw program and kernel calls, and
+// they compare variants of the same kernel under the same name (four squareRoot and three square kernels), which
+// would clash as generated wrappers. The library kernels stay next to the Go code driving them, and many are
+// templates instantiated per element type with fmt.Sprintf, which clgen can't parse.
+//go:generate go run ../../cmd/clgen -dir kernels -out kernels_gen.go
@@ -0,0 +1,257 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"github.com/jgillich/go-opencl/cl"
+	"math"
+	"time"
+)
+
+// Half is an IEEE 754 half-precision float as stored on the device, the OpenCL C type half. Go has no arithmetic
+// on it, convert with HalfFromFloat32 and Float32.
+type Half uint16
+
+// HalfFromFloat32 converts f to the nearest Half, rounding ties to even. Values too large for a Half become
+// infinities and values too small become zeros or subnormals.
+func HalfFromFloat32(f float32) Half {
+	b := math.Float32bits(f)
+	sign := (b >> 16) & 0x8000
+	exp := int32(b>>23) & 0xff
+	mant := b & 0x7fffff
+
+	if exp == 0xff {
+		if mant != 0 {
+			return Half(sign | 0x7e00) // quiet NaN
+		}
+		return Half(sign | 0x7c00)
+	}
+	e := exp - 127 + 15
+	if e >= 0x1f {
+		return Half(sign | 0x7c00)
+	}
+	if e <= 0 {
+		// Subnormal half, or zero if even rounding can't reach the smallest subnormal.
+		if e < -10 {
+			return Half(sign)
+		}
+		mant |= 0x800000
+		shift := uint32(14 - e)
+		m := mant >> shift
+		rem, halfway := mant&(1<<shift-1), uint32(1)<<(shift-1)
+		if rem > halfway || (rem == halfway && m&1 == 1) {
+			m++ // may carry into the smallest normal, which is the right result
+		}
+		return Half(sign | m)
+	}
+	h := uint32(e)<<10 | mant>>13
+	if rem := mant & 0x1fff; rem > 0x1000 || (rem == 0x1000 && h&1 == 1) {
+		h++ // may carry into infinity, which is the right result
+	}
+	return Half(sign | h)
+}
+
+// Float32 converts h to a float32, which represents every Half exactly.
+func (h Half) Float32() float32 {
+	sign := uint32(h&0x8000) << 16
+	exp := uint32(h>>10) & 0x1f
+	mant := uint32(h) & 0x3ff
+	switch exp {
+	case 0:
+		f := float32(mant) / (1 << 24)
+		if sign != 0 {
+			f = -f
+		}
+		return f
+	case 0x1f:
+		return math.Float32frombits(sign | 0x7f800000 | mant<<13)
+	}
+	return math.Float32frombits(sign | (exp+112)<<23 | mant<<13)
+}
+
+func (h Half) String() string {
+	return fmt.Sprint(h.Float32())
+}
+
+// HalfsFromFloat32s converts every element of fs with HalfFromFloat32.
+func HalfsFromFloat32s(fs []float32) []Half {
+	hs := make([]Half, len(fs))
+	for i, f := range fs {
+		hs[i] = HalfFromFloat32(f)
+	}
+	return hs
+}
+
+// Float32sFromHalfs converts every element of hs to a float32.
+func Float32sFromHalfs(hs []Half) []float32 {
+	fs := make([]float32, len(hs))
+	for i, h := range hs {
+		fs[i] = h.Float32()
+	}
+	return fs
+}
+
+// halfSrc only stores halfs and computes in float, with vload_half and vstore_half, so unlike arithmetic on half it
+// needs no cl_khr_fp16.
+var halfSrc = `
+__kernel void squareHalf(
+   __global const half* input,
+   __global half* output,
+   const unsigned int n)
+{
+   const unsigned int i = get_global_id(0);
+   if (i < n) {
+      const float v = vload_half(i, input);
+      vstore_half(v * v, i, output);
+   }
+}
+
+// n is the number of groups of four halfs.
+__kernel void squareRootHalf(
+   __global const half* input,
+   __global half* output,
+   const unsigned int n)
+{
+   const unsigned int i = get_global_id(0);
+   if (i < n) {
+      vstore_half4(sqrt(vload_half4(i, input)), i, output);
+   }
+}
+`
+
+func init() {
+	RegisterKernel(KernelSpec{Name: "half", Source: halfSrc})
+}
+
+// SquareHalf squares every element of in into out, computing in float so it runs on devices without cl_khr_fp16.
+// On devices with it, SquareBuffer[Half] computes in half instead.
+func SquareHalf(ctx context.Context, sess *Session, in, out *Buffer[Half]) error {
+	if in.Len != out.Len {
+		return fmt.Errorf("buffer lengths differ: %d and %d", in.Len, out.Len)
+	}
+	return runElementwise(ctx, sess, "half", "squareHalf", in.Len, in, out, uint32(in.Len))
+}
+
+// SquareRootHalf takes the square root of every element of in into out, computing in float. The length must be a
+// multiple of 4.
+func SquareRootHalf(ctx context.Context, sess *Session, in, out *Buffer[Half]) error {
+	if in.Len != out.Len || in.Len%4 != 0 {
+		return fmt.Errorf("buffer lengths must be equal multiples of 4, got %d and %d", in.Len, out.Len)
+	}
+	return runElementwise(ctx, sess, "half", "squareRootHalf", in.Len/4, in, out, uint32(in.Len/4))
+}
+
+// runSquareRoot uploads data converted with to, takes the square root with sqrt and downloads the result converted
+// back with from. It returns the round trip and kernel times averaged over iterations runs.
+func runSquareRoot[T any](ctx context.Context, sess *Session, data []float32, iterations int, to func(float32) T,
+	from func(T) float64, sqrt func(context.Context, *Session, *Buffer[T], *Buffer[T]) error) ([]float64, time.Duration, time.Duration, error) {
+	host := make([]T, len(data))
+	for i, v := range data {
+		host[i] = to(v)
+	}
+	in, err := NewBuffer[T](sess, cl.MemReadOnly, len(data))
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer in.Release()
+	out, err := NewBuffer[T](sess, cl.MemWriteOnly, len(data))
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer out.Release()
+
+	var total, kernel time.Duration
+	for it := 0; it < iterations; it++ {
+		st := time.Now()
+		if err := in.Write(ctx, host); err != nil {
+			return nil, 0, 0, err
+		}
+		kst := time.Now()
+		if err := sqrt(ctx, sess, in, out); err != nil {
+			return nil, 0, 0, err
+		}
+		kernel += time.Since(kst)
+		if err := out.Read(ctx, host); err != nil {
+			return nil, 0, 0, err
+		}
+		total += time.Since(st)
+	}
+	results := make([]float64, len(host))
+	for i, v := range host {
+		results[i] = from(v)
+	}
+	return results, total / time.Duration(iterations), kernel / time.Duration(iterations), nil
+}
+
+// HalfBenchmark takes the square root of the same data in half, float and double precision, uploading the input
+// and downloading the result every time, and compares throughput and accuracy against a float64 reference. Half is
+// run both stored-only with vload_half and, on devices with cl_khr_fp16, computed in half. Precisions the device
+// doesn't support are skipped.
+func HalfBenchmark(ctx context.Context, deviceIndex int) error {
+	devices, err := getDevices()
+	if err != nil {
+		return err
+	}
+	sess, err := NewSession(devices, deviceIndex)
+	if err != nil {
+		return err
+	}
+	defer sess.Release()
+	fmt.Println(sess)
+	caps := sess.Capabilities()
+
+	// Values up to 60000 stay below the largest half, 65504.
+	elemCount := 16 * 1024 * 1024
+	data := make([]float32, elemCount)
+	for i := range data {
+		data[i] = float32(i%60000) + float32(i%7)/8
+	}
+	iterations := 16
+
+	runs := []struct {
+		name     string
+		elemSize int
+		requires Requirements
+		run      func() ([]float64, time.Duration, time.Duration, error)
+	}{
+		{"half (vload_half)", 2, Requirements{}, func() ([]float64, time.Duration, time.Duration, error) {
+			return runSquareRoot(ctx, sess, data, iterations, HalfFromFloat32, func(h Half) float64 { return float64(h.Float32()) }, SquareRootHalf)
+		}},
+		{"half (cl_khr_fp16)", 2, Requirements{FP16: true}, func() ([]float64, time.Duration, time.Duration, error) {
+			return runSquareRoot(ctx, sess, data, iterations, HalfFromFloat32, func(h Half) float64 { return float64(h.Float32()) }, SquareRootBuffer[Half])
+		}},
+		{"float", 4, Requirements{}, func() ([]float64, time.Duration, time.Duration, error) {
+			return runSquareRoot(ctx, sess, data, iterations, func(f float32) float32 { return f }, func(f float32) float64 { return float64(f) }, SquareRootBuffer[float32])
+		}},
+		{"double", 8, Requirements{FP64: true}, func() ([]float64, time.Duration, time.Duration, error) {
+			return runSquareRoot(ctx, sess, data, iterations, func(f float32) float64 { return float64(f) }, func(f float64) float64 { return f }, SquareRootBuffer[float64])
+		}},
+	}
+
+	fmt.Printf("Build options: %s\n", describeBuildOptions(sess.BuildOptions))
+	fmt.Println(
+		`| Device        | Type | Elements | Round trip | Kernel | Throughput | Max rel. error |
+| ------------- |:-------------:| -----:| -----:| -----:| -----:| -----:|`)
+	for _, r := range runs {
+		if err := caps.Check(r.requires); err != nil {
+			fmt.Printf("| %s   | %s | %d | - | - | - | skipped: %v |\n", sess.Device.Name(), r.name, elemCount, err)
+			continue
+		}
+		results, total, kernel, err := r.run()
+		if err != nil {
+			return fmt.Errorf("%s: %w", r.name, err)
+		}
+		maxErr := 0.0
+		for i, v := range data {
+			want := math.Sqrt(float64(v))
+			if want == 0 {
+				continue
+			}
+			maxErr = math.Max(maxErr, math.Abs(results[i]-want)/want)
+		}
+		// Every element crosses the bus twice, once up and once down.
+		gbs := float64(2*elemCount*r.elemSize) / total.Seconds() / 1e9
+		fmt.Printf("| %s   | %s | %d | %v | %v | %.2f GB/s | %.2e |\n", sess.Device.Name(), r.name, elemCount, total, kernel, gbs, maxErr)
+	}
+	return nil
+}
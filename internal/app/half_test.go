@@ -0,0 +1,83 @@
+package app
+
+import (
+	"math"
+	"testing"
+)
+
+func TestHalfFromFloat32(t *testing.T) {
+	const (
+		minSubnormal = 1.0 / (1 << 24) // 2^-24
+		minNormal    = 1.0 / (1 << 14) // 2^-14
+	)
+	tests := []struct {
+		name string
+		f    float32
+		want Half
+	}{
+		{name: "zero", f: 0, want: 0x0000},
+		{name: "negative zero", f: float32(math.Copysign(0, -1)), want: 0x8000},
+		{name: "one", f: 1, want: 0x3c00},
+		{name: "minus two", f: -2, want: 0xc000},
+		{name: "one third", f: 1.0 / 3, want: 0x3555},
+		{name: "max", f: 65504, want: 0x7bff},
+
+		// Between 1 and the next half, 1+2^-10, the float32 spacing is 2^-23: the tie is 2^-11 away.
+		{name: "tie to even down", f: 1 + 1.0/(1<<11), want: 0x3c00},
+		{name: "tie to even up", f: 1 + 3.0/(1<<11), want: 0x3c02},
+		{name: "just above tie", f: 1 + 1.0/(1<<11) + 1.0/(1<<23), want: 0x3c01},
+		{name: "just below tie", f: 1 + 3.0/(1<<11) - 1.0/(1<<23), want: 0x3c01},
+
+		{name: "overflow just below rounds to max", f: 65519, want: 0x7bff},
+		{name: "overflow tie rounds to infinity", f: 65520, want: 0x7c00},
+		{name: "overflow", f: 1e6, want: 0x7c00},
+		{name: "negative overflow", f: -1e6, want: 0xfc00},
+		{name: "infinity", f: float32(math.Inf(1)), want: 0x7c00},
+		{name: "negative infinity", f: float32(math.Inf(-1)), want: 0xfc00},
+
+		{name: "min normal", f: minNormal, want: 0x0400},
+		{name: "largest subnormal", f: minNormal - minSubnormal, want: 0x03ff},
+		{name: "subnormal rounds up to min normal", f: minNormal - minSubnormal/4, want: 0x0400},
+		{name: "min subnormal", f: minSubnormal, want: 0x0001},
+		{name: "negative min subnormal", f: -minSubnormal, want: 0x8001},
+		{name: "subnormal tie to even down", f: 2.5 * minSubnormal, want: 0x0002},
+		{name: "subnormal tie to even up", f: 3.5 * minSubnormal, want: 0x0004},
+		{name: "half of min subnormal ties to zero", f: minSubnormal / 2, want: 0x0000},
+		{name: "above half of min subnormal", f: minSubnormal / 2 * (1 + 1.0/(1<<20)), want: 0x0001},
+		{name: "underflow", f: minSubnormal / 4, want: 0x0000},
+		{name: "negative underflow", f: -minSubnormal / 4, want: 0x8000},
+		{name: "float32 subnormal", f: math.SmallestNonzeroFloat32, want: 0x0000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := HalfFromFloat32(tt.f); got != tt.want {
+				t.Errorf("HalfFromFloat32(%g) = %#04x, expected %#04x", tt.f, uint16(got), uint16(tt.want))
+			}
+		})
+	}
+}
+
+func TestHalfNaN(t *testing.T) {
+	for _, f := range []float32{float32(math.NaN()), math.Float32frombits(0xff800001)} {
+		h := HalfFromFloat32(f)
+		if h&0x7c00 != 0x7c00 || h&0x3ff == 0 {
+			t.Errorf("HalfFromFloat32(%v) = %#04x, expected a NaN", f, uint16(h))
+		}
+		if back := h.Float32(); !math.IsNaN(float64(back)) {
+			t.Errorf("%#04x converts back to %v, expected NaN", uint16(h), back)
+		}
+	}
+}
+
+// TestHalfRoundTrip converts every Half that isn't a NaN to float32 and back.
+func TestHalfRoundTrip(t *testing.T) {
+	for i := 0; i < 1<<16; i++ {
+		h := Half(i)
+		if h&0x7c00 == 0x7c00 && h&0x3ff != 0 {
+			continue
+		}
+		if got := HalfFromFloat32(h.Float32()); got != h {
+			t.Fatalf("%#04x converts to %g and back to %#04x", i, h.Float32(), uint16(got))
+		}
+	}
+}
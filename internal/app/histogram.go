@@ -0,0 +1,377 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"github.com/jgillich/go-opencl/cl"
+	"math"
+	"time"
+)
+
+// Histogrammable lists the input types Histogram has kernels for.
+type Histogrammable interface {
+	uint8 | float32
+}
+
+// HistogramMode selects how the histogram kernel counts.
+type HistogramMode int
+
+const (
+	// HistogramAuto uses the fastest mode the device supports.
+	HistogramAuto HistogramMode = iota
+	// HistogramLocal counts into a private histogram in local memory per work group and adds it to the result with
+	// one global atomic per bin, so contention on popular bins stays inside the work group.
+	HistogramLocal
+	// HistogramGlobal increments the result bins directly with global atomics.
+	HistogramGlobal
+	// HistogramHost reads the input back and counts on the CPU, for devices without 32 bit atomics.
+	HistogramHost
+)
+
+func (m HistogramMode) String() string {
+	switch m {
+	case HistogramAuto:
+		return "auto"
+	case HistogramLocal:
+		return "local"
+	case HistogramGlobal:
+		return "global"
+	case HistogramHost:
+		return "host"
+	}
+	return fmt.Sprintf("HistogramMode(%d)", int(m))
+}
+
+// histogramBinSrc maps a value to its bin. Values outside [lo, hi) and NaNs are not counted.
+var histogramBinSrc = `
+inline int binOf(%[1]s value, const uint bins, const float lo, const float scale)
+{
+   float v = ((float)value - lo) * scale;
+   if (!(v >= 0.0f && v < (float)bins)) {
+      return -1;
+   }
+   return (int)v;
+}
+`
+
+// The kernels take the atomic functions' prefix as %[2]s: OpenCL C 1.0 only has 32 bit atomics as the
+// cl_khr_*_int32_base_atomics extensions, which have to be enabled and name them atom_inc and atom_add. From 1.1
+// on they are core as atomic_inc and atomic_add.
+var histogramGlobalSrc = `
+__kernel void histogramGlobal(
+   __global const %[1]s* input,
+   const uint n,
+   const uint bins,
+   const float lo,
+   const float scale,
+   __global uint* hist)
+{
+   for (uint i = get_global_id(0); i < n; i += get_global_size(0)) {
+      int bin = binOf(input[i], bins, lo, scale);
+      if (bin >= 0) {
+         %[2]sinc(&hist[bin]);
+      }
+   }
+}
+`
+
+var histogramLocalSrc = `
+__kernel void histogramLocal(
+   __global const %[1]s* input,
+   const uint n,
+   const uint bins,
+   const float lo,
+   const float scale,
+   __global uint* hist,
+   __local uint* local_hist)
+{
+   uint lid = get_local_id(0);
+   uint local_size = get_local_size(0);
+   for (uint b = lid; b < bins; b += local_size) {
+      local_hist[b] = 0;
+   }
+   barrier(CLK_LOCAL_MEM_FENCE);
+
+   for (uint i = get_global_id(0); i < n; i += get_global_size(0)) {
+      int bin = binOf(input[i], bins, lo, scale);
+      if (bin >= 0) {
+         %[2]sinc(&local_hist[bin]);
+      }
+   }
+   barrier(CLK_LOCAL_MEM_FENCE);
+
+   for (uint b = lid; b < bins; b += local_size) {
+      if (local_hist[b] != 0) {
+         %[2]sadd(&hist[b], local_hist[b]);
+      }
+   }
+}
+`
+
+// histogramSpec returns the spec of the global or local histogram kernel for typeName, written for devices with
+// OpenCL C version cVersion. The global and local kernels are separate specs, so devices without local atomics
+// can still build the global one.
+func histogramSpec(typeName string, local bool, cVersion CLVersion) KernelSpec {
+	kind, kernelSrc := "global", histogramGlobalSrc
+	requires := Requirements{GlobalAtomics: true}
+	if local {
+		kind, kernelSrc = "local", histogramLocalSrc
+		requires.LocalAtomics = true
+	}
+	name := "histogram_" + kind + "_" + typeName
+	prefix, pragmas := "atomic_", ""
+	if cVersion.AtLeast(1, 1) {
+		requires.CVersion = CLVersion{1, 1}
+	} else {
+		name += "_cl10"
+		prefix = "atom_"
+		pragmas = "#pragma OPENCL EXTENSION cl_khr_global_int32_base_atomics : enable\n"
+		if local {
+			pragmas += "#pragma OPENCL EXTENSION cl_khr_local_int32_base_atomics : enable\n"
+		}
+	}
+	return KernelSpec{
+		Name:     name,
+		Source:   pragmas + fmt.Sprintf(histogramBinSrc, typeName) + fmt.Sprintf(kernelSrc, typeName, prefix),
+		Requires: requires,
+	}
+}
+
+// The OpenCL C 1.1 specs are registered up front, the 1.0 ones when a 1.0 device first asks for them.
+func init() {
+	for _, typeName := range []string{"uchar", "float"} {
+		RegisterKernel(histogramSpec(typeName, false, CLVersion{1, 1}))
+		RegisterKernel(histogramSpec(typeName, true, CLVersion{1, 1}))
+	}
+}
+
+// maxHistogramGroups caps the number of work groups. The kernels loop over the input, and with local histograms
+// every extra group adds another round of global atomics per bin.
+const maxHistogramGroups = 1024
+
+// histogramSupport reports which atomic modes the session's device can run.
+func histogramSupport(sess *Session) (local, global bool) {
+	caps := sess.Capabilities()
+	return caps.LocalAtomics && caps.GlobalAtomics, caps.GlobalAtomics
+}
+
+// histogramMode resolves mode for the device and bin count, falling back from local to global atomics when the
+// device has no local atomics or the bins don't fit in local memory, and from global atomics to the host.
+func histogramMode(sess *Session, mode HistogramMode, bins int) (HistogramMode, error) {
+	local, global := histogramSupport(sess)
+	fitsLocal := int64(bins*4) <= sess.Capabilities().LocalMemSize
+	switch mode {
+	case HistogramAuto:
+		if local && fitsLocal {
+			return HistogramLocal, nil
+		}
+		if global {
+			return HistogramGlobal, nil
+		}
+		return HistogramHost, nil
+	case HistogramLocal:
+		if !local {
+			return mode, fmt.Errorf("%s has no local 32 bit atomics", sess)
+		}
+		if !fitsLocal {
+			return mode, fmt.Errorf("%d bins do not fit in local memory on %s", bins, sess)
+		}
+	case HistogramGlobal:
+		if !global {
+			return mode, fmt.Errorf("%s has no global 32 bit atomics", sess)
+		}
+	}
+	return mode, nil
+}
+
+// Histogram counts the values of in into bins equal-width bins covering [lo, hi), using local atomics where the
+// device supports them.
+func Histogram[T Histogrammable](ctx context.Context, sess *Session, in *Buffer[T], bins int, lo, hi float32) ([]uint32, error) {
+	return HistogramWith(ctx, sess, in, bins, lo, hi, HistogramAuto, 0)
+}
+
+// HistogramWith is Histogram with an explicit mode and local size. A localSize of 0 picks up to 256. Asking for a
+// mode the device can't run is an error; only HistogramAuto falls back.
+func HistogramWith[T Histogrammable](ctx context.Context, sess *Session, in *Buffer[T], bins int, lo, hi float32, mode HistogramMode, localSize int) ([]uint32, error) {
+	if bins < 1 || !(hi > lo) {
+		return nil, fmt.Errorf("invalid histogram of %d bins over [%v, %v)", bins, lo, hi)
+	}
+	mode, err := histogramMode(sess, mode, bins)
+	if err != nil {
+		return nil, err
+	}
+	if mode == HistogramHost {
+		data, err := in.ReadAll(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return histogramCPU(data, bins, lo, hi), nil
+	}
+
+	kernel, err := histogramKernel[T](ctx, sess, mode)
+	if err != nil {
+		return nil, err
+	}
+	defer kernel.Release()
+
+	maxLocal, err := kernel.WorkGroupSize(sess.Device)
+	if err != nil {
+		return nil, fmt.Errorf("get work group size: %w", err)
+	}
+	if localSize == 0 {
+		localSize = maxLocal
+		if localSize > 256 {
+			localSize = 256
+		}
+	}
+	if localSize > maxLocal {
+		return nil, fmt.Errorf("local size %d is larger than %d", localSize, maxLocal)
+	}
+	groups := (in.Len + localSize - 1) / localSize
+	if groups > maxHistogramGroups {
+		groups = maxHistogramGroups
+	}
+
+	hist, err := NewBufferFrom(ctx, sess, cl.MemReadWrite, make([]uint32, bins))
+	if err != nil {
+		return nil, err
+	}
+	defer hist.Release()
+	scale := float32(float64(bins) / float64(hi-lo))
+	args := []interface{}{in, uint32(in.Len), uint32(bins), lo, scale, hist}
+	if mode == HistogramLocal {
+		args = append(args, cl.LocalBuffer(bins*4))
+	}
+	if err := setKernelArgs(kernel, args...); err != nil {
+		return nil, err
+	}
+	if err := sess.Run(ctx, kernel, []int{groups * localSize}, []int{localSize}); err != nil {
+		return nil, err
+	}
+	return hist.ReadAll(ctx)
+}
+
+// histogramKernel creates the kernel counting values of type T with mode, HistogramGlobal or HistogramLocal.
+func histogramKernel[T Histogrammable](ctx context.Context, sess *Session, mode HistogramMode) (*cl.Kernel, error) {
+	name := "histogramGlobal"
+	if mode == HistogramLocal {
+		name = "histogramLocal"
+	}
+	spec := histogramSpec(clTypeName[T](), mode == HistogramLocal, sess.Capabilities().CVersion)
+	if err := EnsureKernel(spec); err != nil {
+		return nil, err
+	}
+	return sess.Kernel(ctx, spec.Name, name)
+}
+
+// histogramCPU is the host reference for Histogram and the fallback for devices without atomics. It bins with the
+// same float32 arithmetic as the kernels, so values on a bin edge land in the same bin.
+func histogramCPU[T Histogrammable](data []T, bins int, lo, hi float32) []uint32 {
+	hist := make([]uint32, bins)
+	scale := float32(float64(bins) / float64(hi-lo))
+	for _, value := range data {
+		v := (float32(value) - lo) * scale
+		if v >= 0 && v < float32(bins) {
+			hist[int(v)]++
+		}
+	}
+	return hist
+}
+
+// benchmarkHistogram verifies and times the local and global modes over the usual local size sweep.
+func benchmarkHistogram[T Histogrammable](ctx context.Context, sess *Session, data []T, bins int, lo, hi float32) error {
+	buf, err := NewBufferFrom(ctx, sess, cl.MemReadOnly, data)
+	if err != nil {
+		return err
+	}
+	defer buf.Release()
+	want := histogramCPU(data, bins, lo, hi)
+
+	localSizes := []int{1, 2, 4, 8, 16, 32, 64, 128, 256, 512, 1024}
+	iterations := int64(16)
+	for _, mode := range []HistogramMode{HistogramGlobal, HistogramLocal} {
+		if _, err := histogramMode(sess, mode, bins); err != nil {
+			fmt.Printf("| %s   | %s | %s | - | skipped: %v |\n", sess.Device.Name(), clTypeName[T](), mode, err)
+			continue
+		}
+		// HistogramWith rejects local sizes above what the kernel can be launched with, which register or local
+		// memory use can push below the device's max work-group size.
+		kernel, err := histogramKernel[T](ctx, sess, mode)
+		if err != nil {
+			return err
+		}
+		maxLocal, err := kernel.WorkGroupSize(sess.Device)
+		kernel.Release()
+		if err != nil {
+			return fmt.Errorf("get work group size: %w", err)
+		}
+		for _, lz := range localSizes {
+			if lz > maxLocal {
+				continue
+			}
+			var sum = int64(0)
+			for it := 0; it < int(iterations); it++ {
+				st := time.Now()
+				got, err := HistogramWith(ctx, sess, buf, bins, lo, hi, mode, lz)
+				if err != nil {
+					return fmt.Errorf("%s with local size %d: %w", mode, lz, err)
+				}
+				sum += time.Since(st).Microseconds()
+				if it == 0 {
+					for b := range want {
+						if got[b] != want[b] {
+							return fmt.Errorf("%s %s with local size %d: bin %d has %d, expected %d", clTypeName[T](), mode, lz, b, got[b], want[b])
+						}
+					}
+				}
+			}
+			fmt.Printf("| %s   | %s | %s | %d | %v |\n", sess.Device.Name(), clTypeName[T](), mode, lz, (time.Microsecond * time.Duration(sum/iterations)).String())
+		}
+	}
+	return nil
+}
+
+// HistogramBenchmark compares global-only and local-privatized atomics on 16M uint8 values in 256 bins and 16M
+// normally distributed float32 values in 64 bins, verifying every run against the CPU.
+func HistogramBenchmark(ctx context.Context, deviceIndex int) error {
+	devices, err := getDevices()
+	if err != nil {
+		return err
+	}
+	sess, err := NewSession(devices, deviceIndex)
+	if err != nil {
+		return err
+	}
+	defer sess.Release()
+	fmt.Println(sess)
+	local, global := histogramSupport(sess)
+	fmt.Printf("Local atomics: %v, global atomics: %v\n", local, global)
+
+	elemCount := 16777216
+	bytes := make([]uint8, elemCount)
+	floats := make([]float32, elemCount)
+	seed := uint32(1)
+	next := func() uint32 {
+		// xorshift32, deterministic so runs are comparable.
+		seed ^= seed << 13
+		seed ^= seed >> 17
+		seed ^= seed << 5
+		return seed
+	}
+	for i := range bytes {
+		bytes[i] = uint8(next())
+		// Box-Muller transform for a standard normal distribution.
+		u1 := (float64(next()) + 1) / (math.MaxUint32 + 2)
+		u2 := float64(next()) / math.MaxUint32
+		floats[i] = float32(math.Sqrt(-2*math.Log(u1)) * math.Cos(2*math.Pi*u2))
+	}
+
+	fmt.Printf("Build options: %s\n", describeBuildOptions(sess.BuildOptions))
+	fmt.Println(
+		`| Device        | Type | Mode | Local size | Result  |
+| ------------- |:-------------:|:-------------:| -----:| -----:|`)
+	if err := benchmarkHistogram(ctx, sess, bytes, 256, 0, 256); err != nil {
+		return err
+	}
+	return benchmarkHistogram(ctx, sess, floats, 64, -4, 4)
+}
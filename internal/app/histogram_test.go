@@ -0,0 +1,57 @@
+package app
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHistogramSpec(t *testing.T) {
+	const (
+		globalPragma = "cl_khr_global_int32_base_atomics : enable"
+		localPragma  = "cl_khr_local_int32_base_atomics : enable"
+	)
+	tests := []struct {
+		name     string
+		local    bool
+		cVersion CLVersion
+		specName string
+		has      []string
+		hasNot   []string
+		requires Requirements
+	}{
+		{name: "global 1.1", cVersion: CLVersion{1, 1}, specName: "histogram_global_uchar",
+			has: []string{"atomic_inc("}, hasNot: []string{"atom_", "#pragma", "histogramLocal"},
+			requires: Requirements{GlobalAtomics: true, CVersion: CLVersion{1, 1}}},
+		{name: "local 1.2", local: true, cVersion: CLVersion{1, 2}, specName: "histogram_local_uchar",
+			has: []string{"atomic_inc(", "atomic_add("}, hasNot: []string{"atom_", "#pragma", "histogramGlobal"},
+			requires: Requirements{GlobalAtomics: true, LocalAtomics: true, CVersion: CLVersion{1, 1}}},
+		{name: "global 1.0", cVersion: CLVersion{1, 0}, specName: "histogram_global_uchar_cl10",
+			has: []string{"atom_inc(", globalPragma}, hasNot: []string{"atomic_", localPragma},
+			requires: Requirements{GlobalAtomics: true}},
+		{name: "local 1.0", local: true, cVersion: CLVersion{1, 0}, specName: "histogram_local_uchar_cl10",
+			has: []string{"atom_inc(", "atom_add(", globalPragma, localPragma}, hasNot: []string{"atomic_"},
+			requires: Requirements{GlobalAtomics: true, LocalAtomics: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := histogramSpec("uchar", tt.local, tt.cVersion)
+			if spec.Name != tt.specName {
+				t.Errorf("got spec %s, expected %s", spec.Name, tt.specName)
+			}
+			for _, s := range tt.has {
+				if !strings.Contains(spec.Source, s) {
+					t.Errorf("source has no %q:\n%s", s, spec.Source)
+				}
+			}
+			for _, s := range tt.hasNot {
+				if strings.Contains(spec.Source, s) {
+					t.Errorf("source has %q:\n%s", s, spec.Source)
+				}
+			}
+			if !reflect.DeepEqual(spec.Requires, tt.requires) {
+				t.Errorf("got requirements %+v, expected %+v", spec.Requires, tt.requires)
+			}
+		})
+	}
+}
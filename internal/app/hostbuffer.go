@@ -0,0 +1,165 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"github.com/jgillich/go-opencl/cl"
+	"time"
+	"unsafe"
+)
+
+// NewHostBuffer allocates an uninitialized buffer for n elements of T in host-visible memory, with
+// CL_MEM_ALLOC_HOST_PTR. On CPU devices and integrated GPUs sharing memory with the host, such as the Iris, Map then
+// hands out the buffer's memory itself, so data is produced and consumed in place instead of copied with Write and
+// Read. Discrete GPUs typically place it in pinned host memory, which they transfer from faster than pageable memory.
+func NewHostBuffer[T any](sess *Session, flags cl.MemFlag, n int) (*Buffer[T], error) {
+	return NewBuffer[T](sess, flags|cl.MemAllocHostPtr, n)
+}
+
+// Map maps the whole buffer into host memory and returns it as a slice, blocking until it is available. flags
+// says what the host does with it: cl.MapFlagRead to read results, cl.MapFlagWrite to produce input, or both. The
+// slice is only valid until unmap is called, which hands the memory back to the device and must happen before
+// kernels use the buffer again. Any buffer can be mapped, but only host buffers, see NewHostBuffer, avoid a copy.
+func (b *Buffer[T]) Map(ctx context.Context, flags cl.MapFlag) (data []T, unmap func() error, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	mapped, _, err := b.sess.Queue.EnqueueMapBuffer(b.Mem, true, flags, 0, b.Bytes(), nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("map buffer: %w", err)
+	}
+	unmapped := false
+	unmap = func() error {
+		if unmapped {
+			return fmt.Errorf("buffer already unmapped")
+		}
+		unmapped = true
+		if _, err := b.sess.Queue.EnqueueUnmapMemObject(b.Mem, mapped, nil); err != nil {
+			return fmt.Errorf("unmap buffer: %w", err)
+		}
+		// Finish rather than Session.Finish, since an abandoned unmap would leave the buffer unusable.
+		if err := b.sess.Queue.Finish(); err != nil {
+			return fmt.Errorf("unmap buffer: %w", err)
+		}
+		return nil
+	}
+	return unsafe.Slice((*T)(mapped.Ptr()), b.Len), unmap, nil
+}
+
+// roundTripCopy uploads src into in with Write, squares it into out and downloads the result into dst with Read.
+func roundTripCopy(ctx context.Context, sess *Session, in, out *Buffer[float32], src, dst []float32) error {
+	if err := in.Write(ctx, src); err != nil {
+		return err
+	}
+	if err := SquareBuffer(ctx, sess, in, out); err != nil {
+		return err
+	}
+	return out.Read(ctx, dst)
+}
+
+// roundTripMap does what roundTripCopy does through mapped buffers: src is copied into the mapped input and the
+// result out of the mapped output, standing in for an application producing and consuming the data in place.
+func roundTripMap(ctx context.Context, sess *Session, in, out *Buffer[float32], src, dst []float32) error {
+	mapped, unmap, err := in.Map(ctx, cl.MapFlagWrite)
+	if err != nil {
+		return err
+	}
+	copy(mapped, src)
+	if err := unmap(); err != nil {
+		return err
+	}
+	if err := SquareBuffer(ctx, sess, in, out); err != nil {
+		return err
+	}
+	if mapped, unmap, err = out.Map(ctx, cl.MapFlagRead); err != nil {
+		return err
+	}
+	copy(dst, mapped)
+	return unmap()
+}
+
+// ZeroCopyBenchmark squares float buffers of 1M to 64M elements, uploading the input and downloading the result
+// every time, once copying with Write and Read between Go slices and device buffers and once mapping host buffers.
+// It shows per device whether mapping saves the copies; the device's unified memory flag hints at the answer.
+// Results go to the structured benchmark output, see SetBenchOutput.
+func ZeroCopyBenchmark(ctx context.Context, deviceIndex int) error {
+	devices, err := getDevices()
+	if err != nil {
+		return err
+	}
+	sess, err := NewSession(devices, deviceIndex)
+	if err != nil {
+		return err
+	}
+	defer sess.Release()
+	fmt.Println(sess)
+	fmt.Printf("Host unified memory: %v\n", sess.Device.HostUnifiedMemory())
+	fmt.Printf("Build options: %s\n", describeBuildOptions(sess.BuildOptions))
+
+	out := benchWriter()
+	iterations := 16
+	maxAlloc := sess.Device.MaxMemAllocSize()
+	for n := 1 << 20; n <= 64<<20 && int64(4*n) <= maxAlloc; n *= 4 {
+		src := make([]float32, n)
+		for i := range src {
+			src[i] = float32(i % 1024)
+		}
+		dst := make([]float32, n)
+
+		runs := []struct {
+			variant string
+			alloc   func(flags cl.MemFlag) (*Buffer[float32], error)
+			run     func(ctx context.Context, sess *Session, in, out *Buffer[float32], src, dst []float32) error
+		}{
+			{"copy", func(flags cl.MemFlag) (*Buffer[float32], error) { return NewBuffer[float32](sess, flags, n) }, roundTripCopy},
+			{"map", func(flags cl.MemFlag) (*Buffer[float32], error) { return NewHostBuffer[float32](sess, flags, n) }, roundTripMap},
+		}
+		for _, r := range runs {
+			result, err := benchRoundTrip(ctx, sess, r.variant, n, iterations, r.alloc, r.run, src, dst)
+			if err != nil {
+				return fmt.Errorf("%s of %d elements: %w", r.variant, n, err)
+			}
+			if err := out.Write(result); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// benchRoundTrip allocates the input and output buffers with alloc and times iterations of run, checking the
+// squares in dst after the last one.
+func benchRoundTrip(ctx context.Context, sess *Session, variant string, n, iterations int,
+	alloc func(cl.MemFlag) (*Buffer[float32], error),
+	run func(context.Context, *Session, *Buffer[float32], *Buffer[float32], []float32, []float32) error,
+	src, dst []float32) (BenchResult, error) {
+	result := BenchResult{Benchmark: "round trip", Device: sess.Device.Name(), Variant: variant, Size: int64(n),
+		SizeUnit: "elements", BuildOptions: sess.BuildOptions.String(), Work: float64(8 * n), WorkUnit: "B"}
+	in, err := alloc(cl.MemReadOnly)
+	if err != nil {
+		return result, err
+	}
+	defer in.Release()
+	output, err := alloc(cl.MemWriteOnly)
+	if err != nil {
+		return result, err
+	}
+	defer output.Release()
+
+	// The first run includes the driver's lazy setup, so it isn't counted.
+	for it := -1; it < iterations; it++ {
+		st := time.Now()
+		if err := run(ctx, sess, in, output, src, dst); err != nil {
+			return result, err
+		}
+		if it >= 0 {
+			result.Samples = append(result.Samples, time.Since(st))
+		}
+	}
+	for i, v := range src {
+		if dst[i] != v*v {
+			return result, fmt.Errorf("element %d is %v, expected %v", i, dst[i], v*v)
+		}
+	}
+	return result, nil
+}
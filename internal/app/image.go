@@ -0,0 +1,440 @@
+package app
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/jgillich/go-opencl/cl"
+	"image"
+	"image/draw"
+	"image/png"
+	"math"
+	"os"
+	"time"
+)
+
+// Image is an OpenCL 2D or 3D image, which kernels read through a sampler_t with filtering and addressing done by
+// the texture hardware, unlike a Buffer. Its pixels are laid out as Format says.
+type Image struct {
+	Mem    *cl.MemObject
+	Format cl.ImageFormat
+	// Depth is 0 for 2D images.
+	Width, Height, Depth int
+	sess                 *Session
+}
+
+// imageChannels returns the number of channels of order, or 0 for orders this package doesn't map.
+func imageChannels(order cl.ChannelOrder) int {
+	switch order {
+	case cl.ChannelOrderR, cl.ChannelOrderA, cl.ChannelOrderIntensity, cl.ChannelOrderLuminance:
+		return 1
+	case cl.ChannelOrderRG, cl.ChannelOrderRA:
+		return 2
+	case cl.ChannelOrderRGBA, cl.ChannelOrderBGRA, cl.ChannelOrderARGB:
+		return 4
+	}
+	return 0
+}
+
+// channelSize returns the size in bytes of a channel of type t, or 0 for packed types.
+func channelSize(t cl.ChannelDataType) int {
+	switch t {
+	case cl.ChannelDataTypeUNormInt8, cl.ChannelDataTypeSNormInt8, cl.ChannelDataTypeUnsignedInt8,
+		cl.ChannelDataTypeSignedInt8:
+		return 1
+	case cl.ChannelDataTypeUNormInt16, cl.ChannelDataTypeSNormInt16, cl.ChannelDataTypeUnsignedInt16,
+		cl.ChannelDataTypeSignedInt16, cl.ChannelDataTypeHalfFloat:
+		return 2
+	case cl.ChannelDataTypeSignedInt32, cl.ChannelDataTypeUnsignedInt32, cl.ChannelDataTypeFloat:
+		return 4
+	}
+	return 0
+}
+
+// PixelSize returns the size of a pixel in bytes.
+func (im *Image) PixelSize() int {
+	return imageChannels(im.Format.ChannelOrder) * channelSize(im.Format.ChannelDataType)
+}
+
+// Bytes returns the size of the image's pixels in bytes, tightly packed.
+func (im *Image) Bytes() int {
+	depth := im.Depth
+	if depth == 0 {
+		depth = 1
+	}
+	return im.Width * im.Height * depth * im.PixelSize()
+}
+
+// region returns the whole image as an EnqueueReadImage or EnqueueWriteImage region.
+func (im *Image) region() [3]int {
+	depth := im.Depth
+	if depth == 0 {
+		depth = 1
+	}
+	return [3]int{im.Width, im.Height, depth}
+}
+
+// newImage creates an uninitialized image, checking that the device supports images and format first.
+func newImage(sess *Session, flags cl.MemFlag, format cl.ImageFormat, width, height, depth int) (*Image, error) {
+	if err := sess.Capabilities().Check(Requirements{Images: true}); err != nil {
+		return nil, err
+	}
+	if imageChannels(format.ChannelOrder) == 0 || channelSize(format.ChannelDataType) == 0 {
+		return nil, fmt.Errorf("image format %v is not supported by this package", format)
+	}
+	imageType := cl.MemObjectTypeImage2D
+	if depth > 0 {
+		imageType = cl.MemObjectTypeImage3D
+	}
+	formats, err := sess.Context.GetSupportedImageFormats(flags, imageType)
+	if err != nil {
+		return nil, fmt.Errorf("get supported image formats: %w", err)
+	}
+	supported := false
+	for _, f := range formats {
+		supported = supported || f == format
+	}
+	if !supported {
+		return nil, fmt.Errorf("%s does not support %v images: %w", sess.Device.Name(), format, ErrUnsupportedDevice)
+	}
+	im := &Image{Format: format, Width: width, Height: height, Depth: depth, sess: sess}
+	im.Mem, err = createImage(sess, flags, format, width, height, depth)
+	if err != nil {
+		return nil, fmt.Errorf("create %dx%d image: %w", width, height, allocFailure(sess.Device, int64(im.Bytes()), err))
+	}
+	return im, nil
+}
+
+// NewImage2D allocates an uninitialized 2D image.
+func NewImage2D(sess *Session, flags cl.MemFlag, format cl.ImageFormat, width, height int) (*Image, error) {
+	return newImage(sess, flags, format, width, height, 0)
+}
+
+// NewImage3D allocates an uninitialized 3D image. Kernels can read 3D images, writing them needs
+// cl_khr_3d_image_writes.
+func NewImage3D(sess *Session, flags cl.MemFlag, format cl.ImageFormat, width, height, depth int) (*Image, error) {
+	if depth < 1 {
+		return nil, fmt.Errorf("3D image depth must be positive, got %d", depth)
+	}
+	return newImage(sess, flags, format, width, height, depth)
+}
+
+// The image formats Go's image types map to, of 8 and 16 bit normalized integers.
+var (
+	formatRGBA8  = cl.ImageFormat{ChannelOrder: cl.ChannelOrderRGBA, ChannelDataType: cl.ChannelDataTypeUNormInt8}
+	formatR8     = cl.ImageFormat{ChannelOrder: cl.ChannelOrderR, ChannelDataType: cl.ChannelDataTypeUNormInt8}
+	formatR16    = cl.ImageFormat{ChannelOrder: cl.ChannelOrderR, ChannelDataType: cl.ChannelDataTypeUNormInt16}
+	formatRGBA16 = cl.ImageFormat{ChannelOrder: cl.ChannelOrderRGBA, ChannelDataType: cl.ChannelDataTypeUNormInt16}
+)
+
+// ImageFormatOf returns the image format matching the pixels of img and those pixels, tightly packed in the byte
+// order OpenCL expects. *image.RGBA, *image.Gray, *image.Gray16 and *image.RGBA64 map to RGBA and R images of 8 and
+// 16 bit normalized integers. Other image types are converted to RGBA.
+func ImageFormatOf(img image.Image) (cl.ImageFormat, []byte) {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	switch m := img.(type) {
+	case *image.RGBA:
+		return formatRGBA8, packRows(m.Pix, m.Stride, m.PixOffset(b.Min.X, b.Min.Y), 4*w, h, false)
+	case *image.Gray:
+		return formatR8, packRows(m.Pix, m.Stride, m.PixOffset(b.Min.X, b.Min.Y), w, h, false)
+	case *image.Gray16:
+		return formatR16, packRows(m.Pix, m.Stride, m.PixOffset(b.Min.X, b.Min.Y), 2*w, h, true)
+	case *image.RGBA64:
+		return formatRGBA16, packRows(m.Pix, m.Stride, m.PixOffset(b.Min.X, b.Min.Y), 8*w, h, true)
+	}
+	rgba := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(rgba, rgba.Bounds(), img, b.Min, draw.Src)
+	return ImageFormatOf(rgba)
+}
+
+// packRows copies rows of rowBytes from pix, starting at offset and stride apart, into a tightly packed slice.
+// Go stores 16 bit channels big endian, OpenCL in the host's byte order, which swap16 converts to on the little
+// endian hosts OpenCL runs on.
+func packRows(pix []byte, stride, offset, rowBytes, rows int, swap16 bool) []byte {
+	out := make([]byte, rowBytes*rows)
+	for y := 0; y < rows; y++ {
+		copy(out[y*rowBytes:(y+1)*rowBytes], pix[offset+y*stride:])
+	}
+	if swap16 {
+		for i := 0; i < len(out); i += 2 {
+			binary.LittleEndian.PutUint16(out[i:], binary.BigEndian.Uint16(out[i:]))
+		}
+	}
+	return out
+}
+
+// NewImage2DFrom creates a 2D image with the pixels of img, in the format ImageFormatOf picks.
+func NewImage2DFrom(ctx context.Context, sess *Session, flags cl.MemFlag, img image.Image) (*Image, error) {
+	format, pix := ImageFormatOf(img)
+	im, err := NewImage2D(sess, flags, format, img.Bounds().Dx(), img.Bounds().Dy())
+	if err != nil {
+		return nil, err
+	}
+	if err := im.Write(ctx, pix); err != nil {
+		im.Release()
+		return nil, err
+	}
+	return im, nil
+}
+
+// Write uploads the whole image from tightly packed pixels, blocking until the transfer is done.
+func (im *Image) Write(ctx context.Context, data []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(data) != im.Bytes() {
+		return fmt.Errorf("image needs %d bytes of pixels, got %d", im.Bytes(), len(data))
+	}
+	if _, err := im.sess.Queue.EnqueueWriteImage(im.Mem, true, [3]int{}, im.region(), 0, 0, data, nil); err != nil {
+		return fmt.Errorf("write image: %w", err)
+	}
+	return nil
+}
+
+// Read downloads the whole image into data as tightly packed pixels, blocking until the transfer is done.
+func (im *Image) Read(ctx context.Context, data []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(data) != im.Bytes() {
+		return fmt.Errorf("image has %d bytes of pixels, got room for %d", im.Bytes(), len(data))
+	}
+	if _, err := im.sess.Queue.EnqueueReadImage(im.Mem, true, [3]int{}, im.region(), 0, 0, data, nil); err != nil {
+		return fmt.Errorf("read image: %w", err)
+	}
+	return nil
+}
+
+// ReadImage downloads a 2D image into the Go image type ImageFormatOf maps its format from.
+func (im *Image) ReadImage(ctx context.Context) (image.Image, error) {
+	if im.Depth > 0 {
+		return nil, fmt.Errorf("cannot convert a 3D image to a Go image")
+	}
+	data := make([]byte, im.Bytes())
+	if err := im.Read(ctx, data); err != nil {
+		return nil, err
+	}
+	rect := image.Rect(0, 0, im.Width, im.Height)
+	unswap := func(pix []byte) {
+		for i := 0; i < len(pix); i += 2 {
+			binary.BigEndian.PutUint16(pix[i:], binary.LittleEndian.Uint16(pix[i:]))
+		}
+	}
+	switch im.Format {
+	case formatRGBA8:
+		return &image.RGBA{Pix: data, Stride: 4 * im.Width, Rect: rect}, nil
+	case formatR8:
+		return &image.Gray{Pix: data, Stride: im.Width, Rect: rect}, nil
+	case formatR16:
+		unswap(data)
+		return &image.Gray16{Pix: data, Stride: 2 * im.Width, Rect: rect}, nil
+	case formatRGBA16:
+		unswap(data)
+		return &image.RGBA64{Pix: data, Stride: 8 * im.Width, Rect: rect}, nil
+	}
+	return nil, fmt.Errorf("no Go image type for %v images", im.Format)
+}
+
+// Release frees the image.
+func (im *Image) Release() {
+	im.Mem.Release()
+}
+
+func (im *Image) deviceMem() *cl.MemObject {
+	return im.Mem
+}
+
+// elemTypeName is empty since images have no element type, checkKernelArg checks them as images instead.
+func (im *Image) elemTypeName() string {
+	return ""
+}
+
+// clTypeName returns the OpenCL C type of kernel arguments taking the image.
+func (im *Image) clTypeName() string {
+	if im.Depth > 0 {
+		return "image3d_t"
+	}
+	return "image2d_t"
+}
+
+// resizeSrc scales src to the size of dst. Normalized coordinates at the pixel centers make the sampler do the
+// mapping between the sizes, and with a linear filter it interpolates bilinearly.
+var resizeSrc = `
+__kernel void resize(
+   __read_only image2d_t src,
+   __write_only image2d_t dst,
+   sampler_t sampler)
+{
+   const int2 pos = (int2)(get_global_id(0), get_global_id(1));
+   const int2 size = get_image_dim(dst);
+   if (pos.x >= size.x || pos.y >= size.y) {
+      return;
+   }
+   const float2 coord = ((float2)(pos.x, pos.y) + 0.5f) / (float2)(size.x, size.y);
+   write_imagef(dst, pos, read_imagef(src, sampler, coord));
+}
+`
+
+func init() {
+	RegisterKernel(KernelSpec{Name: "image", Source: resizeSrc, Requires: Requirements{Images: true}})
+}
+
+// Resize scales src into dst, which must have the same format, interpolating bilinearly in the texture hardware.
+func Resize(ctx context.Context, sess *Session, src, dst *Image) error {
+	if src.Format != dst.Format || src.Depth > 0 || dst.Depth > 0 {
+		return fmt.Errorf("resize needs 2D images of the same format, got %v and %v", src.Format, dst.Format)
+	}
+	sampler, err := NewSampler(sess, true, AddressClampToEdge, FilterLinear)
+	if err != nil {
+		return err
+	}
+	defer sampler.Release()
+	kernel, err := sess.Kernel(ctx, "image", "resize")
+	if err != nil {
+		return err
+	}
+	defer kernel.Release()
+	if err := setKernelArgs(kernel, src, dst, sampler); err != nil {
+		return err
+	}
+	local, err := resizeLocalSize(sess, kernel)
+	if err != nil {
+		return err
+	}
+	global := []int{(dst.Width + local[0] - 1) / local[0] * local[0], (dst.Height + local[1] - 1) / local[1] * local[1]}
+	return sess.Run(ctx, kernel, global, local)
+}
+
+// resizeLocalSize returns the largest square local size of at most 16x16 the kernel can run with on the device.
+func resizeLocalSize(sess *Session, kernel *cl.Kernel) ([]int, error) {
+	maxLocal, err := kernel.WorkGroupSize(sess.Device)
+	if err != nil {
+		return nil, fmt.Errorf("get work group size: %w", err)
+	}
+	wiSizes := sess.Device.MaxWorkItemSizes()
+	side := 16
+	for side > 1 && (side*side > maxLocal || side > wiSizes[0] || side > wiSizes[1]) {
+		side /= 2
+	}
+	return []int{side, side}, nil
+}
+
+// resizeCPU is the host reference for Resize, sampling like a normalized, clamp-to-edge, linear sampler. It returns
+// every channel of every pixel scaled to 0-1.
+func resizeCPU(src image.Image, width, height int) [][4]float64 {
+	b := src.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	at := func(x, y int) [4]float64 {
+		x = int(math.Max(0, math.Min(float64(sw-1), float64(x))))
+		y = int(math.Max(0, math.Min(float64(sh-1), float64(y))))
+		r, g, bl, a := src.At(b.Min.X+x, b.Min.Y+y).RGBA()
+		return [4]float64{float64(r) / 0xffff, float64(g) / 0xffff, float64(bl) / 0xffff, float64(a) / 0xffff}
+	}
+	out := make([][4]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			u := (float64(x)+0.5)/float64(width)*float64(sw) - 0.5
+			v := (float64(y)+0.5)/float64(height)*float64(sh) - 0.5
+			x0, y0 := int(math.Floor(u)), int(math.Floor(v))
+			fx, fy := u-float64(x0), v-float64(y0)
+			p00, p10, p01, p11 := at(x0, y0), at(x0+1, y0), at(x0, y0+1), at(x0+1, y0+1)
+			for c := range out[0] {
+				out[y*width+x][c] = (1-fx)*(1-fy)*p00[c] + fx*(1-fy)*p10[c] + (1-fx)*fy*p01[c] + fx*fy*p11[c]
+			}
+		}
+	}
+	return out
+}
+
+// ResizeDemo reads the PNG at in, resizes it to width x height on the device with a bilinear sampler, checks the
+// result against the Go reference and writes it to out as a PNG. A zero width or height is derived from the other
+// to keep the aspect ratio, both zero double the size.
+func ResizeDemo(ctx context.Context, deviceIndex int, in, out string, width, height int) error {
+	f, err := os.Open(in)
+	if err != nil {
+		return err
+	}
+	img, err := png.Decode(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("decode %s: %w", in, err)
+	}
+	sw, sh := img.Bounds().Dx(), img.Bounds().Dy()
+	switch {
+	case width == 0 && height == 0:
+		width, height = 2*sw, 2*sh
+	case width == 0:
+		width = int(math.Round(float64(sw) * float64(height) / float64(sh)))
+	case height == 0:
+		height = int(math.Round(float64(sh) * float64(width) / float64(sw)))
+	}
+	if width < 1 || height < 1 {
+		return fmt.Errorf("invalid output size %dx%d", width, height)
+	}
+
+	devices, err := getDevices()
+	if err != nil {
+		return err
+	}
+	sess, err := NewSession(devices, deviceIndex)
+	if err != nil {
+		return err
+	}
+	defer sess.Release()
+	fmt.Println(sess)
+	fmt.Printf("Max samplers: %d\n", sess.Device.MaxSamplers())
+
+	src, err := NewImage2DFrom(ctx, sess, cl.MemReadOnly, img)
+	if err != nil {
+		return err
+	}
+	defer src.Release()
+	dst, err := NewImage2D(sess, cl.MemWriteOnly, src.Format, width, height)
+	if err != nil {
+		return err
+	}
+	defer dst.Release()
+	fmt.Printf("Read %s: %dx%d %T as %v\n", in, sw, sh, img, src.Format)
+
+	st := time.Now()
+	if err := Resize(ctx, sess, src, dst); err != nil {
+		return err
+	}
+	took := time.Since(st)
+	result, err := dst.ReadImage(ctx)
+	if err != nil {
+		return err
+	}
+
+	// The texture hardware interpolates with reduced precision, typically 8 bit weights.
+	want := resizeCPU(img, width, height)
+	diff := 0.0
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			r, g, b, a := result.At(x, y).RGBA()
+			got := [4]float64{float64(r) / 0xffff, float64(g) / 0xffff, float64(b) / 0xffff, float64(a) / 0xffff}
+			for c := range got {
+				diff = math.Max(diff, math.Abs(got[c]-want[y*width+x][c]))
+			}
+		}
+	}
+	if diff > 0.02 {
+		return fmt.Errorf("resized image differs from the reference by %g", diff)
+	}
+	fmt.Printf("Resized to %dx%d in %v, max difference from the reference %.4f\n", width, height, took, diff)
+
+	of, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(of, result); err != nil {
+		of.Close()
+		return fmt.Errorf("encode %s: %w", out, err)
+	}
+	if err := of.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s\n", out)
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build cl10
+// +build cl10
+
+package app
+
+import "github.com/jgillich/go-opencl/cl"
+
+// createImage is unavailable before OpenCL 1.2, since the cl package only wraps clCreateImage.
+func createImage(sess *Session, flags cl.MemFlag, format cl.ImageFormat, width, height, depth int) (*cl.MemObject, error) {
+	return nil, cl.ErrUnsupported
+}
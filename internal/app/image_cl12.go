@@ -0,0 +1,15 @@
+//go:build !cl10
+// +build !cl10
+
+package app
+
+import "github.com/jgillich/go-opencl/cl"
+
+// createImage creates an uninitialized image with clCreateImage, a 3D one if depth is positive.
+func createImage(sess *Session, flags cl.MemFlag, format cl.ImageFormat, width, height, depth int) (*cl.MemObject, error) {
+	desc := cl.ImageDescription{Type: cl.MemObjectTypeImage2D, Width: width, Height: height}
+	if depth > 0 {
+		desc.Type, desc.Depth = cl.MemObjectTypeImage3D, depth
+	}
+	return sess.Context.CreateImage(flags, format, desc, nil)
+}
@@ -0,0 +1,357 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/eriklupander/ocltest/internal/clparse"
+	"github.com/jgillich/go-opencl/cl"
+	"strings"
+)
+
+// AddressSpace is the address space qualifier of a kernel argument.
+type AddressSpace int
+
+const (
+	AddressPrivate AddressSpace = iota
+	AddressGlobal
+	AddressLocal
+	AddressConstant
+)
+
+func (a AddressSpace) String() string {
+	switch a {
+	case AddressPrivate:
+		return "__private"
+	case AddressGlobal:
+		return "__global"
+	case AddressLocal:
+		return "__local"
+	case AddressConstant:
+		return "__constant"
+	}
+	return fmt.Sprintf("AddressSpace(%d)", int(a))
+}
+
+// KernelArg describes one kernel parameter.
+type KernelArg struct {
+	Index int
+	Name  string
+	// TypeName is the OpenCL C type without qualifiers, e.g. "uint" or "float*" for pointers.
+	TypeName string
+	Address  AddressSpace
+	Const    bool
+	Restrict bool
+	Volatile bool
+}
+
+func (a KernelArg) String() string {
+	var b strings.Builder
+	if a.Address != AddressPrivate {
+		b.WriteString(a.Address.String() + " ")
+	}
+	if a.Const {
+		b.WriteString("const ")
+	}
+	if a.Volatile {
+		b.WriteString("volatile ")
+	}
+	b.WriteString(a.TypeName)
+	if a.Restrict {
+		b.WriteString(" restrict")
+	}
+	return b.String() + " " + a.Name
+}
+
+// normalizeTypeName spells type names the way OpenCL's built-in typedefs do, so "unsigned int" and "uint", or
+// "float *" and "float*", compare equal.
+func normalizeTypeName(name string) string {
+	name = strings.Join(strings.Fields(name), " ")
+	name = strings.ReplaceAll(name, " *", "*")
+	for long, short := range map[string]string{
+		"unsigned char":  "uchar",
+		"unsigned short": "ushort",
+		"unsigned int":   "uint",
+		"unsigned long":  "ulong",
+	} {
+		name = strings.ReplaceAll(name, long, short)
+	}
+	return name
+}
+
+// DescribeKernelArgs queries the driver for the name, type and qualifiers of every argument of kernel. It needs a
+// program built with the -cl-kernel-arg-info option (see kernelArgInfoOption) on an OpenCL 1.2 or newer driver,
+// and returns cl.ErrKernelArgInfoNotAvailable or cl.ErrUnsupported otherwise.
+func DescribeKernelArgs(kernel *cl.Kernel) ([]KernelArg, error) {
+	n, err := kernel.NumArgs()
+	if err != nil {
+		return nil, fmt.Errorf("get number of kernel args: %w", err)
+	}
+	args := make([]KernelArg, n)
+	for i := range args {
+		arg, err := queryKernelArg(kernel, i)
+		if err != nil {
+			return nil, err
+		}
+		arg.TypeName = normalizeTypeName(arg.TypeName)
+		args[i] = arg
+	}
+	return args, nil
+}
+
+// ParseKernelArgs describes the arguments of kernelName by parsing its OpenCL C source, for when the driver can't.
+func ParseKernelArgs(src, kernelName string) ([]KernelArg, error) {
+	kernels, err := clparse.Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	k, ok := clparse.Find(kernels, kernelName)
+	if !ok {
+		return nil, fmt.Errorf("no kernel %s in source", kernelName)
+	}
+	args := make([]KernelArg, len(k.Params))
+	for i, p := range k.Params {
+		args[i] = KernelArg{
+			Index:    i,
+			Name:     p.Name,
+			TypeName: p.TypeName(),
+			Address:  AddressSpace(p.Address),
+			Const:    p.Const,
+			Restrict: p.Restrict,
+			Volatile: p.Volatile,
+		}
+	}
+	return args, nil
+}
+
+// CheckKernelArgs validates args against the declaration of kernelName in src without a driver.
+func CheckKernelArgs(src, kernelName string, args ...interface{}) error {
+	declared, err := ParseKernelArgs(src, kernelName)
+	if err != nil {
+		return err
+	}
+	if len(args) != len(declared) {
+		return fmt.Errorf("%s takes %d arguments, got %d", kernelName, len(declared), len(args))
+	}
+	for i, arg := range args {
+		if err := checkKernelArg(declared[i], arg); err != nil {
+			return fmt.Errorf("%s: %w", kernelName, err)
+		}
+	}
+	return nil
+}
+
+// kernelArgInfoOption returns the build option that makes drivers keep argument info for DescribeKernelArgs, or
+// "" for devices older than OpenCL 1.2, whose compilers don't know it.
+func kernelArgInfoOption(device *cl.Device) string {
+	if parseCLVersion(device.Version(), "OpenCL ").AtLeast(1, 2) {
+		return "-cl-kernel-arg-info"
+	}
+	return ""
+}
+
+// CheckedKernel is a kernel that validates its arguments against their declarations before setting them, and
+// allows setting them by name. The declarations come from the driver, or from parsing the kernel's source when the
+// driver can't describe them. Without either, Args is nil and arguments are set unchecked, by position only.
+type CheckedKernel struct {
+	*cl.Kernel
+	Name string
+	Args []KernelArg
+	sess *Session
+	set  []bool
+}
+
+// CheckedKernel creates kernelName from the registered spec's program like Kernel, wrapped in a CheckedKernel.
+// The caller releases it.
+func (s *Session) CheckedKernel(ctx context.Context, specName, kernelName string) (*CheckedKernel, error) {
+	spec, err := LookupKernel(specName)
+	if err != nil {
+		return nil, err
+	}
+	kernel, err := s.Kernel(ctx, specName, kernelName)
+	if err != nil {
+		return nil, err
+	}
+	checked, err := NewCheckedKernel(s, kernel, kernelName, spec.Source)
+	if err != nil {
+		kernel.Release()
+		return nil, err
+	}
+	return checked, nil
+}
+
+// NewCheckedKernel wraps kernel, which was created in sess from src. sess may be nil if Run isn't used, and src
+// may be empty if there's no source to fall back to.
+func NewCheckedKernel(sess *Session, kernel *cl.Kernel, name, src string) (*CheckedKernel, error) {
+	k := &CheckedKernel{Kernel: kernel, Name: name, sess: sess}
+	args, err := DescribeKernelArgs(kernel)
+	switch {
+	case errors.Is(err, cl.ErrKernelArgInfoNotAvailable) || errors.Is(err, cl.ErrUnsupported):
+		n, err := kernel.NumArgs()
+		if err != nil {
+			return nil, fmt.Errorf("get number of kernel args: %w", err)
+		}
+		k.set = make([]bool, n)
+		if src == "" {
+			break
+		}
+		// A parse failure or a signature that doesn't match the built kernel leaves the kernel unchecked rather
+		// than failing it, since the source parser doesn't know all of OpenCL C.
+		if parsed, err := ParseKernelArgs(src, name); err == nil && len(parsed) == n {
+			k.Args = parsed
+		}
+	case err != nil:
+		return nil, fmt.Errorf("describe args of %s: %w", name, err)
+	default:
+		k.Args = args
+		k.set = make([]bool, len(args))
+	}
+	return k, nil
+}
+
+// Checked reports whether the arguments are validated, i.e. whether the driver or the source described them.
+func (k *CheckedKernel) Checked() bool {
+	return k.Args != nil
+}
+
+// SetArgs sets all arguments in order. The number of args must match the kernel's.
+func (k *CheckedKernel) SetArgs(args ...interface{}) error {
+	if len(args) != len(k.set) {
+		return fmt.Errorf("%s takes %d arguments, got %d", k.Name, len(k.set), len(args))
+	}
+	for i, arg := range args {
+		if err := k.SetArg(i, arg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetArg validates arg against the declaration of argument index and sets it.
+func (k *CheckedKernel) SetArg(index int, arg interface{}) error {
+	if index < 0 || index >= len(k.set) {
+		return fmt.Errorf("%s has no argument %d", k.Name, index)
+	}
+	if k.Checked() {
+		if err := checkKernelArg(k.Args[index], arg); err != nil {
+			return fmt.Errorf("%s: %w", k.Name, err)
+		}
+	}
+	if err := setKernelArg(k.Kernel, index, arg); err != nil {
+		return fmt.Errorf("%s: %w", k.Name, err)
+	}
+	k.set[index] = true
+	return nil
+}
+
+// Set sets the argument called name, e.g. k.Set("count", uint32(n)).
+func (k *CheckedKernel) Set(name string, arg interface{}) error {
+	if !k.Checked() {
+		return fmt.Errorf("%s: argument names are not available", k.Name)
+	}
+	for _, a := range k.Args {
+		if a.Name == name {
+			return k.SetArg(a.Index, arg)
+		}
+	}
+	return fmt.Errorf("%s has no argument called %q", k.Name, name)
+}
+
+// Missing returns the arguments that haven't been set yet, by name if known and by index otherwise.
+func (k *CheckedKernel) Missing() []string {
+	var missing []string
+	for i, set := range k.set {
+		if set {
+			continue
+		}
+		if k.Checked() {
+			missing = append(missing, k.Args[i].Name)
+		} else {
+			missing = append(missing, fmt.Sprintf("#%d", i))
+		}
+	}
+	return missing
+}
+
+// Run checks that every argument has been set and runs the kernel in its session like Session.Run.
+func (k *CheckedKernel) Run(ctx context.Context, global, local []int) error {
+	if k.sess == nil {
+		return fmt.Errorf("%s: no session to run in", k.Name)
+	}
+	if missing := k.Missing(); len(missing) > 0 {
+		return fmt.Errorf("%s: arguments not set: %s", k.Name, strings.Join(missing, ", "))
+	}
+	return k.sess.Run(ctx, k.Kernel, global, local)
+}
+
+// checkKernelArg returns an error if the Go value v can't be passed as arg.
+func checkKernelArg(arg KernelArg, v interface{}) error {
+	mismatch := func(what string) error {
+		return fmt.Errorf("argument %d (%s): cannot pass %s", arg.Index, arg, what)
+	}
+	switch v := v.(type) {
+	case cl.LocalBuffer:
+		if arg.Address != AddressLocal {
+			return mismatch("a local buffer")
+		}
+	case *cl.MemObject:
+		if arg.Address != AddressGlobal && arg.Address != AddressConstant {
+			return mismatch("a buffer")
+		}
+	case *Image:
+		if arg.TypeName != v.clTypeName() {
+			return mismatch("an " + v.clTypeName())
+		}
+	case *Sampler:
+		if arg.TypeName != "sampler_t" {
+			return mismatch("a sampler")
+		}
+	case deviceMem:
+		if arg.Address != AddressGlobal && arg.Address != AddressConstant {
+			return mismatch("a buffer")
+		}
+		// Buffers of Go structs can't be checked beyond being buffers.
+		if elem := v.elemTypeName(); elem != "" && elem+"*" != arg.TypeName {
+			return mismatch("a buffer of " + elem)
+		}
+	default:
+		name, ok := scalarCLTypeName(v)
+		if !ok {
+			return mismatch(fmt.Sprintf("a %T", v))
+		}
+		if arg.Address != AddressPrivate || name != arg.TypeName {
+			return mismatch(fmt.Sprintf("a %T (%s)", v, name))
+		}
+	}
+	return nil
+}
+
+// KernelStubs parses every registered kernel spec and prints each kernel's signature followed by a typed Go wrapper
+// stub for it. It needs no device, so it also works as a check that the parser understands all registered sources.
+func KernelStubs() error {
+	for _, name := range RegisteredKernels() {
+		spec, err := LookupKernel(name)
+		if err != nil {
+			return err
+		}
+		kernels, err := clparse.Parse(spec.Source)
+		if err != nil {
+			return fmt.Errorf("parse %s: %w", name, err)
+		}
+		for _, k := range kernels {
+			params := make([]string, len(k.Params))
+			for i, p := range k.Params {
+				params[i] = KernelArg{Name: p.Name, TypeName: p.TypeName(), Address: AddressSpace(p.Address), Const: p.Const,
+					Restrict: p.Restrict, Volatile: p.Volatile}.String()
+			}
+			fmt.Printf("// %s: __kernel void %s(%s)\n", name, k.Name, strings.Join(params, ", "))
+			stub, err := k.GoStub(name)
+			if err != nil {
+				fmt.Printf("// no stub: %v\n\n", err)
+				continue
+			}
+			fmt.Println(stub)
+		}
+	}
+	return nil
+}
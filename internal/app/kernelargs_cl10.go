@@ -0,0 +1,11 @@
+//go:build cl10
+// +build cl10
+
+package app
+
+import "github.com/jgillich/go-opencl/cl"
+
+// queryKernelArg is unavailable before OpenCL 1.2, which introduced clGetKernelArgInfo.
+func queryKernelArg(kernel *cl.Kernel, index int) (KernelArg, error) {
+	return KernelArg{Index: index}, cl.ErrUnsupported
+}
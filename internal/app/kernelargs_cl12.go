@@ -0,0 +1,75 @@
+//go:build !cl10
+// +build !cl10
+
+package app
+
+// #cgo linux pkg-config: OpenCL
+// #cgo darwin LDFLAGS: -framework OpenCL
+// #define CL_USE_DEPRECATED_OPENCL_1_2_APIS
+// #if defined(__APPLE__)
+// #include <OpenCL/cl.h>
+// #else
+// #include <CL/cl.h>
+// #endif
+import "C"
+
+import (
+	"github.com/jgillich/go-opencl/cl"
+	"unsafe"
+)
+
+func argInfoError(code C.cl_int) error {
+	switch code {
+	case C.CL_SUCCESS:
+		return nil
+	case C.CL_KERNEL_ARG_INFO_NOT_AVAILABLE:
+		return cl.ErrKernelArgInfoNotAvailable
+	}
+	return cl.ErrOther(code)
+}
+
+func argInfoString(k C.cl_kernel, index int, param C.cl_kernel_arg_info) (string, error) {
+	var buf [1024]byte
+	if err := argInfoError(C.clGetKernelArgInfo(k, C.cl_uint(index), param, C.size_t(len(buf)), unsafe.Pointer(&buf[0]), nil)); err != nil {
+		return "", err
+	}
+	return C.GoString((*C.char)(unsafe.Pointer(&buf[0]))), nil
+}
+
+// queryKernelArg asks the driver to describe argument index of kernel. The program must have been built with
+// -cl-kernel-arg-info, otherwise drivers may answer cl.ErrKernelArgInfoNotAvailable.
+func queryKernelArg(kernel *cl.Kernel, index int) (KernelArg, error) {
+	k := clKernelHandle(kernel)
+	arg := KernelArg{Index: index}
+	var err error
+	if arg.Name, err = argInfoString(k, index, C.CL_KERNEL_ARG_NAME); err != nil {
+		return arg, err
+	}
+	if arg.TypeName, err = argInfoString(k, index, C.CL_KERNEL_ARG_TYPE_NAME); err != nil {
+		return arg, err
+	}
+
+	var address C.cl_kernel_arg_address_qualifier
+	if err := argInfoError(C.clGetKernelArgInfo(k, C.cl_uint(index), C.CL_KERNEL_ARG_ADDRESS_QUALIFIER, C.size_t(unsafe.Sizeof(address)), unsafe.Pointer(&address), nil)); err != nil {
+		return arg, err
+	}
+	switch address {
+	case C.CL_KERNEL_ARG_ADDRESS_GLOBAL:
+		arg.Address = AddressGlobal
+	case C.CL_KERNEL_ARG_ADDRESS_LOCAL:
+		arg.Address = AddressLocal
+	case C.CL_KERNEL_ARG_ADDRESS_CONSTANT:
+		arg.Address = AddressConstant
+	default:
+		arg.Address = AddressPrivate
+	}
+
+	var qualifier C.cl_kernel_arg_type_qualifier
+	if err := argInfoError(C.clGetKernelArgInfo(k, C.cl_uint(index), C.CL_KERNEL_ARG_TYPE_QUALIFIER, C.size_t(unsafe.Sizeof(qualifier)), unsafe.Pointer(&qualifier), nil)); err != nil {
+		return arg, err
+	}
+	arg.Const = qualifier&C.CL_KERNEL_ARG_TYPE_CONST != 0
+	arg.Restrict = qualifier&C.CL_KERNEL_ARG_TYPE_RESTRICT != 0
+	arg.Volatile = qualifier&C.CL_KERNEL_ARG_TYPE_VOLATILE != 0
+	return arg, nil
+}
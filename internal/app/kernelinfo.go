@@ -0,0 +1,264 @@
+package app
+
+// #cgo linux pkg-config: OpenCL
+// #cgo darwin LDFLAGS: -framework OpenCL
+// #define CL_USE_DEPRECATED_OPENCL_1_2_APIS
+// #if defined(__APPLE__)
+// #include <OpenCL/cl.h>
+// #else
+// #include <CL/cl.h>
+// #endif
+import "C"
+
+import (
+	"context"
+	"fmt"
+	"github.com/eriklupander/ocltest/internal/clparse"
+	"github.com/jgillich/go-opencl/cl"
+	"io"
+	"os"
+	"unsafe"
+)
+
+// KernelInfo is what the driver reports about a kernel built for a device: the work-group sizes it allows and the
+// memory it uses, next to the device limits they are bounded by.
+type KernelInfo struct {
+	Device string
+	// WorkGroupSize is the largest work-group the kernel can be launched with on the device, which register or
+	// local memory use can push below MaxWorkGroupSize.
+	WorkGroupSize int
+	// CompileWorkGroupSize is the size required with __attribute__((reqd_work_group_size)), or zeros.
+	CompileWorkGroupSize [3]int
+	PreferredMultiple    int
+	// LocalMem is the local memory used per work-group in bytes: the kernel's __local variables plus local buffer
+	// arguments set before the query. PrivateMem is the private memory used per work item in bytes.
+	LocalMem   int64
+	PrivateMem int64
+
+	MaxWorkGroupSize int
+	MaxWorkItemSizes []int
+	DeviceLocalMem   int64
+	ComputeUnits     int
+}
+
+// kernelWorkGroupInfo queries param of kernel on device into value, which must point to size bytes.
+func kernelWorkGroupInfo(kernel *cl.Kernel, device *cl.Device, param C.cl_kernel_work_group_info, size uintptr,
+	value unsafe.Pointer) error {
+	switch code := C.clGetKernelWorkGroupInfo(clKernelHandle(kernel), clDeviceHandle(device), param, C.size_t(size),
+		value, nil); code {
+	case C.CL_SUCCESS:
+		return nil
+	case C.CL_INVALID_DEVICE:
+		return cl.ErrInvalidDevice
+	case C.CL_INVALID_VALUE:
+		return cl.ErrInvalidValue
+	case C.CL_INVALID_KERNEL:
+		return cl.ErrInvalidKernel
+	default:
+		return cl.ErrOther(code)
+	}
+}
+
+// QueryKernelInfo asks the driver about kernel built for device. The queries are part of OpenCL 1.0.
+func QueryKernelInfo(kernel *cl.Kernel, device *cl.Device) (KernelInfo, error) {
+	info := KernelInfo{Device: device.Name(), MaxWorkGroupSize: device.MaxWorkGroupSize(),
+		MaxWorkItemSizes: device.MaxWorkItemSizes(), DeviceLocalMem: device.LocalMemSize(),
+		ComputeUnits: device.MaxComputeUnits()}
+	var err error
+	if info.WorkGroupSize, err = kernel.WorkGroupSize(device); err != nil {
+		return info, fmt.Errorf("get work group size: %w", err)
+	}
+	if info.PreferredMultiple, err = kernel.PreferredWorkGroupSizeMultiple(device); err != nil {
+		return info, fmt.Errorf("get preferred work group size multiple: %w", err)
+	}
+	var compile [3]C.size_t
+	if err := kernelWorkGroupInfo(kernel, device, C.CL_KERNEL_COMPILE_WORK_GROUP_SIZE, unsafe.Sizeof(compile),
+		unsafe.Pointer(&compile)); err != nil {
+		return info, fmt.Errorf("get compile work group size: %w", err)
+	}
+	for i, n := range compile {
+		info.CompileWorkGroupSize[i] = int(n)
+	}
+	var local, private C.cl_ulong
+	if err := kernelWorkGroupInfo(kernel, device, C.CL_KERNEL_LOCAL_MEM_SIZE, unsafe.Sizeof(local),
+		unsafe.Pointer(&local)); err != nil {
+		return info, fmt.Errorf("get local memory size: %w", err)
+	}
+	if err := kernelWorkGroupInfo(kernel, device, C.CL_KERNEL_PRIVATE_MEM_SIZE, unsafe.Sizeof(private),
+		unsafe.Pointer(&private)); err != nil {
+		return info, fmt.Errorf("get private memory size: %w", err)
+	}
+	info.LocalMem, info.PrivateMem = int64(local), int64(private)
+	return info, nil
+}
+
+// Occupancy is an estimate of how well launches with a local size fill the device.
+type Occupancy struct {
+	LocalSize int
+	// GroupsPerUnit is the number of work-groups a compute unit holds at once, ActiveGroups that over all units.
+	GroupsPerUnit int
+	ActiveGroups  int
+	// Fraction is the share of a compute unit's work items busy with them, from 0 to 1.
+	Fraction float64
+	// Limit is what caps GroupsPerUnit: "work items", "local memory" or, for local sizes the kernel can't be
+	// launched with, "work-group size".
+	Limit string
+}
+
+// Occupancy estimates how launching the kernel with work-groups of localSize work items fills the device. OpenCL
+// doesn't expose how many work items a compute unit keeps in flight, so that is taken to be the device's max
+// work-group size. Work-groups are padded to the preferred multiple, and together they can use at most the
+// device's local memory per compute unit.
+func (info KernelInfo) Occupancy(localSize int) Occupancy {
+	o := Occupancy{LocalSize: localSize}
+	if localSize < 1 || localSize > info.WorkGroupSize {
+		o.Limit = "work-group size"
+		return o
+	}
+	padded := localSize
+	if m := info.PreferredMultiple; m > 1 {
+		padded = (localSize + m - 1) / m * m
+	}
+	o.GroupsPerUnit, o.Limit = info.MaxWorkGroupSize/padded, "work items"
+	if info.LocalMem > 0 {
+		if byLocal := int(info.DeviceLocalMem / info.LocalMem); byLocal < o.GroupsPerUnit {
+			o.GroupsPerUnit, o.Limit = byLocal, "local memory"
+		}
+	}
+	o.ActiveGroups = o.GroupsPerUnit * info.ComputeUnits
+	o.Fraction = float64(o.GroupsPerUnit*localSize) / float64(info.MaxWorkGroupSize)
+	return o
+}
+
+func (o Occupancy) String() string {
+	return fmt.Sprintf("%.0f%% (%d groups per unit, limited by %s)", 100*o.Fraction, o.GroupsPerUnit, o.Limit)
+}
+
+// annotate adds the occupancy estimate to r's annotations.
+func (o Occupancy) annotate(r *BenchResult) {
+	if r.Annotations == nil {
+		r.Annotations = map[string]string{}
+	}
+	r.Annotations["occupancy"] = fmt.Sprintf("%.2f", o.Fraction)
+	r.Annotations["occupancy_limit"] = o.Limit
+}
+
+// annotate adds the kernel's local and private memory use in bytes and the occupancy estimate for work-groups of
+// localSize work items to r's annotations.
+func (info KernelInfo) annotate(r *BenchResult, localSize int) {
+	info.Occupancy(localSize).annotate(r)
+	r.Annotations["local_mem"] = fmt.Sprint(info.LocalMem)
+	r.Annotations["private_mem"] = fmt.Sprint(info.PrivateMem)
+}
+
+// WriteKernelInfo prints info as a list followed by a Markdown table of the occupancy for every power of two local
+// size the kernel allows, or just its compile work-group size if it has one.
+func WriteKernelInfo(w io.Writer, info KernelInfo) error {
+	compile := "none"
+	if c := info.CompileWorkGroupSize; c[0] > 0 {
+		compile = fmt.Sprintf("%dx%dx%d", c[0], c[1], c[2])
+	}
+	if _, err := fmt.Fprintf(w, `Work-group size: %d (device max %d, work items %v)
+Compile work-group size: %s
+Preferred multiple: %d
+Local memory: %d of %d bytes per work-group
+Private memory: %d bytes per work item
+Compute units: %d
+
+| Local size | Groups per unit | Active groups | Occupancy | Limited by |
+| -----:| -----:| -----:| -----:|:-------------:|
+`, info.WorkGroupSize, info.MaxWorkGroupSize, info.MaxWorkItemSizes, compile, info.PreferredMultiple, info.LocalMem,
+		info.DeviceLocalMem, info.PrivateMem, info.ComputeUnits); err != nil {
+		return err
+	}
+	var localSizes []int
+	if c := info.CompileWorkGroupSize; c[0] > 0 {
+		localSizes = []int{c[0] * c[1] * c[2]}
+	} else {
+		for lz := 1; lz <= info.WorkGroupSize; lz *= 2 {
+			localSizes = append(localSizes, lz)
+		}
+	}
+	for _, lz := range localSizes {
+		o := info.Occupancy(lz)
+		if _, err := fmt.Fprintf(w, "| %d | %d | %d | %.0f%% | %s |\n", lz, o.GroupsPerUnit, o.ActiveGroups,
+			100*o.Fraction, o.Limit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// KernelInfoDemo builds kernels of registered specs and prints what the driver reports about them with an
+// occupancy estimate per local size. An empty specName means every registered spec the device supports, an empty
+// kernelName every kernel in the spec. Local buffer arguments aren't set, so their memory isn't included.
+func KernelInfoDemo(ctx context.Context, deviceIndex int, specName, kernelName string) error {
+	devices, err := getDevices()
+	if err != nil {
+		return err
+	}
+	sess, err := NewSession(devices, deviceIndex)
+	if err != nil {
+		return err
+	}
+	defer sess.Release()
+	fmt.Println(sess)
+	fmt.Printf("Build options: %s\n", describeBuildOptions(sess.BuildOptions))
+
+	specNames := []string{specName}
+	if specName == "" {
+		specNames = RegisteredKernels()
+	}
+	for _, name := range specNames {
+		spec, err := LookupKernel(name)
+		if err != nil {
+			return err
+		}
+		if specName == "" && len(sess.Capabilities().Missing(spec.Requires)) > 0 {
+			fmt.Printf("\n%s: skipped, needs %v\n", name, sess.Capabilities().Missing(spec.Requires))
+			continue
+		}
+		kernels, err := clparse.Parse(spec.Source)
+		if err != nil {
+			return fmt.Errorf("parse %s: %w", name, err)
+		}
+		found := false
+		for _, k := range kernels {
+			if kernelName != "" && k.Name != kernelName {
+				continue
+			}
+			found = true
+			if err := printKernelInfo(ctx, sess, name, k); err != nil {
+				return err
+			}
+		}
+		if !found && kernelName != "" && specName != "" {
+			return fmt.Errorf("no kernel %s in spec %s", kernelName, name)
+		}
+	}
+	return nil
+}
+
+// printKernelInfo builds kernel k of spec specName and prints its KernelInfo.
+func printKernelInfo(ctx context.Context, sess *Session, specName string, k clparse.Kernel) error {
+	kernel, err := sess.Kernel(ctx, specName, k.Name)
+	if err != nil {
+		return err
+	}
+	defer kernel.Release()
+	info, err := QueryKernelInfo(kernel, sess.Device)
+	if err != nil {
+		return fmt.Errorf("%s/%s: %w", specName, k.Name, err)
+	}
+	localArgs := 0
+	for _, p := range k.Params {
+		if p.Pointer && p.Address == clparse.Local {
+			localArgs++
+		}
+	}
+	fmt.Printf("\n%s/%s:\n", specName, k.Name)
+	if localArgs > 0 {
+		fmt.Printf("Local buffer arguments: %d, sized at launch and not included below\n", localArgs)
+	}
+	return WriteKernelInfo(os.Stdout, info)
+}
@@ -0,0 +1,20 @@
+__kernel void multiply2(
+   __global double* input1,
+   __global double* input2,
+   __global double* output,
+   const unsigned int count)
+{
+   int i = get_global_id(0);
+
+   if(i < count) {
+		unsigned int vOffset = i * 4;
+        unsigned int mOffset = i * 16;
+		for (unsigned int row = 0; row < 4; row++) {
+			double a = input2[mOffset + (row*4)+0] * input1[vOffset];
+			double b = input2[mOffset + (row*4)+1] * input1[vOffset + 1];
+			double c = input2[mOffset + (row*4)+2] * input1[vOffset + 2];
+			double d = input2[mOffset + (row*4)+3] * input1[vOffset + 3];
+			output[vOffset + row] = a + b + c + d;
+		}
+   }
+}
@@ -0,0 +1,28 @@
+// Code generated by clgen from kernels/*.cl. DO NOT EDIT.
+
+package app
+
+import (
+	"context"
+	_ "embed"
+)
+
+//go:embed kernels/vectors.cl
+var vectorsSrc string
+
+func init() {
+	RegisterKernel(KernelSpec{Name: "vectors", Source: vectorsSrc, Requires: Requirements{FP64: true}})
+}
+
+// Multiply2 enqueues the multiply2 kernel from the "vectors" kernel spec. Wait for the returned event and release it.
+func Multiply2(ctx context.Context, sess *Session, input1, input2, output *Buffer[float64], count uint32, global, local []int) (*Event, error) {
+	kernel, err := sess.Kernel(ctx, "vectors", "multiply2")
+	if err != nil {
+		return nil, err
+	}
+	defer kernel.Release()
+	if err := setKernelArgs(kernel, input1, input2, output, count); err != nil {
+		return nil, err
+	}
+	return sess.Enqueue(ctx, kernel, global, local)
+}
@@ -0,0 +1,262 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"github.com/jgillich/go-opencl/cl"
+	"time"
+)
+
+// newMultiScheduler opens the scheduler for the given devices and applies static weights if any were passed.
+func newMultiScheduler(deviceIndexes []int, weights []float64) (*Scheduler, error) {
+	sched, err := NewScheduler(deviceIndexes)
+	if err != nil {
+		return nil, err
+	}
+	if len(weights) > 0 {
+		if err := sched.SetWeights(weights); err != nil {
+			sched.Release()
+			return nil, err
+		}
+	}
+	return sched, nil
+}
+
+// buildKernels builds the same kernel on every session of the scheduler, indexed like sched.Sessions.
+func buildKernels(ctx context.Context, sched *Scheduler, src, name string) ([]*cl.Kernel, error) {
+	kernels := make([]*cl.Kernel, 0, len(sched.Sessions))
+	for _, sess := range sched.Sessions {
+		kernel, err := sess.BuildKernel(ctx, src, name)
+		if err != nil {
+			releaseKernels(kernels)
+			return nil, fmt.Errorf("%s: %w", sess, err)
+		}
+		kernels = append(kernels, kernel)
+	}
+	return kernels, nil
+}
+
+func releaseKernels(kernels []*cl.Kernel) {
+	for _, k := range kernels {
+		k.Release()
+	}
+}
+
+// SquareMulti runs the square demo split across several devices. Without weights the split is based on a calibration run.
+func SquareMulti(ctx context.Context, deviceIndexes []int, weights []float64) error {
+	sched, err := newMultiScheduler(deviceIndexes, weights)
+	if err != nil {
+		return err
+	}
+	defer sched.Release()
+
+	kernels, err := buildKernels(ctx, sched, squareSrc, "square")
+	if err != nil {
+		return err
+	}
+	defer releaseKernels(kernels)
+
+	elemCount := 1024 * 1024
+	numbers := make([]int32, elemCount)
+	for i := 0; i < elemCount; i++ {
+		numbers[i] = int32(i)
+	}
+	results := make([]int32, elemCount)
+
+	// Each partition uploads its own part of the input, squares it and downloads the result straight into its
+	// part of the results slice, so the results are back in order once all partitions are done.
+	run := func(ctx context.Context, sess *Session, part Partition) error {
+		offset, count := part.Elems()
+		inputBuffer, err := sess.Context.CreateEmptyBuffer(cl.MemReadOnly, 4*count)
+		if err != nil {
+			return fmt.Errorf("create input buffer: %w", err)
+		}
+		defer inputBuffer.Release()
+		outputBuffer, err := sess.Context.CreateEmptyBuffer(cl.MemWriteOnly, 4*count)
+		if err != nil {
+			return fmt.Errorf("create output buffer: %w", err)
+		}
+		defer outputBuffer.Release()
+
+		if err := writeSlice(sess.Queue, inputBuffer, numbers[offset:offset+count]); err != nil {
+			return fmt.Errorf("write input: %w", err)
+		}
+		kernel := kernels[part.Device]
+		if err := kernel.SetArgs(inputBuffer, outputBuffer); err != nil {
+			return fmt.Errorf("set args: %w", err)
+		}
+		if err := sess.Run(ctx, kernel, part.Global, nil); err != nil {
+			return err
+		}
+		return readSlice(sess.Queue, outputBuffer, results[offset:offset+count])
+	}
+
+	if len(weights) == 0 {
+		if err := sched.Calibrate(ctx, []int{elemCount / 16}, run); err != nil {
+			return err
+		}
+	}
+	parts, err := sched.Split([]int{elemCount}, 1)
+	if err != nil {
+		return err
+	}
+	sched.printPartitions(parts)
+
+	st := time.Now()
+	if err := sched.Run(ctx, parts, run); err != nil {
+		return err
+	}
+	fmt.Printf("Took: %v\n", time.Since(st))
+
+	for i := range numbers {
+		if results[i] != numbers[i]*numbers[i] {
+			return fmt.Errorf("result %d is %d, expected %d", i, results[i], numbers[i]*numbers[i])
+		}
+	}
+	for i := 0; i < elemCount && i < 32; i++ {
+		fmt.Printf("%d ", results[i])
+	}
+	fmt.Println()
+	return nil
+}
+
+// BenchmarkMulti runs the 2D squareRoot benchmark with the rows split across several devices, sweeping the same
+// local sizes as Benchmark. Each row in the table is the wall time until all devices have finished their part.
+func BenchmarkMulti(ctx context.Context, deviceIndexes []int, weights []float64) error {
+	sched, err := newMultiScheduler(deviceIndexes, weights)
+	if err != nil {
+		return err
+	}
+	defer sched.Release()
+
+	kernels, err := buildKernels(ctx, sched, benchmarkSrc, "squareRoot")
+	if err != nil {
+		return err
+	}
+	defer releaseKernels(kernels)
+
+	elems := 1024
+	elemCount := elems * elems
+	numbers := make([]float32, elemCount)
+	for i := 0; i < elemCount; i++ {
+		numbers[i] = float32(i)
+	}
+	results := make([]float32, elemCount)
+
+	if len(weights) == 0 {
+		// Calibrate using the full data path (upload, kernel, download) on a 64 row probe.
+		probe := func(ctx context.Context, sess *Session, part Partition) error {
+			_, count := part.Elems()
+			in, err := sess.Context.CreateEmptyBuffer(cl.MemReadOnly, 4*count)
+			if err != nil {
+				return err
+			}
+			defer in.Release()
+			out, err := sess.Context.CreateEmptyBuffer(cl.MemWriteOnly, 4*count)
+			if err != nil {
+				return err
+			}
+			defer out.Release()
+			if err := writeSlice(sess.Queue, in, numbers[:count]); err != nil {
+				return err
+			}
+			if err := kernels[part.Device].SetArgs(in, out); err != nil {
+				return err
+			}
+			if err := sess.Run(ctx, kernels[part.Device], part.Global, nil); err != nil {
+				return err
+			}
+			return readSlice(sess.Queue, out, results[:count])
+		}
+		if err := sched.Calibrate(ctx, []int{elems, 64}, probe); err != nil {
+			return err
+		}
+	}
+
+	// Only local sizes that every device supports are swept. The split is aligned to the largest of them so each
+	// partition's row count stays divisible by every local size in the sweep.
+	localSizes := []int{1, 2, 4, 8, 16, 32, 64, 128, 256, 512, 1024}
+	var usable []int
+	for _, localSize := range localSizes {
+		ok := true
+		for i, sess := range sched.Sessions {
+			wiSizes := sess.Device.MaxWorkItemSizes()
+			wgSize, err := kernels[i].WorkGroupSize(sess.Device)
+			if err != nil {
+				return fmt.Errorf("%s: get work group size: %w", sess, err)
+			}
+			if localSize*localSize > wgSize || localSize > wiSizes[0] || localSize > wiSizes[1] {
+				ok = false
+			}
+		}
+		if ok && elems%localSize == 0 {
+			usable = append(usable, localSize)
+		}
+	}
+	if len(usable) == 0 {
+		return fmt.Errorf("no local size is supported by all devices")
+	}
+	parts, err := sched.Split([]int{elems, elems}, usable[len(usable)-1])
+	if err != nil {
+		return err
+	}
+	sched.printPartitions(parts)
+
+	// Allocate and fill the buffers for each partition once, the sweep below only times the kernels.
+	inputs := make([]*cl.MemObject, len(parts))
+	outputs := make([]*cl.MemObject, len(parts))
+	for i, part := range parts {
+		sess := sched.Sessions[part.Device]
+		offset, count := part.Elems()
+		if inputs[i], err = sess.Context.CreateEmptyBuffer(cl.MemReadOnly, 4*count); err != nil {
+			return fmt.Errorf("%s: create input buffer: %w", sess, err)
+		}
+		defer inputs[i].Release()
+		if outputs[i], err = sess.Context.CreateEmptyBuffer(cl.MemWriteOnly, 4*count); err != nil {
+			return fmt.Errorf("%s: create output buffer: %w", sess, err)
+		}
+		defer outputs[i].Release()
+		if err := writeSlice(sess.Queue, inputs[i], numbers[offset:offset+count]); err != nil {
+			return fmt.Errorf("%s: write input: %w", sess, err)
+		}
+	}
+	partIndex := make(map[int]int, len(parts))
+	for i, part := range parts {
+		partIndex[part.Device] = i
+	}
+
+	fmt.Printf("Build options: %s\n", describeBuildOptions(DefaultBuildOptions()))
+	fmt.Println(
+		`| Devices       | Work group size | Local size | Result  |
+| ------------- |:-------------:| -----:| -----:|`)
+	iterations := int64(16)
+	for _, localSize := range usable {
+		run := func(ctx context.Context, sess *Session, part Partition) error {
+			i := partIndex[part.Device]
+			if err := kernels[part.Device].SetArgs(inputs[i], outputs[i]); err != nil {
+				return err
+			}
+			return sess.Run(ctx, kernels[part.Device], part.Global, []int{localSize, localSize})
+		}
+		var sum = int64(0)
+		for it := 0; it < int(iterations); it++ {
+			st := time.Now()
+			if err := sched.Run(ctx, parts, run); err != nil {
+				return err
+			}
+			sum += time.Since(st).Microseconds()
+		}
+		fmt.Printf("| %v   | %d | %d | %v |\n", deviceIndexes, elemCount, localSize, (time.Microsecond * time.Duration(sum/iterations)).String())
+	}
+
+	// Gather the results back in order and spot check them.
+	err = sched.Run(ctx, parts, func(ctx context.Context, sess *Session, part Partition) error {
+		offset, count := part.Elems()
+		return readSlice(sess.Queue, outputs[partIndex[part.Device]], results[offset:offset+count])
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%v\n", results[len(numbers)-1])
+	return nil
+}
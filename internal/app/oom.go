@@ -0,0 +1,271 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jgillich/go-opencl/cl"
+)
+
+// ErrOutOfDeviceMemory is matched by the errors returned for allocations the device can't satisfy, see AllocError.
+var ErrOutOfDeviceMemory = errors.New("out of device memory")
+
+// AllocError reports a device allocation that exceeds the device's max allocation size or that the driver failed,
+// with the sizes involved.
+type AllocError struct {
+	Device string
+	// Bytes is the size of the failed allocation, MaxAlloc and GlobalMem the device's max allocation and global
+	// memory size.
+	Bytes     int64
+	MaxAlloc  int64
+	GlobalMem int64
+	// Err is the driver's error, e.g. cl.ErrMemObjectAllocationFailure, or nil if the allocation was rejected for
+	// exceeding MaxAlloc.
+	Err error
+}
+
+func (e *AllocError) Error() string {
+	reason := "exceeds the max allocation size"
+	if e.Err != nil {
+		reason = e.Err.Error()
+	}
+	return fmt.Sprintf("allocate %d bytes on %s: %s (max allocation %d bytes, global memory %d bytes)", e.Bytes,
+		e.Device, reason, e.MaxAlloc, e.GlobalMem)
+}
+
+// Is makes errors.Is(err, ErrOutOfDeviceMemory) true for every AllocError.
+func (e *AllocError) Is(target error) bool {
+	return target == ErrOutOfDeviceMemory
+}
+
+func (e *AllocError) Unwrap() error {
+	return e.Err
+}
+
+// isAllocFailure reports whether err is a driver error for running out of memory. Drivers may allocate lazily, so
+// besides buffer creation any transfer or kernel launch can fail that way, though for launches
+// CL_OUT_OF_RESOURCES may have other causes, see fitChunk.
+func isAllocFailure(err error) bool {
+	return errors.Is(err, cl.ErrMemObjectAllocationFailure) || errors.Is(err, cl.ErrOutOfResources) ||
+		errors.Is(err, cl.ErrInvalidBufferSize)
+}
+
+// allocFailure returns an *AllocError for an allocation of bytes on device that failed with err if err is a driver
+// error for running out of memory, and err otherwise.
+func allocFailure(device *cl.Device, bytes int64, err error) error {
+	if err == nil || !isAllocFailure(err) {
+		return err
+	}
+	return &AllocError{Device: device.Name(), Bytes: bytes, MaxAlloc: device.MaxMemAllocSize(),
+		GlobalMem: device.GlobalMemSize(), Err: err}
+}
+
+// createBuffer creates a buffer of bytes in context for device, rejecting sizes above the device's max allocation
+// size up front instead of leaving them to the driver. Allocation failures are returned as *AllocError.
+func createBuffer(context *cl.Context, device *cl.Device, flags cl.MemFlag, bytes int) (*cl.MemObject, error) {
+	if int64(bytes) > device.MaxMemAllocSize() {
+		return nil, &AllocError{Device: device.Name(), Bytes: int64(bytes), MaxAlloc: device.MaxMemAllocSize(),
+			GlobalMem: device.GlobalMemSize()}
+	}
+	mem, err := context.CreateEmptyBuffer(flags, bytes)
+	if err != nil {
+		return nil, fmt.Errorf("create buffer of %d bytes: %w", bytes, allocFailure(device, int64(bytes), err))
+	}
+	return mem, nil
+}
+
+// minChunk is the smallest chunk ElementwiseSlices falls back to, in elements.
+const minChunk = 64 * 1024
+
+// ElementwiseSlices runs the element-wise kernel called kernel of the registered spec over the host slices ins,
+// writing outs. The kernel takes a buffer per input, then one per output, then the element count as a uint, like
+// the square template and the kernels Map generates. If the slices don't fit on the device at once, because a
+// buffer would exceed the max allocation size or the driver runs out of memory, they are transparently processed in
+// chunks that fit, halving the chunk size until they do.
+func ElementwiseSlices[T any](ctx context.Context, sess *Session, spec, kernel string, ins, outs [][]T) error {
+	_, err := elementwiseSlices(ctx, sess, spec, kernel, ins, outs)
+	return err
+}
+
+// elementwiseSlices is ElementwiseSlices, also returning the chunk size it succeeded with.
+func elementwiseSlices[T any](ctx context.Context, sess *Session, spec, kernel string, ins, outs [][]T) (int, error) {
+	if len(ins) == 0 || len(outs) == 0 {
+		return 0, fmt.Errorf("an element-wise kernel needs at least one input and one output")
+	}
+	n := len(ins[0])
+	for _, s := range append(append([][]T{}, ins...), outs...) {
+		if len(s) != n {
+			return 0, fmt.Errorf("slice lengths differ: %d and %d", n, len(s))
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+
+	// Start with the largest chunk the device could hold: no buffer above the max allocation size, and all of them
+	// within global memory.
+	chunk := n
+	size := int64(elemSize[T]())
+	if max := int(sess.Device.MaxMemAllocSize() / size); chunk > max {
+		chunk = max
+	}
+	if max := int(sess.Device.GlobalMemSize() / (size * int64(len(ins)+len(outs)))); chunk > max {
+		chunk = max
+	}
+	return fitChunk(chunk, func(chunk int) error {
+		return elementwiseChunks(ctx, sess, spec, kernel, ins, outs, chunk)
+	})
+}
+
+// launchError is a kernel launch of elementwiseChunks that failed with err.
+type launchError struct {
+	err error
+}
+
+func (e *launchError) Error() string {
+	return e.err.Error()
+}
+
+func (e *launchError) Unwrap() error {
+	return e.err
+}
+
+// fitChunk calls run with chunk, halving it while run fails for lack of device memory, down to minChunk, and
+// returns the chunk size of the last call.
+//
+// A launch failing with CL_OUT_OF_RESOURCES only may mean running out of memory: the kernel can also need more
+// registers or local memory than the device has, which no chunk size fixes. Such a launch failure is retried with
+// half the chunk, and if that fails the same way, or the chunk can't be halved, the driver's error is returned
+// rather than an AllocError.
+func fitChunk(chunk int, run func(chunk int) error) (int, error) {
+	var launchErr error
+	for {
+		err := run(chunk)
+		var launch *launchError
+		if errors.As(err, &launch) {
+			err = launch.err
+			var alloc *AllocError
+			if errors.As(err, &alloc) && !errors.Is(alloc.Err, cl.ErrMemObjectAllocationFailure) {
+				if chunk <= minChunk || (launchErr != nil && errors.Is(alloc.Err, launchErr)) {
+					return chunk, fmt.Errorf("launch with a chunk of %d elements: %w", chunk, alloc.Err)
+				}
+				launchErr = alloc.Err
+			}
+		}
+		if err == nil || !errors.Is(err, ErrOutOfDeviceMemory) || chunk <= minChunk {
+			return chunk, err
+		}
+		chunk /= 2
+	}
+}
+
+// elementwiseChunks runs kernel over ins and outs chunk elements at a time, through a buffer per slice.
+func elementwiseChunks[T any](ctx context.Context, sess *Session, spec, kernel string, ins, outs [][]T, chunk int) error {
+	var buffers []*Buffer[T]
+	defer func() {
+		for _, buf := range buffers {
+			buf.Release()
+		}
+	}()
+	for range append(append([][]T{}, ins...), outs...) {
+		buf, err := NewBuffer[T](sess, cl.MemReadWrite, chunk)
+		if err != nil {
+			return err
+		}
+		buffers = append(buffers, buf)
+	}
+	inBufs, outBufs := buffers[:len(ins)], buffers[len(ins):]
+	// Lazily allocating drivers report running out of memory on first use, which counts all buffers.
+	total := int64(len(buffers) * chunk * elemSize[T]())
+
+	n := len(ins[0])
+	for off := 0; off < n; off += chunk {
+		m := chunk
+		if off+m > n {
+			m = n - off
+		}
+		args := make([]interface{}, 0, len(buffers)+1)
+		for i, buf := range inBufs {
+			if err := buf.Write(ctx, ins[i][off:off+m]); err != nil {
+				return allocFailure(sess.Device, total, err)
+			}
+			args = append(args, buf)
+		}
+		for _, buf := range outBufs {
+			args = append(args, buf)
+		}
+		args = append(args, uint32(m))
+		if err := runElementwise(ctx, sess, spec, kernel, m, args...); err != nil {
+			return &launchError{err: allocFailure(sess.Device, total, err)}
+		}
+		for i, buf := range outBufs {
+			if err := buf.Read(ctx, outs[i][off:off+m]); err != nil {
+				return allocFailure(sess.Device, total, err)
+			}
+		}
+	}
+	return nil
+}
+
+// SquareSlice squares every element of in into out on the device, in chunks if they don't fit at once.
+func SquareSlice[T Numeric](ctx context.Context, sess *Session, in, out []T) error {
+	spec, err := Instantiate[T]("square")
+	if err != nil {
+		return err
+	}
+	return ElementwiseSlices(ctx, sess, spec, "square", [][]T{in}, [][]T{out})
+}
+
+// OOMDemo shows how allocations the device can't satisfy are reported: it asks for a float buffer just above the
+// device's max allocation size, then squares a slice of that size with SquareSlice, which falls back to chunks.
+// The second part is skipped if the slices would need more than 4G of host memory.
+func OOMDemo(ctx context.Context, deviceIndex int) error {
+	devices, err := getDevices()
+	if err != nil {
+		return err
+	}
+	sess, err := NewSession(devices, deviceIndex)
+	if err != nil {
+		return err
+	}
+	defer sess.Release()
+	fmt.Println(sess)
+	maxAlloc := sess.Device.MaxMemAllocSize()
+	fmt.Printf("Max allocation: %d bytes, global memory: %d bytes\n", maxAlloc, sess.Device.GlobalMemSize())
+
+	n := int(maxAlloc/4) + 1<<20
+	buf, err := NewBuffer[float32](sess, cl.MemReadWrite, n)
+	if err == nil {
+		buf.Release()
+		return fmt.Errorf("allocating %d bytes unexpectedly succeeded", 4*n)
+	}
+	if !errors.Is(err, ErrOutOfDeviceMemory) {
+		return err
+	}
+	fmt.Printf("NewBuffer: %v\n", err)
+
+	if hostBytes := int64(2 * 4 * n); hostBytes > 4<<30 {
+		fmt.Printf("SquareSlice: skipped, %d elements need %d bytes of host memory\n", n, hostBytes)
+		return nil
+	}
+	in := make([]float32, n)
+	for i := range in {
+		in[i] = float32(i % 1024)
+	}
+	out := make([]float32, n)
+	spec, err := Instantiate[float32]("square")
+	if err != nil {
+		return err
+	}
+	chunk, err := elementwiseSlices(ctx, sess, spec, "square", [][]float32{in}, [][]float32{out})
+	if err != nil {
+		return err
+	}
+	for i, v := range in {
+		if out[i] != v*v {
+			return fmt.Errorf("element %d is %v, expected %v", i, out[i], v*v)
+		}
+	}
+	fmt.Printf("SquareSlice: %d elements OK in chunks of %d\n", n, chunk)
+	return nil
+}
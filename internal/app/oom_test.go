@@ -0,0 +1,79 @@
+package app
+
+import (
+	"errors"
+	"github.com/jgillich/go-opencl/cl"
+	"reflect"
+	"testing"
+)
+
+func TestFitChunk(t *testing.T) {
+	oom := func(err error) error {
+		return &AllocError{Device: "ref", Err: err}
+	}
+	errKernel := errors.New("invalid kernel args")
+	// fail returns a run that fails with err at every chunk above fits, recording the chunks it's called with.
+	fail := func(fits int, err error, calls *[]int) func(int) error {
+		return func(chunk int) error {
+			*calls = append(*calls, chunk)
+			if chunk > fits {
+				return err
+			}
+			return nil
+		}
+	}
+	tests := []struct {
+		name      string
+		chunk     int
+		fits      int
+		err       error
+		wantCalls []int
+		wantOOM   bool
+		wantErr   error
+	}{
+		{name: "fits", chunk: 1 << 20, fits: 1 << 20, wantCalls: []int{1 << 20}},
+		{name: "create fails until it fits", chunk: 1 << 20, fits: 1 << 18, err: oom(cl.ErrOutOfResources),
+			wantCalls: []int{1 << 20, 1 << 19, 1 << 18}},
+		{name: "create fails down to minChunk", chunk: 4 * minChunk, fits: 0, err: oom(cl.ErrOutOfResources),
+			wantCalls: []int{4 * minChunk, 2 * minChunk, minChunk}, wantOOM: true},
+		{name: "other errors are returned", chunk: 1 << 20, fits: 0, err: errKernel, wantCalls: []int{1 << 20},
+			wantErr: errKernel},
+		{name: "launch fits at half", chunk: 1 << 20, fits: 1 << 19,
+			err: &launchError{err: oom(cl.ErrOutOfResources)}, wantCalls: []int{1 << 20, 1 << 19}},
+		{name: "launch fails the same way at half", chunk: 1 << 20, fits: 0,
+			err: &launchError{err: oom(cl.ErrOutOfResources)}, wantCalls: []int{1 << 20, 1 << 19},
+			wantErr: cl.ErrOutOfResources},
+		{name: "launch can't halve", chunk: minChunk, fits: 0, err: &launchError{err: oom(cl.ErrOutOfResources)},
+			wantCalls: []int{minChunk}, wantErr: cl.ErrOutOfResources},
+		{name: "launch allocation failures keep halving", chunk: 4 * minChunk, fits: 0,
+			err:       &launchError{err: oom(cl.ErrMemObjectAllocationFailure)},
+			wantCalls: []int{4 * minChunk, 2 * minChunk, minChunk}, wantOOM: true},
+		{name: "launch errors that aren't OOM", chunk: 1 << 20, fits: 0, err: &launchError{err: errKernel},
+			wantCalls: []int{1 << 20}, wantErr: errKernel},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls []int
+			chunk, err := fitChunk(tt.chunk, fail(tt.fits, tt.err, &calls))
+			if !reflect.DeepEqual(calls, tt.wantCalls) {
+				t.Errorf("calls = %v, want %v", calls, tt.wantCalls)
+			}
+			if chunk != calls[len(calls)-1] {
+				t.Errorf("chunk = %d, want the last call's %d", chunk, calls[len(calls)-1])
+			}
+			if got := errors.Is(err, ErrOutOfDeviceMemory); got != tt.wantOOM {
+				t.Errorf("errors.Is(%v, ErrOutOfDeviceMemory) = %v, want %v", err, got, tt.wantOOM)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && !tt.wantOOM && err != nil {
+				t.Errorf("err = %v, want nil", err)
+			}
+			var launch *launchError
+			if errors.As(err, &launch) {
+				t.Errorf("err = %v leaks a launchError", err)
+			}
+		})
+	}
+}
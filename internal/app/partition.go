@@ -0,0 +1,88 @@
+package app
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Partition is the part of a problem assigned to one device. Problems are always split along their last
+// dimension, i.e. by element for 1D problems and by row for 2D problems (get_global_id(1) is the row).
+type Partition struct {
+	Device int   // index of the worker the partition is assigned to
+	Offset int   // first element (1D) or row (2D) of the partition
+	Count  int   // number of elements (1D) or rows (2D) in the partition
+	Global []int // global work size to enqueue for this partition
+}
+
+// Elems returns the partition's offset and length as flat element counts, which is what buffer slicing needs.
+func (p Partition) Elems() (offset, count int) {
+	rowSize := 1
+	for _, d := range p.Global[:len(p.Global)-1] {
+		rowSize *= d
+	}
+	return p.Offset * rowSize, p.Count * rowSize
+}
+
+// SplitWeighted splits a 1D or 2D problem of size dims into one partition per weight, proportional to the weights.
+// Every partition is a multiple of align along the split dimension so that any local size dividing align still
+// divides each partition's global size. Workers that end up with nothing to do are left out of the result.
+func SplitWeighted(dims []int, weights []float64, align int) ([]Partition, error) {
+	if len(dims) != 1 && len(dims) != 2 {
+		return nil, fmt.Errorf("only 1D and 2D problems can be split, got %d dimensions", len(dims))
+	}
+	if align < 1 {
+		align = 1
+	}
+	total := dims[len(dims)-1]
+	if total%align != 0 {
+		return nil, fmt.Errorf("problem size %d is not a multiple of alignment %d", total, align)
+	}
+	weightSum := 0.0
+	for i, w := range weights {
+		if w < 0 || math.IsNaN(w) || math.IsInf(w, 0) {
+			return nil, fmt.Errorf("invalid weight %v for worker %d", w, i)
+		}
+		weightSum += w
+	}
+	if weightSum == 0 {
+		return nil, fmt.Errorf("at least one worker needs a positive weight")
+	}
+
+	// Hand out whole blocks of align units using the largest remainder method, so the counts always add up to
+	// the problem size and no worker is more than one block away from its exact share.
+	blocks := total / align
+	counts := make([]int, len(weights))
+	remainders := make([]float64, len(weights))
+	assigned := 0
+	for i, w := range weights {
+		exact := float64(blocks) * w / weightSum
+		counts[i] = int(exact)
+		remainders[i] = exact - float64(counts[i])
+		assigned += counts[i]
+	}
+	order := make([]int, 0, len(weights))
+	for i, w := range weights {
+		if w > 0 {
+			order = append(order, i)
+		}
+	}
+	sort.SliceStable(order, func(a, b int) bool { return remainders[order[a]] > remainders[order[b]] })
+	for i := 0; assigned < blocks; i++ {
+		counts[order[i%len(order)]]++
+		assigned++
+	}
+
+	parts := make([]Partition, 0, len(weights))
+	offset := 0
+	for i, c := range counts {
+		if c == 0 {
+			continue
+		}
+		global := append([]int{}, dims...)
+		global[len(global)-1] = c * align
+		parts = append(parts, Partition{Device: i, Offset: offset, Count: c * align, Global: global})
+		offset += c * align
+	}
+	return parts, nil
+}
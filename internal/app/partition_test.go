@@ -0,0 +1,167 @@
+package app
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestSplitWeighted(t *testing.T) {
+	tests := []struct {
+		name    string
+		dims    []int
+		weights []float64
+		align   int
+		want    []Partition
+		wantErr bool
+	}{
+		{
+			name:    "equal",
+			dims:    []int{10},
+			weights: []float64{1, 1},
+			want: []Partition{
+				{Device: 0, Offset: 0, Count: 5, Global: []int{5}},
+				{Device: 1, Offset: 5, Count: 5, Global: []int{5}},
+			},
+		},
+		{
+			name:    "proportional",
+			dims:    []int{12},
+			weights: []float64{1, 3},
+			want: []Partition{
+				{Device: 0, Offset: 0, Count: 3, Global: []int{3}},
+				{Device: 1, Offset: 3, Count: 9, Global: []int{9}},
+			},
+		},
+		{
+			// 10/3 each, the remainder goes to the first of the equal remainders.
+			name:    "largest remainder",
+			dims:    []int{10},
+			weights: []float64{1, 1, 1},
+			want: []Partition{
+				{Device: 0, Offset: 0, Count: 4, Global: []int{4}},
+				{Device: 1, Offset: 4, Count: 3, Global: []int{3}},
+				{Device: 2, Offset: 7, Count: 3, Global: []int{3}},
+			},
+		},
+		{
+			// Exact shares 1.4, 2.8 and 5.6 round down to 1, 2 and 5, the remaining two go to the largest remainders.
+			name:    "remainders by size",
+			dims:    []int{10},
+			weights: []float64{1, 2, 4},
+			want: []Partition{
+				{Device: 0, Offset: 0, Count: 1, Global: []int{1}},
+				{Device: 1, Offset: 1, Count: 3, Global: []int{3}},
+				{Device: 2, Offset: 4, Count: 6, Global: []int{6}},
+			},
+		},
+		{
+			name:    "zero weight left out",
+			dims:    []int{8},
+			weights: []float64{1, 0, 1},
+			want: []Partition{
+				{Device: 0, Offset: 0, Count: 4, Global: []int{4}},
+				{Device: 2, Offset: 4, Count: 4, Global: []int{4}},
+			},
+		},
+		{
+			name:    "more devices than items",
+			dims:    []int{3},
+			weights: []float64{1, 1, 1, 1, 1},
+			want: []Partition{
+				{Device: 0, Offset: 0, Count: 1, Global: []int{1}},
+				{Device: 1, Offset: 1, Count: 1, Global: []int{1}},
+				{Device: 2, Offset: 2, Count: 1, Global: []int{1}},
+			},
+		},
+		{
+			name:    "aligned",
+			dims:    []int{64},
+			weights: []float64{1, 2},
+			align:   16,
+			want: []Partition{
+				{Device: 0, Offset: 0, Count: 16, Global: []int{16}},
+				{Device: 1, Offset: 16, Count: 48, Global: []int{48}},
+			},
+		},
+		{
+			name:    "2D splits rows",
+			dims:    []int{32, 8},
+			weights: []float64{3, 1},
+			align:   2,
+			want: []Partition{
+				{Device: 0, Offset: 0, Count: 6, Global: []int{32, 6}},
+				{Device: 1, Offset: 6, Count: 2, Global: []int{32, 2}},
+			},
+		},
+		{name: "empty problem", dims: []int{0}, weights: []float64{1, 1}, want: []Partition{}},
+		{name: "negative weight", dims: []int{10}, weights: []float64{1, -1}, wantErr: true},
+		{name: "NaN weight", dims: []int{10}, weights: []float64{1, math.NaN()}, wantErr: true},
+		{name: "infinite weight", dims: []int{10}, weights: []float64{math.Inf(1)}, wantErr: true},
+		{name: "all zero", dims: []int{10}, weights: []float64{0, 0}, wantErr: true},
+		{name: "no workers", dims: []int{10}, weights: nil, wantErr: true},
+		{name: "not aligned", dims: []int{10}, weights: []float64{1}, align: 4, wantErr: true},
+		{name: "3D", dims: []int{2, 2, 2}, weights: []float64{1}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := SplitWeighted(tt.dims, tt.weights, tt.align)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %v, expected an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, expected %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestSplitWeightedShares checks the invariants of the largest remainder method over many weightings: the
+// partitions are contiguous, cover the problem, are aligned and are less than one block away from their exact share.
+func TestSplitWeightedShares(t *testing.T) {
+	for _, weights := range [][]float64{{1}, {1, 2}, {0.1, 0.7, 0.2}, {5, 0, 3, 1}, {1e-9, 1}, {3, 3, 3, 3, 3, 3, 3}} {
+		for _, align := range []int{1, 4, 32} {
+			for _, total := range []int{0, 32, 96, 1024, 4000} {
+				if total%align != 0 {
+					continue
+				}
+				parts, err := SplitWeighted([]int{total}, weights, align)
+				if err != nil {
+					t.Fatalf("%v, align %d, total %d: %v", weights, align, total, err)
+				}
+				sum := 0.0
+				for _, w := range weights {
+					sum += w
+				}
+				offset := 0
+				for _, p := range parts {
+					if p.Offset != offset || p.Count <= 0 || p.Count%align != 0 {
+						t.Fatalf("%v, align %d, total %d: bad partition %+v after offset %d", weights, align, total, p, offset)
+					}
+					exact := float64(total) * weights[p.Device] / sum
+					if math.Abs(float64(p.Count)-exact) >= float64(align) {
+						t.Errorf("%v, align %d, total %d: device %d got %d, exact share %g", weights, align, total,
+							p.Device, p.Count, exact)
+					}
+					offset += p.Count
+				}
+				if offset != total {
+					t.Errorf("%v, align %d, total %d: partitions cover %d", weights, align, total, offset)
+				}
+			}
+		}
+	}
+}
+
+func TestPartitionElems(t *testing.T) {
+	p := Partition{Device: 1, Offset: 6, Count: 2, Global: []int{32, 2}}
+	if offset, count := p.Elems(); offset != 6*32 || count != 2*32 {
+		t.Errorf("got offset %d, count %d, expected %d, %d", offset, count, 6*32, 2*32)
+	}
+}
@@ -0,0 +1,481 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/eriklupander/ocltest/internal/benchreport"
+	"github.com/jgillich/go-opencl/cl"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// poolSlabSize is the size of the buffers small size classes are carved from.
+	poolSlabSize = 4 << 20
+	// poolMaxCarved is the largest size class carved from slabs. Larger classes get buffers of their own.
+	poolMaxCarved = poolSlabSize / 8
+)
+
+// ErrPoolLimit is returned when an allocation would take a MemPool over its limit.
+var ErrPoolLimit = errors.New("memory pool limit reached")
+
+// PoolStats are the counters of a MemPool. Sizes are in bytes.
+type PoolStats struct {
+	Allocs int // buffers handed out
+	Frees  int // buffers returned
+	Hits   int // allocations served from returned buffers
+	// DeviceAllocs counts the buffers created on the device, including slabs, and SubBuffers those carved from
+	// slabs.
+	DeviceAllocs int
+	SubBuffers   int
+	// InUse is the size of the buffers handed out, rounded up to their size class, and Requested what was asked for.
+	InUse     int64
+	Requested int64
+	// Reserved is the device memory the pool holds, HighWater the most it ever held and Limit the most it may hold.
+	Reserved  int64
+	HighWater int64
+	Limit     int64
+}
+
+func (s PoolStats) String() string {
+	return fmt.Sprintf("%d allocs (%d from the pool), %d frees, %d device buffers, %d sub-buffers, %s in use (%s requested), %s reserved, high water %s of %s",
+		s.Allocs, s.Hits, s.Frees, s.DeviceAllocs, s.SubBuffers, benchreport.FormatSize(s.InUse, "B"),
+		benchreport.FormatSize(s.Requested, "B"), benchreport.FormatSize(s.Reserved, "B"),
+		benchreport.FormatSize(s.HighWater, "B"), benchreport.FormatSize(s.Limit, "B"))
+}
+
+// poolEntry is the pool's record of a buffer it created.
+type poolEntry struct {
+	class     int64
+	requested int64
+	carved    bool
+	live      bool
+	// gen counts how often the buffer was handed out, so releasing a stale Buffer after the memory was handed out
+	// again is caught as a double release instead of freeing someone else's buffer.
+	gen uint64
+}
+
+// poolSlab is a buffer that chunks of one size class are carved from. next is the offset of the next chunk.
+type poolSlab struct {
+	mem        *cl.MemObject
+	size, next int64
+}
+
+// poolMemory is the device memory a MemPool hands out. sessionMemory creates it on a session's device, the tests
+// use a host reference that only tracks the buffers.
+type poolMemory interface {
+	// device returns the device's name, max allocation size and global memory size.
+	device() (name string, maxAlloc, globalMem int64)
+	// baseAddrAlign is the alignment of sub-buffer offsets in bytes.
+	baseAddrAlign() int64
+	createBuffer(size int64) (*cl.MemObject, error)
+	// createSubBuffer returns cl.ErrUnsupported if the device has no sub-buffers.
+	createSubBuffer(parent *cl.MemObject, offset, size int64) (*cl.MemObject, error)
+	release(mem *cl.MemObject)
+}
+
+// sessionMemory is the poolMemory of a session.
+type sessionMemory struct {
+	sess *Session
+}
+
+func (m sessionMemory) device() (string, int64, int64) {
+	return m.sess.Device.Name(), m.sess.Device.MaxMemAllocSize(), m.sess.Device.GlobalMemSize()
+}
+
+// baseAddrAlign converts the alignment the device reports in bits to bytes.
+func (m sessionMemory) baseAddrAlign() int64 {
+	return int64(m.sess.Device.MemBaseAddrAlign() / 8)
+}
+
+func (m sessionMemory) createBuffer(size int64) (*cl.MemObject, error) {
+	return createBuffer(m.sess.Context, m.sess.Device, cl.MemReadWrite, int(size))
+}
+
+func (m sessionMemory) createSubBuffer(parent *cl.MemObject, offset, size int64) (*cl.MemObject, error) {
+	return createSubBuffer(parent, cl.MemReadWrite, int(offset), int(size))
+}
+
+func (m sessionMemory) release(mem *cl.MemObject) {
+	mem.Release()
+}
+
+// MemPool recycles the device memory of a session, so code allocating buffers on every call doesn't create and
+// release OpenCL buffers every time. Requests are rounded up to power of two size classes. Classes up to 512K are
+// carved as sub-buffers from 4M slabs, larger ones get buffers of their own, and released buffers are kept for the
+// next request of their class. The pool never holds more device memory than its limit, the device's global memory
+// size by default, and no request may exceed the device's max allocation size.
+//
+// Buffers from NewPoolBuffer go back to the pool with Release. The pool counts what it does, see Stats, and
+// records releases of buffers that were released already. Check reports those and leaked buffers.
+type MemPool struct {
+	sess     *Session
+	mem      poolMemory
+	maxAlloc int64
+	minClass int64
+
+	mu      sync.Mutex
+	limit   int64
+	entries map[*cl.MemObject]*poolEntry
+	free    map[int64][]*cl.MemObject
+	slabs   map[int64]*poolSlab
+	// slabMems holds every slab, which are only released with the pool.
+	slabMems []*cl.MemObject
+	// noSubBuffers is set once the device turned out not to support sub-buffers, after which small classes get
+	// buffers of their own too.
+	noSubBuffers bool
+	stats        PoolStats
+	problems     []string
+}
+
+// NewMemPool returns an empty pool for the session's context.
+func NewMemPool(sess *Session) *MemPool {
+	return newMemPool(sess, sessionMemory{sess: sess})
+}
+
+// newMemPool returns an empty pool handing out mem for sess.
+func newMemPool(sess *Session, mem poolMemory) *MemPool {
+	// Sub-buffers must start at a multiple of the base address alignment. Size classes are powers of two of at
+	// least that size, so chunks of a slab are always aligned.
+	minClass := int64(256)
+	if align := mem.baseAddrAlign(); align > minClass {
+		minClass = int64(nextPowOf2(int(align)))
+	}
+	_, maxAlloc, globalMem := mem.device()
+	p := &MemPool{
+		sess:     sess,
+		mem:      mem,
+		maxAlloc: maxAlloc,
+		minClass: minClass,
+		limit:    globalMem,
+		entries:  map[*cl.MemObject]*poolEntry{},
+		free:     map[int64][]*cl.MemObject{},
+		slabs:    map[int64]*poolSlab{},
+	}
+	p.stats.Limit = p.limit
+	return p
+}
+
+// SetLimit caps the device memory the pool holds at once. It can't be raised above the device's global memory size.
+func (p *MemPool) SetLimit(bytes int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, _, global := p.mem.device(); bytes > global {
+		bytes = global
+	}
+	p.limit = bytes
+	p.stats.Limit = bytes
+}
+
+// Stats returns the pool's counters.
+func (p *MemPool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stats
+}
+
+// NewPoolBuffer is NewBuffer for memory from p. Pooled buffers are always read-write, since the memory is reused
+// for whatever is requested next. Release returns the buffer to the pool.
+func NewPoolBuffer[T any](p *MemPool, n int) (*Buffer[T], error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("buffer length must be positive, got %d", n)
+	}
+	mem, gen, err := p.get(int64(n * elemSize[T]()))
+	if err != nil {
+		return nil, err
+	}
+	return &Buffer[T]{Mem: mem, Len: n, sess: p.sess, pool: p, poolGen: gen}, nil
+}
+
+// classFor returns the size class serving requests of size bytes. Classes that would exceed the max allocation size
+// are served with buffers of the exact size.
+func (p *MemPool) classFor(bytes int64) int64 {
+	class := p.minClass
+	for class < bytes {
+		class *= 2
+	}
+	if class > p.maxAlloc {
+		return bytes
+	}
+	return class
+}
+
+// get hands out a buffer of at least size bytes and the generation to release it with.
+func (p *MemPool) get(size int64) (*cl.MemObject, uint64, error) {
+	if size > p.maxAlloc {
+		name, maxAlloc, globalMem := p.mem.device()
+		return nil, 0, &AllocError{Device: name, Bytes: size, MaxAlloc: maxAlloc, GlobalMem: globalMem}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	class := p.classFor(size)
+	var mem *cl.MemObject
+	if free := p.free[class]; len(free) > 0 {
+		mem = free[len(free)-1]
+		p.free[class] = free[:len(free)-1]
+		p.stats.Hits++
+	} else {
+		var err error
+		if class <= poolMaxCarved && !p.noSubBuffers {
+			if mem, err = p.carve(class); err != nil {
+				return nil, 0, err
+			}
+		}
+		if mem == nil {
+			if mem, err = p.allocate(class); err != nil {
+				return nil, 0, err
+			}
+			p.entries[mem] = &poolEntry{class: class}
+		}
+	}
+
+	e := p.entries[mem]
+	e.live = true
+	e.requested = size
+	e.gen++
+	p.stats.Allocs++
+	p.stats.InUse += class
+	p.stats.Requested += size
+	return mem, e.gen, nil
+}
+
+// carve returns a new chunk of class bytes from the class's slab, starting a slab if there is none or it is used
+// up. It returns nil without an error if the device doesn't support sub-buffers.
+func (p *MemPool) carve(class int64) (*cl.MemObject, error) {
+	slab := p.slabs[class]
+	if slab == nil || slab.next+class > slab.size {
+		size := int64(poolSlabSize)
+		if size > p.maxAlloc {
+			size = p.maxAlloc / class * class
+		}
+		mem, err := p.allocate(size)
+		if err != nil {
+			return nil, err
+		}
+		p.slabMems = append(p.slabMems, mem)
+		slab = &poolSlab{mem: mem, size: size}
+		p.slabs[class] = slab
+	}
+	mem, err := p.mem.createSubBuffer(slab.mem, slab.next, class)
+	if errors.Is(err, cl.ErrUnsupported) {
+		p.noSubBuffers = true
+		if slab.next == 0 {
+			// Nothing was carved from the slab, so it is of no use.
+			p.mem.release(slab.mem)
+			p.slabMems = p.slabMems[:len(p.slabMems)-1]
+			delete(p.slabs, class)
+			p.stats.DeviceAllocs--
+			p.stats.Reserved -= slab.size
+		}
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("create sub-buffer of %d bytes at offset %d: %w", class, slab.next, err)
+	}
+	slab.next += class
+	p.entries[mem] = &poolEntry{class: class, carved: true}
+	p.stats.SubBuffers++
+	return mem, nil
+}
+
+// allocate creates a device buffer of size bytes, first releasing returned buffers if it would take the pool over
+// its limit.
+func (p *MemPool) allocate(size int64) (*cl.MemObject, error) {
+	if p.stats.Reserved+size > p.limit {
+		p.trim(p.stats.Reserved + size - p.limit)
+	}
+	if p.stats.Reserved+size > p.limit {
+		return nil, fmt.Errorf("allocate %d bytes with %d of %d bytes reserved: %w", size, p.stats.Reserved, p.limit, ErrPoolLimit)
+	}
+	mem, err := p.mem.createBuffer(size)
+	if err != nil {
+		return nil, err
+	}
+	p.stats.DeviceAllocs++
+	p.stats.Reserved += size
+	if p.stats.Reserved > p.stats.HighWater {
+		p.stats.HighWater = p.stats.Reserved
+	}
+	return mem, nil
+}
+
+// trim releases returned buffers of their own, largest first, until at least bytes are freed or none are left.
+// Carved chunks stay, since their slab is only freed with the pool.
+func (p *MemPool) trim(bytes int64) {
+	classes := make([]int64, 0, len(p.free))
+	for class := range p.free {
+		classes = append(classes, class)
+	}
+	sort.Slice(classes, func(i, j int) bool { return classes[i] > classes[j] })
+	for _, class := range classes {
+		var keep []*cl.MemObject
+		for _, mem := range p.free[class] {
+			if bytes <= 0 || p.entries[mem].carved {
+				keep = append(keep, mem)
+				continue
+			}
+			p.mem.release(mem)
+			delete(p.entries, mem)
+			p.stats.Reserved -= class
+			bytes -= class
+		}
+		p.free[class] = keep
+	}
+}
+
+// put takes back a buffer released with Buffer.Release.
+func (p *MemPool) put(mem *cl.MemObject, gen uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e, ok := p.entries[mem]
+	if !ok || !e.live || e.gen != gen {
+		size := int64(0)
+		if ok {
+			size = e.requested
+		}
+		p.problems = append(p.problems, fmt.Sprintf("double release of a %d byte buffer", size))
+		return
+	}
+	e.live = false
+	p.stats.Frees++
+	p.stats.InUse -= e.class
+	p.stats.Requested -= e.requested
+	p.free[e.class] = append(p.free[e.class], mem)
+}
+
+// Check returns an error describing every buffer released twice so far and every buffer not released yet, or nil
+// if there are none.
+func (p *MemPool) Check() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	problems := append([]string(nil), p.problems...)
+	var leaked []int64
+	for _, e := range p.entries {
+		if e.live {
+			leaked = append(leaked, e.requested)
+		}
+	}
+	sort.Slice(leaked, func(i, j int) bool { return leaked[i] > leaked[j] })
+	for _, size := range leaked {
+		problems = append(problems, fmt.Sprintf("leaked %d byte buffer", size))
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("memory pool: %s", strings.Join(problems, ", "))
+}
+
+// Release frees all device memory of the pool, including buffers still handed out, which must not be used
+// afterwards. It returns the result of Check from before the memory was freed.
+func (p *MemPool) Release() error {
+	err := p.Check()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// Sub-buffers go before the slabs they were carved from.
+	for mem, e := range p.entries {
+		if e.carved {
+			p.mem.release(mem)
+		}
+	}
+	for mem, e := range p.entries {
+		if !e.carved {
+			p.mem.release(mem)
+		}
+	}
+	for _, mem := range p.slabMems {
+		p.mem.release(mem)
+	}
+	p.entries = map[*cl.MemObject]*poolEntry{}
+	p.free = map[int64][]*cl.MemObject{}
+	p.slabs = map[int64]*poolSlab{}
+	p.slabMems = nil
+	p.stats.InUse, p.stats.Requested, p.stats.Reserved = 0, 0, 0
+	return err
+}
+
+// PoolDemo squares 2000 float buffers of random sizes from 1K to 2M elements, like a service handling requests,
+// once creating and releasing the buffers for every request and once taking them from a MemPool, and prints the
+// time per request and the pool's statistics. The pool is checked for leaks and double releases at the end.
+func PoolDemo(ctx context.Context, deviceIndex int) error {
+	devices, err := getDevices()
+	if err != nil {
+		return err
+	}
+	sess, err := NewSession(devices, deviceIndex)
+	if err != nil {
+		return err
+	}
+	defer sess.Release()
+	fmt.Println(sess)
+
+	requests := 2000
+	rng := rand.New(rand.NewSource(1))
+	sizes := make([]int, requests)
+	for i := range sizes {
+		sizes[i] = 1024 << rng.Intn(11)
+		sizes[i] += rng.Intn(sizes[i])
+	}
+	data := make([]float32, 2<<20)
+	for i := range data {
+		data[i] = float32(i % 1024)
+	}
+
+	pool := NewMemPool(sess)
+	runs := []struct {
+		name  string
+		alloc func(n int) (*Buffer[float32], error)
+	}{
+		{"NewBuffer", func(n int) (*Buffer[float32], error) { return NewBuffer[float32](sess, cl.MemReadWrite, n) }},
+		{"MemPool", func(n int) (*Buffer[float32], error) { return NewPoolBuffer[float32](pool, n) }},
+	}
+	for _, r := range runs {
+		st := time.Now()
+		for _, n := range sizes {
+			if err := squareRequest(ctx, sess, r.alloc, data[:n]); err != nil {
+				return fmt.Errorf("%s: %w", r.name, err)
+			}
+		}
+		fmt.Printf("%s: %v per request\n", r.name, time.Since(st)/time.Duration(requests))
+	}
+	fmt.Printf("Pool: %v\n", pool.Stats())
+	if err := pool.Release(); err != nil {
+		return err
+	}
+	fmt.Println("Pool: no leaks or double releases")
+	return nil
+}
+
+// squareRequest handles one request of PoolDemo, squaring data on the device in buffers from alloc.
+func squareRequest(ctx context.Context, sess *Session, alloc func(n int) (*Buffer[float32], error), data []float32) error {
+	in, err := alloc(len(data))
+	if err != nil {
+		return err
+	}
+	defer in.Release()
+	out, err := alloc(len(data))
+	if err != nil {
+		return err
+	}
+	defer out.Release()
+	if err := in.Write(ctx, data); err != nil {
+		return err
+	}
+	if err := SquareBuffer(ctx, sess, in, out); err != nil {
+		return err
+	}
+	result := make([]float32, len(data))
+	if err := out.Read(ctx, result); err != nil {
+		return err
+	}
+	for i, v := range data {
+		if result[i] != v*v {
+			return fmt.Errorf("element %d of %d is %v, expected %v", i, len(data), result[i], v*v)
+		}
+	}
+	return nil
+}
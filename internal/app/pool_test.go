@@ -0,0 +1,252 @@
+package app
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// newRefPool returns a pool on reference memory with a 256M max allocation and 1G of global memory.
+func newRefPool() (*MemPool, *refMemory) {
+	mem := newRefMemory(256<<20, 1<<30)
+	return newMemPool(nil, mem), mem
+}
+
+// checkReleased releases p and checks that it freed all of mem without releasing anything twice.
+func checkReleased(t *testing.T, p *MemPool, mem *refMemory) {
+	t.Helper()
+	p.Release()
+	if len(mem.sizes) != 0 {
+		t.Errorf("%d buffers are still live after Release", len(mem.sizes))
+	}
+	if len(mem.problems) != 0 {
+		t.Errorf("device memory problems: %v", mem.problems)
+	}
+}
+
+func TestPoolReuse(t *testing.T) {
+	p, mem := newRefPool()
+	for _, n := range []int{1000, 300 << 10} { // carved from a slab, and a buffer of its own
+		a, err := NewPoolBuffer[float32](p, n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.Release()
+		b, err := NewPoolBuffer[float32](p, n-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b.Mem != a.Mem {
+			t.Errorf("%d elements: a released buffer of the same class wasn't reused", n)
+		}
+		b.Release()
+	}
+	if err := p.Check(); err != nil {
+		t.Error(err)
+	}
+	s := p.Stats()
+	if s.Allocs != 4 || s.Frees != 4 || s.Hits != 2 || s.SubBuffers != 1 || s.InUse != 0 || s.Requested != 0 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+	// The slab and the large buffer.
+	if s.DeviceAllocs != 2 || s.Reserved != poolSlabSize+2<<20 {
+		t.Errorf("unexpected device allocations in %+v", s)
+	}
+	checkReleased(t, p, mem)
+}
+
+func TestPoolDoubleRelease(t *testing.T) {
+	p, mem := newRefPool()
+	buf, err := NewPoolBuffer[float32](p, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.Release()
+	buf.Release()
+	err = p.Check()
+	if err == nil || !strings.Contains(err.Error(), "double release of a 4096 byte buffer") {
+		t.Fatalf("got %v, expected a double release", err)
+	}
+	if s := p.Stats(); s.Frees != 1 || s.InUse != 0 {
+		t.Errorf("the second release was counted: %+v", s)
+	}
+	if err := p.Release(); err == nil {
+		t.Error("Release didn't report the double release")
+	}
+	if len(mem.sizes) != 0 || len(mem.problems) != 0 {
+		t.Errorf("%d buffers live, problems %v", len(mem.sizes), mem.problems)
+	}
+}
+
+// TestPoolStaleRelease releases a Buffer after its memory was handed out again. The generation check must catch it
+// instead of returning the new owner's memory to the pool.
+func TestPoolStaleRelease(t *testing.T) {
+	p, mem := newRefPool()
+	stale, err := NewPoolBuffer[int32](p, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.Release()
+	owner, err := NewPoolBuffer[int32](p, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner.Mem != stale.Mem {
+		t.Fatal("the memory wasn't handed out again")
+	}
+	stale.Release()
+
+	// Had the stale release gone through, the next request would get the owner's memory.
+	other, err := NewPoolBuffer[int32](p, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.Mem == owner.Mem {
+		t.Error("the stale release returned memory that is still in use")
+	}
+	err = p.Check()
+	if err == nil || !strings.Contains(err.Error(), "double release of a 4096 byte buffer") {
+		t.Errorf("got %v, expected a double release", err)
+	}
+	owner.Release()
+	other.Release()
+	if err := p.Check(); err == nil || strings.Contains(err.Error(), "leaked") {
+		t.Errorf("got %v, expected only the double release", err)
+	}
+	checkReleased(t, p, mem)
+}
+
+func TestPoolLeak(t *testing.T) {
+	p, mem := newRefPool()
+	leaked, err := NewPoolBuffer[float32](p, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	large, err := NewPoolBuffer[float32](p, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	released, err := NewPoolBuffer[float32](p, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	released.Release()
+	_ = leaked
+
+	// Leaks are reported largest first, with the requested size.
+	want := "memory pool: leaked 4194304 byte buffer, leaked 4000 byte buffer"
+	if err := p.Check(); err == nil || err.Error() != want {
+		t.Errorf("got %v, expected %q", err, want)
+	}
+	large.Release()
+	if err := p.Release(); err == nil || err.Error() != "memory pool: leaked 4000 byte buffer" {
+		t.Errorf("Release returned %v, expected the leak", err)
+	}
+	if len(mem.sizes) != 0 || len(mem.problems) != 0 {
+		t.Errorf("%d buffers live, problems %v", len(mem.sizes), mem.problems)
+	}
+}
+
+func TestPoolLimit(t *testing.T) {
+	p, mem := newRefPool()
+	p.SetLimit(2 << 20)
+
+	// Classes above poolMaxCarved get buffers of their own, so these take exactly 1M each.
+	a, err := NewPoolBuffer[byte](p, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewPoolBuffer[byte](p, 1<<20-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewPoolBuffer[byte](p, 1<<20); !errors.Is(err, ErrPoolLimit) {
+		t.Fatalf("got %v, expected ErrPoolLimit", err)
+	}
+
+	// Trim: both 1M buffers are returned, and a 2M request releases them to make room.
+	a.Release()
+	b.Release()
+	c, err := NewPoolBuffer[byte](p, 2<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mem.released != 2 {
+		t.Errorf("trimmed %d buffers, expected 2", mem.released)
+	}
+	s := p.Stats()
+	if s.Reserved != 2<<20 || s.HighWater != 2<<20 || s.Limit != 2<<20 || s.DeviceAllocs != 3 {
+		t.Errorf("unexpected stats after trimming %+v", s)
+	}
+
+	// Buffers in use are never trimmed.
+	if _, err := NewPoolBuffer[byte](p, 1<<20); !errors.Is(err, ErrPoolLimit) {
+		t.Errorf("got %v, expected ErrPoolLimit", err)
+	}
+	c.Release()
+	checkReleased(t, p, mem)
+}
+
+// TestPoolLimitKeepsSlabs checks that trimming leaves carved chunks and their slab alone.
+func TestPoolLimitKeepsSlabs(t *testing.T) {
+	p, mem := newRefPool()
+	p.SetLimit(poolSlabSize + 1<<20)
+	small, err := NewPoolBuffer[byte](p, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	small.Release()
+	if _, err := NewPoolBuffer[byte](p, 2<<20); !errors.Is(err, ErrPoolLimit) {
+		t.Fatalf("got %v, expected ErrPoolLimit", err)
+	}
+	if mem.released != 0 {
+		t.Errorf("trimmed %d buffers, expected none", mem.released)
+	}
+	again, err := NewPoolBuffer[byte](p, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Mem != small.Mem {
+		t.Error("the carved chunk was not kept")
+	}
+	again.Release()
+	checkReleased(t, p, mem)
+}
+
+func TestPoolSetLimitClamped(t *testing.T) {
+	p, mem := newRefPool()
+	p.SetLimit(1 << 40)
+	if s := p.Stats(); s.Limit != mem.globalMem {
+		t.Errorf("limit is %d, expected the global memory size %d", s.Limit, mem.globalMem)
+	}
+}
+
+func TestPoolMaxAlloc(t *testing.T) {
+	p, _ := newRefPool()
+	_, err := NewPoolBuffer[byte](p, 256<<20+1)
+	var allocErr *AllocError
+	if !errors.As(err, &allocErr) || allocErr.MaxAlloc != 256<<20 {
+		t.Errorf("got %v, expected an AllocError", err)
+	}
+}
+
+// TestPoolNoSubBuffers checks the fallback to buffers of their own on devices without sub-buffers.
+func TestPoolNoSubBuffers(t *testing.T) {
+	p, mem := newRefPool()
+	mem.noSubBuffers = true
+	a, err := NewPoolBuffer[byte](p, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewPoolBuffer[byte](p, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := p.Stats()
+	if s.SubBuffers != 0 || s.DeviceAllocs != 2 || s.Reserved != 2048 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+	a.Release()
+	b.Release()
+	checkReleased(t, p, mem)
+}
@@ -0,0 +1,517 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"github.com/jgillich/go-opencl/cl"
+	"math"
+	"time"
+)
+
+// Reducible lists the element types Reduce has kernels for.
+type Reducible interface {
+	int32 | float32 | float64
+}
+
+// ReduceOp selects what Reduce computes.
+type ReduceOp int
+
+const (
+	ReduceSum ReduceOp = iota
+	ReduceMin
+	ReduceMax
+	ReduceArgMin
+	ReduceArgMax
+)
+
+var reduceOps = []ReduceOp{ReduceSum, ReduceMin, ReduceMax, ReduceArgMin, ReduceArgMax}
+
+func (op ReduceOp) String() string {
+	switch op {
+	case ReduceSum:
+		return "sum"
+	case ReduceMin:
+		return "min"
+	case ReduceMax:
+		return "max"
+	case ReduceArgMin:
+		return "argmin"
+	case ReduceArgMax:
+		return "argmax"
+	}
+	return fmt.Sprintf("ReduceOp(%d)", int(op))
+}
+
+func (op ReduceOp) isArg() bool {
+	return op == ReduceArgMin || op == ReduceArgMax
+}
+
+// kernelName returns the name of the kernel function implementing op in its registered program.
+func (op ReduceOp) kernelName() string {
+	if op.isArg() {
+		return "argreduce"
+	}
+	return "reduce"
+}
+
+// ReduceResult is the outcome of a reduction. Index is the position of Value in the input for argmin and argmax,
+// with ties going to the lowest index, and -1 for the other ops.
+type ReduceResult[T Reducible] struct {
+	Value T
+	Index int
+}
+
+// Both reduction kernels are two-stage work-group reductions. Every work item first folds a grid-strided part of
+// the input into a private accumulator, then the work group combines the accumulators in local memory with a tree
+// reduction and writes one partial result per group. Running the same kernel again with a single work group over
+// the partials gives the final result. Local sizes must be powers of two for the tree reduction.
+var reduceSrc = `
+%[1]s
+#define T %[2]s
+#define IDENTITY %[3]s
+#define OP(a, b) %[4]s
+
+__kernel void reduce(
+   __global const T* input,
+   __global T* output,
+   __local T* scratch,
+   const unsigned int n)
+{
+   unsigned int lid = get_local_id(0);
+   T acc = IDENTITY;
+   for (unsigned int i = get_global_id(0); i < n; i += get_global_size(0)) {
+      acc = OP(acc, input[i]);
+   }
+   scratch[lid] = acc;
+   barrier(CLK_LOCAL_MEM_FENCE);
+
+   for (unsigned int s = get_local_size(0) / 2; s > 0; s >>= 1) {
+      if (lid < s) {
+         scratch[lid] = OP(scratch[lid], scratch[lid + s]);
+      }
+      barrier(CLK_LOCAL_MEM_FENCE);
+   }
+   if (lid == 0) {
+      output[get_group_id(0)] = scratch[0];
+   }
+}
+`
+
+// The arg variant carries the index of the best value along. In the first stage the index is the input position,
+// in the second stage it is read from the partial indices written by the first one.
+var argReduceSrc = `
+%[1]s
+#define T %[2]s
+#define BETTER(v, vi, best, bestIdx) (bestIdx < 0 || (v) %[3]s (best) || ((v) == (best) && (vi) < (bestIdx)))
+
+__kernel void argreduce(
+   __global const T* input,
+   __global const int* inputIdx,
+   __global T* output,
+   __global int* outputIdx,
+   __local T* scratch,
+   __local int* scratchIdx,
+   const unsigned int n,
+   const int useInputIdx)
+{
+   unsigned int lid = get_local_id(0);
+   T best = 0;
+   int bestIdx = -1;
+   for (unsigned int i = get_global_id(0); i < n; i += get_global_size(0)) {
+      T v = input[i];
+      int vi = useInputIdx ? inputIdx[i] : (int)i;
+      if (BETTER(v, vi, best, bestIdx)) {
+         best = v;
+         bestIdx = vi;
+      }
+   }
+   scratch[lid] = best;
+   scratchIdx[lid] = bestIdx;
+   barrier(CLK_LOCAL_MEM_FENCE);
+
+   for (unsigned int s = get_local_size(0) / 2; s > 0; s >>= 1) {
+      if (lid < s && scratchIdx[lid + s] >= 0) {
+         T v = scratch[lid + s];
+         int vi = scratchIdx[lid + s];
+         if (BETTER(v, vi, scratch[lid], scratchIdx[lid])) {
+            scratch[lid] = v;
+            scratchIdx[lid] = vi;
+         }
+      }
+      barrier(CLK_LOCAL_MEM_FENCE);
+   }
+   if (lid == 0) {
+      output[get_group_id(0)] = scratch[0];
+      outputIdx[get_group_id(0)] = scratchIdx[0];
+   }
+}
+`
+
+// reduceTypes maps the OpenCL C type names Reduce supports to the extension pragma they need and their min and max values.
+var reduceTypes = []struct {
+	name, pragma, min, max string
+}{
+	{"int", "", "INT_MIN", "INT_MAX"},
+	{"float", "", "-INFINITY", "INFINITY"},
+	{"double", "#pragma OPENCL EXTENSION cl_khr_fp64 : enable", "-INFINITY", "INFINITY"},
+}
+
+func reduceSpecName(op ReduceOp, typeName string) string {
+	return fmt.Sprintf("reduce_%s_%s", op, typeName)
+}
+
+func init() {
+	for _, t := range reduceTypes {
+		for _, op := range reduceOps {
+			var src string
+			switch op {
+			case ReduceSum:
+				src = fmt.Sprintf(reduceSrc, t.pragma, t.name, "0", "((a) + (b))")
+			case ReduceMin:
+				src = fmt.Sprintf(reduceSrc, t.pragma, t.name, t.max, "min((a), (b))")
+			case ReduceMax:
+				src = fmt.Sprintf(reduceSrc, t.pragma, t.name, t.min, "max((a), (b))")
+			case ReduceArgMin:
+				src = fmt.Sprintf(argReduceSrc, t.pragma, t.name, "<")
+			case ReduceArgMax:
+				src = fmt.Sprintf(argReduceSrc, t.pragma, t.name, ">")
+			}
+			RegisterKernel(KernelSpec{Name: reduceSpecName(op, t.name), Source: src, Requires: typeRequirements(t.name)})
+		}
+	}
+}
+
+// maxReduceGroups caps the number of work groups in the first stage. More groups than this only adds partials for
+// the second stage without making the first one any faster.
+const maxReduceGroups = 1024
+
+// Reduce reduces buf with op on the session's device using a local size picked from the kernel's work group size.
+func Reduce[T Reducible](ctx context.Context, sess *Session, buf *Buffer[T], op ReduceOp) (ReduceResult[T], error) {
+	return ReduceLocal(ctx, sess, buf, op, 0)
+}
+
+// reduceMaxLocalSize returns the largest local size the reduction kernel for op and T supports on the session's device.
+func reduceMaxLocalSize[T Reducible](ctx context.Context, sess *Session, op ReduceOp) (int, error) {
+	kernel, err := sess.Kernel(ctx, reduceSpecName(op, clTypeName[T]()), op.kernelName())
+	if err != nil {
+		return 0, err
+	}
+	defer kernel.Release()
+	return kernel.WorkGroupSize(sess.Device)
+}
+
+// ReduceLocal is Reduce with an explicit local size, which must be a power of two. A localSize of 0 picks the
+// largest power of two up to 256 that the kernel supports on the device.
+func ReduceLocal[T Reducible](ctx context.Context, sess *Session, buf *Buffer[T], op ReduceOp, localSize int) (ReduceResult[T], error) {
+	kernel, err := sess.Kernel(ctx, reduceSpecName(op, clTypeName[T]()), op.kernelName())
+	if err != nil {
+		return ReduceResult[T]{}, err
+	}
+	defer kernel.Release()
+	ops := deviceReduce[T]{sess: sess, kernel: kernel, op: op}
+	return reduceWith[T, reducePartials[T]](ctx, ops, reducePartials[T]{values: buf}, buf.Len, localSize)
+}
+
+// reduceStages are the kernel launches a reduction is made of, on buffers of type B holding values and, for argmin
+// and argmax, their indices. deviceReduce launches them on a session, the tests run the same steps on the host.
+type reduceStages[T Reducible, B any] interface {
+	// maxLocalSize is the largest work-group reduce can be launched with.
+	maxLocalSize(ctx context.Context) (int, error)
+	alloc(n int) (B, error)
+	release(buf B)
+	// reduce launches groups work groups of localSize over the first n elements of in and writes one partial result
+	// per group to out, like the reduce and argreduce kernels. With useInputIdx the indices are read from in,
+	// otherwise they are the input positions.
+	reduce(ctx context.Context, in, out B, n, groups, localSize int, useInputIdx bool) error
+	// result reads the first partial result of buf.
+	result(ctx context.Context, buf B) (ReduceResult[T], error)
+}
+
+// reduceWith reduces the first n elements of in with ops: the first stage leaves one partial result per work group,
+// the second reduces those with a single work group.
+func reduceWith[T Reducible, B any](ctx context.Context, ops reduceStages[T, B], in B, n, localSize int) (ReduceResult[T],
+	error) {
+	var res ReduceResult[T]
+	maxLocal, err := ops.maxLocalSize(ctx)
+	if err != nil {
+		return res, err
+	}
+	if localSize == 0 {
+		localSize = prevPowOf2(maxLocal)
+		if localSize > 256 {
+			localSize = 256
+		}
+	}
+	if localSize != prevPowOf2(localSize) || localSize > maxLocal {
+		return res, fmt.Errorf("local size %d must be a power of two no larger than %d", localSize, maxLocal)
+	}
+
+	groups := (n + localSize - 1) / localSize
+	if groups > maxReduceGroups {
+		groups = maxReduceGroups
+	}
+	partials, err := ops.alloc(groups)
+	if err != nil {
+		return res, err
+	}
+	defer ops.release(partials)
+	result, err := ops.alloc(1)
+	if err != nil {
+		return res, err
+	}
+	defer ops.release(result)
+
+	if err := ops.reduce(ctx, in, partials, n, groups, localSize, false); err != nil {
+		return res, err
+	}
+	if err := ops.reduce(ctx, partials, result, groups, 1, localSize, true); err != nil {
+		return res, err
+	}
+	return ops.result(ctx, result)
+}
+
+// reducePartials are device buffers of values and, for argmin and argmax, their indices.
+type reducePartials[T Reducible] struct {
+	values  *Buffer[T]
+	indices *Buffer[int32]
+}
+
+// deviceReduce launches kernel, the reduction kernel for op and T, on sess.
+type deviceReduce[T Reducible] struct {
+	sess   *Session
+	kernel *cl.Kernel
+	op     ReduceOp
+}
+
+func (d deviceReduce[T]) maxLocalSize(context.Context) (int, error) {
+	maxLocal, err := d.kernel.WorkGroupSize(d.sess.Device)
+	if err != nil {
+		return 0, fmt.Errorf("get work group size: %w", err)
+	}
+	return maxLocal, nil
+}
+
+func (d deviceReduce[T]) alloc(n int) (reducePartials[T], error) {
+	var p reducePartials[T]
+	values, err := NewBuffer[T](d.sess, cl.MemReadWrite, n)
+	if err != nil {
+		return p, err
+	}
+	p.values = values
+	if d.op.isArg() {
+		if p.indices, err = NewBuffer[int32](d.sess, cl.MemReadWrite, n); err != nil {
+			values.Release()
+			return reducePartials[T]{}, err
+		}
+	}
+	return p, nil
+}
+
+func (d deviceReduce[T]) release(p reducePartials[T]) {
+	p.values.Release()
+	if p.indices != nil {
+		p.indices.Release()
+	}
+}
+
+func (d deviceReduce[T]) reduce(ctx context.Context, in, out reducePartials[T], n, groups, localSize int,
+	useInputIdx bool) error {
+	scratch := cl.LocalBuffer(localSize * elemSize[T]())
+	var err error
+	if !d.op.isArg() {
+		err = setKernelArgs(d.kernel, in.values, out.values, scratch, uint32(n))
+	} else {
+		// The first stage doesn't read inputIdx, but the argument must still be a valid buffer, so the output indices
+		// stand in for it.
+		inIdx, flag := out.indices, int32(0)
+		if useInputIdx {
+			inIdx, flag = in.indices, 1
+		}
+		err = setKernelArgs(d.kernel, in.values, inIdx, out.values, out.indices, scratch, cl.LocalBuffer(localSize*4),
+			uint32(n), flag)
+	}
+	if err != nil {
+		return err
+	}
+	return d.sess.Run(ctx, d.kernel, []int{groups * localSize}, []int{localSize})
+}
+
+func (d deviceReduce[T]) result(ctx context.Context, p reducePartials[T]) (ReduceResult[T], error) {
+	res := ReduceResult[T]{Index: -1}
+	value := make([]T, 1)
+	if err := p.values.Read(ctx, value); err != nil {
+		return res, err
+	}
+	res.Value = value[0]
+	if p.indices != nil {
+		index := make([]int32, 1)
+		if err := p.indices.Read(ctx, index); err != nil {
+			return res, err
+		}
+		res.Index = int(index[0])
+	}
+	return res, nil
+}
+
+// reduceCPU is the host reference used to verify Reduce. Sums are accumulated in 64 bits, so the reference for a
+// large float32 input isn't dominated by its own rounding errors.
+func reduceCPU[T Reducible](data []T, op ReduceOp) ReduceResult[T] {
+	res := ReduceResult[T]{Index: -1}
+	var intSum int64
+	var floatSum float64
+	isInt := clTypeName[T]() == "int"
+	for i, v := range data {
+		switch op {
+		case ReduceSum:
+			if isInt {
+				intSum += int64(v)
+			} else {
+				floatSum += float64(v)
+			}
+		case ReduceMin, ReduceArgMin:
+			if i == 0 || v < res.Value {
+				res.Value = v
+				if op.isArg() {
+					res.Index = i
+				}
+			}
+		case ReduceMax, ReduceArgMax:
+			if i == 0 || v > res.Value {
+				res.Value = v
+				if op.isArg() {
+					res.Index = i
+				}
+			}
+		}
+	}
+	if op == ReduceSum {
+		// Converting the 64 bit integer sum wraps around exactly like the int32 additions on the device do.
+		if isInt {
+			res.Value = T(intSum)
+		} else {
+			res.Value = T(floatSum)
+		}
+	}
+	return res
+}
+
+// reduceMatches compares a device result with the host reference. Floating point sums are summed in a different
+// order on the device, so they only have to agree within a relative tolerance.
+func reduceMatches[T Reducible](got, want ReduceResult[T], op ReduceOp) bool {
+	if got.Index != want.Index {
+		return false
+	}
+	if op != ReduceSum || clTypeName[T]() == "int" {
+		return got.Value == want.Value
+	}
+	tolerance := 1e-3
+	if clTypeName[T]() == "double" {
+		tolerance = 1e-10
+	}
+	diff := math.Abs(float64(got.Value) - float64(want.Value))
+	return diff <= tolerance*math.Max(1, math.Abs(float64(want.Value)))
+}
+
+// verifyReduce runs every op on data and checks the results against reduceCPU.
+func verifyReduce[T Reducible](ctx context.Context, sess *Session, data []T) error {
+	buf, err := NewBufferFrom(ctx, sess, cl.MemReadOnly, data)
+	if err != nil {
+		return err
+	}
+	defer buf.Release()
+	for _, op := range reduceOps {
+		got, err := Reduce(ctx, sess, buf, op)
+		if err != nil {
+			return fmt.Errorf("%s %s: %w", clTypeName[T](), op, err)
+		}
+		if want := reduceCPU(data, op); !reduceMatches(got, want, op) {
+			return fmt.Errorf("%s %s: got %v at %d, expected %v at %d", clTypeName[T](), op, got.Value, got.Index, want.Value, want.Index)
+		}
+		fmt.Printf("%s %s: %v (index %d) OK\n", clTypeName[T](), op, got.Value, got.Index)
+	}
+	return nil
+}
+
+// ReduceBenchmark verifies all reductions against the CPU for int32, float32 and (if supported) float64 and then
+// times each op on 16M float32 values over the same local sizes as BatchedSquare.
+func ReduceBenchmark(ctx context.Context, deviceIndex int) error {
+	devices, err := getDevices()
+	if err != nil {
+		return err
+	}
+	sess, err := NewSession(devices, deviceIndex)
+	if err != nil {
+		return err
+	}
+	defer sess.Release()
+	fmt.Println(sess)
+
+	// Pseudo random values with a pattern that puts the minimum and maximum somewhere in the middle of the data.
+	elemCount := 1 << 20
+	ints := make([]int32, elemCount)
+	floats := make([]float32, elemCount)
+	doubles := make([]float64, elemCount)
+	for i := 0; i < elemCount; i++ {
+		v := (i*7919)%10007 - 5003
+		ints[i] = int32(v)
+		floats[i] = float32(v) / 16
+		doubles[i] = float64(v) / 16
+	}
+	if err := verifyReduce(ctx, sess, ints); err != nil {
+		return err
+	}
+	if err := verifyReduce(ctx, sess, floats); err != nil {
+		return err
+	}
+	if sess.Capabilities().FP64 {
+		if err := verifyReduce(ctx, sess, doubles); err != nil {
+			return err
+		}
+	} else {
+		fmt.Println("double: skipped, device does not support double-precision floating point")
+	}
+
+	elemCount = 16777216
+	numbers := make([]float32, elemCount)
+	for i := 0; i < elemCount; i++ {
+		numbers[i] = float32(i%1000) / 1000
+	}
+	buf, err := NewBufferFrom(ctx, sess, cl.MemReadOnly, numbers)
+	if err != nil {
+		return err
+	}
+	defer buf.Release()
+
+	localSizes := []int{1, 2, 4, 8, 16, 32, 64, 128, 256, 512, 1024}
+	fmt.Printf("Build options: %s\n", describeBuildOptions(sess.BuildOptions))
+	fmt.Println(
+		`| Device        | Op | Local size | Result  |
+| ------------- |:-------------:| -----:| -----:|`)
+	iterations := int64(16)
+	for _, op := range reduceOps {
+		want := reduceCPU(numbers, op)
+		maxLocal, err := reduceMaxLocalSize[float32](ctx, sess, op)
+		if err != nil {
+			return err
+		}
+		for _, lz := range localSizes {
+			if lz > maxLocal {
+				continue
+			}
+			var sum = int64(0)
+			for it := 0; it < int(iterations); it++ {
+				st := time.Now()
+				got, err := ReduceLocal(ctx, sess, buf, op, lz)
+				if err != nil {
+					return fmt.Errorf("%s with local size %d: %w", op, lz, err)
+				}
+				sum += time.Since(st).Microseconds()
+				if it == 0 && !reduceMatches(got, want, op) {
+					return fmt.Errorf("%s with local size %d: got %v at %d, expected %v at %d", op, lz, got.Value, got.Index, want.Value, want.Index)
+				}
+			}
+			fmt.Printf("| %s   | %s | %d | %v |\n", sess.Device.Name(), op, lz, (time.Microsecond * time.Duration(sum/iterations)).String())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestReduceCPU(t *testing.T) {
+	tests := []struct {
+		name string
+		data []int32
+		op   ReduceOp
+		want ReduceResult[int32]
+	}{
+		{name: "sum", data: []int32{3, -1, 4}, op: ReduceSum, want: ReduceResult[int32]{Value: 6, Index: -1}},
+		{name: "sum wraps like int32", data: []int32{math.MaxInt32, 1}, op: ReduceSum,
+			want: ReduceResult[int32]{Value: math.MinInt32, Index: -1}},
+		{name: "min", data: []int32{3, -1, 4, -1}, op: ReduceMin, want: ReduceResult[int32]{Value: -1, Index: -1}},
+		{name: "max", data: []int32{3, -1, 4, -1}, op: ReduceMax, want: ReduceResult[int32]{Value: 4, Index: -1}},
+		{name: "argmin tie goes to the first", data: []int32{3, -1, 4, -1}, op: ReduceArgMin,
+			want: ReduceResult[int32]{Value: -1, Index: 1}},
+		{name: "argmax tie goes to the first", data: []int32{4, -1, 4, 2}, op: ReduceArgMax,
+			want: ReduceResult[int32]{Value: 4, Index: 0}},
+		{name: "argmin all equal", data: []int32{7, 7, 7}, op: ReduceArgMin, want: ReduceResult[int32]{Value: 7}},
+		{name: "argmax of one", data: []int32{math.MinInt32}, op: ReduceArgMax,
+			want: ReduceResult[int32]{Value: math.MinInt32}},
+	}
+	for _, tt := range tests {
+		if got := reduceCPU(tt.data, tt.op); got != tt.want {
+			t.Errorf("%s: reduceCPU(%v, %s) = %+v, want %+v", tt.name, tt.data, tt.op, got, tt.want)
+		}
+	}
+
+	// A float32 running sum stops growing at 1<<24, the 64 bit one doesn't.
+	ones := make([]float32, 1<<24+4)
+	for i := range ones {
+		ones[i] = 1
+	}
+	if got := reduceCPU(ones, ReduceSum); got.Value != 1<<24+4 {
+		t.Errorf("reduceCPU(%d ones, sum) = %v", len(ones), got.Value)
+	}
+}
+
+func TestReduceMatches(t *testing.T) {
+	tests := []struct {
+		name      string
+		got, want ReduceResult[float32]
+		op        ReduceOp
+		match     bool
+	}{
+		{name: "sum within tolerance", got: ReduceResult[float32]{Value: 1000.5, Index: -1},
+			want: ReduceResult[float32]{Value: 1000, Index: -1}, op: ReduceSum, match: true},
+		{name: "sum beyond tolerance", got: ReduceResult[float32]{Value: 1002, Index: -1},
+			want: ReduceResult[float32]{Value: 1000, Index: -1}, op: ReduceSum},
+		{name: "small sums are compared absolutely", got: ReduceResult[float32]{Value: 0.0005, Index: -1},
+			want: ReduceResult[float32]{Index: -1}, op: ReduceSum, match: true},
+		{name: "min is exact", got: ReduceResult[float32]{Value: 1.0001, Index: -1},
+			want: ReduceResult[float32]{Value: 1, Index: -1}, op: ReduceMin},
+		{name: "argmin index differs", got: ReduceResult[float32]{Value: 1, Index: 5},
+			want: ReduceResult[float32]{Value: 1, Index: 2}, op: ReduceArgMin},
+		{name: "argmax", got: ReduceResult[float32]{Value: 1, Index: 2}, want: ReduceResult[float32]{Value: 1, Index: 2},
+			op: ReduceArgMax, match: true},
+	}
+	for _, tt := range tests {
+		if got := reduceMatches(tt.got, tt.want, tt.op); got != tt.match {
+			t.Errorf("%s: reduceMatches(%+v, %+v) = %v, want %v", tt.name, tt.got, tt.want, got, tt.match)
+		}
+	}
+	if reduceMatches(ReduceResult[float64]{Value: 1 + 1e-8}, ReduceResult[float64]{Value: 1}, ReduceSum) {
+		t.Error("double sums match within the float tolerance")
+	}
+	if reduceMatches(ReduceResult[int32]{Value: 1001}, ReduceResult[int32]{Value: 1000}, ReduceSum) {
+		t.Error("int sums aren't exact")
+	}
+}
+
+// reduceLengths are the lengths worth reducing with work-groups of localSize: a single element, less than a group,
+// not a multiple of the local size, and more than maxReduceGroups groups, so work items fold several elements.
+func reduceLengths(localSize int) []int {
+	return []int{1, localSize - 1, localSize, localSize + 1, 5*localSize + 3, maxReduceGroups*localSize + 5,
+		3*maxReduceGroups*localSize - 1}
+}
+
+// testReduce reduces data made with value with every op for every length of reduceLengths and compares with
+// reduceCPU.
+func testReduce[T Reducible](t *testing.T, value func(i int) T) {
+	const localSize = 4
+	for _, n := range reduceLengths(localSize) {
+		data := make([]T, n)
+		for i := range data {
+			data[i] = value(i)
+		}
+		for _, op := range reduceOps {
+			t.Run(fmt.Sprintf("n=%d %s", n, op), func(t *testing.T) {
+				ops := &refReduce[T]{op: op, maxLocal: 64}
+				got, err := reduceWith[T, refPartials[T]](context.Background(), ops, refPartials[T]{values: data}, n,
+					localSize)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want := reduceCPU(data, op); !reduceMatches(got, want, op) {
+					t.Errorf("got %v at %d, expected %v at %d", got.Value, got.Index, want.Value, want.Index)
+				}
+
+				groups := (n + localSize - 1) / localSize
+				if groups > maxReduceGroups {
+					groups = maxReduceGroups
+				}
+				want := [][3]int{{n, groups, localSize}, {groups, 1, localSize}}
+				if fmt.Sprint(ops.launches) != fmt.Sprint(want) {
+					t.Errorf("launched %v, expected %v", ops.launches, want)
+				}
+			})
+		}
+	}
+}
+
+func TestReduceInt32(t *testing.T) {
+	// The minimum and maximum repeat every 5 elements, across work items and groups, starting at 3 and 2.
+	testReduce(t, func(i int) int32 { return int32((i+2)%5) - 2 })
+}
+
+func TestReduceFloat32(t *testing.T) {
+	testReduce(t, func(i int) float32 { return float32((i*7919)%10007-5003) / 16 })
+}
+
+func TestReduceTies(t *testing.T) {
+	// Every element is the minimum and the maximum, so every partial carries a candidate and the lowest index must
+	// win in both stages.
+	testReduce(t, func(int) int32 { return 1 })
+	testReduce(t, func(i int) float64 { return -float64(i % 3) })
+}
+
+func TestReduceLocalSize(t *testing.T) {
+	data := []int32{5, 1, 4}
+	tests := []struct {
+		localSize, maxLocal int
+		wantLocal           int
+		wantErr             string
+	}{
+		{localSize: 0, maxLocal: 1024, wantLocal: 256},
+		{localSize: 0, maxLocal: 96, wantLocal: 64},
+		{localSize: 8, maxLocal: 96, wantLocal: 8},
+		{localSize: 12, maxLocal: 96, wantErr: "power of two"},
+		{localSize: 128, maxLocal: 96, wantErr: "no larger than 96"},
+	}
+	for _, tt := range tests {
+		ops := &refReduce[int32]{op: ReduceArgMin, maxLocal: tt.maxLocal}
+		got, err := reduceWith[int32, refPartials[int32]](context.Background(), ops, refPartials[int32]{values: data},
+			len(data), tt.localSize)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("local size %d of %d: error = %v, want it to mention %q", tt.localSize, tt.maxLocal, err,
+					tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != (ReduceResult[int32]{Value: 1, Index: 1}) {
+			t.Errorf("local size %d of %d = %+v, %v", tt.localSize, tt.maxLocal, got, err)
+			continue
+		}
+		if ops.launches[0][2] != tt.wantLocal {
+			t.Errorf("local size %d of %d launched with %d, want %d", tt.localSize, tt.maxLocal, ops.launches[0][2],
+				tt.wantLocal)
+		}
+	}
+}
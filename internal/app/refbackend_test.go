@@ -0,0 +1,368 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"github.com/jgillich/go-opencl/cl"
+	"math"
+	"sync"
+	"time"
+)
+
+// The reference backend stands in for OpenCL devices in tests, so the host side logic around the kernels runs
+// without a driver: it does the kernels' work on the host, following their structure closely enough to exercise
+// the same edge cases.
+
+// refClock is a simulated clock that only moves when a refDevice reports the time it took.
+type refClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *refClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *refClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// refDevice is a simulated device that squares int32s at a fixed speed.
+type refDevice struct {
+	name string
+	// perElement is how long the device takes per element.
+	perElement time.Duration
+	// clock, if set, is advanced by the time a run takes instead of sleeping for it.
+	clock *refClock
+	// fail, if set, is returned by every run instead of doing the work.
+	fail error
+}
+
+func (d *refDevice) String() string {
+	return d.name
+}
+
+// square squares the partition's elements of in into out, taking as long as the device's speed says, either on
+// its clock or by sleeping. A sleeping device gives up with ctx.Err() if ctx is done before then.
+func (d *refDevice) square(ctx context.Context, part Partition, in, out []int32) error {
+	if d.fail != nil {
+		return d.fail
+	}
+	offset, count := part.Elems()
+	took := time.Duration(count) * d.perElement
+	if d.clock != nil {
+		d.clock.advance(took)
+	} else {
+		select {
+		case <-time.After(took):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	for i := offset; i < offset+count; i++ {
+		out[i] = in[i] * in[i]
+	}
+	return nil
+}
+
+// refDevices returns a run function for runPartitions and calibrateWeights that squares in into out on the
+// partition's device.
+func refDevices(devices []*refDevice, in, out []int32) func(context.Context, Partition) error {
+	return func(ctx context.Context, part Partition) error {
+		d := devices[part.Device]
+		if err := d.square(ctx, part, in, out); err != nil {
+			return fmt.Errorf("%s: %w", d, err)
+		}
+		return nil
+	}
+}
+
+// refScan runs the scan kernels on host slices, scanning each block with the same up-sweep and down-sweep as
+// scanBlock. It records the launches so tests can check how deep the block sums recursed.
+type refScan[T Scannable] struct {
+	// maxLocal is the work-group size scanBlock reports.
+	maxLocal int
+	// blockLaunches holds n and localSize of every scanBlocks call.
+	blockLaunches [][2]int
+}
+
+func (r *refScan[T]) maxLocalSize(context.Context) (int, error) {
+	return r.maxLocal, nil
+}
+
+func (r *refScan[T]) alloc(n int) ([]T, error) {
+	return make([]T, n), nil
+}
+
+func (r *refScan[T]) release([]T) {}
+
+func (r *refScan[T]) scanBlocks(_ context.Context, in, out, blockSums []T, n, localSize int, inclusive bool) error {
+	r.blockLaunches = append(r.blockLaunches, [2]int{n, localSize})
+	halfSize, blockSize := localSize, 2*localSize
+	temp := make([]T, blockSize)
+	loaded := make([]T, blockSize)
+	for group := 0; group*blockSize < n; group++ {
+		base := group * blockSize
+		for i := range loaded {
+			loaded[i] = 0
+			if base+i < n {
+				loaded[i] = in[base+i]
+			}
+		}
+		copy(temp, loaded)
+
+		offset := 1
+		for d := halfSize; d > 0; d >>= 1 {
+			for lid := 0; lid < d; lid++ {
+				x, y := offset*(2*lid+1)-1, offset*(2*lid+2)-1
+				temp[y] += temp[x]
+			}
+			offset <<= 1
+		}
+		blockSums[group] = temp[blockSize-1]
+		temp[blockSize-1] = 0
+		for d := 1; d < blockSize; d <<= 1 {
+			offset >>= 1
+			for lid := 0; lid < d; lid++ {
+				x, y := offset*(2*lid+1)-1, offset*(2*lid+2)-1
+				temp[x], temp[y] = temp[y], temp[y]+temp[x]
+			}
+		}
+
+		for i := 0; i < blockSize && base+i < n; i++ {
+			out[base+i] = temp[i]
+			if inclusive {
+				out[base+i] += loaded[i]
+			}
+		}
+	}
+	return nil
+}
+
+func (r *refScan[T]) addOffsets(_ context.Context, data, offsets []T, n, blockSize, _ int) error {
+	for i := 0; i < n; i++ {
+		data[i] += offsets[i/blockSize]
+	}
+	return nil
+}
+
+// refCompact runs the compaction kernels on host slices with a Go predicate.
+type refCompact[T Scannable] struct {
+	*refScan[uint32]
+	predicate func(T) bool
+}
+
+func (r refCompact[T]) allocOutput(n int) ([]T, error) {
+	return make([]T, n), nil
+}
+
+func (r refCompact[T]) releaseOutput([]T) {}
+
+func (r refCompact[T]) flags(_ context.Context, in []T, flags []uint32, n int) error {
+	for i := 0; i < n; i++ {
+		flags[i] = 0
+		if r.predicate(in[i]) {
+			flags[i] = 1
+		}
+	}
+	return nil
+}
+
+func (r refCompact[T]) readAt(_ context.Context, buf []uint32, i int) (uint32, error) {
+	return buf[i], nil
+}
+
+func (r refCompact[T]) scatter(_ context.Context, in []T, flags, positions []uint32, out []T, n int) error {
+	for i := 0; i < n; i++ {
+		if flags[i] != 0 {
+			out[positions[i]] = in[i]
+		}
+	}
+	return nil
+}
+
+// refReduce runs the reduction kernels for op on host slices, folding grid-strided elements into one accumulator
+// per work item and combining a group's accumulators with the same tree reduction as the kernels. It records the
+// launches so tests can check both stages.
+type refReduce[T Reducible] struct {
+	op ReduceOp
+	// maxLocal is the work-group size the kernel reports.
+	maxLocal int
+	// launches holds n, groups and localSize of every reduce call.
+	launches [][3]int
+}
+
+// refPartials are host values and their indices.
+type refPartials[T Reducible] struct {
+	values  []T
+	indices []int32
+}
+
+func (r *refReduce[T]) maxLocalSize(context.Context) (int, error) {
+	return r.maxLocal, nil
+}
+
+func (r *refReduce[T]) alloc(n int) (refPartials[T], error) {
+	return refPartials[T]{values: make([]T, n), indices: make([]int32, n)}, nil
+}
+
+func (r *refReduce[T]) release(refPartials[T]) {}
+
+// identity returns the IDENTITY the reduce kernel starts its accumulators with.
+func (r *refReduce[T]) identity() T {
+	limit := math.Inf(1)
+	if clTypeName[T]() == "int" {
+		limit = math.MaxInt32
+	}
+	switch r.op {
+	case ReduceMin:
+		return T(limit)
+	case ReduceMax:
+		if clTypeName[T]() == "int" {
+			return T(math.MinInt32)
+		}
+		return T(-limit)
+	}
+	return 0
+}
+
+// better is the argreduce kernel's BETTER: whether v at vi replaces best at bestIdx.
+func (r *refReduce[T]) better(v T, vi int32, best T, bestIdx int32) bool {
+	if r.op == ReduceArgMin {
+		return bestIdx < 0 || v < best || (v == best && vi < bestIdx)
+	}
+	return bestIdx < 0 || v > best || (v == best && vi < bestIdx)
+}
+
+func (r *refReduce[T]) fold(a, b T) T {
+	switch r.op {
+	case ReduceMin:
+		if b < a {
+			return b
+		}
+		return a
+	case ReduceMax:
+		if b > a {
+			return b
+		}
+		return a
+	}
+	return a + b
+}
+
+func (r *refReduce[T]) reduce(_ context.Context, in, out refPartials[T], n, groups, localSize int,
+	useInputIdx bool) error {
+	r.launches = append(r.launches, [3]int{n, groups, localSize})
+	global := groups * localSize
+	scratch := make([]T, localSize)
+	scratchIdx := make([]int32, localSize)
+	for group := 0; group < groups; group++ {
+		for lid := 0; lid < localSize; lid++ {
+			acc, accIdx := r.identity(), int32(-1)
+			if r.op.isArg() {
+				acc = 0
+			}
+			for i := group*localSize + lid; i < n; i += global {
+				if !r.op.isArg() {
+					acc = r.fold(acc, in.values[i])
+					continue
+				}
+				vi := int32(i)
+				if useInputIdx {
+					vi = in.indices[i]
+				}
+				if r.better(in.values[i], vi, acc, accIdx) {
+					acc, accIdx = in.values[i], vi
+				}
+			}
+			scratch[lid], scratchIdx[lid] = acc, accIdx
+		}
+		for s := localSize / 2; s > 0; s >>= 1 {
+			for lid := 0; lid < s; lid++ {
+				if !r.op.isArg() {
+					scratch[lid] = r.fold(scratch[lid], scratch[lid+s])
+				} else if scratchIdx[lid+s] >= 0 && r.better(scratch[lid+s], scratchIdx[lid+s], scratch[lid],
+					scratchIdx[lid]) {
+					scratch[lid], scratchIdx[lid] = scratch[lid+s], scratchIdx[lid+s]
+				}
+			}
+		}
+		out.values[group], out.indices[group] = scratch[0], scratchIdx[0]
+	}
+	return nil
+}
+
+func (r *refReduce[T]) result(_ context.Context, p refPartials[T]) (ReduceResult[T], error) {
+	res := ReduceResult[T]{Value: p.values[0], Index: -1}
+	if r.op.isArg() {
+		res.Index = int(p.indices[0])
+	}
+	return res, nil
+}
+
+// refMemory is a poolMemory whose buffers are placeholders that are never passed to OpenCL. It tracks which are
+// live, so tests can check what a pool frees, and records releases the device would reject.
+type refMemory struct {
+	maxAlloc, globalMem int64
+	noSubBuffers        bool
+	// sizes holds the size of every live buffer, parents the buffer a live sub-buffer was carved from.
+	sizes    map[*cl.MemObject]int64
+	parents  map[*cl.MemObject]*cl.MemObject
+	released int
+	problems []string
+}
+
+func newRefMemory(maxAlloc, globalMem int64) *refMemory {
+	return &refMemory{maxAlloc: maxAlloc, globalMem: globalMem, sizes: map[*cl.MemObject]int64{},
+		parents: map[*cl.MemObject]*cl.MemObject{}}
+}
+
+func (m *refMemory) device() (string, int64, int64) {
+	return "reference", m.maxAlloc, m.globalMem
+}
+
+func (m *refMemory) baseAddrAlign() int64 {
+	return 128
+}
+
+func (m *refMemory) createBuffer(size int64) (*cl.MemObject, error) {
+	if size > m.maxAlloc {
+		return nil, cl.ErrInvalidBufferSize
+	}
+	mem := &cl.MemObject{}
+	m.sizes[mem] = size
+	return mem, nil
+}
+
+func (m *refMemory) createSubBuffer(parent *cl.MemObject, offset, size int64) (*cl.MemObject, error) {
+	if m.noSubBuffers {
+		return nil, cl.ErrUnsupported
+	}
+	parentSize, ok := m.sizes[parent]
+	if !ok || offset%m.baseAddrAlign() != 0 || offset+size > parentSize {
+		return nil, cl.ErrInvalidValue
+	}
+	mem := &cl.MemObject{}
+	m.sizes[mem] = size
+	m.parents[mem] = parent
+	return mem, nil
+}
+
+func (m *refMemory) release(mem *cl.MemObject) {
+	if _, ok := m.sizes[mem]; !ok {
+		m.problems = append(m.problems, "released a buffer that isn't live")
+		return
+	}
+	for _, parent := range m.parents {
+		if parent == mem {
+			m.problems = append(m.problems, "released a buffer before its sub-buffers")
+		}
+	}
+	delete(m.sizes, mem)
+	delete(m.parents, mem)
+	m.released++
+}
@@ -0,0 +1,134 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"github.com/jgillich/go-opencl/cl"
+	"sort"
+	"sync"
+)
+
+// KernelSpec describes an OpenCL program in the kernel registry. A program may contain several kernels, which
+// are looked up by their function name once the program has been built.
+type KernelSpec struct {
+	Name   string // unique registry key, e.g. "reduce_sum_float"
+	Source string // OpenCL C source of the program
+	// Options are the spec's own build options, e.g. defines the source relies on. The session's options are
+	// added on top of them when the program is built.
+	Options BuildOptions
+	// Requires lists the device features the program needs. Sessions refuse to build it on devices without them.
+	Requires Requirements
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]KernelSpec{}
+)
+
+// RegisterKernel adds spec to the kernel registry. It is meant to be called from init functions and panics if
+// the name is empty or already taken, since that is always a programming error.
+func RegisterKernel(spec KernelSpec) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if spec.Name == "" {
+		panic("RegisterKernel: empty kernel spec name")
+	}
+	if _, exists := registry[spec.Name]; exists {
+		panic("RegisterKernel: duplicate kernel spec " + spec.Name)
+	}
+	registry[spec.Name] = spec
+}
+
+// EnsureKernel registers spec unless a spec with the same name, source and options is registered already. It is the
+// runtime counterpart of RegisterKernel for programs generated on the fly, such as compaction predicates.
+func EnsureKernel(spec KernelSpec) error {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if spec.Name == "" {
+		return fmt.Errorf("empty kernel spec name")
+	}
+	if existing, exists := registry[spec.Name]; exists {
+		if existing.Source != spec.Source || existing.Options.String() != spec.Options.String() {
+			return fmt.Errorf("kernel spec %s is already registered with a different source or options", spec.Name)
+		}
+		return nil
+	}
+	registry[spec.Name] = spec
+	return nil
+}
+
+// LookupKernel returns the registered spec called name.
+func LookupKernel(name string) (KernelSpec, error) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	spec, ok := registry[name]
+	if !ok {
+		return KernelSpec{}, fmt.Errorf("no kernel spec registered as %q", name)
+	}
+	return spec, nil
+}
+
+// RegisteredKernels returns the names of all registered specs in sorted order.
+func RegisteredKernels() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Program returns the program for the registered spec, building it the first time it is asked for with the spec's
+// options merged with the session's BuildOptions. Built programs are cached per session, keyed by spec name and
+// options, and released together with the session. Programs keep their argument info where the device supports
+// it, so their kernels can be wrapped in a CheckedKernel.
+func (s *Session) Program(ctx context.Context, specName string) (*cl.Program, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	spec, err := LookupKernel(specName)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.Capabilities().Check(spec.Requires); err != nil {
+		return nil, fmt.Errorf("kernel spec %s: %w", spec.Name, err)
+	}
+	options := spec.Options.Merge(s.BuildOptions).For(s.Device)
+	key := spec.Name + " " + options
+
+	s.programsMu.Lock()
+	defer s.programsMu.Unlock()
+	if program, ok := s.programs[key]; ok {
+		return program, nil
+	}
+	program, err := s.Context.CreateProgramWithSource([]string{spec.Source})
+	if err != nil {
+		return nil, fmt.Errorf("create program %s: %w", spec.Name, err)
+	}
+	if err := program.BuildProgram(nil, options); err != nil {
+		program.Release()
+		return nil, fmt.Errorf("build program %s with options %q: %w", spec.Name, options, err)
+	}
+	if s.programs == nil {
+		s.programs = map[string]*cl.Program{}
+	}
+	s.programs[key] = program
+	return program, nil
+}
+
+// Kernel creates kernelName from the registered spec's program. Kernels carry their own argument state, so every
+// call returns a new kernel which the caller must release. Only the program build is cached.
+func (s *Session) Kernel(ctx context.Context, specName, kernelName string) (*cl.Kernel, error) {
+	program, err := s.Program(ctx, specName)
+	if err != nil {
+		return nil, err
+	}
+	kernel, err := program.CreateKernel(kernelName)
+	if err != nil {
+		return nil, fmt.Errorf("create kernel %s from %s: %w", kernelName, specName, err)
+	}
+	return kernel, nil
+}
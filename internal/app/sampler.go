@@ -0,0 +1,91 @@
+package app
+
+// #cgo linux pkg-config: OpenCL
+// #cgo darwin LDFLAGS: -framework OpenCL
+// #define CL_USE_DEPRECATED_OPENCL_1_2_APIS
+// #if defined(__APPLE__)
+// #include <OpenCL/cl.h>
+// #else
+// #include <CL/cl.h>
+// #endif
+import "C"
+
+import (
+	"fmt"
+	"github.com/jgillich/go-opencl/cl"
+	"unsafe"
+)
+
+// AddressingMode is what a sampler reads outside an image.
+type AddressingMode int
+
+const (
+	// AddressNone leaves reads outside the image undefined, for kernels that never make them.
+	AddressNone AddressingMode = C.CL_ADDRESS_NONE
+	// AddressClampToEdge reads the nearest edge pixel.
+	AddressClampToEdge AddressingMode = C.CL_ADDRESS_CLAMP_TO_EDGE
+	// AddressClamp reads the border color, transparent black or opaque black for images without alpha.
+	AddressClamp AddressingMode = C.CL_ADDRESS_CLAMP
+	// AddressRepeat wraps around, only with normalized coordinates.
+	AddressRepeat AddressingMode = C.CL_ADDRESS_REPEAT
+	// AddressMirroredRepeat mirrors at the edges, only with normalized coordinates.
+	AddressMirroredRepeat AddressingMode = C.CL_ADDRESS_MIRRORED_REPEAT
+)
+
+// FilterMode is how a sampler combines pixels around the coordinate it reads at.
+type FilterMode int
+
+const (
+	// FilterNearest reads the nearest pixel.
+	FilterNearest FilterMode = C.CL_FILTER_NEAREST
+	// FilterLinear interpolates the nearest 2x2 (or 2x2x2 for 3D images) pixels, i.e. bilinearly or trilinearly.
+	FilterLinear FilterMode = C.CL_FILTER_LINEAR
+)
+
+// Sampler is an OpenCL sampler object, passed to kernels as a sampler_t argument. The cl package has no sampler
+// support, so it is created with clCreateSampler directly.
+type Sampler struct {
+	// NormalizedCoords makes kernels address images with coordinates from 0 to 1 instead of in pixels.
+	NormalizedCoords bool
+	Addressing       AddressingMode
+	Filter           FilterMode
+	handle           C.cl_sampler
+}
+
+// NewSampler creates a sampler in the session's context. Repeating addressing modes require normalized
+// coordinates.
+func NewSampler(sess *Session, normalizedCoords bool, addressing AddressingMode, filter FilterMode) (*Sampler, error) {
+	if !normalizedCoords && (addressing == AddressRepeat || addressing == AddressMirroredRepeat) {
+		return nil, fmt.Errorf("repeating addressing modes require normalized coordinates")
+	}
+	var normalized C.cl_bool = C.CL_FALSE
+	if normalizedCoords {
+		normalized = C.CL_TRUE
+	}
+	var code C.cl_int
+	handle := C.clCreateSampler(clContextHandle(sess.Context), normalized, C.cl_addressing_mode(addressing),
+		C.cl_filter_mode(filter), &code)
+	switch code {
+	case C.CL_SUCCESS:
+		return &Sampler{NormalizedCoords: normalizedCoords, Addressing: addressing, Filter: filter, handle: handle}, nil
+	case C.CL_INVALID_VALUE:
+		return nil, fmt.Errorf("create sampler: %w", cl.ErrInvalidValue)
+	case C.CL_INVALID_OPERATION:
+		// Returned by devices without image support.
+		return nil, fmt.Errorf("create sampler: %w", cl.ErrInvalidOperation)
+	}
+	return nil, fmt.Errorf("create sampler: %w", cl.ErrOther(code))
+}
+
+// Release frees the sampler.
+func (s *Sampler) Release() {
+	if s.handle != nil {
+		C.clReleaseSampler(s.handle)
+		s.handle = nil
+	}
+}
+
+// setArg sets the sampler as argument index of kernel.
+func (s *Sampler) setArg(kernel *cl.Kernel, index int) error {
+	return kernel.SetArgUnsafe(index, int(unsafe.Sizeof(s.handle)), unsafe.Pointer(&s.handle))
+}
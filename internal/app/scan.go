@@ -0,0 +1,562 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"github.com/jgillich/go-opencl/cl"
+	"hash/fnv"
+	"time"
+)
+
+// Scannable lists the element types the scan kernels are registered for.
+type Scannable interface {
+	int32 | uint32 | float32
+}
+
+// scanSrc holds a Blelloch work-efficient scan. Each work group scans a block of twice its local size in local
+// memory: the up-sweep builds partial sums in a balanced tree, the down-sweep turns them into an exclusive scan.
+// Every group also writes its block total to blockSums. Scanning the block totals and adding them back with
+// addOffsets extends the scan to arbitrary lengths, recursing as many levels as needed.
+var scanSrc = `
+#define T %s
+
+__kernel void scanBlock(
+   __global const T* input,
+   __global T* output,
+   __global T* blockSums,
+   __local T* temp,
+   const unsigned int n,
+   const int inclusive)
+{
+   unsigned int lid = get_local_id(0);
+   unsigned int halfSize = get_local_size(0);
+   unsigned int blockSize = halfSize * 2;
+   unsigned int base = get_group_id(0) * blockSize;
+
+   T a = (base + lid < n) ? input[base + lid] : 0;
+   T b = (base + lid + halfSize < n) ? input[base + lid + halfSize] : 0;
+   temp[lid] = a;
+   temp[lid + halfSize] = b;
+
+   unsigned int offset = 1;
+   for (unsigned int d = halfSize; d > 0; d >>= 1) {
+      barrier(CLK_LOCAL_MEM_FENCE);
+      if (lid < d) {
+         unsigned int x = offset * (2 * lid + 1) - 1;
+         unsigned int y = offset * (2 * lid + 2) - 1;
+         temp[y] += temp[x];
+      }
+      offset <<= 1;
+   }
+
+   barrier(CLK_LOCAL_MEM_FENCE);
+   if (lid == 0) {
+      blockSums[get_group_id(0)] = temp[blockSize - 1];
+      temp[blockSize - 1] = 0;
+   }
+
+   for (unsigned int d = 1; d < blockSize; d <<= 1) {
+      offset >>= 1;
+      barrier(CLK_LOCAL_MEM_FENCE);
+      if (lid < d) {
+         unsigned int x = offset * (2 * lid + 1) - 1;
+         unsigned int y = offset * (2 * lid + 2) - 1;
+         T t = temp[x];
+         temp[x] = temp[y];
+         temp[y] += t;
+      }
+   }
+   barrier(CLK_LOCAL_MEM_FENCE);
+
+   if (base + lid < n) {
+      output[base + lid] = inclusive ? temp[lid] + a : temp[lid];
+   }
+   if (base + lid + halfSize < n) {
+      output[base + lid + halfSize] = inclusive ? temp[lid + halfSize] + b : temp[lid + halfSize];
+   }
+}
+
+__kernel void addOffsets(
+   __global T* data,
+   __global const T* offsets,
+   const unsigned int n,
+   const unsigned int blockSize)
+{
+   unsigned int i = get_global_id(0);
+   if (i < n) {
+      data[i] += offsets[i / blockSize];
+   }
+}
+`
+
+// compactSrc wraps a user supplied predicate into the two kernels compaction needs around the scan: one that
+// evaluates the predicate into 0/1 flags and one that scatters the kept elements to their scanned positions.
+var compactSrc = `
+#define T %s
+
+%s
+
+__kernel void compactFlags(
+   __global const T* input,
+   __global uint* flags,
+   const unsigned int n)
+{
+   unsigned int i = get_global_id(0);
+   if (i < n) {
+      flags[i] = predicate(input[i]) ? 1 : 0;
+   }
+}
+
+__kernel void compactScatter(
+   __global const T* input,
+   __global const uint* flags,
+   __global const uint* positions,
+   __global T* output,
+   const unsigned int n)
+{
+   unsigned int i = get_global_id(0);
+   if (i < n && flags[i]) {
+      output[positions[i]] = input[i];
+   }
+}
+`
+
+func scanSpecName(typeName string) string {
+	return "scan_" + typeName
+}
+
+func init() {
+	for _, typeName := range []string{"int", "uint", "float"} {
+		RegisterKernel(KernelSpec{Name: scanSpecName(typeName), Source: fmt.Sprintf(scanSrc, typeName)})
+	}
+}
+
+// InclusiveScan writes the inclusive prefix sum of in to out, i.e. out[i] = in[0] + ... + in[i]. in and out
+// may be the same buffer.
+func InclusiveScan[T Scannable](ctx context.Context, sess *Session, in, out *Buffer[T]) error {
+	return scan(ctx, sess, in, out, in.Len, true, 0)
+}
+
+// ExclusiveScan writes the exclusive prefix sum of in to out, i.e. out[0] = 0 and out[i] = in[0] + ... + in[i-1].
+// in and out may be the same buffer.
+func ExclusiveScan[T Scannable](ctx context.Context, sess *Session, in, out *Buffer[T]) error {
+	return scan(ctx, sess, in, out, in.Len, false, 0)
+}
+
+// scan scans the first n elements of in into out. A localSize of 0 picks the largest power of two up to 256 the
+// kernel supports on the device.
+func scan[T Scannable](ctx context.Context, sess *Session, in, out *Buffer[T], n int, inclusive bool, localSize int) error {
+	if out.Len < n {
+		return fmt.Errorf("output buffer holds %d elements, scan needs %d", out.Len, n)
+	}
+	return scanWith[*Buffer[T]](ctx, deviceScan[T]{sess: sess}, in, out, n, inclusive, localSize)
+}
+
+// scanOps are the kernel launches a scan is made of, on buffers of type B. deviceScan launches them on a session,
+// the tests run the same steps on the host.
+type scanOps[B any] interface {
+	// maxLocalSize is the largest work-group scanBlocks can be launched with.
+	maxLocalSize(ctx context.Context) (int, error)
+	alloc(n int) (B, error)
+	release(buf B)
+	// scanBlocks scans the first n elements of in into out in blocks of 2*localSize and writes the block totals
+	// to blockSums, like the scanBlock kernel.
+	scanBlocks(ctx context.Context, in, out, blockSums B, n, localSize int, inclusive bool) error
+	// addOffsets adds offsets[i/blockSize] to the first n elements of data, like the addOffsets kernel.
+	addOffsets(ctx context.Context, data, offsets B, n, blockSize, localSize int) error
+}
+
+// scanWith scans the first n elements of in into out with ops, recursing on the block sums as long as there is
+// more than one block.
+func scanWith[B any](ctx context.Context, ops scanOps[B], in, out B, n int, inclusive bool, localSize int) error {
+	if n == 0 {
+		return nil
+	}
+	if localSize == 0 {
+		maxLocal, err := ops.maxLocalSize(ctx)
+		if err != nil {
+			return err
+		}
+		localSize = prevPowOf2(maxLocal)
+		if localSize > 256 {
+			localSize = 256
+		}
+	}
+	blockSize := 2 * localSize
+	blocks := (n + blockSize - 1) / blockSize
+
+	blockSums, err := ops.alloc(blocks)
+	if err != nil {
+		return err
+	}
+	defer ops.release(blockSums)
+	if err := ops.scanBlocks(ctx, in, out, blockSums, n, localSize, inclusive); err != nil {
+		return err
+	}
+	if blocks == 1 {
+		return nil
+	}
+
+	// Turn the block totals into block offsets and add them to every element of their block.
+	if err := scanWith(ctx, ops, blockSums, blockSums, blocks, false, localSize); err != nil {
+		return err
+	}
+	return ops.addOffsets(ctx, out, blockSums, n, blockSize, localSize)
+}
+
+// deviceScan launches the scan kernels for T on sess. If scratch is set, the block sum buffers are kept there
+// instead of being released.
+type deviceScan[T Scannable] struct {
+	sess    *Session
+	scratch *scanScratch[T]
+}
+
+// scanScratch keeps the block sum buffers of finished scans for later scans of the same length, so that repeated
+// scans, like the passes of a radix sort, allocate only once.
+type scanScratch[T Scannable] struct {
+	free map[int][]*Buffer[T]
+}
+
+// Release frees the kept buffers.
+func (s *scanScratch[T]) Release() {
+	for _, bufs := range s.free {
+		for _, buf := range bufs {
+			buf.Release()
+		}
+	}
+	s.free = nil
+}
+
+func (d deviceScan[T]) kernel(ctx context.Context, name string) (*cl.Kernel, error) {
+	return d.sess.Kernel(ctx, scanSpecName(clTypeName[T]()), name)
+}
+
+func (d deviceScan[T]) maxLocalSize(ctx context.Context) (int, error) {
+	kernel, err := d.kernel(ctx, "scanBlock")
+	if err != nil {
+		return 0, err
+	}
+	defer kernel.Release()
+	maxLocal, err := kernel.WorkGroupSize(d.sess.Device)
+	if err != nil {
+		return 0, fmt.Errorf("get work group size: %w", err)
+	}
+	return maxLocal, nil
+}
+
+func (d deviceScan[T]) alloc(n int) (*Buffer[T], error) {
+	if d.scratch != nil {
+		if bufs := d.scratch.free[n]; len(bufs) > 0 {
+			d.scratch.free[n] = bufs[:len(bufs)-1]
+			return bufs[len(bufs)-1], nil
+		}
+	}
+	return NewBuffer[T](d.sess, cl.MemReadWrite, n)
+}
+
+func (d deviceScan[T]) release(buf *Buffer[T]) {
+	if d.scratch == nil {
+		buf.Release()
+		return
+	}
+	if d.scratch.free == nil {
+		d.scratch.free = map[int][]*Buffer[T]{}
+	}
+	d.scratch.free[buf.Len] = append(d.scratch.free[buf.Len], buf)
+}
+
+func (d deviceScan[T]) scanBlocks(ctx context.Context, in, out, blockSums *Buffer[T], n, localSize int,
+	inclusive bool) error {
+	kernel, err := d.kernel(ctx, "scanBlock")
+	if err != nil {
+		return err
+	}
+	defer kernel.Release()
+	flag := int32(0)
+	if inclusive {
+		flag = 1
+	}
+	scratch := cl.LocalBuffer(2 * localSize * elemSize[T]())
+	if err := setKernelArgs(kernel, in, out, blockSums, scratch, uint32(n), flag); err != nil {
+		return err
+	}
+	return d.sess.Run(ctx, kernel, []int{blockSums.Len * localSize}, []int{localSize})
+}
+
+func (d deviceScan[T]) addOffsets(ctx context.Context, data, offsets *Buffer[T], n, blockSize, localSize int) error {
+	kernel, err := d.kernel(ctx, "addOffsets")
+	if err != nil {
+		return err
+	}
+	defer kernel.Release()
+	if err := setKernelArgs(kernel, data, offsets, uint32(n), uint32(blockSize)); err != nil {
+		return err
+	}
+	global := (n + localSize - 1) / localSize * localSize
+	return d.sess.Run(ctx, kernel, []int{global}, []int{localSize})
+}
+
+// Compact keeps the elements of in for which predicate returns true, in their original order. predicate is
+// OpenCL C source defining the function `int predicate(T value)`, where T is the element type, for example
+//
+//	int predicate(T value) { return value > 0; }
+//
+// The returned buffer has room for in.Len elements, of which the first count are the kept ones. The caller
+// releases it.
+func Compact[T Scannable](ctx context.Context, sess *Session, in *Buffer[T], predicate string) (*Buffer[T], int, error) {
+	typeName := clTypeName[T]()
+	h := fnv.New64a()
+	h.Write([]byte(predicate))
+	spec := KernelSpec{
+		Name:   fmt.Sprintf("compact_%s_%x", typeName, h.Sum64()),
+		Source: fmt.Sprintf(compactSrc, typeName, predicate),
+	}
+	if err := EnsureKernel(spec); err != nil {
+		return nil, 0, err
+	}
+	flagsKernel, err := sess.Kernel(ctx, spec.Name, "compactFlags")
+	if err != nil {
+		return nil, 0, err
+	}
+	defer flagsKernel.Release()
+	scatterKernel, err := sess.Kernel(ctx, spec.Name, "compactScatter")
+	if err != nil {
+		return nil, 0, err
+	}
+	defer scatterKernel.Release()
+
+	ops := deviceCompact[T]{deviceScan: deviceScan[uint32]{sess: sess}, flagsKernel: flagsKernel,
+		scatterKernel: scatterKernel}
+	return compactWith[*Buffer[T], *Buffer[uint32]](ctx, ops, in, in.Len)
+}
+
+// compactOps are the kernel launches a compaction is made of, on elements in buffers of type B and flags and
+// positions in buffers of type F.
+type compactOps[B, F any] interface {
+	scanOps[F]
+	allocOutput(n int) (B, error)
+	releaseOutput(buf B)
+	// flags evaluates the predicate for the first n elements of in into 0/1 flags, like compactFlags.
+	flags(ctx context.Context, in B, flags F, n int) error
+	// readAt reads element i of buf back to the host.
+	readAt(ctx context.Context, buf F, i int) (uint32, error)
+	// scatter writes the flagged elements of in to their positions in out, like compactScatter.
+	scatter(ctx context.Context, in B, flags, positions F, out B, n int) error
+}
+
+// compactWith compacts the first n elements of in with ops. It returns the output buffer and the number of kept
+// elements, or the zero B and 0 if n is 0.
+func compactWith[B, F any](ctx context.Context, ops compactOps[B, F], in B, n int) (B, int, error) {
+	var zero B
+	if n == 0 {
+		return zero, 0, nil
+	}
+	flags, err := ops.alloc(n)
+	if err != nil {
+		return zero, 0, err
+	}
+	defer ops.release(flags)
+	positions, err := ops.alloc(n)
+	if err != nil {
+		return zero, 0, err
+	}
+	defer ops.release(positions)
+
+	if err := ops.flags(ctx, in, flags, n); err != nil {
+		return zero, 0, err
+	}
+	if err := scanWith[F](ctx, ops, flags, positions, n, false, 0); err != nil {
+		return zero, 0, err
+	}
+
+	// The number of kept elements is the last position plus the last flag.
+	last, err := ops.readAt(ctx, positions, n-1)
+	if err != nil {
+		return zero, 0, err
+	}
+	lastFlag, err := ops.readAt(ctx, flags, n-1)
+	if err != nil {
+		return zero, 0, err
+	}
+	count := int(last + lastFlag)
+
+	out, err := ops.allocOutput(n)
+	if err != nil {
+		return zero, 0, err
+	}
+	if err := ops.scatter(ctx, in, flags, positions, out, n); err != nil {
+		ops.releaseOutput(out)
+		return zero, 0, err
+	}
+	return out, count, nil
+}
+
+// deviceCompact launches the compaction kernels for T, built with the predicate, on the session of its scan.
+type deviceCompact[T Scannable] struct {
+	deviceScan[uint32]
+	flagsKernel, scatterKernel *cl.Kernel
+}
+
+func (d deviceCompact[T]) allocOutput(n int) (*Buffer[T], error) {
+	return NewBuffer[T](d.sess, cl.MemReadWrite, n)
+}
+
+func (d deviceCompact[T]) releaseOutput(buf *Buffer[T]) {
+	buf.Release()
+}
+
+func (d deviceCompact[T]) flags(ctx context.Context, in *Buffer[T], flags *Buffer[uint32], n int) error {
+	if err := setKernelArgs(d.flagsKernel, in, flags, uint32(n)); err != nil {
+		return err
+	}
+	return d.sess.Run(ctx, d.flagsKernel, []int{(n + 63) / 64 * 64}, nil)
+}
+
+func (d deviceCompact[T]) readAt(ctx context.Context, buf *Buffer[uint32], i int) (uint32, error) {
+	v := make([]uint32, 1)
+	if err := buf.ReadAt(ctx, i, v); err != nil {
+		return 0, err
+	}
+	return v[0], nil
+}
+
+func (d deviceCompact[T]) scatter(ctx context.Context, in *Buffer[T], flags, positions *Buffer[uint32],
+	out *Buffer[T], n int) error {
+	if err := setKernelArgs(d.scatterKernel, in, flags, positions, out, uint32(n)); err != nil {
+		return err
+	}
+	return d.sess.Run(ctx, d.scatterKernel, []int{(n + 63) / 64 * 64}, nil)
+}
+
+// scanCPU is the host reference for InclusiveScan and ExclusiveScan.
+func scanCPU[T Scannable](data []T, inclusive bool) []T {
+	out := make([]T, len(data))
+	var acc T
+	for i, v := range data {
+		if inclusive {
+			acc += v
+			out[i] = acc
+		} else {
+			out[i] = acc
+			acc += v
+		}
+	}
+	return out
+}
+
+// verifyScan scans data both ways on the device and compares with scanCPU. The inputs are small integers, so
+// float32 sums are exact and the results must match bit for bit.
+func verifyScan[T Scannable](ctx context.Context, sess *Session, data []T) error {
+	in, err := NewBufferFrom(ctx, sess, cl.MemReadOnly, data)
+	if err != nil {
+		return err
+	}
+	defer in.Release()
+	out, err := NewBuffer[T](sess, cl.MemReadWrite, len(data))
+	if err != nil {
+		return err
+	}
+	defer out.Release()
+
+	for _, inclusive := range []bool{true, false} {
+		kind := "exclusive"
+		if inclusive {
+			kind = "inclusive"
+		}
+		st := time.Now()
+		if inclusive {
+			err = InclusiveScan(ctx, sess, in, out)
+		} else {
+			err = ExclusiveScan(ctx, sess, in, out)
+		}
+		if err != nil {
+			return fmt.Errorf("%s %s scan of %d: %w", clTypeName[T](), kind, len(data), err)
+		}
+		took := time.Since(st)
+		got, err := out.ReadAll(ctx)
+		if err != nil {
+			return err
+		}
+		want := scanCPU(data, inclusive)
+		for i := range want {
+			if got[i] != want[i] {
+				return fmt.Errorf("%s %s scan of %d: element %d is %v, expected %v", clTypeName[T](), kind, len(data), i, got[i], want[i])
+			}
+		}
+		fmt.Printf("%s %s scan of %d elements OK, took %v\n", clTypeName[T](), kind, len(data), took)
+	}
+	return nil
+}
+
+// ScanDemo verifies inclusive and exclusive scans of several lengths, including ones that need more than one
+// level of block sums, and then compacts a float buffer down to its positive values.
+func ScanDemo(ctx context.Context, deviceIndex int) error {
+	devices, err := getDevices()
+	if err != nil {
+		return err
+	}
+	sess, err := NewSession(devices, deviceIndex)
+	if err != nil {
+		return err
+	}
+	defer sess.Release()
+	fmt.Println(sess)
+
+	for _, n := range []int{1, 7, 512, 1000, 65537, 1<<20 + 3} {
+		ints := make([]int32, n)
+		uints := make([]uint32, n)
+		floats := make([]float32, n)
+		for i := 0; i < n; i++ {
+			ints[i] = int32(i%7) - 3
+			uints[i] = uint32(i % 5)
+			floats[i] = float32(i % 3)
+		}
+		if err := verifyScan(ctx, sess, ints); err != nil {
+			return err
+		}
+		if err := verifyScan(ctx, sess, uints); err != nil {
+			return err
+		}
+		if err := verifyScan(ctx, sess, floats); err != nil {
+			return err
+		}
+	}
+
+	// Compaction: think of the values as ray hit distances where negative means the ray missed.
+	n := 1<<20 + 11
+	distances := make([]float32, n)
+	var want []float32
+	for i := range distances {
+		distances[i] = float32((i*7919)%1000) - 500
+		if distances[i] > 0 {
+			want = append(want, distances[i])
+		}
+	}
+	in, err := NewBufferFrom(ctx, sess, cl.MemReadOnly, distances)
+	if err != nil {
+		return err
+	}
+	defer in.Release()
+
+	st := time.Now()
+	out, count, err := Compact(ctx, sess, in, "int predicate(T value) { return value > 0; }")
+	if err != nil {
+		return err
+	}
+	defer out.Release()
+	took := time.Since(st)
+	if count != len(want) {
+		return fmt.Errorf("compact kept %d elements, expected %d", count, len(want))
+	}
+	got := make([]float32, count)
+	if err := out.Read(ctx, got); err != nil {
+		return err
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			return fmt.Errorf("compacted element %d is %v, expected %v", i, got[i], want[i])
+		}
+	}
+	fmt.Printf("compact kept %d of %d elements OK, took %v\n", count, n, took)
+	return nil
+}
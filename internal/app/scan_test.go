@@ -0,0 +1,128 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+// scanLengths are the lengths worth scanning with work-groups of localSize: empty, a single element, around one
+// block, around the most one level of block sums covers, and long enough for three levels.
+func scanLengths(localSize int) []int {
+	block := 2 * localSize
+	return []int{0, 1, block - 1, block, block + 1, block*block - 1, block * block, block*block + 1,
+		3*block*block + 5}
+}
+
+// testScan scans data made with value for every length of scanLengths, both ways, and compares with scanCPU.
+func testScan[T Scannable](t *testing.T, value func(i int) T) {
+	const localSize = 4
+	for _, n := range scanLengths(localSize) {
+		data := make([]T, n)
+		for i := range data {
+			data[i] = value(i)
+		}
+		for _, inclusive := range []bool{false, true} {
+			t.Run(fmt.Sprintf("n=%d inclusive=%v", n, inclusive), func(t *testing.T) {
+				ops := &refScan[T]{maxLocal: localSize}
+				out := make([]T, n)
+				if err := scanWith[[]T](context.Background(), ops, data, out, n, inclusive, 0); err != nil {
+					t.Fatal(err)
+				}
+				want := scanCPU(data, inclusive)
+				for i := range want {
+					if out[i] != want[i] {
+						t.Fatalf("element %d is %v, expected %v", i, out[i], want[i])
+					}
+				}
+
+				// Every level divides the length by the block size until one block is left.
+				levels := 0
+				for m := n; m > 0; m = (m + 2*localSize - 1) / (2 * localSize) {
+					levels++
+					if m <= 2*localSize {
+						break
+					}
+				}
+				if len(ops.blockLaunches) != levels {
+					t.Errorf("scanned %d levels %v, expected %d", len(ops.blockLaunches), ops.blockLaunches, levels)
+				}
+			})
+		}
+	}
+}
+
+func TestScanInt32(t *testing.T) {
+	testScan(t, func(i int) int32 { return int32(i%7) - 3 })
+}
+
+func TestScanUint32(t *testing.T) {
+	testScan(t, func(i int) uint32 { return uint32(i % 5) })
+}
+
+// The inputs are small integers, so the float32 sums are exact.
+func TestScanFloat32(t *testing.T) {
+	testScan(t, func(i int) float32 { return float32(i%3) - 0.5 })
+}
+
+func TestScanInPlace(t *testing.T) {
+	data := []int32{3, 1, 4, 1, 5, 9, 2, 6, 5, 3, 5, 8, 9, 7, 9, 3, 2, 3, 8, 4}
+	want := scanCPU(data, true)
+	if err := scanWith[[]int32](context.Background(), &refScan[int32]{maxLocal: 2}, data, data, len(data), true,
+		0); err != nil {
+		t.Fatal(err)
+	}
+	for i := range want {
+		if data[i] != want[i] {
+			t.Fatalf("element %d is %d, expected %d", i, data[i], want[i])
+		}
+	}
+}
+
+func TestScanLocalSize(t *testing.T) {
+	for _, tt := range []struct{ maxLocal, want int }{{1024, 256}, {256, 256}, {200, 128}, {1, 1}} {
+		ops := &refScan[int32]{maxLocal: tt.maxLocal}
+		data := make([]int32, 10)
+		if err := scanWith[[]int32](context.Background(), ops, data, data, len(data), false, 0); err != nil {
+			t.Fatal(err)
+		}
+		if got := ops.blockLaunches[0][1]; got != tt.want {
+			t.Errorf("work group size %d: scanned with local size %d, expected %d", tt.maxLocal, got, tt.want)
+		}
+	}
+}
+
+func TestCompact(t *testing.T) {
+	positive := func(v float32) bool { return v > 0 }
+	tests := []struct {
+		name string
+		in   []float32
+		want []float32
+	}{
+		{name: "empty", in: nil, want: nil},
+		{name: "single kept", in: []float32{1}, want: []float32{1}},
+		{name: "single dropped", in: []float32{-1}, want: nil},
+		{name: "none survive", in: []float32{-1, -2, 0, -4, -5, -6, -7, -8, -9, -10, -11}, want: nil},
+		{name: "all survive", in: []float32{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+			want: []float32{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}},
+		{name: "some survive", in: []float32{-1, 2, 0, 4, -5, 6, 7, -8, 9, -10, 11, 12, -13},
+			want: []float32{2, 4, 6, 7, 9, 11, 12}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ops := refCompact[float32]{refScan: &refScan[uint32]{maxLocal: 2}, predicate: positive}
+			out, count, err := compactWith[[]float32, []uint32](context.Background(), ops, tt.in, len(tt.in))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != len(tt.want) {
+				t.Fatalf("kept %d elements %v, expected %v", count, out, tt.want)
+			}
+			for i := range tt.want {
+				if out[i] != tt.want[i] {
+					t.Fatalf("element %d is %v, expected %v", i, out[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
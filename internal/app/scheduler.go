@@ -0,0 +1,157 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// PartFunc runs one partition of a problem on the given session. Implementations write their results into the
+// partition's region of a shared output slice, which is how the results end up gathered back in order.
+type PartFunc func(ctx context.Context, sess *Session, part Partition) error
+
+// Scheduler splits problems across several devices, each with its own Session.
+type Scheduler struct {
+	Sessions []*Session
+	Weights  []float64
+}
+
+// NewScheduler opens a session per device index. Until SetWeights or Calibrate is called all devices get an equal share.
+func NewScheduler(deviceIndexes []int) (*Scheduler, error) {
+	if len(deviceIndexes) == 0 {
+		return nil, fmt.Errorf("no devices given")
+	}
+	devices, err := getDevices()
+	if err != nil {
+		return nil, err
+	}
+	s := &Scheduler{}
+	for _, idx := range deviceIndexes {
+		sess, err := NewSession(devices, idx)
+		if err != nil {
+			s.Release()
+			return nil, err
+		}
+		s.Sessions = append(s.Sessions, sess)
+		s.Weights = append(s.Weights, 1)
+	}
+	return s, nil
+}
+
+// Release releases all sessions of the scheduler.
+func (s *Scheduler) Release() {
+	for _, sess := range s.Sessions {
+		sess.Release()
+	}
+}
+
+// SetWeights sets static relative weights, one per session, e.g. []float64{1, 3} gives the second device three times the work.
+func (s *Scheduler) SetWeights(weights []float64) error {
+	if len(weights) != len(s.Sessions) {
+		return fmt.Errorf("got %d weights for %d devices", len(weights), len(s.Sessions))
+	}
+	s.Weights = append([]float64{}, weights...)
+	return nil
+}
+
+// Calibrate measures each device's throughput by running a probe problem of size dims on it and uses the
+// measured units per second as weights. The probe runs twice per device and only the second run counts, so
+// one-off costs such as lazy kernel compilation don't skew the result.
+func (s *Scheduler) Calibrate(ctx context.Context, dims []int, run PartFunc) error {
+	weights, err := calibrateWeights(ctx, len(s.Sessions), dims, s.partRunner(run), time.Now)
+	if err != nil {
+		return err
+	}
+	s.Weights = weights
+	return nil
+}
+
+// calibrateWeights is Calibrate for devices numbered 0 to devices-1, which run is called with as the partition's
+// Device. The probe runs are timed with now.
+func calibrateWeights(ctx context.Context, devices int, dims []int, run func(context.Context, Partition) error,
+	now func() time.Time) ([]float64, error) {
+	weights := make([]float64, devices)
+	for i := range weights {
+		part := Partition{Device: i, Offset: 0, Count: dims[len(dims)-1], Global: append([]int{}, dims...)}
+		if err := run(ctx, part); err != nil {
+			return nil, fmt.Errorf("calibrate: %w", err)
+		}
+		st := now()
+		if err := run(ctx, part); err != nil {
+			return nil, fmt.Errorf("calibrate: %w", err)
+		}
+		elapsed := now().Sub(st)
+		if elapsed <= 0 {
+			elapsed = time.Nanosecond
+		}
+		weights[i] = float64(part.Count) / elapsed.Seconds()
+	}
+	return weights, nil
+}
+
+// partRunner adapts run to the scheduler's sessions, naming the session in errors.
+func (s *Scheduler) partRunner(run PartFunc) func(context.Context, Partition) error {
+	return func(ctx context.Context, part Partition) error {
+		sess := s.Sessions[part.Device]
+		if err := run(ctx, sess, part); err != nil {
+			return fmt.Errorf("%s: %w", sess, err)
+		}
+		return nil
+	}
+}
+
+// Split partitions a problem of size dims across the sessions according to the current weights.
+func (s *Scheduler) Split(dims []int, align int) ([]Partition, error) {
+	return SplitWeighted(dims, s.Weights, align)
+}
+
+// Run executes all partitions concurrently, one goroutine per partition, and waits for all of them. The first
+// error encountered is returned. A failing partition cancels the context passed to the others, so they can stop
+// early instead of finishing work whose result will be thrown away.
+func (s *Scheduler) Run(ctx context.Context, parts []Partition, run PartFunc) error {
+	return runPartitions(ctx, parts, s.partRunner(run))
+}
+
+// runPartitions is Run for any run function, with the partitions' Device telling run where to run them.
+func runPartitions(ctx context.Context, parts []Partition, run func(context.Context, Partition) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(parts))
+	for i := range parts {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := run(ctx, parts[i]); err != nil {
+				errs[i] = err
+				cancel()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Prefer reporting a real failure over the cancellations it caused in the other partitions.
+	var firstErr error
+	for _, err := range errs {
+		if err != nil && !errors.Is(err, context.Canceled) {
+			return err
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// printPartitions prints which device got which part of the problem.
+func (s *Scheduler) printPartitions(parts []Partition) {
+	for _, p := range parts {
+		fmt.Printf("%s: weight %.3g, offset %d, count %d, global %v\n", s.Sessions[p.Device], s.Weights[p.Device], p.Offset, p.Count, p.Global)
+	}
+}
@@ -0,0 +1,104 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestSchedulerSimulatedSpeeds calibrates reference devices of different speeds, splits a problem by the measured
+// throughput and checks that the results are gathered back in order.
+func TestSchedulerSimulatedSpeeds(t *testing.T) {
+	clock := &refClock{}
+	devices := []*refDevice{
+		{name: "slow", perElement: 4 * time.Microsecond, clock: clock},
+		{name: "fast", perElement: time.Microsecond, clock: clock},
+	}
+	n := 16384
+	in := make([]int32, n)
+	for i := range in {
+		in[i] = int32(i % 1000)
+	}
+	out := make([]int32, n)
+	run := refDevices(devices, in, out)
+
+	weights, err := calibrateWeights(context.Background(), len(devices), []int{4096}, run, clock.Now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 4096 elements take the slow device 16.384ms and the fast one 4.096ms.
+	if want := []float64{4096 / 0.016384, 4096 / 0.004096}; math.Abs(weights[0]-want[0]) > 1e-6 ||
+		math.Abs(weights[1]-want[1]) > 1e-6 {
+		t.Errorf("calibrated weights %v, expected %v", weights, want)
+	}
+
+	parts, err := SplitWeighted([]int{n}, weights, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) != 2 || parts[1].Count <= parts[0].Count {
+		t.Fatalf("got partitions %v, expected the fast device to get the larger one", parts)
+	}
+	if err := runPartitions(context.Background(), parts, run); err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range in {
+		if out[i] != v*v {
+			t.Fatalf("element %d is %d, expected %d", i, out[i], v*v)
+		}
+	}
+}
+
+// TestRunCancelsSiblings checks that a failing partition cancels the others and its error is the one returned.
+func TestRunCancelsSiblings(t *testing.T) {
+	errBroken := errors.New("device lost")
+	devices := []*refDevice{
+		{name: "slow", perElement: time.Millisecond},
+		{name: "broken", fail: errBroken},
+		{name: "slow too", perElement: time.Millisecond},
+	}
+	n := 3000
+	in, out := make([]int32, n), make([]int32, n)
+	parts, err := SplitWeighted([]int{n}, []float64{1, 1, 1}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var canceled int32
+	square := refDevices(devices, in, out)
+	run := func(ctx context.Context, part Partition) error {
+		err := square(ctx, part)
+		if errors.Is(err, context.Canceled) {
+			atomic.AddInt32(&canceled, 1)
+		}
+		return err
+	}
+
+	// Uncanceled, the slow devices take a second for their thousand elements.
+	st := time.Now()
+	err = runPartitions(context.Background(), parts, run)
+	if !errors.Is(err, errBroken) {
+		t.Fatalf("got error %v, expected %v", err, errBroken)
+	}
+	if took := time.Since(st); took > 500*time.Millisecond {
+		t.Errorf("Run took %v, the slow partitions weren't canceled", took)
+	}
+	if canceled != 2 {
+		t.Errorf("%d partitions saw the cancellation, expected 2", canceled)
+	}
+}
+
+func TestRunCanceledContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	called := false
+	err := runPartitions(ctx, []Partition{{Count: 1, Global: []int{1}}}, func(context.Context, Partition) error {
+		called = true
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) || called {
+		t.Errorf("got error %v with run called %v, expected context.Canceled without calling run", err, called)
+	}
+}
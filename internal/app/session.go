@@ -0,0 +1,205 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"github.com/jgillich/go-opencl/cl"
+	"sync"
+	"unsafe"
+)
+
+// Session bundles the OpenCL objects every demo sets up for a single device: the device itself, a context
+// and a command queue bound to that device.
+type Session struct {
+	Index   int
+	Device  *cl.Device
+	Context *cl.Context
+	Queue   *cl.CommandQueue
+	// BuildOptions are added to the options of every program the session builds. NewSession starts out with
+	// DefaultBuildOptions.
+	BuildOptions BuildOptions
+
+	// inflight tracks Finish calls abandoned because their context was done, Release waits for them.
+	inflight sync.WaitGroup
+
+	capsOnce sync.Once
+	caps     Capabilities
+
+	// programs caches programs built from the kernel registry, keyed by spec name and build options.
+	programsMu sync.Mutex
+	programs   map[string]*cl.Program
+
+	// gemmTuned caches the GEMM variant and tile size MatMul autotuned, keyed by element type and build options.
+	gemmMu    sync.Mutex
+	gemmTuned map[string]gemmChoice
+}
+
+// getDevices returns all devices of the first platform, in the same order as the -device index refers to them.
+func getDevices() ([]*cl.Device, error) {
+	platforms, err := cl.GetPlatforms()
+	if err != nil {
+		return nil, fmt.Errorf("get platforms: %w", err)
+	}
+	if len(platforms) == 0 {
+		return nil, fmt.Errorf("GetPlatforms returned no platforms")
+	}
+	devices, err := platforms[0].GetDevices(cl.DeviceTypeAll)
+	if err != nil {
+		return nil, fmt.Errorf("get devices: %w", err)
+	}
+	if len(devices) == 0 {
+		return nil, fmt.Errorf("GetDevices returned no devices")
+	}
+	return devices, nil
+}
+
+// NewSession creates a context and command queue for devices[deviceIndex].
+func NewSession(devices []*cl.Device, deviceIndex int) (*Session, error) {
+	if deviceIndex < 0 || deviceIndex >= len(devices) {
+		return nil, fmt.Errorf("device index %d out of range, %d devices available", deviceIndex, len(devices))
+	}
+	device := devices[deviceIndex]
+	context, err := cl.CreateContext([]*cl.Device{device})
+	if err != nil {
+		return nil, fmt.Errorf("create context for %s: %w", device.Name(), err)
+	}
+	queue, err := context.CreateCommandQueue(device, 0)
+	if err != nil {
+		context.Release()
+		return nil, fmt.Errorf("create command queue for %s: %w", device.Name(), err)
+	}
+	return &Session{Index: deviceIndex, Device: device, Context: context, Queue: queue, BuildOptions: DefaultBuildOptions()}, nil
+}
+
+// BuildKernel compiles src for the session's device with the session's BuildOptions and returns the kernel called
+// name.
+func (s *Session) BuildKernel(ctx context.Context, src, name string) (*cl.Kernel, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	program, err := s.Context.CreateProgramWithSource([]string{src})
+	if err != nil {
+		return nil, fmt.Errorf("create program: %w", err)
+	}
+	// The kernel keeps its own reference to the program, so we can let go of ours once the kernel exists.
+	defer program.Release()
+
+	if err := program.BuildProgram(nil, s.BuildOptions.String()); err != nil {
+		return nil, fmt.Errorf("build program with options %q: %w", s.BuildOptions, err)
+	}
+	kernel, err := program.CreateKernel(name)
+	if err != nil {
+		return nil, fmt.Errorf("create kernel %s: %w", name, err)
+	}
+	return kernel, nil
+}
+
+// Finish blocks until all commands in the session's queue have completed, or until ctx is done. In the latter case
+// the commands are abandoned: they still run to completion on the device, but Finish returns ctx.Err() right away.
+func (s *Session) Finish(ctx context.Context) error {
+	return s.wait(ctx, s.Queue.Finish)
+}
+
+// wait runs the blocking call block, returning its error, or ctx.Err() as soon as ctx is done. An abandoned call
+// keeps running in the background and is waited for by Release.
+func (s *Session) wait(ctx context.Context, block func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	s.inflight.Add(1)
+	go func() {
+		defer s.inflight.Done()
+		done <- block()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Run enqueues kernel over the given global and local work sizes and waits for it using Finish. Nothing is
+// enqueued if ctx is already done.
+func (s *Session) Run(ctx context.Context, kernel *cl.Kernel, global, local []int) error {
+	event, err := s.Enqueue(ctx, kernel, global, local)
+	if err != nil {
+		return err
+	}
+	defer event.Release()
+	return s.Finish(ctx)
+}
+
+// Enqueue enqueues kernel over the given global and local work sizes without waiting for it. The returned event
+// completes when the kernel has run and must be released. Nothing is enqueued if ctx is already done.
+func (s *Session) Enqueue(ctx context.Context, kernel *cl.Kernel, global, local []int) (*Event, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	event, err := s.Queue.EnqueueNDRangeKernel(kernel, nil, global, local, nil)
+	if err != nil {
+		return nil, fmt.Errorf("enqueue kernel: %w", err)
+	}
+	return &Event{sess: s, event: event}, nil
+}
+
+// Event is a command enqueued in a session's queue, such as a kernel launched by the wrappers clgen generates.
+type Event struct {
+	sess  *Session
+	event *cl.Event
+}
+
+// Wait blocks until the command has completed, or until ctx is done. In the latter case the command is abandoned
+// like in Session.Finish.
+func (e *Event) Wait(ctx context.Context) error {
+	return e.sess.wait(ctx, func() error {
+		return cl.WaitForEvents([]*cl.Event{e.event})
+	})
+}
+
+// Release frees the event. The command itself still runs to completion.
+func (e *Event) Release() {
+	e.event.Release()
+}
+
+// Release frees the queue and context. The session must not be used afterwards. If a Finish call was abandoned
+// because its context was done, Release first waits for the abandoned commands to complete.
+func (s *Session) Release() {
+	s.inflight.Wait()
+	s.programsMu.Lock()
+	for _, program := range s.programs {
+		program.Release()
+	}
+	s.programs = nil
+	s.programsMu.Unlock()
+	s.gemmMu.Lock()
+	s.gemmTuned = nil
+	s.gemmMu.Unlock()
+	s.Queue.Release()
+	s.Context.Release()
+}
+
+func (s *Session) String() string {
+	return fmt.Sprintf("Device %d - %s", s.Index, s.Device.Name())
+}
+
+// writeSlice uploads data into buf, blocking until the transfer is done.
+func writeSlice[T any](queue *cl.CommandQueue, buf *cl.MemObject, data []T) error {
+	if len(data) == 0 {
+		return nil
+	}
+	size := int(unsafe.Sizeof(data[0])) * len(data)
+	_, err := queue.EnqueueWriteBuffer(buf, true, 0, size, unsafe.Pointer(&data[0]), nil)
+	return err
+}
+
+// readSlice downloads len(data) elements from buf into data, blocking until the transfer is done.
+func readSlice[T any](queue *cl.CommandQueue, buf *cl.MemObject, data []T) error {
+	if len(data) == 0 {
+		return nil
+	}
+	size := int(unsafe.Sizeof(data[0])) * len(data)
+	_, err := queue.EnqueueReadBuffer(buf, true, 0, size, unsafe.Pointer(&data[0]), nil)
+	return err
+}
@@ -0,0 +1,445 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"github.com/jgillich/go-opencl/cl"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// Sortable lists the key types Sort and SortByKey support.
+type Sortable interface {
+	uint32 | int32 | float32
+}
+
+// The sort kernels work on uint keys only. sortKeysSrc maps the other key types onto uints that order the same
+// way: signed ints get their sign bit flipped, floats get all bits flipped when negative and only the sign bit
+// flipped otherwise. The mapping is undone after sorting.
+var sortKeysSrc = `
+#define T %s
+#define AS_T as_%[1]s
+#define ENCODE(k) %s
+#define DECODE(k) %s
+
+__kernel void encodeKeys(
+   __global const T* input,
+   __global uint* output,
+   const unsigned int n)
+{
+   unsigned int i = get_global_id(0);
+   if (i < n) {
+      uint k = as_uint(input[i]);
+      output[i] = ENCODE(k);
+   }
+}
+
+__kernel void decodeKeys(
+   __global const uint* input,
+   __global T* output,
+   const unsigned int n)
+{
+   unsigned int i = get_global_id(0);
+   if (i < n) {
+      uint k = input[i];
+      output[i] = AS_T(DECODE(k));
+   }
+}
+`
+
+// sortSrc holds the two sorting paths. Large inputs take an LSD radix sort four bits at a time. Every work group
+// owns a tile of one key per work item: radixCount writes the tile's digit histogram, digit-major so that an
+// exclusive scan over all histograms gives every (digit, group) pair the position its keys start at, and
+// radixScatter moves each key there, after the keys of the same digit before it in the tile. That keeps every pass
+// stable. Small inputs are sorted by a bitonic network in the local memory of a single work group, using the
+// original index as tie breaker so that the result is stable too.
+var sortSrc = `
+#define RADIX_DIGITS 16
+
+__kernel void radixCount(
+   __global const uint* keys,
+   __global uint* histograms,
+   __local uint* digits,
+   const unsigned int n,
+   const unsigned int shift)
+{
+   unsigned int lid = get_local_id(0);
+   unsigned int i = get_global_id(0);
+   unsigned int size = get_local_size(0);
+
+   // Padding past n gets a digit no work item counts.
+   digits[lid] = i < n ? (keys[i] >> shift) & (RADIX_DIGITS - 1) : RADIX_DIGITS;
+   barrier(CLK_LOCAL_MEM_FENCE);
+
+   for (unsigned int d = lid; d < RADIX_DIGITS; d += size) {
+      unsigned int count = 0;
+      for (unsigned int j = 0; j < size; j++) {
+         count += digits[j] == d;
+      }
+      histograms[d * get_num_groups(0) + get_group_id(0)] = count;
+   }
+}
+
+__kernel void radixScatter(
+   __global const uint* keysIn,
+   __global const uint* valuesIn,
+   __global const uint* offsets,
+   __global uint* keysOut,
+   __global uint* valuesOut,
+   __local uint* digits,
+   const unsigned int n,
+   const unsigned int shift,
+   const int hasValues)
+{
+   unsigned int lid = get_local_id(0);
+   unsigned int i = get_global_id(0);
+
+   uint key = i < n ? keysIn[i] : 0;
+   uint digit = i < n ? (key >> shift) & (RADIX_DIGITS - 1) : RADIX_DIGITS;
+   digits[lid] = digit;
+   barrier(CLK_LOCAL_MEM_FENCE);
+   if (i >= n) {
+      return;
+   }
+
+   unsigned int rank = 0;
+   for (unsigned int j = 0; j < lid; j++) {
+      rank += digits[j] == digit;
+   }
+   unsigned int dst = offsets[digit * get_num_groups(0) + get_group_id(0)] + rank;
+   keysOut[dst] = key;
+   if (hasValues) {
+      valuesOut[dst] = valuesIn[i];
+   }
+}
+
+__kernel void bitonicSortLocal(
+   __global uint* keys,
+   __global uint* values,
+   __local uint* lkeys,
+   __local uint* lidx,
+   __local uint* lvalues,
+   const unsigned int n,
+   const int hasValues)
+{
+   unsigned int lid = get_local_id(0);
+   unsigned int size = get_local_size(0) * 2;
+
+   // Every work item loads two elements. Padding sorts last: it has the largest key and an index past n.
+   for (unsigned int j = lid; j < size; j += get_local_size(0)) {
+      lkeys[j] = j < n ? keys[j] : 0xFFFFFFFF;
+      lidx[j] = j;
+      if (hasValues) {
+         lvalues[j] = j < n ? values[j] : 0;
+      }
+   }
+
+   for (unsigned int block = 2; block <= size; block <<= 1) {
+      for (unsigned int stride = block >> 1; stride > 0; stride >>= 1) {
+         barrier(CLK_LOCAL_MEM_FENCE);
+         unsigned int pos = 2 * lid - (lid & (stride - 1));
+         unsigned int partner = pos + stride;
+         bool ascending = (pos & block) == 0;
+         uint ka = lkeys[pos], kb = lkeys[partner];
+         uint ia = lidx[pos], ib = lidx[partner];
+         bool greater = ka > kb || (ka == kb && ia > ib);
+         if (greater == ascending) {
+            lkeys[pos] = kb;
+            lkeys[partner] = ka;
+            lidx[pos] = ib;
+            lidx[partner] = ia;
+         }
+      }
+   }
+   barrier(CLK_LOCAL_MEM_FENCE);
+
+   for (unsigned int j = lid; j < n; j += get_local_size(0)) {
+      keys[j] = lkeys[j];
+      if (hasValues) {
+         values[j] = lvalues[lidx[j]];
+      }
+   }
+}
+`
+
+func init() {
+	RegisterKernel(KernelSpec{Name: "sort", Source: sortSrc})
+	RegisterKernel(KernelSpec{Name: "sortkeys_uint", Source: fmt.Sprintf(sortKeysSrc, "uint", "(k)", "(k)")})
+	RegisterKernel(KernelSpec{Name: "sortkeys_int", Source: fmt.Sprintf(sortKeysSrc, "int", "((k) ^ 0x80000000)", "((k) ^ 0x80000000)")})
+	RegisterKernel(KernelSpec{Name: "sortkeys_float", Source: fmt.Sprintf(sortKeysSrc, "float",
+		"(((k) & 0x80000000) ? ~(k) : ((k) ^ 0x80000000))",
+		"(((k) & 0x80000000) ? ((k) ^ 0x80000000) : ~(k))")})
+}
+
+// Sort sorts keys in ascending order in place.
+func Sort[T Sortable](ctx context.Context, sess *Session, keys *Buffer[T]) error {
+	return SortByKey(ctx, sess, keys, nil)
+}
+
+// SortByKey sorts keys in ascending order in place and applies the same permutation to values, e.g. sorting hit
+// record ids by distance. Equal keys keep their relative order. values may be nil.
+func SortByKey[T Sortable](ctx context.Context, sess *Session, keys *Buffer[T], values *Buffer[uint32]) error {
+	n := keys.Len
+	if values != nil && values.Len != n {
+		return fmt.Errorf("got %d values for %d keys", values.Len, n)
+	}
+	keySpec := "sortkeys_" + clTypeName[T]()
+
+	encoded, err := NewBuffer[uint32](sess, cl.MemReadWrite, n)
+	if err != nil {
+		return err
+	}
+	defer encoded.Release()
+	if err := runElementwise(ctx, sess, keySpec, "encodeKeys", n, keys, encoded, uint32(n)); err != nil {
+		return err
+	}
+
+	bitonicMax, err := bitonicMaxSize(ctx, sess)
+	if err != nil {
+		return err
+	}
+	if n <= bitonicMax {
+		err = bitonicSort(ctx, sess, encoded, values)
+	} else {
+		err = radixSort(ctx, sess, encoded, values)
+	}
+	if err != nil {
+		return err
+	}
+	return runElementwise(ctx, sess, keySpec, "decodeKeys", n, encoded, keys, uint32(n))
+}
+
+// runElementwise runs a one work item per element kernel from the registry over n elements.
+func runElementwise(ctx context.Context, sess *Session, spec, name string, n int, args ...interface{}) error {
+	kernel, err := sess.Kernel(ctx, spec, name)
+	if err != nil {
+		return err
+	}
+	defer kernel.Release()
+	if err := setKernelArgs(kernel, args...); err != nil {
+		return err
+	}
+	global := (n + 63) / 64 * 64
+	return sess.Run(ctx, kernel, []int{global}, nil)
+}
+
+// bitonicMaxSize returns the largest input the single work group bitonic path can sort on the session's device.
+// Each work item handles two elements and the local size is capped at 512.
+func bitonicMaxSize(ctx context.Context, sess *Session) (int, error) {
+	kernel, err := sess.Kernel(ctx, "sort", "bitonicSortLocal")
+	if err != nil {
+		return 0, err
+	}
+	defer kernel.Release()
+	maxLocal, err := kernel.WorkGroupSize(sess.Device)
+	if err != nil {
+		return 0, fmt.Errorf("get work group size: %w", err)
+	}
+	if maxLocal > 512 {
+		maxLocal = 512
+	}
+	return 2 * prevPowOf2(maxLocal), nil
+}
+
+func bitonicSort(ctx context.Context, sess *Session, keys *Buffer[uint32], values *Buffer[uint32]) error {
+	kernel, err := sess.Kernel(ctx, "sort", "bitonicSortLocal")
+	if err != nil {
+		return err
+	}
+	defer kernel.Release()
+
+	size := nextPowOf2(keys.Len)
+	if size < 2 {
+		size = 2
+	}
+	hasValues := int32(1)
+	if values == nil {
+		// The values argument must still be a valid buffer, it is just never touched.
+		values, hasValues = keys, 0
+	}
+	local := cl.LocalBuffer(size * 4)
+	if err := setKernelArgs(kernel, keys, values, local, local, local, uint32(keys.Len), hasValues); err != nil {
+		return err
+	}
+	return sess.Run(ctx, kernel, []int{size / 2}, []int{size / 2})
+}
+
+// radixBits is the width of the digits radixSort sorts by per pass. With 4 bits the 32 bit keys take 8 passes and a
+// work group's histogram is 16 counters.
+const radixBits = 4
+
+func radixSort(ctx context.Context, sess *Session, keys *Buffer[uint32], values *Buffer[uint32]) error {
+	n := keys.Len
+	countKernel, err := sess.Kernel(ctx, "sort", "radixCount")
+	if err != nil {
+		return err
+	}
+	defer countKernel.Release()
+	scatterKernel, err := sess.Kernel(ctx, "sort", "radixScatter")
+	if err != nil {
+		return err
+	}
+	defer scatterKernel.Release()
+
+	// Both kernels count over their tile in a loop, so tiles stay at 256 keys at most.
+	localSize := 256
+	for _, kernel := range []*cl.Kernel{countKernel, scatterKernel} {
+		maxLocal, err := kernel.WorkGroupSize(sess.Device)
+		if err != nil {
+			return fmt.Errorf("get work group size: %w", err)
+		}
+		if maxLocal < localSize {
+			localSize = prevPowOf2(maxLocal)
+		}
+	}
+	groups := (n + localSize - 1) / localSize
+	global := []int{groups * localSize}
+	digits := cl.LocalBuffer(localSize * 4)
+
+	// The histograms, the block sums of their scan and the buffers the passes ping-pong between are allocated
+	// once and reused by every pass.
+	histograms, err := NewBuffer[uint32](sess, cl.MemReadWrite, groups<<radixBits)
+	if err != nil {
+		return err
+	}
+	defer histograms.Release()
+	scratch := &scanScratch[uint32]{}
+	defer scratch.Release()
+	histScan := deviceScan[uint32]{sess: sess, scratch: scratch}
+	keysTmp, err := NewBuffer[uint32](sess, cl.MemReadWrite, n)
+	if err != nil {
+		return err
+	}
+	defer keysTmp.Release()
+
+	hasValues := int32(0)
+	valuesIn, valuesTmp := keys, keysTmp
+	if values != nil {
+		hasValues = 1
+		valuesIn = values
+		if valuesTmp, err = NewBuffer[uint32](sess, cl.MemReadWrite, n); err != nil {
+			return err
+		}
+		defer valuesTmp.Release()
+	}
+
+	// An even number of passes ping-pongs between the buffers, so the sorted result ends up back in keys and values.
+	srcKeys, dstKeys := keys, keysTmp
+	srcValues, dstValues := valuesIn, valuesTmp
+	for shift := 0; shift < 32; shift += radixBits {
+		if err := setKernelArgs(countKernel, srcKeys, histograms, digits, uint32(n), uint32(shift)); err != nil {
+			return err
+		}
+		if err := sess.Run(ctx, countKernel, global, []int{localSize}); err != nil {
+			return err
+		}
+		if err := scanWith[*Buffer[uint32]](ctx, histScan, histograms, histograms, histograms.Len, false, 0); err != nil {
+			return err
+		}
+		if err := setKernelArgs(scatterKernel, srcKeys, srcValues, histograms, dstKeys, dstValues, digits, uint32(n),
+			uint32(shift), hasValues); err != nil {
+			return err
+		}
+		if err := sess.Run(ctx, scatterKernel, global, []int{localSize}); err != nil {
+			return err
+		}
+		srcKeys, dstKeys = dstKeys, srcKeys
+		srcValues, dstValues = dstValues, srcValues
+	}
+	return nil
+}
+
+// verifySort sorts keys with indexes as values on the device, and checks the result against sort.SliceStable on the host.
+func verifySort[T Sortable](ctx context.Context, sess *Session, keys []T) (device, host time.Duration, err error) {
+	indexes := make([]uint32, len(keys))
+	for i := range indexes {
+		indexes[i] = uint32(i)
+	}
+	keyBuf, err := NewBufferFrom(ctx, sess, cl.MemReadWrite, keys)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer keyBuf.Release()
+	valueBuf, err := NewBufferFrom(ctx, sess, cl.MemReadWrite, indexes)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer valueBuf.Release()
+
+	st := time.Now()
+	if err := SortByKey(ctx, sess, keyBuf, valueBuf); err != nil {
+		return 0, 0, err
+	}
+	device = time.Since(st)
+
+	want := append([]T{}, keys...)
+	wantIndexes := append([]uint32{}, indexes...)
+	st = time.Now()
+	sort.SliceStable(wantIndexes, func(a, b int) bool { return want[wantIndexes[a]] < want[wantIndexes[b]] })
+	host = time.Since(st)
+
+	gotKeys, err := keyBuf.ReadAll(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	gotIndexes, err := valueBuf.ReadAll(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	for i := range wantIndexes {
+		if gotIndexes[i] != wantIndexes[i] || gotKeys[i] != keys[wantIndexes[i]] {
+			return 0, 0, fmt.Errorf("%s sort of %d: element %d is %v (index %d), expected %v (index %d)",
+				clTypeName[T](), len(keys), i, gotKeys[i], gotIndexes[i], keys[wantIndexes[i]], wantIndexes[i])
+		}
+	}
+	return device, host, nil
+}
+
+// SortBenchmark sorts random uint, int and float keys with their indexes as values, verifies the results and
+// compares the device time with sort.SliceStable on the host. The smallest size takes the bitonic path.
+func SortBenchmark(ctx context.Context, deviceIndex int) error {
+	devices, err := getDevices()
+	if err != nil {
+		return err
+	}
+	sess, err := NewSession(devices, deviceIndex)
+	if err != nil {
+		return err
+	}
+	defer sess.Release()
+	fmt.Println(sess)
+
+	rnd := rand.New(rand.NewSource(1))
+	fmt.Printf("Build options: %s\n", describeBuildOptions(sess.BuildOptions))
+	fmt.Println(
+		`| Device        | Type | Elements | Device  | Host (sort.SliceStable) |
+| ------------- |:-------------:| -----:| -----:| -----:|`)
+	for _, n := range []int{300, 1 << 16, 1 << 20, 1 << 22} {
+		uints := make([]uint32, n)
+		ints := make([]int32, n)
+		floats := make([]float32, n)
+		for i := 0; i < n; i++ {
+			uints[i] = rnd.Uint32()
+			ints[i] = int32(rnd.Uint32()) % 1000 // plenty of duplicates to check stability
+			floats[i] = float32(rnd.NormFloat64() * 1000)
+		}
+		report := func(typeName string, device, host time.Duration) {
+			fmt.Printf("| %s   | %s | %d | %v | %v |\n", sess.Device.Name(), typeName, n, device, host)
+		}
+		device, host, err := verifySort(ctx, sess, uints)
+		if err != nil {
+			return err
+		}
+		report("uint", device, host)
+		if device, host, err = verifySort(ctx, sess, ints); err != nil {
+			return err
+		}
+		report("int", device, host)
+		if device, host, err = verifySort(ctx, sess, floats); err != nil {
+			return err
+		}
+		report("float", device, host)
+	}
+	return nil
+}
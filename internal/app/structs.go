@@ -1,6 +1,7 @@
 package app
 
 import (
+	"context"
 	"fmt"
 	"github.com/jgillich/go-opencl/cl"
 	"github.com/sirupsen/logrus"
@@ -39,7 +40,7 @@ type MyStruct struct {
 	Padding   [48]byte   // 48 bytes => Total 128 bytes
 }
 
-func Structs(deviceIndex int) {
+func Structs(ctx context.Context, deviceIndex int) error {
 	wgSize := 256
 	// add first arg
 	input1 := make([]MyStruct, 0)
@@ -56,101 +57,97 @@ func Structs(deviceIndex int) {
 	ss := nextPowOf2(int(sx))
 
 	fmt.Printf("size of a MyStruct is: %d bytes\n", ss)
-	platforms, err := cl.GetPlatforms()
-	if err != nil {
-		logrus.Fatalf("Failed to get platforms: %+v", err)
-	}
-	platform := platforms[0]
-
-	devices, err := platform.GetDevices(cl.DeviceTypeAll)
-	if err != nil {
-		logrus.Fatalf("Failed to get devices: %+v", err)
-	}
-	if len(devices) == 0 {
-		logrus.Fatalf("GetDevices returned no devices")
-	}
+	// 1. Select a device to use. On my mac: 0 == CPU, 1 == Iris GPU, 2 == GeForce 750M GPU
+	// 2. The session holds an OpenCL context and a "Command Queue" bound to the selected device.
 	if deviceIndex < 0 {
 		deviceIndex = 0
 	}
-	device := devices[deviceIndex]
-	logrus.Infof("Using device %d %v", deviceIndex, device.Name())
-
-	// 1. Select a device to use. On my mac: 0 == CPU, 1 == Iris GPU, 2 == GeForce 750M GPU
-	// Use selected device to create an OpenCL context
-	context, err := cl.CreateContext([]*cl.Device{device})
+	sess, err := openDemoSession(deviceIndex)
 	if err != nil {
-		logrus.Fatalf("CreateContext failed: %+v", err)
+		return err
 	}
+	defer sess.Release()
+	device := sess.Device
+	logrus.Infof("Using device %d %v", deviceIndex, device.Name())
 
-	// 2. Create a "Command Queue" bound to the selected device
-	queue, err := context.CreateCommandQueue(device, 0)
-	if err != nil {
-		logrus.Fatalf("CreateCommandQueue failed: %+v", err)
+	// The struct holds double4s and the kernel prints them, so the device needs double precision and printf.
+	if err := sess.Capabilities().Check(Requirements{FP64: true, Printf: true}); err != nil {
+		logrus.Errorf("cannot run structs: %v", err)
+		return nil
 	}
 
 	// 3.1 Create an OpenCL "program" from the source code.
-	program, err := context.CreateProgramWithSource([]string{printRayStructSrc})
+	program, err := sess.Context.CreateProgramWithSource([]string{printRayStructSrc})
 	if err != nil {
-		logrus.Fatalf("CreateProgramWithSource failed: %+v", err)
+		return fmt.Errorf("create program: %w", err)
 	}
+	defer program.Release()
 
-	// 3.2 Build the OpenCL program (compile it?)
-	if err := program.BuildProgram(nil, ""); err != nil {
-		logrus.Fatalf("BuildProgram failed: %+v", err)
+	// 3.2 Build the OpenCL program (compile it?). -cl-kernel-arg-info keeps the argument names and types around
+	//     for step 4 on drivers that support it.
+	if err := program.BuildProgram(nil, sess.BuildOptions.For(device)); err != nil {
+		return fmt.Errorf("build program: %w", err)
 	}
 
 	// 3.3 Create the actual Kernel with a name, the Kernel is what we call when we want to execute something.
 	kernel, err := program.CreateKernel("printRayStruct")
 	if err != nil {
-		logrus.Fatalf("CreateKernel failed: %+v", err)
-	}
-
-	// 4. Some kind of error-check where we make sure the parameters passed are supported?
-	for i := 0; i < 2; i++ {
-		name, err := kernel.ArgName(i)
-		if err == cl.ErrUnsupported {
-			logrus.Errorf("GetKernelArgInfo for arg: %d ErrUnsupported", i)
-			break
-		} else if err != nil {
-			logrus.Errorf("GetKernelArgInfo for name failed: %+v", err)
-			break
-		} else {
-			logrus.Infof("Kernel arg %d: %s", i, name)
+		return fmt.Errorf("create kernel: %w", err)
+	}
+	defer kernel.Release()
+
+	// 4. Ask the driver what arguments the kernel expects. Drivers that don't keep argument info return
+	//    ErrKernelArgInfoNotAvailable or ErrUnsupported, in which case we parse the kernel's signature instead.
+	args, err := DescribeKernelArgs(kernel)
+	if err != nil {
+		logrus.Warnf("DescribeKernelArgs failed, parsing the source instead: %+v", err)
+		if args, err = ParseKernelArgs(printRayStructSrc, "printRayStruct"); err != nil {
+			logrus.Errorf("ParseKernelArgs failed: %+v", err)
 		}
 	}
+	for _, arg := range args {
+		logrus.Infof("Kernel arg %d: %s", arg.Index, arg)
+	}
 
 	// 5. Time to start loading data into GPU memory
 
 	// 5.1 create OpenCL buffers (memory) for the input data.
-	param1, err := context.CreateEmptyBuffer(cl.MemReadOnly, ss*len(input1))
+	param1, err := sess.Context.CreateEmptyBuffer(cl.MemReadOnly, ss*len(input1))
 	if err != nil {
-		logrus.Fatalf("CreateBuffer failed for matrices input: %+v", err)
+		return fmt.Errorf("create input buffer: %w", err)
 	}
+	defer param1.Release()
 
 	// 5.2 create OpenCL buffers (memory) for the output data
-	output, err := context.CreateEmptyBuffer(cl.MemWriteOnly, len(input1)*8)
+	output, err := sess.Context.CreateEmptyBuffer(cl.MemWriteOnly, len(input1)*8)
 	if err != nil {
-		logrus.Fatalf("CreateBuffer failed for output: %+v", err)
+		return fmt.Errorf("create output buffer: %w", err)
 	}
+	defer output.Release()
 
 	// 5.3 This is where we connect our input to the command queue, and upload the actual data into GPU memory
 	//     The dataPtr:s seems to be a point to the first element of the input,
 	//     while dataSize should be the total length of the data.
 	dataPtr := unsafe.Pointer(&input1[0])
 	dataSize := ss * len(input1)
-	if _, err := queue.EnqueueWriteBuffer(param1, true, 0, dataSize, dataPtr, nil); err != nil {
-		logrus.Fatalf("EnqueueWriteBuffer failed: %+v", err)
+	if _, err := sess.Queue.EnqueueWriteBuffer(param1, true, 0, dataSize, dataPtr, nil); err != nil {
+		return fmt.Errorf("write input: %w", err)
 	}
 
-	// 5.4 Kernel is our program and here we explicitly bind our 3 parameters to it
-	if err := kernel.SetArgs(param1, output); err != nil {
-		logrus.Fatalf("SetKernelArgs failed: %+v", err)
+	// 5.4 Kernel is our program and here we explicitly bind our 2 parameters to it. The signature parsed from
+	//     printRayStructSrc catches wrong argument counts or kinds even when the driver has no argument info.
+	checked, err := NewCheckedKernel(nil, kernel, "printRayStruct", printRayStructSrc)
+	if err != nil {
+		return fmt.Errorf("check kernel: %w", err)
+	}
+	if err := checked.SetArgs(param1, output); err != nil {
+		return fmt.Errorf("set kernel args: %w", err)
 	}
 
 	// 6. Determine device's WorkGroup size. This is probably how many items the GPU can process at a time.
 	local, err := kernel.WorkGroupSize(device)
 	if err != nil {
-		logrus.Fatalf("WorkGroupSize failed: %+v", err)
+		return fmt.Errorf("get work group size: %w", err)
 	}
 	logrus.Infof("Work group size: %d", local)
 	size, _ := kernel.PreferredWorkGroupSizeMultiple(nil)
@@ -168,14 +165,10 @@ func Structs(deviceIndex int) {
 
 	st := time.Now()
 
-	// 7. Finally, start work! Enqueue executes the loaded args on the specified kernel.
-	if _, err := queue.EnqueueNDRangeKernel(kernel, nil, []int{len(input1)}, nil, nil); err != nil {
-		logrus.Fatalf("EnqueueNDRangeKernel failed: %+v", err)
-	}
-
-	// 8. Finish() blocks the main goroutine until the OpenCL queue is empty, i.e. all calculations are done
-	if err := queue.Finish(); err != nil {
-		logrus.Fatalf("Finish failed: %+v", err)
+	// 7. Finally, start work! Run enqueues the kernel with the loaded args and
+	// 8. blocks until the OpenCL queue is empty, i.e. all calculations are done
+	if err := sess.Run(ctx, kernel, []int{len(input1)}, nil); err != nil {
+		return err
 	}
 
 	logrus.Infof("Took: %v", time.Since(st))
@@ -186,7 +179,8 @@ func Structs(deviceIndex int) {
 	// 10. The EnqueueReadBuffer copies the data in the OpenCL "output" buffer into the "results" slice.
 	dataPtrOut := unsafe.Pointer(&results[0])
 	dataSizeOut := int(unsafe.Sizeof(results[0])) * len(results)
-	if _, err := queue.EnqueueReadBuffer(output, true, 0, dataSizeOut, dataPtrOut, nil); err != nil {
-		logrus.Fatalf("EnqueueReadBuffer failed: %+v", err)
+	if _, err := sess.Queue.EnqueueReadBuffer(output, true, 0, dataSizeOut, dataPtrOut, nil); err != nil {
+		return fmt.Errorf("read output: %w", err)
 	}
+	return nil
 }
@@ -0,0 +1,11 @@
+//go:build cl10
+// +build cl10
+
+package app
+
+import "github.com/jgillich/go-opencl/cl"
+
+// createSubBuffer is unavailable before OpenCL 1.1, which introduced clCreateSubBuffer.
+func createSubBuffer(parent *cl.MemObject, flags cl.MemFlag, offset, size int) (*cl.MemObject, error) {
+	return nil, cl.ErrUnsupported
+}
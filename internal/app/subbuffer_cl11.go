@@ -0,0 +1,39 @@
+//go:build !cl10
+// +build !cl10
+
+package app
+
+// #cgo linux pkg-config: OpenCL
+// #cgo darwin LDFLAGS: -framework OpenCL
+// #define CL_USE_DEPRECATED_OPENCL_1_2_APIS
+// #if defined(__APPLE__)
+// #include <OpenCL/cl.h>
+// #else
+// #include <CL/cl.h>
+// #endif
+import "C"
+
+import (
+	"github.com/jgillich/go-opencl/cl"
+	"unsafe"
+)
+
+// createSubBuffer returns a buffer aliasing size bytes of parent starting at offset, with clCreateSubBuffer, which
+// the cl package doesn't wrap. offset must be a multiple of the device's MemBaseAddrAlign.
+func createSubBuffer(parent *cl.MemObject, flags cl.MemFlag, offset, size int) (*cl.MemObject, error) {
+	region := C.cl_buffer_region{origin: C.size_t(offset), size: C.size_t(size)}
+	var code C.cl_int
+	mem := C.clCreateSubBuffer(clMemHandle(parent), C.cl_mem_flags(flags),
+		C.CL_BUFFER_CREATE_TYPE_REGION, unsafe.Pointer(&region), &code)
+	switch code {
+	case C.CL_SUCCESS:
+		return newCLMemObject(mem, size), nil
+	case C.CL_MISALIGNED_SUB_BUFFER_OFFSET:
+		return nil, cl.ErrMisalignedSubBufferOffset
+	case C.CL_MEM_OBJECT_ALLOCATION_FAILURE:
+		return nil, cl.ErrMemObjectAllocationFailure
+	case C.CL_INVALID_VALUE:
+		return nil, cl.ErrInvalidValue
+	}
+	return nil, cl.ErrOther(code)
+}
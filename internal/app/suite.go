@@ -0,0 +1,256 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"github.com/jgillich/go-opencl/cl"
+	"time"
+)
+
+// fmaTemplateSrc keeps eight independent FMA chains per work item busy, enough to hide the FMA latency on most
+// devices, so the kernel is bound by arithmetic throughput. Every work item does fmaPerItem FMAs, i.e. twice as
+// many floating point operations.
+var fmaTemplateSrc = `
+#define FMA_LOOPS 128
+
+__kernel void fmaChain(
+   __global T* output,
+   const T b,
+   const T c)
+{
+   T a0 = (T)get_global_id(0);
+   T a1 = a0 + (T)1, a2 = a0 + (T)2, a3 = a0 + (T)3;
+   T a4 = a0 + (T)4, a5 = a0 + (T)5, a6 = a0 + (T)6, a7 = a0 + (T)7;
+   for (int i = 0; i < FMA_LOOPS; i++) {
+      a0 = fma(a0, b, c); a1 = fma(a1, b, c); a2 = fma(a2, b, c); a3 = fma(a3, b, c);
+      a4 = fma(a4, b, c); a5 = fma(a5, b, c); a6 = fma(a6, b, c); a7 = fma(a7, b, c);
+   }
+   // Storing the sum keeps the compiler from dropping the chains.
+   output[get_global_id(0)] = a0 + a1 + a2 + a3 + a4 + a5 + a6 + a7;
+}
+
+__kernel void empty(__global T* output)
+{
+}
+`
+
+const fmaPerItem = 8 * 128
+
+func init() {
+	RegisterTemplate(KernelTemplate{Name: "bench", Params: []string{"T"}, Source: fmaTemplateSrc})
+}
+
+// suiteTransferSizes returns the transfer sizes in bytes, 4K to 256M in steps of 4, up to maxAlloc.
+func suiteTransferSizes(maxAlloc int64) []int64 {
+	var sizes []int64
+	for size := int64(4 << 10); size <= 256<<20 && size <= maxAlloc; size *= 4 {
+		sizes = append(sizes, size)
+	}
+	return sizes
+}
+
+// benchTransfers measures host to device, device to host and device to device bandwidth for every size.
+func benchTransfers(ctx context.Context, sess *Session, out *BenchWriter, iterations int) error {
+	maxAlloc := sess.Device.MaxMemAllocSize()
+	// Two buffers of each size live at the same time for the copy benchmark.
+	if global := sess.Device.GlobalMemSize() / 4; global < maxAlloc {
+		maxAlloc = global
+	}
+	for _, size := range suiteTransferSizes(maxAlloc) {
+		host := make([]byte, size)
+		src, err := NewBuffer[byte](sess, cl.MemReadWrite, int(size))
+		if err != nil {
+			return err
+		}
+		dst, err := NewBuffer[byte](sess, cl.MemReadWrite, int(size))
+		if err != nil {
+			src.Release()
+			return err
+		}
+
+		// A device copy reads and writes every byte, so it moves twice the size.
+		runs := []struct {
+			name string
+			work int64
+			run  func() error
+		}{
+			{"h2d", size, func() error { return src.Write(ctx, host) }},
+			{"d2h", size, func() error { return src.Read(ctx, host) }},
+			{"d2d", 2 * size, func() error { return src.CopyTo(ctx, dst) }},
+		}
+		for _, r := range runs {
+			result := BenchResult{Benchmark: r.name, Device: sess.Device.Name(), Size: size, SizeUnit: "B",
+				Work: float64(r.work), WorkUnit: "B"}
+			for it := 0; it < iterations; it++ {
+				st := time.Now()
+				if err := r.run(); err != nil {
+					src.Release()
+					dst.Release()
+					return fmt.Errorf("%s of %d bytes: %w", r.name, size, err)
+				}
+				result.Samples = append(result.Samples, time.Since(st))
+			}
+			if err := out.Write(result); err != nil {
+				src.Release()
+				dst.Release()
+				return err
+			}
+		}
+		src.Release()
+		dst.Release()
+	}
+	return nil
+}
+
+// benchFMA measures the FLOPS of FMA chains in T.
+func benchFMA[T float32 | float64](ctx context.Context, sess *Session, out *BenchWriter, iterations int) error {
+	result := BenchResult{Benchmark: "fma", Device: sess.Device.Name(), Variant: clTypeName[T](),
+		BuildOptions: sess.BuildOptions.String(), WorkUnit: "FLOP"}
+	if err := sess.Capabilities().Check(typeRequirements(clTypeName[T]())); err != nil {
+		result.Skipped = err.Error()
+		return out.Write(result)
+	}
+	spec, err := Instantiate[T]("bench")
+	if err != nil {
+		return err
+	}
+
+	// Enough work items to fill every compute unit many times over.
+	items := 1 << 20
+	buf, err := NewBuffer[T](sess, cl.MemWriteOnly, items)
+	if err != nil {
+		return err
+	}
+	defer buf.Release()
+	kernel, err := sess.Kernel(ctx, spec, "fmaChain")
+	if err != nil {
+		return err
+	}
+	defer kernel.Release()
+	// b just below 1 and c = 0 keep the values finite for any number of loops.
+	if err := setKernelArgs(kernel, buf, T(0.999), T(0)); err != nil {
+		return err
+	}
+
+	result.Size, result.SizeUnit = int64(items), "elements"
+	result.Work = float64(2 * fmaPerItem * items)
+	// The first run includes the driver's lazy setup, so it isn't counted.
+	for it := -1; it < iterations; it++ {
+		st := time.Now()
+		if err := sess.Run(ctx, kernel, []int{items}, nil); err != nil {
+			return err
+		}
+		if it >= 0 {
+			result.Samples = append(result.Samples, time.Since(st))
+		}
+	}
+	return out.Write(result)
+}
+
+// benchLaunch measures the round trip of launching an empty kernel and waiting for it, the per-kernel cost of
+// enqueueing a batch of launches before a single Finish, and the cost of Finish on an empty queue.
+func benchLaunch(ctx context.Context, sess *Session, out *BenchWriter, iterations int) error {
+	spec, err := Instantiate[float32]("bench")
+	if err != nil {
+		return err
+	}
+	buf, err := NewBuffer[float32](sess, cl.MemWriteOnly, 1)
+	if err != nil {
+		return err
+	}
+	defer buf.Release()
+	kernel, err := sess.Kernel(ctx, spec, "empty")
+	if err != nil {
+		return err
+	}
+	defer kernel.Release()
+	if err := setKernelArgs(kernel, buf); err != nil {
+		return err
+	}
+
+	// The queue is used directly, without the goroutine Session.Finish uses for cancellation, to measure the
+	// driver rather than this package.
+	enqueue := func() error {
+		_, err := sess.Queue.EnqueueNDRangeKernel(kernel, nil, []int{1}, nil, nil)
+		return err
+	}
+	const batch = 64
+	runs := []struct {
+		name string
+		run  func() (time.Duration, error)
+	}{
+		{"launch+finish", func() (time.Duration, error) {
+			st := time.Now()
+			if err := enqueue(); err != nil {
+				return 0, err
+			}
+			err := sess.Queue.Finish()
+			return time.Since(st), err
+		}},
+		{fmt.Sprintf("enqueue (batch of %d)", batch), func() (time.Duration, error) {
+			st := time.Now()
+			for i := 0; i < batch; i++ {
+				if err := enqueue(); err != nil {
+					return 0, err
+				}
+			}
+			took := time.Since(st)
+			return took / batch, sess.Queue.Finish()
+		}},
+		{"finish (empty queue)", func() (time.Duration, error) {
+			st := time.Now()
+			err := sess.Queue.Finish()
+			return time.Since(st), err
+		}},
+	}
+	for _, r := range runs {
+		result := BenchResult{Benchmark: "latency", Device: sess.Device.Name(), Variant: r.name}
+		for it := -1; it < iterations; it++ {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			took, err := r.run()
+			if err != nil {
+				return fmt.Errorf("%s: %w", r.name, err)
+			}
+			if it >= 0 {
+				result.Samples = append(result.Samples, took)
+			}
+		}
+		if err := out.Write(result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BenchSuite characterizes a device in one run: host to device, device to host and on-device copy bandwidth over
+// transfer sizes from 4K to 256M, peak float and double FLOPS with FMA chains, and kernel launch and Finish
+// latency. Results go to the structured benchmark output, see SetBenchOutput.
+func BenchSuite(ctx context.Context, deviceIndex int) error {
+	devices, err := getDevices()
+	if err != nil {
+		return err
+	}
+	sess, err := NewSession(devices, deviceIndex)
+	if err != nil {
+		return err
+	}
+	defer sess.Release()
+	fmt.Println(sess)
+	fmt.Println(sess.Capabilities())
+	fmt.Printf("Build options: %s\n", describeBuildOptions(sess.BuildOptions))
+
+	out := benchWriter()
+	iterations := 16
+	if err := benchTransfers(ctx, sess, out, iterations); err != nil {
+		return err
+	}
+	if err := benchFMA[float32](ctx, sess, out, iterations); err != nil {
+		return err
+	}
+	if err := benchFMA[float64](ctx, sess, out, iterations); err != nil {
+		return err
+	}
+	return benchLaunch(ctx, sess, out, iterations)
+}
@@ -0,0 +1,341 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"github.com/eriklupander/ocltest/internal/benchreport"
+	"github.com/jgillich/go-opencl/cl"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseSize parses a size with an optional binary suffix, e.g. 64K or 16M.
+func parseSize(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	digits, mult := s, 1
+	switch {
+	case strings.HasSuffix(s, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		digits = s[:len(s)-1]
+	}
+	n, err := strconv.Atoi(digits)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
+
+// ParseSizes parses a -sizes flag value, either a comma separated list such as 1K,1M,16M or a range FROM..TO:STEP
+// where STEP is xN for a geometric or +N for an arithmetic progression, e.g. 1K..64M:x4. The step defaults to x2.
+// Sizes take the binary suffixes K, M and G.
+func ParseSizes(s string) ([]int, error) {
+	from, rest, isRange := strings.Cut(s, "..")
+	if !isRange {
+		var sizes []int
+		for _, f := range strings.Split(s, ",") {
+			if strings.TrimSpace(f) == "" {
+				continue
+			}
+			n, err := parseSize(f)
+			if err != nil {
+				return nil, err
+			}
+			sizes = append(sizes, n)
+		}
+		return sizes, nil
+	}
+
+	to, step, _ := strings.Cut(rest, ":")
+	if step == "" {
+		step = "x2"
+	}
+	start, err := parseSize(from)
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseSize(to)
+	if err != nil {
+		return nil, err
+	}
+	if end < start {
+		return nil, fmt.Errorf("size range %s ends before it starts", s)
+	}
+	var next func(int) int
+	switch {
+	case strings.HasPrefix(step, "x"):
+		factor, err := strconv.Atoi(step[1:])
+		if err != nil || factor < 2 {
+			return nil, fmt.Errorf("invalid size step %q, expected x2 or larger", step)
+		}
+		next = func(n int) int { return n * factor }
+	case strings.HasPrefix(step, "+"):
+		inc, err := parseSize(step[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid size step %q: %w", step, err)
+		}
+		next = func(n int) int { return n + inc }
+	default:
+		return nil, fmt.Errorf("invalid size step %q, expected xN or +N", step)
+	}
+	var sizes []int
+	for n := start; n <= end; n = next(n) {
+		sizes = append(sizes, n)
+	}
+	return sizes, nil
+}
+
+// sweepKernel describes how a benchmark's kernel is launched for a problem size, so it can be swept over sizes.
+type sweepKernel struct {
+	src, name string
+	// launch returns the global and local sizes processing n elements with local size lz in every dimension, or
+	// false if n can't be split that way.
+	launch func(n, lz int) (global, local []int, ok bool)
+}
+
+// sweepKernels are the benchmarks SizeSweep supports, keyed by op name. Every kernel reads and writes one 4 byte
+// element per element of the problem size.
+var sweepKernels = map[string]sweepKernel{
+	// benchmark runs on a square 2D range, so sizes that aren't squares are rounded down to one.
+	"benchmark": {benchmarkSrc, "squareRoot", func(n, lz int) ([]int, []int, bool) {
+		side := squareSide(n)
+		return []int{side, side}, []int{lz, lz}, side%lz == 0
+	}},
+	// Every benchmark2 work item processes 16 elements.
+	"benchmark2": {benchmark2Src, "squareRoot", func(n, lz int) ([]int, []int, bool) {
+		return []int{n / 16}, []int{lz}, n%16 == 0 && (n/16)%lz == 0
+	}},
+	"benchmark3": {benchmark3Src, "squareRoot", func(n, lz int) ([]int, []int, bool) {
+		return []int{n}, []int{lz}, n%lz == 0
+	}},
+	// Every batched-square work item processes as many elements as there are work items in its group.
+	"batched-square": {batchedSquareSrc, "square", func(n, lz int) ([]int, []int, bool) {
+		return []int{n / lz}, []int{lz}, n%(lz*lz) == 0
+	}},
+}
+
+// squareSide returns the side of the largest square with at most n elements.
+func squareSide(n int) int {
+	side := 1
+	for (side+1)*(side+1) <= n {
+		side++
+	}
+	return side
+}
+
+// SizeSweep runs the kernel of the benchmark op named benchmark, one of benchmark, benchmark2, benchmark3 and
+// batched-square, for every problem size in sizes (in elements) and every local size the kernel and size allow.
+// Results go to the structured benchmark output, see SetBenchOutput, followed by a grid of the time per element
+// with a row per size and a column per local size, which shows the size from which launch overhead stops
+// dominating.
+func SizeSweep(ctx context.Context, deviceIndex int, benchmark string, sizes []int) error {
+	sk, ok := sweepKernels[benchmark]
+	if !ok {
+		return fmt.Errorf("-sizes is only supported by benchmark, benchmark2, benchmark3 and batched-square, not %s", benchmark)
+	}
+	devices, err := getDevices()
+	if err != nil {
+		return err
+	}
+	sess, err := NewSession(devices, deviceIndex)
+	if err != nil {
+		return err
+	}
+	defer sess.Release()
+	fmt.Println(sess)
+	fmt.Printf("Build options: %s\n", describeBuildOptions(sess.BuildOptions))
+
+	kernel, err := sess.BuildKernel(ctx, sk.src, sk.name)
+	if err != nil {
+		return err
+	}
+	defer kernel.Release()
+	info, err := QueryKernelInfo(kernel, sess.Device)
+	if err != nil {
+		return err
+	}
+
+	out := benchWriter()
+	iterations := 16
+	localSizes := []int{1, 2, 4, 8, 16, 32, 64, 128, 256, 512, 1024}
+	var results []BenchResult
+	for _, n := range sizes {
+		if benchmark == "benchmark" {
+			side := squareSide(n)
+			n = side * side
+		}
+		if int64(4*n) > sess.Device.MaxMemAllocSize() {
+			result := BenchResult{Benchmark: benchmark, Device: sess.Device.Name(), Size: int64(n), SizeUnit: "elements",
+				Skipped: fmt.Sprintf("%d bytes exceed the max allocation of %d", 4*n, sess.Device.MaxMemAllocSize())}
+			if err := out.Write(result); err != nil {
+				return err
+			}
+			continue
+		}
+		sizeResults, err := sweepSize(ctx, sess, kernel, benchmark, sk, n, localSizes, info, iterations)
+		if err != nil {
+			return fmt.Errorf("%d elements: %w", n, err)
+		}
+		for _, r := range sizeResults {
+			if err := out.Write(r); err != nil {
+				return err
+			}
+		}
+		results = append(results, sizeResults...)
+	}
+	fmt.Println()
+	return WriteSweepGrid(os.Stdout, results)
+}
+
+// sweepSize measures kernel on n elements for every local size in localSizes that fits the kernel and device, see
+// measureLocalSizes.
+func sweepSize(ctx context.Context, sess *Session, kernel *cl.Kernel, benchmark string, sk sweepKernel, n int,
+	localSizes []int, info KernelInfo, iterations int) ([]BenchResult, error) {
+	data := make([]float32, n)
+	for i := range data {
+		data[i] = float32(i % 1024)
+	}
+	// batched-square's kernel works on ints. It squares the bit patterns of the floats, which doesn't change its
+	// timing.
+	in, err := NewBufferFrom(ctx, sess, cl.MemReadOnly, data)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Release()
+	output, err := NewBuffer[float32](sess, cl.MemWriteOnly, n)
+	if err != nil {
+		return nil, err
+	}
+	defer output.Release()
+	if err := setKernelArgs(kernel, in, output); err != nil {
+		return nil, err
+	}
+	return measureLocalSizes(ctx, sess, kernel, benchmark, sk, n, localSizes, info, iterations)
+}
+
+// measureLocalSizes times kernel, whose arguments are set, on n elements launched as sk describes, for every local
+// size in localSizes that fits the kernel and device. The results are annotated with the kernel's memory use and
+// the occupancy estimate for the local size.
+func measureLocalSizes(ctx context.Context, sess *Session, kernel *cl.Kernel, benchmark string, sk sweepKernel, n int,
+	localSizes []int, info KernelInfo, iterations int) ([]BenchResult, error) {
+	var results []BenchResult
+	for _, lz := range localSizes {
+		global, local, ok := sk.launch(n, lz)
+		if !ok {
+			continue
+		}
+		groupSize := 1
+		fits := true
+		for d, l := range local {
+			groupSize *= l
+			fits = fits && l <= info.MaxWorkItemSizes[d]
+		}
+		if !fits || groupSize > info.WorkGroupSize {
+			continue
+		}
+
+		result := BenchResult{Benchmark: benchmark, Device: sess.Device.Name(), Size: int64(n), SizeUnit: "elements",
+			LocalSize: lz, BuildOptions: sess.BuildOptions.String(), Work: float64(8 * n), WorkUnit: "B"}
+		info.annotate(&result, groupSize)
+		// The first run includes the driver's lazy setup, so it isn't counted.
+		for it := -1; it < iterations; it++ {
+			st := time.Now()
+			if err := sess.Run(ctx, kernel, global, local); err != nil {
+				return nil, err
+			}
+			if it >= 0 {
+				result.Samples = append(result.Samples, time.Since(st))
+			}
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// WriteSweepGrid prints results as Markdown grids of the mean time per element in nanoseconds, one per device and
+// benchmark, with a row per size and a column per local size. Skipped results and results without a size are left
+// out.
+func WriteSweepGrid(w io.Writer, results []BenchResult) error {
+	type gridKey struct{ device, benchmark, variant string }
+	type cellKey struct {
+		size  int64
+		local int
+	}
+	var keys []gridKey
+	grids := map[gridKey]map[cellKey]BenchResult{}
+	for _, r := range results {
+		if r.Skipped != "" || r.Size == 0 || len(r.Samples) == 0 {
+			continue
+		}
+		k := gridKey{r.Device, r.Benchmark, r.Variant}
+		if grids[k] == nil {
+			grids[k] = map[cellKey]BenchResult{}
+			keys = append(keys, k)
+		}
+		grids[k][cellKey{r.Size, r.LocalSize}] = r
+	}
+
+	for _, k := range keys {
+		var sizes []int64
+		var locals []int
+		seenSize, seenLocal := map[int64]bool{}, map[int]bool{}
+		for c := range grids[k] {
+			if !seenSize[c.size] {
+				seenSize[c.size] = true
+				sizes = append(sizes, c.size)
+			}
+			if !seenLocal[c.local] {
+				seenLocal[c.local] = true
+				locals = append(locals, c.local)
+			}
+		}
+		sort.Slice(sizes, func(i, j int) bool { return sizes[i] < sizes[j] })
+		sort.Ints(locals)
+
+		title := k.benchmark
+		if k.variant != "" {
+			title += " " + k.variant
+		}
+		var b strings.Builder
+		fmt.Fprintf(&b, "%s on %s, ns per element by size and local size:\n\n| Size |", title, k.device)
+		for _, l := range locals {
+			fmt.Fprintf(&b, " %d |", l)
+		}
+		b.WriteString(" Best |\n| -----:|")
+		for range locals {
+			b.WriteString(" -----:|")
+		}
+		b.WriteString(" -----:|\n")
+		for _, size := range sizes {
+			fmt.Fprintf(&b, "| %s |", benchreport.FormatSize(int64(size), ""))
+			best, bestNs := 0, 0.0
+			for _, l := range locals {
+				r, ok := grids[k][cellKey{size, l}]
+				if !ok {
+					b.WriteString(" - |")
+					continue
+				}
+				ns := float64(r.Mean()) / float64(size)
+				if best == 0 || ns < bestNs {
+					best, bestNs = l, ns
+				}
+				fmt.Fprintf(&b, " %.3f |", ns)
+			}
+			fmt.Fprintf(&b, " %d |\n", best)
+		}
+		b.WriteString("\n")
+		if _, err := io.WriteString(w, b.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
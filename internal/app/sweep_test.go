@@ -0,0 +1,58 @@
+package app
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSizes(t *testing.T) {
+	const (
+		K = 1 << 10
+		M = 1 << 20
+	)
+	tests := []struct {
+		s       string
+		want    []int
+		wantErr bool
+	}{
+		{s: "1024", want: []int{1024}},
+		{s: "1K,1M,16M", want: []int{K, M, 16 * M}},
+		{s: " 64K , 2G ,", want: []int{64 * K, 2 << 30}},
+		{s: "1K..64M:x4", want: []int{K, 4 * K, 16 * K, 64 * K, 256 * K, M, 4 * M, 16 * M, 64 * M}},
+		{s: "1K..8K", want: []int{K, 2 * K, 4 * K, 8 * K}},
+		{s: "1K..10K:x3", want: []int{K, 3 * K, 9 * K}},
+		{s: "100..400:+100", want: []int{100, 200, 300, 400}},
+		{s: "1K..4K:+1K", want: []int{K, 2 * K, 3 * K, 4 * K}},
+		{s: "1K..2500:+512", want: []int{K, 1536, 2 * K}},
+		{s: "4K..4K", want: []int{4 * K}},
+		{s: "8K..4K", wantErr: true},
+		{s: "1K..4K:x1", wantErr: true},
+		{s: "1K..4K:x", wantErr: true},
+		{s: "1K..4K:+0", wantErr: true},
+		{s: "1K..4K:+-1", wantErr: true},
+		{s: "1K..4K:*2", wantErr: true},
+		{s: "..4K", wantErr: true},
+		{s: "1K..", wantErr: true},
+		{s: "1Q", wantErr: true},
+		{s: "0", wantErr: true},
+		{s: "-1K", wantErr: true},
+		{s: "1K,,x", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			got, err := ParseSizes(tt.s)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %v, expected an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, expected %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,297 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"github.com/jgillich/go-opencl/cl"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KernelTemplate is an OpenCL program written against type parameters instead of concrete types. Each parameter,
+// e.g. T, is defined as a macro when the template is instantiated, together with its vector types T2, T3, T4, T8
+// and T16, so the source can use T and T4 like any other type.
+type KernelTemplate struct {
+	Name   string   // unique template name, e.g. "square"
+	Params []string // type parameter names, e.g. {"T"} or {"TIn", "TOut"}
+	Source string   // OpenCL C source using the parameters
+	// Options are build options every instantiation is compiled with.
+	Options BuildOptions
+	// Requires are the device features every instantiation needs. Instantiations with double or half add fp64 or
+	// fp16 to them.
+	Requires Requirements
+}
+
+var (
+	templatesMu sync.RWMutex
+	templates   = map[string]KernelTemplate{}
+)
+
+// RegisterTemplate adds t to the template registry. Like RegisterKernel it is meant for init functions and panics
+// on an empty or duplicate name, or a template without type parameters.
+func RegisterTemplate(t KernelTemplate) {
+	templatesMu.Lock()
+	defer templatesMu.Unlock()
+	if t.Name == "" {
+		panic("RegisterTemplate: empty template name")
+	}
+	if _, exists := templates[t.Name]; exists {
+		panic("RegisterTemplate: duplicate template " + t.Name)
+	}
+	if len(t.Params) == 0 {
+		panic("RegisterTemplate: template " + t.Name + " has no type parameters")
+	}
+	templates[t.Name] = t
+}
+
+// templateTypes are the OpenCL C scalar types type parameters can be bound to.
+var templateTypes = map[string]bool{
+	"char": true, "uchar": true, "short": true, "ushort": true, "int": true, "uint": true,
+	"long": true, "ulong": true, "half": true, "float": true, "double": true,
+}
+
+// typePragmas returns the extension pragmas a program using the given OpenCL C types needs: cl_khr_fp64 for double
+// and cl_khr_fp16 for half, including their vector types.
+func typePragmas(typeNames ...string) string {
+	r := typeRequirements(typeNames...)
+	var b strings.Builder
+	if r.FP64 {
+		b.WriteString("#pragma OPENCL EXTENSION cl_khr_fp64 : enable\n")
+	}
+	if r.FP16 {
+		b.WriteString("#pragma OPENCL EXTENSION cl_khr_fp16 : enable\n")
+	}
+	return b.String()
+}
+
+// InstantiateKernel registers the instantiation of the template called name for the given OpenCL C types, one per
+// type parameter in order, and returns its spec name, e.g. "square<double>". Instantiations are registered once
+// per template and type set, and like any spec their programs are built once per session and build options.
+func InstantiateKernel(name string, typeNames ...string) (string, error) {
+	templatesMu.RLock()
+	t, ok := templates[name]
+	templatesMu.RUnlock()
+	if !ok {
+		return "", fmt.Errorf("no kernel template registered as %q", name)
+	}
+	if len(typeNames) != len(t.Params) {
+		return "", fmt.Errorf("template %s takes %d type parameters, got %d", name, len(t.Params), len(typeNames))
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "// %s instantiated with", t.Name)
+	for i, param := range t.Params {
+		fmt.Fprintf(&b, " %s=%s", param, typeNames[i])
+	}
+	b.WriteString("\n" + typePragmas(typeNames...))
+	for i, param := range t.Params {
+		typeName := typeNames[i]
+		if !templateTypes[typeName] {
+			return "", fmt.Errorf("template %s: cannot bind %s to %q, not an OpenCL C scalar type", name, param, typeName)
+		}
+		fmt.Fprintf(&b, "#define %s %s\n", param, typeName)
+		for _, width := range []int{2, 3, 4, 8, 16} {
+			fmt.Fprintf(&b, "#define %s%d %s%d\n", param, width, typeName, width)
+		}
+	}
+	b.WriteString(t.Source)
+
+	spec := KernelSpec{
+		Name:     t.Name + "<" + strings.Join(typeNames, ",") + ">",
+		Source:   b.String(),
+		Options:  t.Options,
+		Requires: t.Requires.Merge(typeRequirements(typeNames...)),
+	}
+	if err := EnsureKernel(spec); err != nil {
+		return "", err
+	}
+	return spec.Name, nil
+}
+
+// Instantiate is InstantiateKernel for single-parameter templates, bound to the OpenCL type of T.
+func Instantiate[T any](name string) (string, error) {
+	typeName, ok := lookupCLTypeName[T]()
+	if !ok {
+		var zero T
+		return "", fmt.Errorf("template %s: no OpenCL type for %T", name, zero)
+	}
+	return InstantiateKernel(name, typeName)
+}
+
+var squareTemplateSrc = `
+__kernel void square(
+   __global const T* input,
+   __global T* output,
+   const unsigned int n)
+{
+   const unsigned int i = get_global_id(0);
+   if (i < n) {
+      output[i] = input[i] * input[i];
+   }
+}
+`
+
+// squareRootTemplateSrc works on four elements at a time, so n is the number of T4s.
+var squareRootTemplateSrc = `
+__kernel void squareRoot(
+   __global const T* input,
+   __global T* output,
+   const unsigned int n)
+{
+   const unsigned int i = get_global_id(0);
+   if (i < n) {
+      const T4 v = vload4(i, input);
+      vstore4(sqrt(v), i, output);
+   }
+}
+`
+
+func init() {
+	RegisterTemplate(KernelTemplate{Name: "square", Params: []string{"T"}, Source: squareTemplateSrc})
+	RegisterTemplate(KernelTemplate{Name: "squareRoot", Params: []string{"T"}, Source: squareRootTemplateSrc})
+}
+
+// Numeric are the Go types SquareBuffer is demonstrated with.
+type Numeric interface {
+	~int32 | ~uint16 | ~uint32 | ~float32 | ~float64
+}
+
+// SquareBuffer squares every element of in into out on the device, for any element type the template supports.
+func SquareBuffer[T Numeric](ctx context.Context, sess *Session, in, out *Buffer[T]) error {
+	if in.Len != out.Len {
+		return fmt.Errorf("buffer lengths differ: %d and %d", in.Len, out.Len)
+	}
+	spec, err := Instantiate[T]("square")
+	if err != nil {
+		return err
+	}
+	return runElementwise(ctx, sess, spec, "square", in.Len, in, out, uint32(in.Len))
+}
+
+// FloatingPoint are the floating point element types, including Half, which devices only compute in with
+// cl_khr_fp16.
+type FloatingPoint interface {
+	Float | Half
+}
+
+// SquareRootBuffer takes the square root of every element of in into out. The length must be a multiple of 4.
+func SquareRootBuffer[T FloatingPoint](ctx context.Context, sess *Session, in, out *Buffer[T]) error {
+	if in.Len != out.Len || in.Len%4 != 0 {
+		return fmt.Errorf("buffer lengths must be equal multiples of 4, got %d and %d", in.Len, out.Len)
+	}
+	spec, err := Instantiate[T]("squareRoot")
+	if err != nil {
+		return err
+	}
+	return runElementwise(ctx, sess, spec, "squareRoot", in.Len/4, in, out, uint32(in.Len/4))
+}
+
+// verifySquare runs SquareBuffer for T on the device and compares the result with the CPU.
+func verifySquare[T Numeric](ctx context.Context, sess *Session, n int) error {
+	data := make([]T, n)
+	for i := range data {
+		data[i] = T(i % 200)
+	}
+	in, err := NewBufferFrom(ctx, sess, cl.MemReadOnly, data)
+	if err != nil {
+		return err
+	}
+	defer in.Release()
+	out, err := NewBuffer[T](sess, cl.MemWriteOnly, n)
+	if err != nil {
+		return err
+	}
+	defer out.Release()
+
+	st := time.Now()
+	if err := SquareBuffer(ctx, sess, in, out); err != nil {
+		return err
+	}
+	took := time.Since(st)
+	got := make([]T, n)
+	if err := out.Read(ctx, got); err != nil {
+		return err
+	}
+	for i, v := range data {
+		if want := v * v; got[i] != want {
+			return fmt.Errorf("square<%s>: element %d is %v, expected %v", clTypeName[T](), i, got[i], want)
+		}
+	}
+	fmt.Printf("square<%s>: %d elements OK, took %v\n", clTypeName[T](), n, took)
+	return nil
+}
+
+// verifySquareRoot runs SquareRootBuffer for T on the device and compares the result with the CPU.
+func verifySquareRoot[T Float](ctx context.Context, sess *Session, n int) error {
+	data := make([]T, n)
+	for i := range data {
+		data[i] = T(i)
+	}
+	in, err := NewBufferFrom(ctx, sess, cl.MemReadOnly, data)
+	if err != nil {
+		return err
+	}
+	defer in.Release()
+	out, err := NewBuffer[T](sess, cl.MemWriteOnly, n)
+	if err != nil {
+		return err
+	}
+	defer out.Release()
+
+	st := time.Now()
+	if err := SquareRootBuffer(ctx, sess, in, out); err != nil {
+		return err
+	}
+	took := time.Since(st)
+	got := make([]T, n)
+	if err := out.Read(ctx, got); err != nil {
+		return err
+	}
+	for i, v := range data {
+		want := math.Sqrt(float64(v))
+		if math.Abs(float64(got[i])-want) > 1e-5*math.Max(1, want) {
+			return fmt.Errorf("squareRoot<%s>: element %d is %v, expected %v", clTypeName[T](), i, got[i], want)
+		}
+	}
+	fmt.Printf("squareRoot<%s>: %d elements OK, took %v\n", clTypeName[T](), n, took)
+	return nil
+}
+
+// TemplateDemo instantiates the square and squareRoot templates for several element types, including double where the device
+// supports it, and checks every instantiation against the CPU.
+func TemplateDemo(ctx context.Context, deviceIndex int) error {
+	devices, err := getDevices()
+	if err != nil {
+		return err
+	}
+	sess, err := NewSession(devices, deviceIndex)
+	if err != nil {
+		return err
+	}
+	defer sess.Release()
+	fmt.Println(sess)
+
+	n := 1 << 20
+	checks := []func() error{
+		func() error { return verifySquare[int32](ctx, sess, n) },
+		func() error { return verifySquare[uint16](ctx, sess, n) },
+		func() error { return verifySquare[uint32](ctx, sess, n) },
+		func() error { return verifySquare[float32](ctx, sess, n) },
+		func() error { return verifySquareRoot[float32](ctx, sess, n) },
+	}
+	if err := sess.Capabilities().Check(Requirements{FP64: true}); err != nil {
+		fmt.Printf("double: skipped, %v\n", err)
+	} else {
+		checks = append(checks,
+			func() error { return verifySquare[float64](ctx, sess, n) },
+			func() error { return verifySquareRoot[float64](ctx, sess, n) })
+	}
+	for _, check := range checks {
+		if err := check(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -7,3 +7,11 @@ func nextPowOf2(n int) int {
 	}
 	return k
 }
+
+func prevPowOf2(n int) int {
+	k := 1
+	for k<<1 <= n {
+		k = k << 1
+	}
+	return k
+}
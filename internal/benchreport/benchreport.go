@@ -0,0 +1,368 @@
+// Package benchreport renders structured benchmark results, as written by the demos with -bench-format=json, into
+// self-contained HTML or SVG charts. Like clparse it needs no OpenCL driver, and it only uses the standard library
+// so reports can be viewed offline.
+package benchreport
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Result is one measured configuration of a benchmark, with every sample kept so reports can show the spread. The
+// demos write it as app.BenchResult, one JSON object per line.
+type Result struct {
+	Benchmark string `json:"benchmark"` // e.g. "h2d" or "fma"
+	Device    string `json:"device"`
+	Variant   string `json:"variant,omitempty"` // e.g. the element type
+	// Size is the problem size in SizeUnit, e.g. bytes transferred or elements processed.
+	Size         int64  `json:"size,omitempty"`
+	SizeUnit     string `json:"size_unit,omitempty"`
+	LocalSize    int    `json:"local_size,omitempty"`
+	BuildOptions string `json:"build_options,omitempty"`
+	// Samples are the durations of the individual runs.
+	Samples []time.Duration `json:"samples_ns,omitempty"`
+	// Work is what a single run accomplishes in WorkUnit, "B" for bytes moved or "FLOP" for floating point
+	// operations. Throughput is derived from it.
+	Work     float64 `json:"work,omitempty"`
+	WorkUnit string  `json:"work_unit,omitempty"`
+	// Skipped explains why the configuration wasn't run, e.g. because the device lacks fp64.
+	Skipped string `json:"skipped,omitempty"`
+	// Annotations hold additional per-result information such as an occupancy estimate.
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// FormatAnnotations returns the annotations as key=value pairs sorted by key, e.g. "local_mem=0, occupancy=0.50".
+func (r Result) FormatAnnotations() string {
+	keys := make([]string, 0, len(r.Annotations))
+	for k := range r.Annotations {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = k + "=" + r.Annotations[k]
+	}
+	return strings.Join(pairs, ", ")
+}
+
+// Mean returns the average of the samples.
+func (r Result) Mean() time.Duration {
+	if len(r.Samples) == 0 {
+		return 0
+	}
+	var sum time.Duration
+	for _, s := range r.Samples {
+		sum += s
+	}
+	return sum / time.Duration(len(r.Samples))
+}
+
+// StdDev returns the sample standard deviation of the samples.
+func (r Result) StdDev() time.Duration {
+	if len(r.Samples) < 2 {
+		return 0
+	}
+	mean := float64(r.Mean())
+	var sq float64
+	for _, s := range r.Samples {
+		sq += (float64(s) - mean) * (float64(s) - mean)
+	}
+	return time.Duration(math.Sqrt(sq / float64(len(r.Samples)-1)))
+}
+
+// Throughput returns the work per second at the mean sample time in a readable unit, e.g. 12.3 "GB/s", or 0 and
+// "" if the result has no work.
+func (r Result) Throughput() (float64, string) {
+	mean := r.Mean()
+	if r.Work == 0 || mean == 0 {
+		return 0, ""
+	}
+	return r.Work / mean.Seconds() / 1e9, r.throughputUnit()
+}
+
+// throughputUnit returns the unit Work per second is reported in, e.g. GB/s.
+func (r Result) throughputUnit() string {
+	switch r.WorkUnit {
+	case "B":
+		return "GB/s"
+	case "FLOP":
+		return "GFLOPS"
+	}
+	return "G" + r.WorkUnit + "/s"
+}
+
+// Read decodes the results in r, one JSON object per line. Lines that aren't JSON objects, such as the device
+// description the demos print when results and other output share stdout, are ignored.
+func Read(r io.Reader) ([]Result, error) {
+	var results []Result
+	scanner := bufio.NewScanner(r)
+	// Results carry every sample, so lines can be long.
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(text, "{") {
+			continue
+		}
+		var result Result
+		if err := json.Unmarshal([]byte(text), &result); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		results = append(results, result)
+	}
+	return results, scanner.Err()
+}
+
+// Format selects the kind of report Write produces.
+type Format string
+
+const (
+	// HTML is a page with every chart inline and a table of all results.
+	HTML Format = "html"
+	// SVG is a single image with the charts stacked vertically.
+	SVG Format = "svg"
+)
+
+// ParseFormat parses a report format name.
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(s); f {
+	case HTML, SVG:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown report format %q, expected html or svg", s)
+}
+
+// Write renders results as a report in format. It draws a chart of the mean time against the local size for every
+// benchmark, variant and size run at several local sizes, with a line per device, and a chart of the throughput
+// against the problem size for every benchmark and variant run at several sizes, with a line per device at its best
+// local size. Error bars span one standard deviation of the samples either way.
+func Write(w io.Writer, results []Result, format Format, title string) error {
+	charts := append(localSizeCharts(results), sizeCharts(results)...)
+	var b strings.Builder
+	switch format {
+	case SVG:
+		writeSVGReport(&b, charts, title)
+	default:
+		writeHTMLReport(&b, charts, results, title)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// groupKey identifies the results drawn in one chart.
+type groupKey struct {
+	benchmark, variant string
+	size               int64
+}
+
+// measured returns the results that were run and have samples, which are the only ones charts can show.
+func measured(results []Result) []Result {
+	var out []Result
+	for _, r := range results {
+		if r.Skipped == "" && len(r.Samples) > 0 {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// localSizeCharts returns a chart of time against local size per benchmark, variant and size, for the groups run
+// at more than one local size.
+func localSizeCharts(results []Result) []chart {
+	var keys []groupKey
+	groups := map[groupKey][]Result{}
+	for _, r := range measured(results) {
+		if r.LocalSize == 0 {
+			continue
+		}
+		k := groupKey{r.Benchmark, r.Variant, r.Size}
+		if groups[k] == nil {
+			keys = append(keys, k)
+		}
+		groups[k] = append(groups[k], r)
+	}
+
+	var charts []chart
+	for _, k := range keys {
+		group := groups[k]
+		if distinct(group, func(r Result) float64 { return float64(r.LocalSize) }) < 2 {
+			continue
+		}
+		scale, unit := timeScale(group)
+		c := chart{
+			title:   chartTitle(k.benchmark, k.variant, k.size, group[0].SizeUnit),
+			xLabel:  "Local size",
+			yLabel:  "Mean time (" + unit + ")",
+			xFormat: func(x float64) string { return fmt.Sprint(int64(x)) },
+		}
+		for _, device := range devices(group) {
+			s := series{name: device}
+			for _, r := range group {
+				if r.Device == device {
+					s.points = append(s.points, point{x: float64(r.LocalSize), y: float64(r.Mean()) / scale,
+						err: float64(r.StdDev()) / scale})
+				}
+			}
+			c.series = append(c.series, s)
+		}
+		charts = append(charts, c)
+	}
+	return charts
+}
+
+// sizeCharts returns a chart of throughput against problem size per benchmark and variant, for those run at more
+// than one size. A device run at several local sizes is drawn at the best one for every size.
+func sizeCharts(results []Result) []chart {
+	var keys []groupKey
+	groups := map[groupKey][]Result{}
+	for _, r := range measured(results) {
+		if r.Size == 0 || r.Work == 0 {
+			continue
+		}
+		k := groupKey{benchmark: r.Benchmark, variant: r.Variant}
+		if groups[k] == nil {
+			keys = append(keys, k)
+		}
+		groups[k] = append(groups[k], r)
+	}
+
+	var charts []chart
+	for _, k := range keys {
+		group := groups[k]
+		if distinct(group, func(r Result) float64 { return float64(r.Size) }) < 2 {
+			continue
+		}
+		sizeUnit := group[0].SizeUnit
+		c := chart{
+			title:   chartTitle(k.benchmark, k.variant, 0, ""),
+			xLabel:  "Size",
+			yLabel:  "Throughput (" + group[0].throughputUnit() + ")",
+			xFormat: func(x float64) string { return FormatSize(int64(x), sizeUnit) },
+		}
+		for _, device := range devices(group) {
+			best := map[int64]point{}
+			for _, r := range group {
+				if r.Device != device {
+					continue
+				}
+				mean, sd := float64(r.Mean()), float64(r.StdDev())
+				p := point{x: float64(r.Size), y: r.Work / mean}
+				// The error bar is the throughput one standard deviation slower and faster than the mean.
+				if sd > 0 && sd < mean {
+					p.err = (r.Work/(mean-sd) - r.Work/(mean+sd)) / 2
+				}
+				if old, ok := best[r.Size]; !ok || p.y > old.y {
+					best[r.Size] = p
+				}
+			}
+			s := series{name: device}
+			for _, p := range best {
+				s.points = append(s.points, p)
+			}
+			c.series = append(c.series, s)
+		}
+		charts = append(charts, c)
+	}
+	return charts
+}
+
+// chartTitle names a chart after its benchmark, variant and, if not 0, size.
+func chartTitle(benchmark, variant string, size int64, sizeUnit string) string {
+	title := benchmark
+	if variant != "" {
+		title += " " + variant
+	}
+	if size > 0 {
+		title += ", " + FormatSize(size, sizeUnit)
+		if sizeUnit != "" && sizeUnit != "B" {
+			title += " " + sizeUnit
+		}
+	}
+	return title
+}
+
+// devices returns the devices in results in order of appearance.
+func devices(results []Result) []string {
+	var names []string
+	seen := map[string]bool{}
+	for _, r := range results {
+		if !seen[r.Device] {
+			seen[r.Device] = true
+			names = append(names, r.Device)
+		}
+	}
+	return names
+}
+
+// distinct returns the number of distinct values of key in results.
+func distinct(results []Result, key func(Result) float64) int {
+	seen := map[float64]bool{}
+	for _, r := range results {
+		seen[key(r)] = true
+	}
+	return len(seen)
+}
+
+// timeScale returns the nanoseconds per unit and the name of the unit the times of results read best in.
+func timeScale(results []Result) (float64, string) {
+	var max float64
+	for _, r := range results {
+		max = math.Max(max, float64(r.Mean()+r.StdDev()))
+	}
+	switch {
+	case max >= 1e9:
+		return 1e9, "s"
+	case max >= 1e6:
+		return 1e6, "ms"
+	case max >= 1e3:
+		return 1e3, "µs"
+	}
+	return 1, "ns"
+}
+
+// FormatSize formats n with binary suffixes, e.g. 64M for 64*1024*1024, adding B for sizes in unit "B".
+func FormatSize(n int64, unit string) string {
+	s := fmt.Sprint(n)
+	for _, u := range []struct {
+		suffix string
+		size   int64
+	}{{"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}} {
+		if n >= u.size && n%u.size == 0 {
+			s = fmt.Sprintf("%d%s", n/u.size, u.suffix)
+			break
+		}
+	}
+	if unit == "B" {
+		s += "B"
+	}
+	return s
+}
+
+// sortedResults returns results ordered by benchmark, variant, device, size and local size, for the result table.
+func sortedResults(results []Result) []Result {
+	sorted := append([]Result(nil), results...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if a.Benchmark != b.Benchmark {
+			return a.Benchmark < b.Benchmark
+		}
+		if a.Variant != b.Variant {
+			return a.Variant < b.Variant
+		}
+		if a.Device != b.Device {
+			return a.Device < b.Device
+		}
+		if a.Size != b.Size {
+			return a.Size < b.Size
+		}
+		return a.LocalSize < b.LocalSize
+	})
+	return sorted
+}
@@ -0,0 +1,231 @@
+package benchreport
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// samples returns durations in nanoseconds.
+func samples(ns ...int) []time.Duration {
+	d := make([]time.Duration, len(ns))
+	for i, n := range ns {
+		d[i] = time.Duration(n)
+	}
+	return d
+}
+
+func TestRead(t *testing.T) {
+	long := `{"benchmark":"h2d","device":"GPU","samples_ns":[` + strings.Repeat("100,", 20000) + `100]}`
+	tests := []struct {
+		name    string
+		input   string
+		want    []Result
+		wantErr string
+	}{
+		{
+			name: "results among other output",
+			input: "Device 0 - GPU: max work group size: 256\n\n" +
+				`{"benchmark":"h2d","device":"GPU","size":1024,"size_unit":"B","samples_ns":[100,200],"work":1024,"work_unit":"B"}` + "\n" +
+				"| Device | Benchmark |\n" +
+				`  {"benchmark":"fma","device":"CPU","variant":"float","skipped":"no fp64","annotations":{"occupancy":"0.50"}}  ` + "\n",
+			want: []Result{
+				{Benchmark: "h2d", Device: "GPU", Size: 1024, SizeUnit: "B", Samples: samples(100, 200), Work: 1024,
+					WorkUnit: "B"},
+				{Benchmark: "fma", Device: "CPU", Variant: "float", Skipped: "no fp64",
+					Annotations: map[string]string{"occupancy": "0.50"}},
+			},
+		},
+		{name: "no results", input: "Device 0 - GPU\n"},
+		{name: "malformed", input: "Device 0 - GPU\n{\"benchmark\":\"h2d\"}\n{\"benchmark\":\n", wantErr: "line 3"},
+		{name: "long lines", input: long + "\n",
+			want: []Result{{Benchmark: "h2d", Device: "GPU", Samples: samples(make([]int, 20001)...)}}},
+	}
+	for i := range tests[3].want[0].Samples {
+		tests[3].want[0].Samples[i] = 100
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Read(strings.NewReader(tt.input))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Read() error = %v, want it to mention %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Read() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Read() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMeanStdDevThroughput(t *testing.T) {
+	r := Result{Samples: samples(90, 90, 100, 110, 110), Work: 1000, WorkUnit: "B"}
+	if got := r.Mean(); got != 100 {
+		t.Errorf("Mean() = %v, want 100ns", got)
+	}
+	if got := r.StdDev(); got != 10 {
+		t.Errorf("StdDev() = %v, want 10ns", got)
+	}
+	if v, unit := r.Throughput(); math.Abs(v-10) > 1e-9 || unit != "GB/s" {
+		t.Errorf("Throughput() = %v %s, want 10 GB/s", v, unit)
+	}
+	if v, unit := (Result{Samples: samples(100)}).Throughput(); v != 0 || unit != "" {
+		t.Errorf("Throughput() without work = %v %q, want 0 \"\"", v, unit)
+	}
+	if got := (Result{Samples: samples(100)}).StdDev(); got != 0 {
+		t.Errorf("StdDev() of one sample = %v, want 0", got)
+	}
+}
+
+func TestSizeCharts(t *testing.T) {
+	results := []Result{
+		// Mean 100ns, std dev 10ns: 10 per ns, the best of the two local sizes.
+		{Benchmark: "h2d", Device: "A", Size: 1024, SizeUnit: "B", LocalSize: 64,
+			Samples: samples(90, 90, 100, 110, 110), Work: 1000, WorkUnit: "B"},
+		{Benchmark: "h2d", Device: "A", Size: 1024, SizeUnit: "B", LocalSize: 128, Samples: samples(200, 200),
+			Work: 1000, WorkUnit: "B"},
+		// No spread, so no error bar.
+		{Benchmark: "h2d", Device: "A", Size: 2048, SizeUnit: "B", LocalSize: 64, Samples: samples(50, 50),
+			Work: 4000, WorkUnit: "B"},
+		// The std dev exceeds the mean, so the slower bound would be infinite: no error bar.
+		{Benchmark: "h2d", Device: "B", Size: 1024, SizeUnit: "B", Samples: samples(10, 1000), Work: 1000,
+			WorkUnit: "B"},
+		{Benchmark: "h2d", Device: "B", Size: 2048, SizeUnit: "B", Skipped: "out of memory"},
+		// Run at a single size, so not charted.
+		{Benchmark: "fma", Device: "A", Size: 1024, Samples: samples(100), Work: 100, WorkUnit: "FLOP"},
+	}
+	charts := sizeCharts(results)
+	if len(charts) != 1 {
+		t.Fatalf("sizeCharts() returned %d charts, want 1", len(charts))
+	}
+	c := charts[0]
+	if c.title != "h2d" || c.yLabel != "Throughput (GB/s)" || c.xFormat(2048) != "2KB" {
+		t.Errorf("chart title %q, y label %q, x format %q", c.title, c.yLabel, c.xFormat(2048))
+	}
+	want := []series{
+		{name: "A", points: []point{{x: 1024, y: 10, err: (1000.0/90 - 1000.0/110) / 2}, {x: 2048, y: 80}}},
+		{name: "B", points: []point{{x: 1024, y: 1000.0 / 505}}},
+	}
+	if len(c.series) != len(want) {
+		t.Fatalf("chart has %d series, want %d", len(c.series), len(want))
+	}
+	for i, s := range c.series {
+		sort.Slice(s.points, func(i, j int) bool { return s.points[i].x < s.points[j].x })
+		if s.name != want[i].name || len(s.points) != len(want[i].points) {
+			t.Errorf("series %d = %+v, want %+v", i, s, want[i])
+			continue
+		}
+		for j, p := range s.points {
+			w := want[i].points[j]
+			if p.x != w.x || math.Abs(p.y-w.y) > 1e-9 || math.Abs(p.err-w.err) > 1e-9 {
+				t.Errorf("series %s point %d = %+v, want %+v", s.name, j, p, w)
+			}
+		}
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	tests := []struct {
+		n    int64
+		unit string
+		want string
+	}{
+		{n: 1000, want: "1000"},
+		{n: 1024, want: "1K"},
+		{n: 1536, want: "1536"},
+		{n: 64 << 20, want: "64M"},
+		{n: 2 << 30, unit: "B", want: "2GB"},
+		{n: 100, unit: "B", want: "100B"},
+		{n: 4096, unit: "elements", want: "4K"},
+	}
+	for _, tt := range tests {
+		if got := FormatSize(tt.n, tt.unit); got != tt.want {
+			t.Errorf("FormatSize(%d, %q) = %q, want %q", tt.n, tt.unit, got, tt.want)
+		}
+	}
+}
+
+// reportResults are charted once by local size, for h2d at 1K, and once by size.
+var reportResults = []Result{
+	{Benchmark: "h2d", Device: "A<1>", Size: 1024, SizeUnit: "B", LocalSize: 64, Samples: samples(90, 90, 100, 110, 110),
+		Work: 1000, WorkUnit: "B", Annotations: map[string]string{"regs": "32", "occupancy": "0.50"}},
+	{Benchmark: "h2d", Device: "A<1>", Size: 1024, SizeUnit: "B", LocalSize: 128, Samples: samples(200, 200),
+		Work: 1000, WorkUnit: "B"},
+	{Benchmark: "h2d", Device: "A<1>", Size: 2048, SizeUnit: "B", LocalSize: 64, Samples: samples(50, 50), Work: 4000,
+		WorkUnit: "B"},
+	{Benchmark: "fma", Device: "A<1>", Variant: "double", Skipped: "no fp64"},
+}
+
+func TestWriteSVG(t *testing.T) {
+	var b bytes.Buffer
+	if err := Write(&b, reportResults, SVG, "Runs & more"); err != nil {
+		t.Fatal(err)
+	}
+	out := b.String()
+	if !strings.HasPrefix(out, `<svg xmlns="http://www.w3.org/2000/svg" width="760" height="800"`) {
+		t.Errorf("report doesn't start with an SVG sized for two charts: %.100s", out)
+	}
+	for _, want := range []string{
+		"Runs &amp; more",
+		`<svg xmlns="http://www.w3.org/2000/svg" y="40"`,
+		`<svg xmlns="http://www.w3.org/2000/svg" y="420"`,
+		">h2d, 1KB</text>",
+		">Local size</text>",
+		">Throughput (GB/s)</text>",
+		">A&lt;1&gt;</text>",
+		"<path d=", // the error bar of the 1K run at local size 64
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("report lacks %q", want)
+		}
+	}
+	if n := strings.Count(out, "<svg"); n != 3 {
+		t.Errorf("report has %d <svg> elements, want 3", n)
+	}
+	if strings.Contains(out, "<table") {
+		t.Error("SVG report has a result table")
+	}
+}
+
+func TestWriteHTML(t *testing.T) {
+	var b bytes.Buffer
+	if err := Write(&b, reportResults, HTML, "Runs & more"); err != nil {
+		t.Fatal(err)
+	}
+	out := b.String()
+	for _, want := range []string{
+		"<title>Runs &amp; more</title>",
+		"<h1>Runs &amp; more</h1>",
+		"<td>A&lt;1&gt;</td><td>h2d</td><td></td><td>1KB</td><td>64</td><td>5</td><td>100ns</td><td>10ns</td>" +
+			"<td>10.00 GB/s</td><td>occupancy=0.50, regs=32</td></tr>",
+		`<td colspan="4">skipped: no fp64</td>`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("report lacks %q", want)
+		}
+	}
+	if n := strings.Count(out, "<svg"); n != 2 {
+		t.Errorf("report has %d charts, want 2", n)
+	}
+	// Rows are sorted by benchmark, so the skipped fma comes first.
+	if fma, h2d := strings.Index(out, "<td>fma</td>"), strings.Index(out, "<td>h2d</td>"); fma < 0 || fma > h2d {
+		t.Errorf("fma row at %d, h2d row at %d, want fma first", fma, h2d)
+	}
+
+	b.Reset()
+	if err := Write(&b, reportResults[3:], HTML, "Skipped"); err != nil {
+		t.Fatal(err)
+	}
+	if out := b.String(); !strings.Contains(out, "nothing to chart") || strings.Contains(out, "<svg") {
+		t.Errorf("report without charts = %s", out)
+	}
+}
@@ -0,0 +1,217 @@
+package benchreport
+
+import (
+	"fmt"
+	"html"
+	"math"
+	"sort"
+	"strings"
+)
+
+// chart is a line chart with a series per device. The x axis is logarithmic since local and problem sizes grow
+// geometrically, the y axis is linear from 0.
+type chart struct {
+	title, xLabel, yLabel string
+	xFormat               func(float64) string
+	series                []series
+}
+
+type series struct {
+	name   string
+	points []point
+}
+
+// point is a mean y at x, with an error bar of err either way.
+type point struct {
+	x, y, err float64
+}
+
+const (
+	chartWidth   = 760
+	chartHeight  = 380
+	marginLeft   = 70
+	marginRight  = 200 // room for the legend
+	marginTop    = 36
+	marginBottom = 56
+)
+
+// palette is a set of colors that stay distinguishable for the first few devices.
+var palette = []string{"#1f77b4", "#d62728", "#2ca02c", "#ff7f0e", "#9467bd", "#8c564b", "#e377c2", "#17becf"}
+
+// writeSVG draws c as an <svg> element at y, in the coordinate system of an enclosing SVG, or at 0 for an inline
+// chart.
+func writeSVG(b *strings.Builder, c chart, y int) {
+	plotW := float64(chartWidth - marginLeft - marginRight)
+	plotH := float64(chartHeight - marginTop - marginBottom)
+
+	var xs []float64
+	seenX := map[float64]bool{}
+	var maxY float64
+	for _, s := range c.series {
+		sort.Slice(s.points, func(i, j int) bool { return s.points[i].x < s.points[j].x })
+		for _, p := range s.points {
+			if !seenX[p.x] {
+				seenX[p.x] = true
+				xs = append(xs, p.x)
+			}
+			maxY = math.Max(maxY, p.y+p.err)
+		}
+	}
+	sort.Float64s(xs)
+	if len(xs) == 0 {
+		return
+	}
+	minLog, maxLog := math.Log2(xs[0]), math.Log2(xs[len(xs)-1])
+	if maxLog == minLog {
+		minLog, maxLog = minLog-1, maxLog+1
+	}
+	step := niceStep(maxY / 5)
+	top := step * math.Ceil(maxY/step)
+	if top == 0 {
+		top = 1
+	}
+	px := func(x float64) float64 { return marginLeft + (math.Log2(x)-minLog)/(maxLog-minLog)*plotW }
+	py := func(v float64) float64 { return marginTop + plotH - v/top*plotH }
+
+	fmt.Fprintf(b, `<svg xmlns="http://www.w3.org/2000/svg" y="%d" width="%d" height="%d" viewBox="0 0 %d %d" font-family="sans-serif" font-size="12">`+"\n",
+		y, chartWidth, chartHeight, chartWidth, chartHeight)
+	fmt.Fprintf(b, `<rect width="%d" height="%d" fill="white"/>`+"\n", chartWidth, chartHeight)
+	fmt.Fprintf(b, `<text x="%d" y="22" font-size="15" font-weight="bold">%s</text>`+"\n", marginLeft, html.EscapeString(c.title))
+
+	// Grid lines and y ticks.
+	for v := 0.0; v <= top*1.0001; v += step {
+		fmt.Fprintf(b, `<line x1="%d" y1="%.1f" x2="%.1f" y2="%.1f" stroke="#ddd"/>`+"\n", marginLeft, py(v), marginLeft+plotW, py(v))
+		fmt.Fprintf(b, `<text x="%d" y="%.1f" text-anchor="end" dominant-baseline="middle">%s</text>`+"\n", marginLeft-6, py(v), formatTick(v, step))
+	}
+	// x ticks at the measured values, thinned out so the labels don't overlap.
+	every := (len(xs) + 11) / 12
+	for i, x := range xs {
+		if i%every != 0 {
+			continue
+		}
+		fmt.Fprintf(b, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke="#888"/>`+"\n", px(x), marginTop+plotH, px(x), marginTop+plotH+4)
+		fmt.Fprintf(b, `<text x="%.1f" y="%.1f" text-anchor="middle">%s</text>`+"\n", px(x), marginTop+plotH+18, html.EscapeString(c.xFormat(x)))
+	}
+	fmt.Fprintf(b, `<rect x="%d" y="%d" width="%.1f" height="%.1f" fill="none" stroke="#888"/>`+"\n", marginLeft, marginTop, plotW, plotH)
+	fmt.Fprintf(b, `<text x="%.1f" y="%d" text-anchor="middle">%s</text>`+"\n", marginLeft+plotW/2, chartHeight-12, html.EscapeString(c.xLabel))
+	fmt.Fprintf(b, `<text transform="translate(16 %.1f) rotate(-90)" text-anchor="middle">%s</text>`+"\n", marginTop+plotH/2, html.EscapeString(c.yLabel))
+
+	for i, s := range c.series {
+		color := palette[i%len(palette)]
+		var line []string
+		for _, p := range s.points {
+			line = append(line, fmt.Sprintf("%.1f,%.1f", px(p.x), py(p.y)))
+		}
+		fmt.Fprintf(b, `<polyline points="%s" fill="none" stroke="%s" stroke-width="2"/>`+"\n", strings.Join(line, " "), color)
+		for _, p := range s.points {
+			x := px(p.x)
+			if p.err > 0 {
+				lo, hi := py(math.Max(p.y-p.err, 0)), py(p.y+p.err)
+				fmt.Fprintf(b, `<path d="M%.1f %.1fV%.1fM%.1f %.1fh8M%.1f %.1fh8" stroke="%s"/>`+"\n", x, lo, hi, x-4, lo, x-4, hi, color)
+			}
+			fmt.Fprintf(b, `<circle cx="%.1f" cy="%.1f" r="3" fill="%s"><title>%s: %s, %s</title></circle>`+"\n",
+				x, py(p.y), color, html.EscapeString(s.name), html.EscapeString(c.xFormat(p.x)), formatTick(p.y, step/100))
+		}
+		ly := marginTop + 8 + 18*i
+		fmt.Fprintf(b, `<rect x="%.1f" y="%d" width="12" height="12" fill="%s"/>`+"\n", marginLeft+plotW+14, ly, color)
+		fmt.Fprintf(b, `<text x="%.1f" y="%d">%s</text>`+"\n", marginLeft+plotW+32, ly+10, html.EscapeString(legendName(s.name)))
+	}
+	b.WriteString("</svg>\n")
+}
+
+// legendName shortens long device names so they fit next to the chart.
+func legendName(name string) string {
+	if r := []rune(name); len(r) > 26 {
+		return string(r[:25]) + "…"
+	}
+	return name
+}
+
+// niceStep rounds step up to 1, 2 or 5 times a power of ten.
+func niceStep(step float64) float64 {
+	if step <= 0 {
+		return 1
+	}
+	pow := math.Pow(10, math.Floor(math.Log10(step)))
+	for _, m := range []float64{1, 2, 5} {
+		if m*pow >= step {
+			return m * pow
+		}
+	}
+	return 10 * pow
+}
+
+// formatTick formats v with as many decimals as step needs.
+func formatTick(v, step float64) string {
+	decimals := 0
+	if step < 1 {
+		decimals = int(math.Ceil(-math.Log10(step)))
+	}
+	return fmt.Sprintf("%.*f", decimals, v)
+}
+
+// writeSVGReport writes the charts as one SVG image, stacked under a title.
+func writeSVGReport(b *strings.Builder, charts []chart, title string) {
+	height := 40 + chartHeight*len(charts)
+	fmt.Fprintf(b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-family="sans-serif">`+"\n", chartWidth, height)
+	fmt.Fprintf(b, `<rect width="%d" height="%d" fill="white"/>`+"\n", chartWidth, height)
+	fmt.Fprintf(b, `<text x="10" y="26" font-size="18" font-weight="bold">%s</text>`+"\n", html.EscapeString(title))
+	for i, c := range charts {
+		writeSVG(b, c, 40+chartHeight*i)
+	}
+	b.WriteString("</svg>\n")
+}
+
+// writeHTMLReport writes a page with the charts inline, followed by a table of all results.
+func writeHTMLReport(b *strings.Builder, charts []chart, results []Result, title string) {
+	fmt.Fprintf(b, `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>%s</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; font-size: 13px; }
+th, td { border: 1px solid #ccc; padding: 3px 8px; text-align: right; }
+th:nth-child(-n+3), td:nth-child(-n+3) { text-align: left; }
+</style>
+</head>
+<body>
+<h1>%s</h1>
+`, html.EscapeString(title), html.EscapeString(title))
+	if len(charts) == 0 {
+		b.WriteString("<p>No benchmark was run at several local or problem sizes, so there is nothing to chart.</p>\n")
+	}
+	for _, c := range charts {
+		b.WriteString("<div>\n")
+		writeSVG(b, c, 0)
+		b.WriteString("</div>\n")
+	}
+
+	b.WriteString(`<h2>Results</h2>
+<table>
+<tr><th>Device</th><th>Benchmark</th><th>Variant</th><th>Size</th><th>Local size</th><th>Samples</th><th>Mean</th><th>Std dev</th><th>Throughput</th><th>Annotations</th></tr>
+`)
+	for _, r := range sortedResults(results) {
+		size, local := "-", "-"
+		if r.Size > 0 {
+			size = FormatSize(r.Size, r.SizeUnit)
+		}
+		if r.LocalSize > 0 {
+			local = fmt.Sprint(r.LocalSize)
+		}
+		fmt.Fprintf(b, "<tr><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td>", html.EscapeString(r.Device),
+			html.EscapeString(r.Benchmark), html.EscapeString(r.Variant), size, local)
+		if r.Skipped != "" {
+			fmt.Fprintf(b, "<td colspan=\"4\">skipped: %s</td><td></td></tr>\n", html.EscapeString(r.Skipped))
+			continue
+		}
+		throughput := "-"
+		if v, unit := r.Throughput(); unit != "" {
+			throughput = fmt.Sprintf("%.2f %s", v, unit)
+		}
+		fmt.Fprintf(b, "<td>%d</td><td>%v</td><td>%v</td><td>%s</td><td>%s</td></tr>\n", len(r.Samples), r.Mean(),
+			r.StdDev(), throughput, html.EscapeString(r.FormatAnnotations()))
+	}
+	b.WriteString("</table>\n</body>\n</html>\n")
+}
@@ -0,0 +1,393 @@
+// Package clparse extracts kernel signatures from OpenCL C source without a driver. It understands just enough of
+// the language for that: comments, object-like #define macros, qualifiers, pointers and attributes. Kernel
+// bodies are skipped.
+package clparse
+
+import (
+	"fmt"
+	"strings"
+)
+
+// AddressSpace is the address space qualifier of a parameter.
+type AddressSpace int
+
+const (
+	Private AddressSpace = iota
+	Global
+	Local
+	Constant
+)
+
+func (a AddressSpace) String() string {
+	switch a {
+	case Private:
+		return "__private"
+	case Global:
+		return "__global"
+	case Local:
+		return "__local"
+	case Constant:
+		return "__constant"
+	}
+	return fmt.Sprintf("AddressSpace(%d)", int(a))
+}
+
+// Param is a kernel parameter.
+type Param struct {
+	Name string
+	// Type is the base type with macros expanded and unsigned types spelled like the OpenCL typedefs, e.g.
+	// "uint", "float4" or "struct tag_mystruct". For pointers it is the pointee type.
+	Type    string
+	Pointer bool
+	Address AddressSpace
+	// Const is set for const values and pointers to const.
+	Const    bool
+	Volatile bool
+	Restrict bool
+	// Access is the image access qualifier, "read_only", "write_only" or "read_write", if any.
+	Access string
+}
+
+// TypeName returns the type the way clGetKernelArgInfo reports it, e.g. "float*" or "uint".
+func (p Param) TypeName() string {
+	if p.Pointer {
+		return p.Type + "*"
+	}
+	return p.Type
+}
+
+// Kernel is the signature of a __kernel function.
+type Kernel struct {
+	Name   string
+	Params []Param
+	// Line is the line of the kernel's name in the source, starting at 1.
+	Line int
+}
+
+// Find returns the kernel called name from kernels.
+func Find(kernels []Kernel, name string) (Kernel, bool) {
+	for _, k := range kernels {
+		if k.Name == name {
+			return k, true
+		}
+	}
+	return Kernel{}, false
+}
+
+type token struct {
+	text string
+	line int
+}
+
+// tokenize splits src into identifiers, numbers and single punctuation characters, dropping comments and
+// preprocessor lines. Object-like macros are recorded in macros and expanded in the tokens that follow.
+func tokenize(src string) ([]token, error) {
+	var tokens []token
+	macros := map[string][]string{}
+	line := 1
+	atLineStart := true
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '\n':
+			line++
+			atLineStart = true
+			i++
+		case c == ' ' || c == '\t' || c == '\r' || c == '\f' || c == '\v':
+			i++
+		case c == '\\' && i+1 < len(src) && src[i+1] == '\n':
+			line++
+			i += 2
+		case strings.HasPrefix(src[i:], "//"):
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(src[i:], "/*"):
+			end := strings.Index(src[i+2:], "*/")
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: unterminated comment", line)
+			}
+			line += strings.Count(src[i:i+2+end], "\n")
+			i += end + 4
+		case c == '#' && atLineStart:
+			start := i
+			for i < len(src) && (src[i] != '\n' || src[i-1] == '\\') {
+				i++
+			}
+			directive := strings.ReplaceAll(src[start+1:i], "\\\n", " ")
+			line += strings.Count(src[start:i], "\n")
+			defineMacro(macros, directive)
+		case c == '"' || c == '\'':
+			// String and character literals only occur in bodies, e.g. printf formats. Skip them whole so their
+			// contents aren't taken for tokens.
+			j := i + 1
+			for j < len(src) && src[j] != c {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			tokens = append(tokens, token{text: src[i:min(j+1, len(src))], line: line})
+			i = j + 1
+			atLineStart = false
+		case isIdentStart(c) || isDigit(c):
+			j := i
+			for j < len(src) && (isIdentStart(src[j]) || isDigit(src[j])) {
+				j++
+			}
+			word := src[i:j]
+			if expansion, ok := macros[word]; ok {
+				for _, w := range expansion {
+					tokens = append(tokens, token{text: w, line: line})
+				}
+			} else {
+				tokens = append(tokens, token{text: word, line: line})
+			}
+			i = j
+			atLineStart = false
+		default:
+			tokens = append(tokens, token{text: string(c), line: line})
+			i++
+			atLineStart = false
+		}
+	}
+	return tokens, nil
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// defineMacro records `define NAME tokens...` directives. Function-like macros and other directives are ignored;
+// kernel signatures rarely use them.
+func defineMacro(macros map[string][]string, directive string) {
+	fields := strings.Fields(directive)
+	if len(fields) < 2 || fields[0] != "define" || strings.Contains(fields[1], "(") {
+		return
+	}
+	body := strings.Join(fields[2:], " ")
+	tokens, err := tokenize(body)
+	if err != nil {
+		return
+	}
+	var expansion []string
+	for _, t := range tokens {
+		// Expand macros defined earlier, as the preprocessor would when the macro is used.
+		if inner, ok := macros[t.text]; ok {
+			expansion = append(expansion, inner...)
+		} else {
+			expansion = append(expansion, t.text)
+		}
+	}
+	macros[fields[1]] = expansion
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// Parse returns the signatures of all kernels in src, in source order.
+func Parse(src string) ([]Kernel, error) {
+	tokens, err := tokenize(src)
+	if err != nil {
+		return nil, err
+	}
+
+	var kernels []Kernel
+	depth := 0
+	for i := 0; i < len(tokens); i++ {
+		switch t := tokens[i].text; {
+		case t == "{":
+			depth++
+		case t == "}":
+			depth--
+		case depth == 0 && (t == "__kernel" || t == "kernel"):
+			k, next, err := parseKernel(tokens, i+1)
+			if err != nil {
+				return nil, err
+			}
+			kernels = append(kernels, k)
+			i = next - 1
+		}
+	}
+	return kernels, nil
+}
+
+// skipAttributes skips __attribute__((...)) groups starting at i.
+func skipAttributes(tokens []token, i int) (int, error) {
+	for i < len(tokens) && tokens[i].text == "__attribute__" {
+		end, err := matchParen(tokens, i+1)
+		if err != nil {
+			return 0, err
+		}
+		i = end + 1
+	}
+	return i, nil
+}
+
+// matchParen returns the index of the parenthesis closing the one at i.
+func matchParen(tokens []token, i int) (int, error) {
+	if i >= len(tokens) || tokens[i].text != "(" {
+		return 0, fmt.Errorf("expected ( after line %d", tokens[min(i, len(tokens)-1)].line)
+	}
+	depth := 0
+	for j := i; j < len(tokens); j++ {
+		switch tokens[j].text {
+		case "(":
+			depth++
+		case ")":
+			depth--
+			if depth == 0 {
+				return j, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("line %d: unbalanced parentheses", tokens[i].line)
+}
+
+// parseKernel parses the signature following a __kernel keyword at i and returns the index after it.
+func parseKernel(tokens []token, i int) (Kernel, int, error) {
+	i, err := skipAttributes(tokens, i)
+	if err != nil {
+		return Kernel{}, 0, err
+	}
+	if i+2 >= len(tokens) || tokens[i].text != "void" {
+		line := tokens[min(i, len(tokens)-1)].line
+		return Kernel{}, 0, fmt.Errorf("line %d: kernels must return void", line)
+	}
+	k := Kernel{Name: tokens[i+1].text, Line: tokens[i+1].line}
+	end, err := matchParen(tokens, i+2)
+	if err != nil {
+		return Kernel{}, 0, err
+	}
+
+	var param []token
+	flush := func() error {
+		if len(param) == 0 {
+			return nil
+		}
+		p, err := parseParam(param)
+		if err != nil {
+			return fmt.Errorf("kernel %s: %w", k.Name, err)
+		}
+		if p != nil {
+			k.Params = append(k.Params, *p)
+		}
+		param = nil
+		return nil
+	}
+	depth := 0
+	for j := i + 3; j < end; j++ {
+		switch tokens[j].text {
+		case "(":
+			depth++
+		case ")":
+			depth--
+		case ",":
+			if depth == 0 {
+				if err := flush(); err != nil {
+					return Kernel{}, 0, err
+				}
+				continue
+			}
+		}
+		param = append(param, tokens[j])
+	}
+	if err := flush(); err != nil {
+		return Kernel{}, 0, err
+	}
+	return k, end + 1, nil
+}
+
+var unsignedTypes = map[string]string{"char": "uchar", "short": "ushort", "int": "uint", "long": "ulong"}
+
+// parseParam parses the tokens of one parameter declaration. It returns nil for a lone void.
+func parseParam(tokens []token) (*Param, error) {
+	var p Param
+	var typeWords []string
+	stars := 0
+	unsigned := false
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i].text
+		switch t {
+		case "__global", "global":
+			p.Address = Global
+		case "__local", "local":
+			p.Address = Local
+		case "__constant", "constant":
+			p.Address = Constant
+		case "__private", "private":
+			p.Address = Private
+		case "const":
+			p.Const = true
+		case "volatile":
+			p.Volatile = true
+		case "restrict", "__restrict":
+			p.Restrict = true
+		case "__read_only", "read_only", "__write_only", "write_only", "__read_write", "read_write":
+			p.Access = strings.TrimPrefix(t, "__")
+		case "signed":
+		case "unsigned":
+			unsigned = true
+		case "*":
+			stars++
+		case "__attribute__":
+			end, err := matchParen(tokens, i+1)
+			if err != nil {
+				return nil, err
+			}
+			i = end
+		case "[":
+			return nil, fmt.Errorf("line %d: array parameters are not allowed in kernels", tokens[i].line)
+		default:
+			if !isIdentStart(t[0]) {
+				return nil, fmt.Errorf("line %d: unexpected %q in parameter", tokens[i].line, t)
+			}
+			typeWords = append(typeWords, t)
+		}
+	}
+	if len(typeWords) == 1 && typeWords[0] == "void" && stars == 0 {
+		return nil, nil
+	}
+	if len(typeWords) < 2 && !(unsigned && len(typeWords) == 1) {
+		return nil, fmt.Errorf("line %d: cannot parse parameter %q", tokens[0].line, joinTokens(tokens))
+	}
+	if stars > 1 {
+		return nil, fmt.Errorf("line %d: pointers to pointers are not allowed in kernels", tokens[0].line)
+	}
+
+	p.Name = typeWords[len(typeWords)-1]
+	typeWords = typeWords[:len(typeWords)-1]
+	switch {
+	case unsigned && len(typeWords) == 0:
+		typeWords = []string{"uint"}
+	case unsigned && unsignedTypes[typeWords[0]] != "":
+		typeWords[0] = unsignedTypes[typeWords[0]]
+	}
+	// "long int" and friends are spelled without the int.
+	if len(typeWords) == 2 && typeWords[1] == "int" && typeWords[0] != "struct" {
+		typeWords = typeWords[:1]
+	}
+	p.Type = strings.Join(typeWords, " ")
+	p.Pointer = stars == 1
+	// Images always live in global memory, which is also what drivers report for them.
+	if strings.HasPrefix(p.Type, "image") {
+		p.Address = Global
+	}
+	return &p, nil
+}
+
+func joinTokens(tokens []token) string {
+	words := make([]string, len(tokens))
+	for i, t := range tokens {
+		words[i] = t.text
+	}
+	return strings.Join(words, " ")
+}
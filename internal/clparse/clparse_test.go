@@ -0,0 +1,192 @@
+package clparse
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func texts(tokens []token) []string {
+	words := make([]string, len(tokens))
+	for i, t := range tokens {
+		words[i] = t.text
+	}
+	return words
+}
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want []string
+	}{
+		{name: "punctuation", src: "a(b*c);", want: []string{"a", "(", "b", "*", "c", ")", ";"}},
+		{name: "comments", src: "a // b\n/* c\nd */ e", want: []string{"a", "e"}},
+		{name: "object-like macro", src: "#define T float\nT x", want: []string{"float", "x"}},
+		{name: "macro of several tokens", src: "#define PTR __global T*\nPTR p",
+			want: []string{"__global", "T", "*", "p"}},
+		{name: "macro using an earlier macro", src: "#define T uint\n#define PTR __global T*\nPTR p",
+			want: []string{"__global", "uint", "*", "p"}},
+		{name: "continued define", src: "#define T \\\n  unsigned int\nT x", want: []string{"unsigned", "int", "x"}},
+		{name: "function-like macro ignored", src: "#define F(x) x\nF(y)", want: []string{"F", "(", "y", ")"}},
+		{name: "other directives dropped", src: "#pragma OPENCL EXTENSION all : enable\n#ifdef X\nint\n#endif",
+			want: []string{"int"}},
+		{name: "hash inside a line", src: "a # b", want: []string{"a", "#", "b"}},
+		{name: "string literal kept whole", src: `printf("a, b (%d)\n", x)`,
+			want: []string{"printf", "(", `"a, b (%d)\n"`, ",", "x", ")"}},
+		{name: "escaped quote", src: `'\'' x`, want: []string{`'\''`, "x"}},
+		{name: "numbers", src: "0x1F 3", want: []string{"0x1F", "3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens, err := tokenize(tt.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := texts(tokens); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, expected %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTokenizeLines(t *testing.T) {
+	tokens, err := tokenize("a\n/* x\ny */ b\n#define T \\\n int\nT // c\n  d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []int
+	for _, tok := range tokens {
+		lines = append(lines, tok.line)
+	}
+	if want := []int{1, 3, 6, 7}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("tokens %q are on lines %v, expected %v", texts(tokens), lines, want)
+	}
+}
+
+func TestTokenizeUnterminatedComment(t *testing.T) {
+	if _, err := tokenize("a /* b"); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+// param tokenizes src and parses it as a single parameter.
+func param(t *testing.T, src string) (*Param, error) {
+	t.Helper()
+	tokens, err := tokenize(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parseParam(tokens)
+}
+
+func TestParseParam(t *testing.T) {
+	tests := []struct {
+		src  string
+		want Param
+	}{
+		{src: "float x", want: Param{Name: "x", Type: "float"}},
+		{src: "__global const float* in", want: Param{Name: "in", Type: "float", Pointer: true, Address: Global,
+			Const: true}},
+		{src: "global float4 *restrict out", want: Param{Name: "out", Type: "float4", Pointer: true, Address: Global,
+			Restrict: true}},
+		{src: "__local volatile int* tmp", want: Param{Name: "tmp", Type: "int", Pointer: true, Address: Local,
+			Volatile: true}},
+		{src: "__constant uchar* lut", want: Param{Name: "lut", Type: "uchar", Pointer: true, Address: Constant}},
+		{src: "unsigned n", want: Param{Name: "n", Type: "uint"}},
+		{src: "unsigned int n", want: Param{Name: "n", Type: "uint"}},
+		{src: "const unsigned int n", want: Param{Name: "n", Type: "uint", Const: true}},
+		{src: "unsigned char c", want: Param{Name: "c", Type: "uchar"}},
+		{src: "unsigned short s", want: Param{Name: "s", Type: "ushort"}},
+		{src: "unsigned long l", want: Param{Name: "l", Type: "ulong"}},
+		{src: "unsigned long int l", want: Param{Name: "l", Type: "ulong"}},
+		{src: "long int l", want: Param{Name: "l", Type: "long"}},
+		{src: "signed char c", want: Param{Name: "c", Type: "char"}},
+		{src: "__global struct tag_ray* rays", want: Param{Name: "rays", Type: "struct tag_ray", Pointer: true,
+			Address: Global}},
+		{src: "struct int_pair p", want: Param{Name: "p", Type: "struct int_pair"}},
+		{src: "__read_only image2d_t img", want: Param{Name: "img", Type: "image2d_t", Address: Global,
+			Access: "read_only"}},
+		{src: "write_only image2d_t img", want: Param{Name: "img", Type: "image2d_t", Address: Global,
+			Access: "write_only"}},
+		{src: "__global float* __attribute__((aligned(16))) p", want: Param{Name: "p", Type: "float", Pointer: true,
+			Address: Global}},
+		{src: "#define T unsigned int\nT n", want: Param{Name: "n", Type: "uint"}},
+		{src: "#define REAL double\n__global const REAL* x", want: Param{Name: "x", Type: "double", Pointer: true,
+			Address: Global, Const: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			p, err := param(t, tt.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p == nil || !reflect.DeepEqual(*p, tt.want) {
+				t.Errorf("got %+v, expected %+v", p, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseParamErrors(t *testing.T) {
+	for _, src := range []string{"float", "float x[4]", "__global float** p", "float 1x", "__global float* ("} {
+		t.Run(src, func(t *testing.T) {
+			if p, err := param(t, src); err == nil {
+				t.Errorf("got %+v, expected an error", p)
+			}
+		})
+	}
+	if p, err := param(t, "void"); p != nil || err != nil {
+		t.Errorf("void: got %+v, %v, expected no parameter", p, err)
+	}
+}
+
+func TestParse(t *testing.T) {
+	src := `#define T float
+// __kernel void commented(int x)
+inline T twice(T x) { return 2 * x; }
+
+__kernel __attribute__((reqd_work_group_size(64, 1, 1)))
+void scale(__global T* data,
+           const unsigned int n)
+{
+   if (get_global_id(0) < n) { data[get_global_id(0)] = twice(data[get_global_id(0)]); }
+}
+
+kernel void noArgs(void) {}
+`
+	kernels, err := Parse(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Kernel{
+		{Name: "scale", Line: 6, Params: []Param{
+			{Name: "data", Type: "float", Pointer: true, Address: Global},
+			{Name: "n", Type: "uint", Const: true},
+		}},
+		{Name: "noArgs", Line: 12},
+	}
+	if !reflect.DeepEqual(kernels, want) {
+		t.Errorf("got %+v, expected %+v", kernels, want)
+	}
+	if k, ok := Find(kernels, "noArgs"); !ok || k.Name != "noArgs" {
+		t.Errorf("Find noArgs returned %+v, %v", k, ok)
+	}
+	if _, ok := Find(kernels, "missing"); ok {
+		t.Error("Find returned a missing kernel")
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, src := range []string{
+		"__kernel int f(int x) {}",
+		"__kernel void f(int x {}",
+		"__kernel void f(__global int* p[2]) {}",
+	} {
+		if _, err := Parse(src); err == nil {
+			t.Errorf("%q: expected an error", src)
+		} else if !strings.Contains(err.Error(), "line") {
+			t.Errorf("%q: error %q has no line", src, err)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package clparse
+
+import (
+	"fmt"
+	gotoken "go/token"
+	"strings"
+	"unicode"
+)
+
+// goScalarTypes maps OpenCL C scalar types to the Go types app.Buffer and setKernelArgs use for them.
+var goScalarTypes = map[string]string{
+	"char":   "int8",
+	"uchar":  "uint8",
+	"short":  "int16",
+	"ushort": "uint16",
+	"int":    "int32",
+	"uint":   "uint32",
+	"long":   "int64",
+	"ulong":  "uint64",
+	"half":   "Half",
+	"float":  "float32",
+	"double": "float64",
+	"float2": "complex64",
+}
+
+// GoType returns the Go type a generated wrapper takes for p: *Buffer[T] for global and constant pointers to
+// types with a Go equivalent, *cl.MemObject for other pointers such as structs, cl.LocalBuffer for local pointers,
+// *Image and *Sampler for images and samplers and the Go scalar type for values.
+func (p Param) GoType() (string, error) {
+	elem, known := goScalarTypes[p.Type]
+	switch {
+	case p.Pointer && p.Address == Local:
+		return "cl.LocalBuffer", nil
+	case p.Pointer && known:
+		return "*Buffer[" + elem + "]", nil
+	case p.Pointer:
+		return "*cl.MemObject", nil
+	case known:
+		return elem, nil
+	case p.Type == "image2d_t" || p.Type == "image3d_t":
+		return "*Image", nil
+	case p.Type == "sampler_t":
+		return "*Sampler", nil
+	}
+	return "", fmt.Errorf("parameter %s: no Go type for %s", p.Name, p.Type)
+}
+
+// GoName returns the exported Go name of the kernel, e.g. Multiply2 for multiply2 and ReduceSum for reduce_sum.
+func (k Kernel) GoName() string {
+	var b strings.Builder
+	upper := true
+	for _, r := range k.Name {
+		if r == '_' {
+			upper = true
+			continue
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// stubReserved are the names the generated function body uses itself.
+var stubReserved = map[string]bool{"ctx": true, "sess": true, "kernel": true, "err": true, "global": true, "local": true}
+
+// goParamName returns a Go identifier for the parameter, in camel case and without clashing with keywords or the
+// stub's own names.
+func goParamName(name string) string {
+	parts := strings.Split(strings.Trim(name, "_"), "_")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+	if camel := strings.Join(parts, ""); camel != "" {
+		name = camel
+	}
+	if gotoken.IsKeyword(name) || stubReserved[name] {
+		return name + "Arg"
+	}
+	return name
+}
+
+// GoStub returns the source of a typed Go wrapper for the kernel, meant for package app. The wrapper creates the
+// kernel from the registered spec specName, sets its arguments in order and enqueues it with the given work sizes,
+// returning the launch's event without waiting for it:
+//
+//	func Multiply2(ctx context.Context, sess *Session, input1, input2, output *Buffer[float64], count uint32, global, local []int) (*Event, error)
+func (k Kernel) GoStub(specName string) (string, error) {
+	type group struct {
+		names  []string
+		goType string
+	}
+	var groups []group
+	var args []string
+	for _, p := range k.Params {
+		goType, err := p.GoType()
+		if err != nil {
+			return "", fmt.Errorf("kernel %s: %w", k.Name, err)
+		}
+		name := goParamName(p.Name)
+		args = append(args, name)
+		// Consecutive parameters of the same type share it, like gofmt'ed code would.
+		if n := len(groups); n > 0 && groups[n-1].goType == goType {
+			groups[n-1].names = append(groups[n-1].names, name)
+		} else {
+			groups = append(groups, group{names: []string{name}, goType: goType})
+		}
+	}
+
+	params := []string{"ctx context.Context", "sess *Session"}
+	for _, g := range groups {
+		params = append(params, strings.Join(g.names, ", ")+" "+g.goType)
+	}
+	params = append(params, "global, local []int")
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "// %s enqueues the %s kernel from the %q kernel spec. Wait for the returned event and release it.\n",
+		k.GoName(), k.Name, specName)
+	fmt.Fprintf(&b, "func %s(%s) (*Event, error) {\n", k.GoName(), strings.Join(params, ", "))
+	fmt.Fprintf(&b, "\tkernel, err := sess.Kernel(ctx, %q, %q)\n", specName, k.Name)
+	b.WriteString("\tif err != nil {\n\t\treturn nil, err\n\t}\n")
+	// The queue keeps its own reference to the kernel until the launch completes.
+	b.WriteString("\tdefer kernel.Release()\n")
+	if len(args) > 0 {
+		fmt.Fprintf(&b, "\tif err := setKernelArgs(kernel, %s); err != nil {\n\t\treturn nil, err\n\t}\n", strings.Join(args, ", "))
+	}
+	b.WriteString("\treturn sess.Enqueue(ctx, kernel, global, local)\n")
+	b.WriteString("}\n")
+	return b.String(), nil
+}